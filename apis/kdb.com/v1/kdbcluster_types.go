@@ -20,6 +20,8 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/sqc157400661/kdb/apis/shared"
 )
 
 type HostInfo struct {
@@ -71,6 +73,14 @@ type InstanceDesc struct {
 
 	LogSize resource.Quantity `json:"logSize"`
 
+	// Autoscale grows the data volume with its usage.
+	// +optional
+	Autoscale *shared.StorageAutoscaleSpec `json:"autoscale,omitempty"`
+
+	// LogAutoscale grows the log volume with its usage.
+	// +optional
+	LogAutoscale *shared.StorageAutoscaleSpec `json:"logAutoscale,omitempty"`
+
 	// The port on which kdb should listen.
 	// +optional
 	// +kubebuilder:default=5432
@@ -105,6 +115,51 @@ type KDBClusterSpec struct {
 	// EngineVersion the major version of KDB engine installed in the image
 	// +kubebuilder:validation:Required
 	EngineVersion string `json:"engineVersion"`
+
+	// Placement spreads the pods of the instances over nodes or zones, in
+	// addition to the affinity of each instance.
+	// +optional
+	Placement *PlacementSpec `json:"placement,omitempty"`
+}
+
+// PlacementPolicy tells whether the pods of a cluster must or should be
+// spread.
+type PlacementPolicy string
+
+const (
+	// PlacementPreferred spreads the pods when the nodes allow it, pods are
+	// scheduled anyway.
+	PlacementPreferred PlacementPolicy = "Preferred"
+	// PlacementRequired leaves pods pending rather than placing two of them
+	// in the same domain.
+	PlacementRequired PlacementPolicy = "Required"
+)
+
+// PlacementTopology is the failure domain the pods of a cluster are spread
+// over.
+type PlacementTopology string
+
+const (
+	PlacementTopologyNode PlacementTopology = "Node"
+	PlacementTopologyZone PlacementTopology = "Zone"
+)
+
+// PlacementSpec generates the pod anti-affinity and the topology spread
+// constraints of the instances of a cluster, they select the pods by the
+// cluster id label. The cluster writes them into the spec of its instances,
+// changing the placement rolls the pods of existing instances.
+type PlacementSpec struct {
+	// Policy is Preferred or Required.
+	// +optional
+	// +kubebuilder:default=Preferred
+	// +kubebuilder:validation:Enum={Preferred,Required}
+	Policy PlacementPolicy `json:"policy,omitempty"`
+
+	// Topology is Node to spread over nodes or Zone to spread over zones.
+	// +optional
+	// +kubebuilder:default=Node
+	// +kubebuilder:validation:Enum={Node,Zone}
+	Topology PlacementTopology `json:"topology,omitempty"`
 }
 
 // KDBClusterStatus defines the observed state of KDBCluster
@@ -123,6 +178,10 @@ type KDBClusterStatus struct {
 	// +optional
 	Message string `json:"message,omitempty"`
 
+	// Placement reports how the pods of the instances are spread.
+	// +optional
+	Placement *PlacementStatus `json:"placement,omitempty"`
+
 	// conditions represent the observations of KDB pvc current state.
 	// Known .status.conditions.type are: "PersistentVolumeResizing",
 	// "Progressing", "ProxyAvailable"
@@ -133,6 +192,25 @@ type KDBClusterStatus struct {
 	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
+// KDBClusterTopologySpread is the condition that tells whether the pods of a
+// cluster with a placement are spread over as many domains as they can be.
+const KDBClusterTopologySpread = "TopologySpread"
+
+// PlacementStatus reports the failure domains of the pods of a cluster.
+type PlacementStatus struct {
+	// Pods is the number of scheduled pods of the instances.
+	// +optional
+	Pods int32 `json:"pods,omitempty"`
+
+	// Domains is the number of nodes or zones the pods run in.
+	// +optional
+	Domains int32 `json:"domains,omitempty"`
+
+	// AvailableDomains is the number of schedulable nodes or zones.
+	// +optional
+	AvailableDomains int32 `json:"availableDomains,omitempty"`
+}
+
 // +genclient
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 // +kubebuilder:object:root=true
@@ -0,0 +1,96 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// KDBDatabaseSpec defines the desired state of KDBDatabase
+type KDBDatabaseSpec struct {
+	// Target is the instance the database is created in.
+	Target InstanceRef `json:"target"`
+
+	// Name is the name of the database. Defaults to the name of the object.
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// CharacterSet is the default character set of the database.
+	// +optional
+	CharacterSet string `json:"characterSet,omitempty"`
+
+	// Collation is the default collation of the database.
+	// +optional
+	Collation string `json:"collation,omitempty"`
+
+	// DeletionPolicy decides whether the database is dropped with the
+	// object. Defaults to Retain so that no data is lost by accident.
+	// +optional
+	// +kubebuilder:default=Retain
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+}
+
+// KDBDatabaseStatus defines the observed state of KDBDatabase
+type KDBDatabaseStatus struct {
+	SchemaStatus `json:",inline"`
+}
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="instance",type="string",JSONPath=".status.instance"
+// +kubebuilder:printcolumn:name="ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+// +kubebuilder:printcolumn:name="age",type="date",JSONPath=".metadata.creationTimestamp"
+// KDBDatabase is the Schema for the KDBDatabases API
+type KDBDatabase struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   KDBDatabaseSpec   `json:"spec,omitempty"`
+	Status KDBDatabaseStatus `json:"status,omitempty"`
+}
+
+// DatabaseName returns the name of the database.
+func (d *KDBDatabase) DatabaseName() string {
+	if d.Spec.Name != "" {
+		return d.Spec.Name
+	}
+	return d.Name
+}
+
+// SchemaTarget returns the instance the database belongs to.
+func (d *KDBDatabase) SchemaTarget() InstanceRef { return d.Spec.Target }
+
+// SchemaDeletionPolicy returns what happens to the database with the object.
+func (d *KDBDatabase) SchemaDeletionPolicy() DeletionPolicy { return d.Spec.DeletionPolicy }
+
+// SchemaStatus returns the status of the object.
+func (d *KDBDatabase) SchemaStatus() *SchemaStatus { return &d.Status.SchemaStatus }
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:object:root=true
+// KDBDatabaseList contains a list of KDBDatabase
+type KDBDatabaseList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []KDBDatabase `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&KDBDatabase{}, &KDBDatabaseList{})
+}
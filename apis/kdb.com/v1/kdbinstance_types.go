@@ -19,15 +19,33 @@ package v1
 import (
 	"github.com/sqc157400661/util"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/sqc157400661/kdb/apis/shared"
 )
 
 const (
-	PersistentVolumeResizing = "PersistentVolumeResizing"
-	KDBInstanceProgressing   = "Progressing"
-	ProxyAvailable           = "ProxyAvailable"
+	PersistentVolumeResizing   = "PersistentVolumeResizing"
+	KDBInstanceProgressing     = "Progressing"
+	ProxyAvailable             = "ProxyAvailable"
+	KDBInstanceConfigValid     = "ConfigValid"
+	KDBInstanceRestartRequired = "RestartRequired"
+	KDBInstanceUpgrading       = "Upgrading"
+	KDBInstanceResourcesFit    = "ResourcesFit"
+
+	KDBInstanceReplicationHealthy = "ReplicationHealthy"
+	KDBInstanceDrainBlocked       = "DrainBlocked"
+)
+
+// Phases of a major version upgrade, see MajorUpgradeStatus.
+const (
+	MajorUpgradePreCheck         = "PreCheck"
+	MajorUpgradeBackup           = "Backup"
+	MajorUpgradeUpgrading        = "Upgrading"
+	MajorUpgradeAwaitingFinalize = "AwaitingFinalize"
+	MajorUpgradeRollingBack      = "RollingBack"
 )
 
 // KDBInstanceSpec defines the desired state of KDBInstance
@@ -55,25 +73,101 @@ type KDBInstanceSpec struct {
 	// +optional
 	Engine string `json:"engine"`
 
-	// EngineVersion the major version of KDB engine installed in the image
+	// EngineVersion the major version of KDB engine installed in the image.
+	// Changing it starts a major upgrade, see MajorUpgradeStatus. Setting the
+	// versions back before the upgrade is finalized rolls it back by restoring
+	// the backup taken before the upgrade. It must be the major version of
+	// EngineFullVersion, a mismatch is rejected.
 	// +kubebuilder:validation:Required
 	EngineVersion string `json:"engineVersion"`
 
-	// EngineFullVersion the full version of KDB engine installed in the image
+	// EngineFullVersion the full version of KDB engine installed in the image.
+	// Changing it resolves the images of the version again and rolls the pods.
+	// Downgrades are rejected unless the instance is annotated with
+	// kdb.allow-downgrade=true.
 	// +optional
 	EngineFullVersion string `json:"engineFullVersion"`
 
 	// Whether or not the kdb instance should be stopped.
-	// set statefulset replicas = 0 to deleting pod, but keep pvc
+	// The replicas are stopped before the master, which flushes its data
+	// before it shuts down. On start the master is started before the
+	// replicas. The StatefulSets are scaled to zero, the PVCs are kept.
 	// +optional
 	Shutdown *bool `json:"shutdown,omitempty"`
 
+	// Hibernation stops and starts the instance on a schedule, see
+	// HibernationSpec.
+	// +optional
+	Hibernation *HibernationSpec `json:"hibernation,omitempty"`
+
+	// CredentialsSecret is the name of a Secret in the namespace of the
+	// instance holding passwords of the database users under the keys
+	// "root-password", "repl-password", "monitor-password" and
+	// "backup-password". The passwords it lacks are generated. It is read when
+	// the instance is created, the passwords are then kept in the credentials
+	// Secret of the instance. The instances of a KDBCluster reference the
+	// credentials Secret of the cluster, so that they share the passwords.
+	// +optional
+	CredentialsSecret string `json:"credentialsSecret,omitempty"`
+
+	// CredentialRotation rotates the passwords of the database users
+	// periodically, see CredentialRotationSpec.
+	// +optional
+	CredentialRotation *CredentialRotationSpec `json:"credentialRotation,omitempty"`
+
+	// TLS enables TLS for the client and the replication connections, see
+	// TLSSpec.
+	// +optional
+	TLS *TLSSpec `json:"tls,omitempty"`
+
+	// NetworkPolicy restricts the traffic to the pods of the instance, see
+	// NetworkPolicySpec.
+	// +optional
+	NetworkPolicy *NetworkPolicySpec `json:"networkPolicy,omitempty"`
+
+	// Seeding configures how the replicas added to a running instance copy
+	// its data, see SeedingSpec.
+	// +optional
+	Seeding *SeedingSpec `json:"seeding,omitempty"`
+
+	// SecurityProfile is the Pod Security Standard the pods of the instance
+	// meet: "restricted", "baseline" or "legacy". The restricted profile runs
+	// the containers as RunAsUser with a read-only root filesystem and no
+	// capabilities. The baseline profile allows the capabilities of the
+	// container runtime and a writable root filesystem. The legacy profile is
+	// the security context of the instances created before the profiles
+	// existed, they keep it. New instances default to baseline.
+	// More info: https://kubernetes.io/docs/concepts/security/pod-security-standards/
+	// +kubebuilder:validation:Enum=restricted;baseline;legacy
+	// +optional
+	SecurityProfile SecurityProfile `json:"securityProfile,omitempty"`
+
+	// RunAsUser is the user of the containers of the restricted and baseline
+	// profiles, it has to own the database files of the engine image.
+	// Defaults to 999, the mysql user of the MySQL images, or 26 for
+	// PostgreSQL.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	RunAsUser *int64 `json:"runAsUser,omitempty"`
+
+	// FSGroup is the group that owns the volumes of the pods. Defaults to
+	// RunAsUser, or 26 for the legacy profile.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	FSGroup *int64 `json:"fsGroup,omitempty"`
+
 	// A list of group IDs applied to the process of a container. These can be
 	// useful when accessing shared file systems with constrained permissions.
 	// More info: https://kubernetes.io/docs/reference/kubernetes-api/workload-resources/pod-v1/#security-context
 	// +optional
 	SupplementalGroups []int64 `json:"supplementalGroups,omitempty"`
 
+	// Config overrides options of the database configuration file. Keys are
+	// written to the [mysqld] group unless prefixed with another group, e.g.
+	// "client.default-character-set". Options managed by the operator such as
+	// datadir, socket, read_only or ssl_ca are rejected, and so are options
+	// the server does not know unless prefixed with "loose-".
+	// +optional
 	Config map[string]string `json:"config,omitempty"`
 }
 
@@ -85,6 +179,38 @@ type KDBInstanceStatus struct {
 	// +optional
 	InstanceSet shared.InstanceSetStatus `json:"instance,omitempty"`
 
+	// Phase is one of "Pending", "Running", "Stopping", "Stopped" or
+	// "Starting".
+	// +optional
+	Phase string `json:"phase,omitempty"`
+
+	// StoppedAt is the time the instance stopped.
+	// +optional
+	StoppedAt *metav1.Time `json:"stoppedAt,omitempty"`
+
+	// StoppedSets are the StatefulSets scaled to zero while the instance is
+	// stopping or starting.
+	// +optional
+	StoppedSets []string `json:"stoppedSets,omitempty"`
+
+	// MasterSet is the StatefulSet whose pod was the master when the
+	// instance stopped. It starts before the others.
+	// +optional
+	MasterSet string `json:"masterSet,omitempty"`
+
+	// Hibernation is the state of the hibernation schedules.
+	// +optional
+	Hibernation *HibernationStatus `json:"hibernation,omitempty"`
+
+	// Credentials is the state of the rotation of the passwords of the
+	// database users.
+	// +optional
+	Credentials *CredentialsStatus `json:"credentials,omitempty"`
+
+	// TLS is the state of the certificate of the servers.
+	// +optional
+	TLS *TLSStatus `json:"tls,omitempty"`
+
 	// +optional
 	Message string `json:"message,omitempty"`
 
@@ -92,9 +218,44 @@ type KDBInstanceStatus struct {
 	// +optional
 	PVCPhase corev1.PersistentVolumeClaimPhase `json:"pvcPhase,omitempty"`
 
+	// Volumes reports the size and the resize progress of each data and log
+	// volume of the instance.
+	// +optional
+	Volumes []VolumeStatus `json:"volumes,omitempty"`
+
+	// ConfigHash is the hash of the database configuration file rendered from
+	// the engine template and Config.
+	// +optional
+	ConfigHash string `json:"configHash,omitempty"`
+
+	// ConfigUpdateTime is when the config changed last. Pods created later
+	// have loaded it.
+	// +optional
+	ConfigUpdateTime *metav1.Time `json:"configUpdateTime,omitempty"`
+
+	// EngineFullVersion is the version reported by the running server.
+	// +optional
+	EngineFullVersion string `json:"engineFullVersion,omitempty"`
+
+	// MajorUpgrade is the progress of a major version upgrade. It is removed
+	// once the upgrade is finalized or rolled back.
+	// +optional
+	MajorUpgrade *MajorUpgradeStatus `json:"majorUpgrade,omitempty"`
+
+	// PendingRestart lists the changed parameters that only take effect after
+	// the pods are restarted.
+	// +optional
+	PendingRestart []string `json:"pendingRestart,omitempty"`
+
+	// Seeding reports the replicas copying the data of the instance before
+	// they replicate. A replica is removed once it replicates.
+	// +optional
+	Seeding []ReplicaSeedStatus `json:"seeding,omitempty"`
+
 	// conditions represent the observations of KDB pvc current state.
 	// Known .status.conditions.type are: "PersistentVolumeResizing",
-	// "Progressing", "ProxyAvailable"
+	// "Progressing", "ProxyAvailable", "ConfigValid", "RestartRequired",
+	// "Upgrading", "ResourcesFit", "ReplicationHealthy"
 	// +optional
 	// +listType=map
 	// +listMapKey=type
@@ -102,6 +263,332 @@ type KDBInstanceStatus struct {
 	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
+// Resize states of a volume, see VolumeStatus.
+const (
+	VolumeResizing                = "Resizing"
+	VolumeFileSystemResizePending = "FileSystemResizePending"
+	VolumeResizeFailed            = "Failed"
+)
+
+// VolumeStatus is the observed size of a PersistentVolumeClaim.
+type VolumeStatus struct {
+	// Name of the PersistentVolumeClaim.
+	Name string `json:"name"`
+
+	// InstanceSet is the StatefulSet whose pod mounts the volume.
+	// +optional
+	InstanceSet string `json:"instanceSet,omitempty"`
+
+	// Requested is the size requested by the spec.
+	// +optional
+	Requested resource.Quantity `json:"requested,omitempty"`
+
+	// Capacity is the size reported by the volume.
+	// +optional
+	Capacity resource.Quantity `json:"capacity,omitempty"`
+
+	// Resize is one of "Resizing", "FileSystemResizePending" or "Failed"
+	// while the capacity is below the requested size.
+	// +optional
+	Resize string `json:"resize,omitempty"`
+
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// Used is the file system usage of a volume with an autoscale spec, read
+	// in the database container.
+	// +optional
+	Used *resource.Quantity `json:"used,omitempty"`
+
+	// UsageTime is when Used was read.
+	// +optional
+	UsageTime *metav1.Time `json:"usageTime,omitempty"`
+
+	// Autoscaled is the size the volume was grown to by autoscaling. It is
+	// kept in the kdb.autoscaled-size annotation of the PersistentVolumeClaim.
+	// +optional
+	Autoscaled *resource.Quantity `json:"autoscaled,omitempty"`
+
+	// LastAutoscaleTime is the last time autoscaling grew the volume or
+	// found it at its maximum size.
+	// +optional
+	LastAutoscaleTime *metav1.Time `json:"lastAutoscaleTime,omitempty"`
+}
+
+// HibernationSpec stops the instance between the stop and the start time of
+// its schedules, e.g. at night and on weekends. The instance is also stopped
+// when Shutdown is set. The schedules are ignored, and the instance runs,
+// while it is annotated with kdb.suspend-hibernation=true.
+type HibernationSpec struct {
+	// +kubebuilder:validation:MinItems=1
+	Schedules []HibernationSchedule `json:"schedules"`
+
+	// TimeZone is the IANA name of the time zone of the schedules, e.g.
+	// "Europe/Berlin". Defaults to UTC.
+	// +optional
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+// HibernationSchedule is a pair of cron expressions in the standard five field
+// format, e.g. stop at "0 20 * * 1-5" and start at "0 8 * * 1-5".
+type HibernationSchedule struct {
+	// Stop is when the instance stops.
+	Stop string `json:"stop"`
+
+	// Start is when the instance starts again.
+	Start string `json:"start"`
+}
+
+// HibernationStatus is the state of the hibernation schedules.
+type HibernationStatus struct {
+	// Hibernating reports whether the schedules stop the instance.
+	// +optional
+	Hibernating bool `json:"hibernating,omitempty"`
+
+	// NextStop is the next time a schedule stops the instance.
+	// +optional
+	NextStop *metav1.Time `json:"nextStop,omitempty"`
+
+	// NextStart is the next time a schedule starts the instance.
+	// +optional
+	NextStart *metav1.Time `json:"nextStart,omitempty"`
+
+	// Message explains why the schedules are not followed.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// CredentialRotationSpec rotates the passwords of the root, replication,
+// monitor and backup users. A rotation also starts when the instance is
+// annotated with kdb.rotate-credentials set to a new value.
+type CredentialRotationSpec struct {
+	// IntervalDays rotates the passwords once the last rotation, or the
+	// creation of the instance, is older.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	IntervalDays *int32 `json:"intervalDays,omitempty"`
+}
+
+// CredentialsStatus is the state of the rotation of the passwords. A rotation
+// sets the new password of each user on the master, the replicas replicate
+// it, and stores it in the credentials Secret of the instance. Servers that
+// support dual passwords keep accepting the old passwords for a while so that
+// the pods read the new ones from the Secret first.
+type CredentialsStatus struct {
+	// LastRotated is when the passwords were rotated last.
+	// +optional
+	LastRotated *metav1.Time `json:"lastRotated,omitempty"`
+
+	// LastRequest is the value of the kdb.rotate-credentials annotation the
+	// last rotation was started for.
+	// +optional
+	LastRequest string `json:"lastRequest,omitempty"`
+
+	// Rotation is the rotation in progress.
+	// +optional
+	Rotation *CredentialRotationStatus `json:"rotation,omitempty"`
+}
+
+// CredentialRotationStatus tracks a rotation of the passwords.
+type CredentialRotationStatus struct {
+	// StartTime is when the rotation started.
+	StartTime metav1.Time `json:"startTime"`
+
+	// Reason is what started the rotation, "Requested" or "Interval".
+	Reason string `json:"reason"`
+
+	// Pending are the keys of the credentials Secret whose password is not
+	// set yet.
+	// +optional
+	Pending []string `json:"pending,omitempty"`
+
+	// UpdateTime is when the last password was stored in the Secret, the
+	// old passwords are discarded a grace period later.
+	// +optional
+	UpdateTime *metav1.Time `json:"updateTime,omitempty"`
+
+	// Message explains why the rotation does not progress.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// SeedMethod is how a new replica copies the data of the instance.
+type SeedMethod string
+
+const (
+	// SeedMethodClone copies the data with the CLONE plugin, MySQL 8.0.17 and
+	// later.
+	SeedMethodClone SeedMethod = "Clone"
+	// SeedMethodXtrabackup streams a backup of xtrabackup to the replica.
+	SeedMethodXtrabackup SeedMethod = "Xtrabackup"
+)
+
+// SeedingSpec configures the seeding of the replicas added to a running
+// instance.
+type SeedingSpec struct {
+	// Method is Clone or Xtrabackup. Defaults to Clone when the server
+	// supports it.
+	// +optional
+	// +kubebuilder:validation:Enum={Clone,Xtrabackup}
+	Method SeedMethod `json:"method,omitempty"`
+}
+
+// Phases of the seeding of a replica, see ReplicaSeedStatus.
+const (
+	SeedPending     = "Pending"
+	SeedCopying     = "Copying"
+	SeedReplicating = "Replicating"
+)
+
+// ReplicaSeedStatus is the progress of the seeding of a new replica.
+type ReplicaSeedStatus struct {
+	// Set is the instance set of the replica.
+	Set string `json:"set"`
+
+	// Method copying the data.
+	// +optional
+	Method SeedMethod `json:"method,omitempty"`
+
+	// Phase is Pending while the replica or a donor is not ready, Copying
+	// while the data is copied and Replicating until the replica
+	// replicates from the master.
+	// +optional
+	Phase string `json:"phase,omitempty"`
+
+	// Donor is the pod the data is copied from, a replica when one is ready.
+	// +optional
+	Donor string `json:"donor,omitempty"`
+
+	// Progress is the percentage of the data copied, when it is known.
+	// +optional
+	Progress int32 `json:"progress,omitempty"`
+
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// Message explains why the seeding does not progress.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// NetworkPolicySpec configures the NetworkPolicy of an instance. The database
+// port accepts the pods of the instance and of its cluster, its proxy, and
+// AllowedClients. The other ports, e.g. of the sidecar, only accept the
+// namespace of the operator, which reaches all ports. All other traffic to
+// the pods is denied.
+type NetworkPolicySpec struct {
+	// Enabled generates the NetworkPolicy. Defaults to network_policy.enabled
+	// of the global config.
+	// +optional
+	Enabled *bool `json:"enabled,omitempty"`
+
+	// AllowedClients are the pods, namespaces or IP blocks that may connect
+	// to the database port.
+	// +optional
+	AllowedClients []networkingv1.NetworkPolicyPeer `json:"allowedClients,omitempty"`
+
+	// Scrapers are the pods, namespaces or IP blocks that may connect to the
+	// port named "exporter" of the metrics exporter.
+	// +optional
+	Scrapers []networkingv1.NetworkPolicyPeer `json:"scrapers,omitempty"`
+}
+
+// SecurityProfile is a Pod Security Standard of the pods of an instance.
+type SecurityProfile string
+
+const (
+	SecurityProfileRestricted SecurityProfile = "restricted"
+	SecurityProfileBaseline   SecurityProfile = "baseline"
+	SecurityProfileLegacy     SecurityProfile = "legacy"
+)
+
+// TLSSpec configures the certificate of the servers. By default it is issued
+// by the CA of the operator, the Secret kdb-root-ca in the namespace of the
+// instance, for the DNS names of the instance and renewed before it expires.
+type TLSSpec struct {
+	// CASecret is the name of a Secret in the namespace of the instance
+	// holding the "ca.crt" and the "ca.key" of a CA that issues the
+	// certificate instead of the CA of the operator.
+	// +optional
+	CASecret string `json:"caSecret,omitempty"`
+
+	// CertificateSecret is the name of a Secret in the namespace of the
+	// instance holding the "tls.crt", the "tls.key" and the "ca.crt" of the
+	// servers, e.g. one issued by cert-manager. The certificate is used as
+	// is, its owner renews it.
+	// +optional
+	CertificateSecret string `json:"certificateSecret,omitempty"`
+
+	// RequireSecureTransport rejects the TCP connections without TLS, the
+	// unix socket is still allowed. Defaults to true.
+	// +optional
+	RequireSecureTransport *bool `json:"requireSecureTransport,omitempty"`
+}
+
+// TLSStatus is the state of the certificate of the servers. A new
+// certificate is written to the TLS Secret of the instance and reloaded by
+// the servers once the pods see the new files.
+type TLSStatus struct {
+	// NotAfter is when the certificate expires.
+	// +optional
+	NotAfter *metav1.Time `json:"notAfter,omitempty"`
+
+	// CertificateHash is the hash of the certificate in the TLS Secret.
+	// +optional
+	CertificateHash string `json:"certificateHash,omitempty"`
+
+	// LoadedHash is the hash of the certificate the servers loaded.
+	// +optional
+	LoadedHash string `json:"loadedHash,omitempty"`
+
+	// UpdateTime is when the certificate was written to the TLS Secret.
+	// +optional
+	UpdateTime *metav1.Time `json:"updateTime,omitempty"`
+
+	// ReplicationSecured reports whether the replicas connect to their
+	// source with TLS. Those that replicated before TLS was enabled do not
+	// until their channel is changed.
+	// +optional
+	ReplicationSecured bool `json:"replicationSecured,omitempty"`
+}
+
+// MajorUpgradeStatus tracks a major version upgrade. The upgrade checks the
+// server, takes a backup and upgrades the replicas first. The master role then
+// moves to an upgraded replica and the previous master is upgraded as well, a
+// server never replicates from a newer major version. The upgrade is kept
+// until the instance is annotated with kdb.finalize-upgrade set to
+// ToVersion. Until then setting the versions back restores the backup with
+// FromVersion. The data written after the backup stays on the volumes, next
+// to the restored data directory.
+type MajorUpgradeStatus struct {
+	// FromVersion is the engine full version before the upgrade.
+	FromVersion string `json:"fromVersion"`
+
+	// ToVersion is the engine full version of the upgrade.
+	ToVersion string `json:"toVersion"`
+
+	// Phase is one of "PreCheck", "Backup", "Upgrading", "AwaitingFinalize"
+	// or "RollingBack".
+	Phase string `json:"phase"`
+
+	// Backup is the name of the backup taken before the upgrade.
+	// +optional
+	Backup string `json:"backup,omitempty"`
+
+	// RestoreSet is the StatefulSet that restores the backup while the
+	// upgrade is rolled back. The other sets copy its data afterwards.
+	// +optional
+	RestoreSet string `json:"restoreSet,omitempty"`
+
+	// Restored reports whether the pod of RestoreSet restored the backup.
+	// +optional
+	Restored bool `json:"restored,omitempty"`
+
+	// StartTime is when the upgrade started.
+	// +optional
+	StartTime metav1.Time `json:"startTime,omitempty"`
+}
+
 // +genclient
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 // +kubebuilder:object:root=true
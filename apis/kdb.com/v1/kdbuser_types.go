@@ -0,0 +1,179 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// SchemaReady is the condition of a KDBUser or a KDBDatabase that reports
+	// whether the object is applied to its instance.
+	SchemaReady = "Ready"
+)
+
+// DeletionPolicy decides what happens to the account or the schema when its
+// object is deleted.
+// +kubebuilder:validation:Enum=Delete;Retain
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyDelete drops the account or the schema.
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+	// DeletionPolicyRetain keeps the account or the schema.
+	DeletionPolicyRetain DeletionPolicy = "Retain"
+)
+
+// InstanceRef names the KDBInstance, or the KDBCluster, in the namespace of
+// the object that an account or a schema belongs to. The objects of a
+// KDBCluster are applied to its instance that does not replicate from
+// another instance.
+type InstanceRef struct {
+	// InstanceName is the name of a KDBInstance.
+	// +optional
+	InstanceName string `json:"instanceName,omitempty"`
+
+	// ClusterName is the name of a KDBCluster.
+	// +optional
+	ClusterName string `json:"clusterName,omitempty"`
+}
+
+// SchemaStatus is the status shared by KDBUser and KDBDatabase.
+type SchemaStatus struct {
+	// ObservedGeneration is the generation of the spec last applied.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Instance is the name of the KDBInstance the object is applied to.
+	// +optional
+	Instance string `json:"instance,omitempty"`
+
+	// conditions represent the observations of the object. Known
+	// .status.conditions.type are: "Ready"
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// KDBUserSpec defines the desired state of KDBUser
+type KDBUserSpec struct {
+	// Target is the instance the user is created in.
+	Target InstanceRef `json:"target"`
+
+	// Name is the name of the database user. Defaults to the name of the
+	// object.
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// Host is the host the user connects from.
+	// +optional
+	// +kubebuilder:default="%"
+	Host string `json:"host,omitempty"`
+
+	// PasswordSecret selects the key of a Secret in the namespace of the
+	// object holding the password of the user. A change of the password is
+	// applied to the user.
+	PasswordSecret corev1.SecretKeySelector `json:"passwordSecret"`
+
+	// Grants are the privileges of the user. Privileges granted outside of
+	// the spec are revoked.
+	// +optional
+	Grants []Grant `json:"grants,omitempty"`
+
+	// DeletionPolicy decides whether the user is dropped with the object.
+	// +optional
+	// +kubebuilder:default=Delete
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+}
+
+// Grant is a set of privileges on a database object.
+type Grant struct {
+	// Privileges are the privileges, e.g. "SELECT" or "ALL PRIVILEGES". The
+	// static privileges of MySQL but GRANT OPTION, PROXY and USAGE are
+	// allowed, and the dynamic ones such as BACKUP_ADMIN.
+	// +kubebuilder:validation:MinItems=1
+	// +kubebuilder:validation:items:Pattern=`^[A-Za-z]+([ _][A-Za-z]+)*$`
+	Privileges []string `json:"privileges"`
+
+	// Database is the database of the privileges, "*" for all.
+	// +optional
+	// +kubebuilder:default="*"
+	Database string `json:"database,omitempty"`
+
+	// Table is the table of the privileges, "*" for all.
+	// +optional
+	// +kubebuilder:default="*"
+	Table string `json:"table,omitempty"`
+}
+
+// KDBUserStatus defines the observed state of KDBUser
+type KDBUserStatus struct {
+	SchemaStatus `json:",inline"`
+
+	// PasswordVersion is the resource version of the password Secret last
+	// applied.
+	// +optional
+	PasswordVersion string `json:"passwordVersion,omitempty"`
+}
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="instance",type="string",JSONPath=".status.instance"
+// +kubebuilder:printcolumn:name="ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+// +kubebuilder:printcolumn:name="age",type="date",JSONPath=".metadata.creationTimestamp"
+// KDBUser is the Schema for the KDBUsers API
+type KDBUser struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   KDBUserSpec   `json:"spec,omitempty"`
+	Status KDBUserStatus `json:"status,omitempty"`
+}
+
+// UserName returns the name of the database user.
+func (u *KDBUser) UserName() string {
+	if u.Spec.Name != "" {
+		return u.Spec.Name
+	}
+	return u.Name
+}
+
+// SchemaTarget returns the instance the user belongs to.
+func (u *KDBUser) SchemaTarget() InstanceRef { return u.Spec.Target }
+
+// SchemaDeletionPolicy returns what happens to the user with the object.
+func (u *KDBUser) SchemaDeletionPolicy() DeletionPolicy { return u.Spec.DeletionPolicy }
+
+// SchemaStatus returns the status of the object.
+func (u *KDBUser) SchemaStatus() *SchemaStatus { return &u.Status.SchemaStatus }
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:object:root=true
+// KDBUserList contains a list of KDBUser
+type KDBUserList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []KDBUser `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&KDBUser{}, &KDBUserList{})
+}
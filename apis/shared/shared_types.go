@@ -3,7 +3,9 @@ package shared
 import (
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 // SchemalessObject is a map compatible with JSON object.
@@ -109,12 +111,66 @@ type InstanceSetSpec struct {
 	// More info: https://kubernetes.io/docs/concepts/workloads/pods/pod-topology-spread-constraints/
 	// +optional
 	TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+
+	// Probes tunes the startup, readiness and liveness probes of the database
+	// container. Unset values use the defaults of the engine.
+	// Changing this value causes KDB pod to restart.
+	// +optional
+	Probes *ProbeSpec `json:"probes,omitempty"`
+}
+
+// ProbeSpec defines the thresholds of the database container probes.
+type ProbeSpec struct {
+	// Startup tunes the startup probe. Its period multiplied by its failure
+	// threshold bounds the time allowed for crash recovery.
+	// +optional
+	Startup *ProbeThresholds `json:"startup,omitempty"`
+
+	// Readiness tunes the readiness probe.
+	// +optional
+	Readiness *ProbeThresholds `json:"readiness,omitempty"`
+
+	// Liveness tunes the liveness probe.
+	// +optional
+	Liveness *ProbeThresholds `json:"liveness,omitempty"`
+
+	// MaxReplicationLagSeconds is the replication lag above which a replica
+	// is reported as not ready.
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	MaxReplicationLagSeconds *int32 `json:"maxReplicationLagSeconds,omitempty"`
+}
+
+// ProbeThresholds overrides the timing fields of a probe.
+// More info: https://kubernetes.io/docs/concepts/workloads/pods/pod-lifecycle#container-probes
+type ProbeThresholds struct {
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	InitialDelaySeconds *int32 `json:"initialDelaySeconds,omitempty"`
+
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	PeriodSeconds *int32 `json:"periodSeconds,omitempty"`
+
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	TimeoutSeconds *int32 `json:"timeoutSeconds,omitempty"`
+
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	FailureThreshold *int32 `json:"failureThreshold,omitempty"`
 }
 
 const (
 	InstanceStatusRunning = "Running"
 	InstanceStatusPending = "Pending"
 	InstanceStatusFailed  = "Failed"
+	InstanceStatusStopped = "Stopped"
+
+	// InstanceStatusStopping and InstanceStatusStarting are the phases of an
+	// instance while its pods are stopped or started one at a time.
+	InstanceStatusStopping = "Stopping"
+	InstanceStatusStarting = "Starting"
 )
 
 // InstanceSetStatus instance status
@@ -131,7 +187,9 @@ type InstanceSetStatus struct {
 	// +optional
 	UpdatedReplicas int32 `json:"updatedReplicas,omitempty"`
 
-	// PodInfos contains information about the working pod of mysql instance
+	// PodInfos lists every pod of the instance, ready or not, with the state
+	// of its database and of its replication. That state is read at most once
+	// a minute, ObservedTime tells when, and is kept in between.
 	// +optional
 	PodInfos []PodStatusInfo `json:"podInfos,omitempty"`
 }
@@ -152,6 +210,65 @@ type PodStatusInfo struct {
 
 	// +optional
 	HostIP string `json:"hostIP,omitempty"`
+
+	// Role of the pod, master or replica.
+	// +optional
+	Role string `json:"role,omitempty"`
+
+	// Ready reports whether the pod is ready.
+	// +optional
+	Ready bool `json:"ready,omitempty"`
+
+	// ReadOnly reports whether the database refuses the writes of clients.
+	// +optional
+	ReadOnly *bool `json:"readOnly,omitempty"`
+
+	// ServerVersion is the engine full version the server of the pod runs.
+	// +optional
+	ServerVersion string `json:"serverVersion,omitempty"`
+
+	// GTIDExecuted is the set of the transactions the database applied.
+	// +optional
+	GTIDExecuted string `json:"gtidExecuted,omitempty"`
+
+	// Replication is the state of the replication of a replica.
+	// +optional
+	Replication *ReplicationStatus `json:"replication,omitempty"`
+
+	// Message explains why the state of the database is unknown.
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// ObservedTime is when the state of the database was read.
+	// +optional
+	ObservedTime *metav1.Time `json:"observedTime,omitempty"`
+}
+
+// ReplicationStatus is the state of the replication of a database from its
+// source.
+type ReplicationStatus struct {
+	// Source is the host and port the database replicates from.
+	// +optional
+	Source string `json:"source,omitempty"`
+
+	// IOThread is the state of the thread receiving the transactions of the
+	// source: Yes, No or Connecting.
+	// +optional
+	IOThread string `json:"ioThread,omitempty"`
+
+	// SQLThread is the state of the thread applying the transactions: Yes or
+	// No.
+	// +optional
+	SQLThread string `json:"sqlThread,omitempty"`
+
+	// SecondsBehindSource is the replication lag, unset when it is unknown
+	// because a thread does not run.
+	// +optional
+	SecondsBehindSource *int64 `json:"secondsBehindSource,omitempty"`
+
+	// LastError is the last error of the receiving or the applying thread.
+	// +optional
+	LastError string `json:"lastError,omitempty"`
 }
 
 // Default sets the default values for an instance set spec, including the name
@@ -190,6 +307,71 @@ type PVCSpec struct {
 	StorageClass string `json:"storageClass"`
 
 	Size resource.Quantity `json:"size"`
+
+	// Autoscale grows the volume when the usage of its file system, read in
+	// the database container every minute, reaches a threshold. The grown
+	// size is kept in an annotation of the PersistentVolumeClaim, a larger
+	// Size still takes precedence.
+	// +optional
+	Autoscale *StorageAutoscaleSpec `json:"autoscale,omitempty"`
+}
+
+// StorageAutoscaleSpec defines when and how much a volume grows.
+type StorageAutoscaleSpec struct {
+	// Threshold is the percentage of the file system in use above which the
+	// volume grows.
+	// +optional
+	// +kubebuilder:default="80%"
+	// +kubebuilder:validation:XIntOrString
+	Threshold intstr.IntOrString `json:"threshold,omitempty"`
+
+	// Increment is the percentage of the current size the volume grows by.
+	// The volume grows by at least 1Gi.
+	// +optional
+	// +kubebuilder:default="20%"
+	// +kubebuilder:validation:XIntOrString
+	Increment intstr.IntOrString `json:"increment,omitempty"`
+
+	// Max is the size the volume never grows beyond.
+	Max resource.Quantity `json:"max"`
+
+	// CooldownSeconds is the minimum time between two growths of a volume.
+	// Many storage providers limit how often a volume may be modified.
+	// Defaults to 6 hours.
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	CooldownSeconds *int32 `json:"cooldownSeconds,omitempty"`
+}
+
+// ShouldGrow reports whether used bytes of capacity reach the threshold.
+func (a *StorageAutoscaleSpec) ShouldGrow(used, capacity resource.Quantity) bool {
+	if capacity.IsZero() {
+		return false
+	}
+	threshold, err := intstr.GetScaledValueFromIntOrPercent(&a.Threshold, 100, true)
+	if err != nil || threshold <= 0 {
+		threshold = 80
+	}
+	return used.Value()*100 >= capacity.Value()*int64(threshold)
+}
+
+// Grow returns the size a volume of size current grows to, rounded up to a
+// whole Gi and limited by Max.
+func (a *StorageAutoscaleSpec) Grow(current resource.Quantity) resource.Quantity {
+	const gi = int64(1) << 30
+	increment, err := intstr.GetScaledValueFromIntOrPercent(&a.Increment, 100, true)
+	if err != nil || increment <= 0 {
+		increment = 20
+	}
+	grown := current.Value() + current.Value()*int64(increment)/100
+	if grown < current.Value()+gi {
+		grown = current.Value() + gi
+	}
+	grown = (grown + gi - 1) / gi * gi
+	if grown > a.Max.Value() {
+		grown = a.Max.Value()
+	}
+	return *resource.NewQuantity(grown, resource.BinarySI)
 }
 
 // Metadata contains metadata for custom resources
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"gotest.tools/v3/assert"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"sigs.k8s.io/yaml"
 )
 
@@ -53,3 +54,34 @@ func TestSchemalessObjectDeepCopy(t *testing.T) {
 		assert.Assert(t, !reflect.DeepEqual(one, change))
 	}
 }
+
+func TestStorageAutoscaleSpec(t *testing.T) {
+	t.Parallel()
+
+	var autoscale StorageAutoscaleSpec
+	assert.NilError(t, yaml.Unmarshal(
+		[]byte(`{ threshold: 90%, increment: 50%, max: 12Gi }`), &autoscale,
+	))
+
+	t.Run("ShouldGrow", func(t *testing.T) {
+		assert.Assert(t, !autoscale.ShouldGrow(resource.MustParse("8Gi"), resource.MustParse("10Gi")))
+		assert.Assert(t, autoscale.ShouldGrow(resource.MustParse("9Gi"), resource.MustParse("10Gi")))
+		assert.Assert(t, !autoscale.ShouldGrow(resource.MustParse("9Gi"), resource.Quantity{}))
+
+		// An unset threshold grows at 80%.
+		var unset StorageAutoscaleSpec
+		assert.Assert(t, unset.ShouldGrow(resource.MustParse("8Gi"), resource.MustParse("10Gi")))
+	})
+
+	t.Run("Grow", func(t *testing.T) {
+		grown := autoscale.Grow(resource.MustParse("4Gi"))
+		assert.Equal(t, grown.String(), "6Gi")
+
+		// The increment is at least 1Gi and rounded up to a whole Gi.
+		grown = autoscale.Grow(resource.MustParse("1000Mi"))
+		assert.Equal(t, grown.String(), "2Gi")
+
+		grown = autoscale.Grow(resource.MustParse("10Gi"))
+		assert.Equal(t, grown.String(), "12Gi")
+	})
+}
@@ -12,6 +12,7 @@ import (
 	conf "github.com/sqc157400661/kdb/pkg/config"
 	"github.com/sqc157400661/kdb/pkg/controller"
 	"github.com/sqc157400661/kdb/pkg/featuregate"
+	"github.com/sqc157400661/kdb/pkg/metrics"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
@@ -192,6 +193,9 @@ func addControllersToManager(mgr manager.Manager) (err error) {
 		err = errors.Wrap(err, "Unable to new defaultReconcileHelper.")
 		return
 	}
+	// Export the operator metrics on the manager's metrics endpoint.
+	metrics.Register(mgr.GetClient())
+
 	if err = (&controller.KDBInstanceReconciler{
 		ReconcileHelper: helper,
 		Owner:           controller.KDBInstanceControllerName,
@@ -201,5 +205,21 @@ func addControllersToManager(mgr manager.Manager) (err error) {
 		err = errors.Wrap(err, "unable to create KDBInstance controller")
 		return
 	}
+	if err = (&controller.KDBUserReconciler{
+		ReconcileHelper: helper,
+		Owner:           controller.KDBUserControllerName,
+		Recorder:        mgr.GetEventRecorderFor(controller.KDBUserControllerName),
+	}).SetupWithManager(mgr); err != nil {
+		err = errors.Wrap(err, "unable to create KDBUser controller")
+		return
+	}
+	if err = (&controller.KDBDatabaseReconciler{
+		ReconcileHelper: helper,
+		Owner:           controller.KDBDatabaseControllerName,
+		Recorder:        mgr.GetEventRecorderFor(controller.KDBDatabaseControllerName),
+	}).SetupWithManager(mgr); err != nil {
+		err = errors.Wrap(err, "unable to create KDBDatabase controller")
+		return
+	}
 	return
 }
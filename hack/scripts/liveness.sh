@@ -1 +1,25 @@
 #!/bin/bash
+# Liveness probe of the database container.
+#
+# Only checks that the server process answers on its local socket. It never
+# runs queries, so a master saturated by its workload or by max_connections
+# is not restarted by the kubelet.
+
+mysql_alive() {
+  # mysqladmin ping exits 0 as soon as the server answers, even when the
+  # login is refused.
+  mysqladmin ping --connect-timeout=5 \
+    -S "${KDB_MYSQL_SOCKET:-/kdbdata/socket/mysqld.sock}" >/dev/null 2>&1
+}
+
+pg_alive() {
+  # pg_isready exits 1 while the server rejects connections (e.g. during
+  # shutdown) and 2 when there is no response at all.
+  pg_isready -q -t 5 -p "${KDB_PORT:-5432}"
+  [ $? -ne 2 ]
+}
+
+case "${ENGINE_ENV,,}" in
+  pg) pg_alive ;;
+  *) mysql_alive ;;
+esac
@@ -1 +1,53 @@
-#!/bin/bash
\ No newline at end of file
+#!/bin/bash
+# Readiness probe of the database container.
+#
+# Usage: readiness.sh [max_replication_lag_seconds]
+#
+# The database is ready once it answers queries. A replica is only ready while
+# both replication threads are running and it lags at most
+# max_replication_lag_seconds behind its source.
+
+MAX_LAG=${1:-30}
+
+# While the credentials are rotated the server may only accept the pending
+# root password, before the kubelet updates the file of the current one.
+mysql_query() {
+  local user file password
+  user=$(sed -n 's/^root_user: *//p' /etc/config/config.yaml 2>/dev/null)
+  for file in root-password pending-root-password; do
+    [ "${file}" = root-password ] || [ -f "/etc/config/credentials/${file}" ] || continue
+    password=$(cat "/etc/config/credentials/${file}" 2>/dev/null)
+    MYSQL_PWD="${password}" mysql --connect-timeout=5 -u"${user:-root}" \
+      -S "${KDB_MYSQL_SOCKET:-/kdbdata/socket/mysqld.sock}" -e "$1" 2>/dev/null && return 0
+  done
+  return 1
+}
+
+mysql_ready() {
+  local status lag
+  # SHOW REPLICA STATUS exists since 8.0.22, older servers only know SLAVE.
+  status=$(mysql_query 'SHOW REPLICA STATUS\G') ||
+    status=$(mysql_query 'SHOW SLAVE STATUS\G') || return 1
+
+  # Not a replica: answering the query is enough.
+  [ -z "${status}" ] && return 0
+
+  grep -Eq '(Replica|Slave)_IO_Running: Yes' <<<"${status}" || return 1
+  grep -Eq '(Replica|Slave)_SQL_Running: Yes' <<<"${status}" || return 1
+  lag=$(sed -nE 's/.*Seconds_Behind_(Source|Master): ([0-9]+).*/\2/p' <<<"${status}")
+  [ -n "${lag}" ] && [ "${lag}" -le "${MAX_LAG}" ]
+}
+
+pg_ready() {
+  local lag
+  pg_isready -q -t 5 -p "${KDB_PORT:-5432}" || return 1
+  lag=$(psql -p "${KDB_PORT:-5432}" -XtAc \
+    "SELECT CASE WHEN NOT pg_is_in_recovery() OR pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+      ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp())::int, 0) END" 2>/dev/null) || return 1
+  [ "${lag}" -le "${MAX_LAG}" ]
+}
+
+case "${ENGINE_ENV,,}" in
+  pg) pg_ready ;;
+  *) mysql_ready ;;
+esac
@@ -0,0 +1,15 @@
+#!/bin/bash
+# Startup probe of the database container.
+#
+# Succeeds once the server accepts connections, that is after InnoDB crash
+# recovery or WAL replay is done. Liveness and readiness only start after it.
+
+case "${ENGINE_ENV,,}" in
+  pg)
+    pg_isready -q -t 5 -p "${KDB_PORT:-5432}"
+    ;;
+  *)
+    mysqladmin ping --connect-timeout=5 \
+      -S "${KDB_MYSQL_SOCKET:-/kdbdata/socket/mysqld.sock}" >/dev/null 2>&1
+    ;;
+esac
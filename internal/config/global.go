@@ -6,15 +6,28 @@ import (
 	"github.com/sqc157400661/util"
 )
 
+// DBConfig holds the database users. The passwords of each instance are
+// generated in its credentials Secret, these passwords are only used for the
+// instances created before.
 type DBConfig struct {
 	RootUser     string `json:"root_user" yaml:"root_user"`
 	RootPassword string `json:"root_password" yaml:"root_password"`
 	ReplUser     string `yaml:"repl_user" json:"repl_user"`
 	ReplPassword string `yaml:"repl_password" json:"repl_password"`
 }
+
+// NetworkPolicyConfig holds the defaults of the NetworkPolicies of the
+// instances.
+type NetworkPolicyConfig struct {
+	// Enabled generates the NetworkPolicies of the instances that do not
+	// configure it, isolating them by default.
+	Enabled bool `json:"enabled" yaml:"enabled"`
+}
+
 type GlobalConfig struct {
-	DB                  DBConfig       `json:"db" yaml:"db"`
-	MySQLInstanceConfig InstanceConfig `json:"mysql_instance_config" yaml:"mysql_instance_config"`
+	DB                  DBConfig            `json:"db" yaml:"db"`
+	MySQLInstanceConfig InstanceConfig      `json:"mysql_instance_config" yaml:"mysql_instance_config"`
+	NetworkPolicy       NetworkPolicyConfig `json:"network_policy" yaml:"network_policy"`
 }
 
 type InstanceImage struct {
@@ -0,0 +1,263 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// MySQLDefaultSection is the option group of my.cnf that receives the keys of
+// KDBInstanceSpec.Config which do not name a section.
+const MySQLDefaultSection = "mysqld"
+
+// mysqlSections are the option groups a config key may be prefixed with, e.g.
+// "client.default-character-set". Keys like "validate_password.policy" whose
+// prefix is not a known group are plugin variables of [mysqld].
+var mysqlSections = sets.NewString(
+	"client", "mysql", "mysqld", "mysqld_safe", "mysqldump", "mysqladmin",
+)
+
+// mysqlForbiddenKeys are managed by the operator. They point into the volumes
+// mounted by the pod or hold the identity, replication, read only and TLS
+// settings the sidecar depends on, so they cannot be overridden through
+// KDBInstanceSpec.Config.
+var mysqlForbiddenKeys = sets.NewString(
+	"basedir", "datadir", "tmpdir", "plugin_dir", "secure_file_priv",
+	"innodb_data_home_dir", "innodb_log_group_home_dir", "innodb_undo_directory",
+	"socket", "mysqlx_socket", "pid_file",
+	"log_error", "log_bin", "log_bin_index", "relay_log", "relay_log_index",
+	"slow_query_log_file", "general_log_file",
+	"user", "port", "bind_address", "skip_networking", "mysqlx_port", "admin_address",
+	"server_id", "report_host", "gtid_mode", "enforce_gtid_consistency",
+	"read_only", "super_read_only",
+	"ssl", "require_secure_transport",
+)
+
+// mysqlForbiddenPrefixes start the names of option families managed by the
+// operator, e.g. ssl_ca. TLS is configured through KDBInstanceSpec.TLS.
+var mysqlForbiddenPrefixes = []string{"ssl_"}
+
+var mysqlKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_.-]*$`)
+
+// mysqlOptionPrefixes modify the option they are put in front of: loose
+// ignores unknown options, skip, disable and enable set booleans, maximum sets
+// the upper bound of a variable.
+var mysqlOptionPrefixes = []string{"loose_", "skip_", "disable_", "enable_", "maximum_"}
+
+// normalizeMySQLKey returns key the way mysqld compares option names, where
+// dashes and underscores are interchangeable.
+func normalizeMySQLKey(key string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(key)), "-", "_")
+}
+
+// isForbiddenMySQLKey reports whether name sets an option managed by the
+// operator, also through the option prefixes, e.g. "loose-skip-log-bin".
+func isForbiddenMySQLKey(name string) bool {
+	name = normalizeMySQLKey(name)
+	for {
+		if mysqlForbiddenKeys.Has(name) {
+			return true
+		}
+		for _, prefix := range mysqlForbiddenPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		}
+		stripped := name
+		for _, prefix := range mysqlOptionPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				stripped = name[len(prefix):]
+				break
+			}
+		}
+		if stripped == name {
+			return false
+		}
+		name = stripped
+	}
+}
+
+// isKnownMySQLKey reports whether name is an option of the option group
+// section, also through the option prefixes, e.g. "skip-slave-start". Options
+// with the loose prefix are known, the programs ignore them when they are not.
+func isKnownMySQLKey(section, name string) bool {
+	options := mysqlClientOptions[section]
+	if section == MySQLDefaultSection {
+		options = mysqldOptions
+	}
+	name = normalizeMySQLKey(name)
+	for {
+		if options.Has(name) || strings.HasPrefix(name, "loose_") {
+			return true
+		}
+		stripped := name
+		for _, prefix := range mysqlOptionPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				stripped = name[len(prefix):]
+				break
+			}
+		}
+		if stripped == name {
+			return false
+		}
+		name = stripped
+	}
+}
+
+// splitMySQLKey returns the option group and the option name of a config key.
+func splitMySQLKey(key string) (section, name string) {
+	if i := strings.Index(key, "."); i > 0 && mysqlSections.Has(key[:i]) {
+		return key[:i], key[i+1:]
+	}
+	return MySQLDefaultSection, key
+}
+
+// ValidateMySQLConfig checks the keys and values of KDBInstanceSpec.Config and
+// returns all the problems found. Unknown options are rejected, mysqld would
+// not start with them, unless they carry the loose prefix.
+func ValidateMySQLConfig(overrides map[string]string) error {
+	var errs []error
+	for _, key := range sortedKeys(overrides) {
+		section, name := splitMySQLKey(key)
+		switch {
+		case !mysqlKeyPattern.MatchString(name):
+			errs = append(errs, fmt.Errorf("config %q: invalid option name", key))
+		case isForbiddenMySQLKey(name):
+			errs = append(errs, fmt.Errorf("config %q: option is managed by the operator", key))
+		case !isKnownMySQLKey(section, name):
+			errs = append(errs, fmt.Errorf("config %q: unknown option, prefix it with loose- if the server "+
+				"may not know it", key))
+		case strings.ContainsAny(overrides[key], "\r\n"):
+			errs = append(errs, fmt.Errorf("config %q: value must be a single line", key))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// RenderMySQLConfig merges the layers of overrides into the my.cnf template
+// tmpl, a later layer wins over an earlier one. Options already present in the
+// template are replaced in place, new options are appended to their option
+// group. An override with an empty value is written as a bare flag, e.g.
+// "skip-name-resolve". The last layer holds KDBInstanceSpec.Config and is
+// validated, the layers before are set by the operator.
+func RenderMySQLConfig(tmpl string, layers ...map[string]string) (string, error) {
+	if len(layers) > 0 {
+		if err := ValidateMySQLConfig(layers[len(layers)-1]); err != nil {
+			return "", err
+		}
+	}
+	cnf := parseMyCnf(tmpl)
+	for _, overrides := range layers {
+		for _, key := range sortedKeys(overrides) {
+			section, name := splitMySQLKey(key)
+			cnf.set(section, name, overrides[key])
+		}
+	}
+	return cnf.String(), nil
+}
+
+// myCnf is a line preserving model of an option file, so that the comments of
+// the templates survive the merge.
+type myCnf struct {
+	// preamble holds the lines before the first option group.
+	preamble []string
+	sections []*myCnfSection
+}
+
+type myCnfSection struct {
+	name  string
+	lines []string
+}
+
+func parseMyCnf(text string) *myCnf {
+	cnf := &myCnf{}
+	var current *myCnfSection
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			current = &myCnfSection{name: strings.TrimSpace(trimmed[1 : len(trimmed)-1])}
+			cnf.sections = append(cnf.sections, current)
+			continue
+		}
+		if current == nil {
+			cnf.preamble = append(cnf.preamble, line)
+			continue
+		}
+		current.lines = append(current.lines, line)
+	}
+	return cnf
+}
+
+// optionName returns the normalized option name of an option file line, or ""
+// for blank lines and comments.
+func optionName(line string) string {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") ||
+		strings.HasPrefix(line, "!") {
+		return ""
+	}
+	if i := strings.Index(line, "="); i >= 0 {
+		line = line[:i]
+	}
+	return normalizeMySQLKey(line)
+}
+
+func (c *myCnf) set(section, name, value string) {
+	line := name
+	if value != "" {
+		line = name + " = " + value
+	}
+
+	var target *myCnfSection
+	for _, s := range c.sections {
+		if s.name == section {
+			target = s
+		}
+	}
+	if target == nil {
+		target = &myCnfSection{name: section}
+		c.sections = append(c.sections, target)
+	}
+
+	// Replace every occurrence, mysqld would otherwise use the last one.
+	replaced := false
+	key := normalizeMySQLKey(name)
+	for i, l := range target.lines {
+		if optionName(l) == key {
+			target.lines[i] = line
+			replaced = true
+		}
+	}
+	if replaced {
+		return
+	}
+
+	// Append after the last option so trailing blank lines stay at the end.
+	at := len(target.lines)
+	for at > 0 && strings.TrimSpace(target.lines[at-1]) == "" {
+		at--
+	}
+	target.lines = append(target.lines[:at], append([]string{line}, target.lines[at:]...)...)
+}
+
+func (c *myCnf) String() string {
+	lines := append([]string{}, c.preamble...)
+	for _, s := range c.sections {
+		lines = append(lines, "["+s.name+"]")
+		lines = append(lines, s.lines...)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
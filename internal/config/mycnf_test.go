@@ -0,0 +1,189 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/assert/cmp"
+)
+
+func TestRenderMySQLConfig(t *testing.T) {
+	t.Parallel()
+
+	tmpl := strings.Join([]string{
+		"# header",
+		"[client]",
+		"connect_timeout = 10",
+		"",
+		"[mysqld]",
+		"# pool",
+		"innodb-buffer-pool-size=805306368",
+		"long_query_time = 2",
+		"",
+	}, "\n")
+
+	t.Run("Overrides", func(t *testing.T) {
+		cnf, err := RenderMySQLConfig(tmpl, map[string]string{
+			"innodb_buffer_pool_size":  "1G",
+			"max_connections":          "500",
+			"client.connect_timeout":   "5",
+			"validate_password.policy": "MEDIUM",
+			"mysqldump.quick":          "",
+			"skip-name-resolve":        "",
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, cnf, strings.Join([]string{
+			"# header",
+			"[client]",
+			"connect_timeout = 5",
+			"",
+			"[mysqld]",
+			"# pool",
+			"innodb_buffer_pool_size = 1G",
+			"long_query_time = 2",
+			"max_connections = 500",
+			"skip-name-resolve",
+			"validate_password.policy = MEDIUM",
+			"",
+			"[mysqldump]",
+			"quick",
+		}, "\n"))
+	})
+
+	t.Run("OperatorLayers", func(t *testing.T) {
+		cnf, err := RenderMySQLConfig(tmpl, map[string]string{"ssl_ca": "/tls/ca.crt"},
+			map[string]string{"max_connections": "500"})
+		assert.NilError(t, err)
+		assert.Assert(t, strings.Contains(cnf, "ssl_ca = /tls/ca.crt\nmax_connections = 500"))
+
+		_, err = RenderMySQLConfig(tmpl, nil, map[string]string{"ssl_ca": "/tmp/ca.crt"})
+		assert.ErrorContains(t, err, `"ssl_ca": option is managed by the operator`)
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		cnf, err := RenderMySQLConfig(tmpl, nil)
+		assert.NilError(t, err)
+		assert.Equal(t, cnf, tmpl)
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		_, err := RenderMySQLConfig(tmpl, map[string]string{
+			"datadir":               "/tmp",
+			"mysqld.socket":         "/tmp/mysqld.sock",
+			"server-id":             "2",
+			"!includedir":           "/etc",
+			"init_connect":          "SET a=1\n[mysqld]",
+			"max_connections":       "500",
+			"loose-datadir":         "/tmp",
+			"skip-log-bin":          "",
+			"disable_log_bin":       "",
+			"loose_skip_networking": "",
+		})
+		assert.ErrorContains(t, err, `"loose-datadir"`)
+		assert.ErrorContains(t, err, `"skip-log-bin"`)
+		assert.ErrorContains(t, err, `"disable_log_bin"`)
+		assert.ErrorContains(t, err, `"loose_skip_networking"`)
+		assert.ErrorContains(t, err, `"datadir"`)
+		assert.ErrorContains(t, err, `"mysqld.socket"`)
+		assert.ErrorContains(t, err, `"server-id"`)
+		assert.ErrorContains(t, err, `"!includedir"`)
+		assert.ErrorContains(t, err, `"init_connect"`)
+	})
+
+	t.Run("Managed", func(t *testing.T) {
+		keys := []string{
+			"read_only", "loose-super_read_only", "report-host", "log_bin_index", "relay-log-index",
+			"innodb_undo_directory", "mysqlx_port", "admin_address", "ssl_ca", "ssl-cipher", "skip-ssl",
+			"require_secure_transport",
+		}
+		overrides := map[string]string{}
+		for _, key := range keys {
+			overrides[key] = "1"
+		}
+		err := ValidateMySQLConfig(overrides)
+		for _, key := range keys {
+			assert.ErrorContains(t, err, fmt.Sprintf("%q: option is managed by the operator", key))
+		}
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		err := ValidateMySQLConfig(map[string]string{
+			"max_conections":      "500",
+			"client.quick":        "",
+			"mysqldump.quick":     "",
+			"skip-slave-start":    "",
+			"loose-some_plugin_x": "1",
+		})
+		assert.ErrorContains(t, err, `"max_conections": unknown option`)
+		assert.ErrorContains(t, err, `"client.quick": unknown option`)
+		assert.Assert(t, !strings.Contains(err.Error(), "mysqldump.quick"))
+		assert.Assert(t, !strings.Contains(err.Error(), "skip-slave-start"))
+		assert.Assert(t, !strings.Contains(err.Error(), "loose-some_plugin_x"))
+	})
+
+	t.Run("Valid", func(t *testing.T) {
+		assert.Assert(t, cmp.Nil(ValidateMySQLConfig(map[string]string{
+			"max_connections":                       "500",
+			"skip-name-resolve":                     "",
+			"loose_group_replication_start_on_boot": "OFF",
+		})))
+	})
+}
+
+func TestDiffMySQLConfig(t *testing.T) {
+	t.Parallel()
+
+	applied := strings.Join([]string{
+		"[client]",
+		"connect_timeout = 10",
+		"[mysqld]",
+		"max_connections = 100",
+		"innodb_buffer_pool_chunk_size=33554432  # 32MiB",
+		"innodb_log_file_size = 256M",
+		"long_query_time = 2",
+	}, "\n")
+
+	t.Run("Unchanged", func(t *testing.T) {
+		change := DiffMySQLConfig(applied, applied)
+		assert.Equal(t, len(change.Dynamic), 0)
+		assert.Assert(t, !change.RestartRequired())
+	})
+
+	t.Run("Changed", func(t *testing.T) {
+		desired, err := RenderMySQLConfig(applied, map[string]string{
+			"client.connect_timeout": "5",
+			"max-connections":        "200",
+			"innodb_log_file_size":   "512M",
+			"skip-name-resolve":      "",
+			"sql_mode":               "STRICT_TRANS_TABLES",
+		})
+		assert.NilError(t, err)
+		desired = strings.Replace(desired, "long_query_time = 2\n", "", 1)
+
+		change := DiffMySQLConfig(applied, desired)
+		assert.DeepEqual(t, change.Dynamic, map[string]string{
+			"max_connections": "200",
+			"sql_mode":        "STRICT_TRANS_TABLES",
+		})
+		assert.DeepEqual(t, change.Static, []string{"innodb_log_file_size", "skip_name_resolve"})
+		assert.DeepEqual(t, change.Removed, []string{"long_query_time"})
+		assert.Assert(t, change.RestartRequired())
+	})
+	t.Run("StartupOnly", func(t *testing.T) {
+		desired, err := RenderMySQLConfig(applied, map[string]string{
+			"loose-max_connect_errors": "1000",
+			"default-time-zone":        "+00:00",
+			"binlog-ignore-db":         "scratch",
+			"replicate-do-db":          "app",
+		})
+		assert.NilError(t, err)
+
+		change := DiffMySQLConfig(applied, desired)
+		assert.Equal(t, len(change.Dynamic), 0)
+		assert.DeepEqual(t, change.Static, []string{
+			"binlog_ignore_db", "default_time_zone", "loose_max_connect_errors", "replicate_do_db",
+		})
+	})
+}
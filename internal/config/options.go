@@ -0,0 +1,439 @@
+package config
+
+import "k8s.io/apimachinery/pkg/util/sets"
+
+// mysqldOptions are the [mysqld] options KDBInstanceSpec.Config may set, the
+// server options and system variables of MySQL 5.7 and 8.0. mysqld does not
+// start with an option it does not know, other options need the loose prefix.
+// - https://dev.mysql.com/doc/refman/8.0/en/server-option-variable-reference.html
+var mysqldOptions = sets.NewString(
+	"auto_increment_increment",
+	"auto_increment_offset",
+	"autocommit",
+	"automatic_sp_privileges",
+	"back_log",
+	"big_tables",
+	"binlog_cache_size",
+	"binlog_checksum",
+	"binlog_do_db",
+	"binlog_error_action",
+	"binlog_expire_logs_seconds",
+	"binlog_format",
+	"binlog_group_commit_sync_delay",
+	"binlog_group_commit_sync_no_delay_count",
+	"binlog_ignore_db",
+	"binlog_order_commits",
+	"binlog_row_image",
+	"binlog_row_metadata",
+	"binlog_row_value_options",
+	"binlog_rows_query_log_events",
+	"binlog_stmt_cache_size",
+	"binlog_transaction_compression",
+	"binlog_transaction_compression_level_zstd",
+	"binlog_transaction_dependency_history_size",
+	"binlog_transaction_dependency_tracking",
+	"block_encryption_mode",
+	"bulk_insert_buffer_size",
+	"character_set_client_handshake",
+	"character_set_filesystem",
+	"character_set_server",
+	"check_proxy_users",
+	"collation_server",
+	"completion_type",
+	"concurrent_insert",
+	"connect_timeout",
+	"core_file",
+	"cte_max_recursion_depth",
+	"default_authentication_plugin",
+	"default_collation_for_utf8mb4",
+	"default_password_lifetime",
+	"default_storage_engine",
+	"default_table_encryption",
+	"default_time_zone",
+	"default_tmp_storage_engine",
+	"default_week_format",
+	"delay_key_write",
+	"delayed_insert_limit",
+	"delayed_insert_timeout",
+	"delayed_queue_size",
+	"disconnect_on_expired_password",
+	"div_precision_increment",
+	"end_markers_in_json",
+	"eq_range_index_dive_limit",
+	"event_scheduler",
+	"expire_logs_days",
+	"explicit_defaults_for_timestamp",
+	"flush",
+	"flush_time",
+	"ft_boolean_syntax",
+	"ft_max_word_len",
+	"ft_min_word_len",
+	"ft_query_expansion_limit",
+	"ft_stopword_file",
+	"general_log",
+	"generated_random_password_length",
+	"group_concat_max_len",
+	"histogram_generation_max_mem_size",
+	"host_cache_size",
+	"information_schema_stats_expiry",
+	"init_connect",
+	"init_file",
+	"init_replica",
+	"init_slave",
+	"innodb_adaptive_flushing",
+	"innodb_adaptive_flushing_lwm",
+	"innodb_adaptive_hash_index",
+	"innodb_adaptive_hash_index_parts",
+	"innodb_adaptive_max_sleep_delay",
+	"innodb_autoextend_increment",
+	"innodb_autoinc_lock_mode",
+	"innodb_buffer_pool_chunk_size",
+	"innodb_buffer_pool_dump_at_shutdown",
+	"innodb_buffer_pool_dump_now",
+	"innodb_buffer_pool_dump_pct",
+	"innodb_buffer_pool_in_core_file",
+	"innodb_buffer_pool_instances",
+	"innodb_buffer_pool_load_at_startup",
+	"innodb_buffer_pool_size",
+	"innodb_change_buffer_max_size",
+	"innodb_change_buffering",
+	"innodb_checksum_algorithm",
+	"innodb_cmp_per_index_enabled",
+	"innodb_commit_concurrency",
+	"innodb_compression_failure_threshold_pct",
+	"innodb_compression_level",
+	"innodb_compression_pad_pct_max",
+	"innodb_concurrency_tickets",
+	"innodb_data_file_path",
+	"innodb_deadlock_detect",
+	"innodb_dedicated_server",
+	"innodb_default_row_format",
+	"innodb_disable_sort_file_cache",
+	"innodb_doublewrite",
+	"innodb_fast_shutdown",
+	"innodb_file_per_table",
+	"innodb_fill_factor",
+	"innodb_flush_log_at_timeout",
+	"innodb_flush_log_at_trx_commit",
+	"innodb_flush_method",
+	"innodb_flush_neighbors",
+	"innodb_flush_sync",
+	"innodb_flushing_avg_loops",
+	"innodb_force_recovery",
+	"innodb_ft_cache_size",
+	"innodb_ft_enable_stopword",
+	"innodb_ft_max_token_size",
+	"innodb_ft_min_token_size",
+	"innodb_ft_result_cache_limit",
+	"innodb_ft_sort_pll_degree",
+	"innodb_ft_total_cache_size",
+	"innodb_io_capacity",
+	"innodb_io_capacity_max",
+	"innodb_large_prefix",
+	"innodb_lock_wait_timeout",
+	"innodb_log_buffer_size",
+	"innodb_log_checksums",
+	"innodb_log_compressed_pages",
+	"innodb_log_file_size",
+	"innodb_log_files_in_group",
+	"innodb_log_write_ahead_size",
+	"innodb_lru_scan_depth",
+	"innodb_max_dirty_pages_pct",
+	"innodb_max_dirty_pages_pct_lwm",
+	"innodb_max_purge_lag",
+	"innodb_max_purge_lag_delay",
+	"innodb_max_undo_log_size",
+	"innodb_monitor_disable",
+	"innodb_monitor_enable",
+	"innodb_numa_interleave",
+	"innodb_old_blocks_pct",
+	"innodb_old_blocks_time",
+	"innodb_online_alter_log_max_size",
+	"innodb_open_files",
+	"innodb_optimize_fulltext_only",
+	"innodb_page_cleaners",
+	"innodb_page_size",
+	"innodb_parallel_read_threads",
+	"innodb_print_all_deadlocks",
+	"innodb_purge_batch_size",
+	"innodb_purge_rseg_truncate_frequency",
+	"innodb_purge_threads",
+	"innodb_random_read_ahead",
+	"innodb_read_ahead_threshold",
+	"innodb_read_io_threads",
+	"innodb_read_only",
+	"innodb_redo_log_capacity",
+	"innodb_rollback_on_timeout",
+	"innodb_rollback_segments",
+	"innodb_sort_buffer_size",
+	"innodb_spin_wait_delay",
+	"innodb_stats_auto_recalc",
+	"innodb_stats_include_delete_marked",
+	"innodb_stats_method",
+	"innodb_stats_on_metadata",
+	"innodb_stats_persistent",
+	"innodb_stats_persistent_sample_pages",
+	"innodb_stats_transient_sample_pages",
+	"innodb_status_output",
+	"innodb_status_output_locks",
+	"innodb_strict_mode",
+	"innodb_sync_array_size",
+	"innodb_sync_spin_loops",
+	"innodb_table_locks",
+	"innodb_temp_data_file_path",
+	"innodb_thread_concurrency",
+	"innodb_thread_sleep_delay",
+	"innodb_undo_log_truncate",
+	"innodb_undo_tablespaces",
+	"innodb_use_native_aio",
+	"innodb_write_io_threads",
+	"interactive_timeout",
+	"internal_tmp_disk_storage_engine",
+	"internal_tmp_mem_storage_engine",
+	"join_buffer_size",
+	"keep_files_on_create",
+	"key_buffer_size",
+	"key_cache_age_threshold",
+	"key_cache_block_size",
+	"key_cache_division_limit",
+	"large_pages",
+	"lc_messages",
+	"lc_time_names",
+	"local_infile",
+	"lock_wait_timeout",
+	"log_bin_trust_function_creators",
+	"log_error_services",
+	"log_error_suppression_list",
+	"log_error_verbosity",
+	"log_output",
+	"log_queries_not_using_indexes",
+	"log_raw",
+	"log_replica_updates",
+	"log_slave_updates",
+	"log_slow_admin_statements",
+	"log_slow_extra",
+	"log_slow_replica_statements",
+	"log_slow_slave_statements",
+	"log_throttle_queries_not_using_indexes",
+	"log_timestamps",
+	"long_query_time",
+	"low_priority_updates",
+	"lower_case_table_names",
+	"mandatory_roles",
+	"master_info_repository",
+	"master_verify_checksum",
+	"max_allowed_packet",
+	"max_binlog_cache_size",
+	"max_binlog_size",
+	"max_binlog_stmt_cache_size",
+	"max_connect_errors",
+	"max_connections",
+	"max_delayed_threads",
+	"max_error_count",
+	"max_execution_time",
+	"max_heap_table_size",
+	"max_join_size",
+	"max_length_for_sort_data",
+	"max_points_in_geometry",
+	"max_prepared_stmt_count",
+	"max_relay_log_size",
+	"max_seeks_for_key",
+	"max_sort_length",
+	"max_sp_recursion_depth",
+	"max_user_connections",
+	"max_write_lock_count",
+	"min_examined_row_limit",
+	"myisam_data_pointer_size",
+	"myisam_max_sort_file_size",
+	"myisam_mmap_size",
+	"myisam_recover_options",
+	"myisam_repair_threads",
+	"myisam_sort_buffer_size",
+	"myisam_stats_method",
+	"myisam_use_mmap",
+	"net_buffer_length",
+	"net_read_timeout",
+	"net_retry_count",
+	"net_write_timeout",
+	"ngram_token_size",
+	"old_alter_table",
+	"open_files_limit",
+	"optimizer_prune_level",
+	"optimizer_search_depth",
+	"optimizer_switch",
+	"optimizer_trace",
+	"optimizer_trace_features",
+	"optimizer_trace_limit",
+	"optimizer_trace_max_mem_size",
+	"optimizer_trace_offset",
+	"parser_max_mem_size",
+	"partial_revokes",
+	"password_history",
+	"password_require_current",
+	"password_reuse_interval",
+	"performance_schema",
+	"performance_schema_consumer_events_statements_history_long",
+	"performance_schema_digests_size",
+	"performance_schema_events_statements_history_long_size",
+	"performance_schema_events_statements_history_size",
+	"performance_schema_instrument",
+	"performance_schema_max_digest_length",
+	"performance_schema_max_sql_text_length",
+	"plugin_load",
+	"plugin_load_add",
+	"preload_buffer_size",
+	"query_alloc_block_size",
+	"query_cache_limit",
+	"query_cache_size",
+	"query_cache_type",
+	"query_prealloc_size",
+	"range_alloc_block_size",
+	"range_optimizer_max_mem_size",
+	"read_buffer_size",
+	"read_rnd_buffer_size",
+	"regexp_stack_limit",
+	"regexp_time_limit",
+	"relay_log_info_repository",
+	"relay_log_purge",
+	"relay_log_recovery",
+	"relay_log_space_limit",
+	"replica_checkpoint_group",
+	"replica_checkpoint_period",
+	"replica_compressed_protocol",
+	"replica_exec_mode",
+	"replica_max_allowed_packet",
+	"replica_net_timeout",
+	"replica_parallel_type",
+	"replica_parallel_workers",
+	"replica_pending_jobs_size_max",
+	"replica_preserve_commit_order",
+	"replica_skip_errors",
+	"replica_sql_verify_checksum",
+	"replica_transaction_retries",
+	"replica_type_conversions",
+	"replicate_do_db",
+	"replicate_do_table",
+	"replicate_ignore_db",
+	"replicate_ignore_table",
+	"replicate_rewrite_db",
+	"replicate_same_server_id",
+	"replicate_wild_do_table",
+	"replicate_wild_ignore_table",
+	"replication_optimize_for_static_plugin_config",
+	"replication_sender_observe_commit_only",
+	"rpl_read_size",
+	"rpl_semi_sync_master_enabled",
+	"rpl_semi_sync_master_timeout",
+	"rpl_semi_sync_master_wait_for_slave_count",
+	"rpl_semi_sync_master_wait_point",
+	"rpl_semi_sync_slave_enabled",
+	"rpl_semi_sync_replica_enabled",
+	"rpl_semi_sync_source_enabled",
+	"rpl_semi_sync_source_timeout",
+	"rpl_semi_sync_source_wait_for_replica_count",
+	"rpl_semi_sync_source_wait_point",
+	"rpl_stop_replica_timeout",
+	"rpl_stop_slave_timeout",
+	"schema_definition_cache",
+	"select_into_buffer_size",
+	"select_into_disk_sync",
+	"session_track_gtids",
+	"session_track_schema",
+	"session_track_state_change",
+	"session_track_system_variables",
+	"session_track_transaction_info",
+	"sha256_password_auto_generate_rsa_keys",
+	"show_compatibility_56",
+	"skip_external_locking",
+	"skip_name_resolve",
+	"skip_replica_start",
+	"skip_show_database",
+	"skip_slave_start",
+	"slave_checkpoint_group",
+	"slave_checkpoint_period",
+	"slave_compressed_protocol",
+	"slave_exec_mode",
+	"slave_max_allowed_packet",
+	"slave_net_timeout",
+	"slave_parallel_type",
+	"slave_parallel_workers",
+	"slave_pending_jobs_size_max",
+	"slave_preserve_commit_order",
+	"slave_skip_errors",
+	"slave_sql_verify_checksum",
+	"slave_transaction_retries",
+	"slave_type_conversions",
+	"slow_launch_time",
+	"slow_query_log",
+	"sort_buffer_size",
+	"sql_generate_invisible_primary_key",
+	"sql_mode",
+	"sql_require_primary_key",
+	"stored_program_cache",
+	"stored_program_definition_cache",
+	"sync_binlog",
+	"sync_master_info",
+	"sync_relay_log",
+	"sync_relay_log_info",
+	"sync_source_info",
+	"table_definition_cache",
+	"table_open_cache",
+	"table_open_cache_instances",
+	"tablespace_definition_cache",
+	"temptable_max_mmap",
+	"temptable_max_ram",
+	"temptable_use_mmap",
+	"thread_cache_size",
+	"thread_handling",
+	"thread_stack",
+	"tls_version",
+	"tmp_table_size",
+	"transaction_alloc_block_size",
+	"transaction_isolation",
+	"transaction_prealloc_size",
+	"transaction_read_only",
+	"transaction_write_set_extraction",
+	"tx_isolation",
+	"tx_read_only",
+	"updatable_views_with_limit",
+	"validate_password.check_user_name",
+	"validate_password.dictionary_file",
+	"validate_password.length",
+	"validate_password.mixed_case_count",
+	"validate_password.number_count",
+	"validate_password.policy",
+	"validate_password.special_char_count",
+	"validate_password_check_user_name",
+	"validate_password_dictionary_file",
+	"validate_password_length",
+	"validate_password_mixed_case_count",
+	"validate_password_number_count",
+	"validate_password_policy",
+	"validate_password_special_char_count",
+	"wait_timeout",
+	"windowing_use_high_precision",
+)
+
+// mysqlClientOptions are the options of the option groups of the client
+// programs KDBInstanceSpec.Config may set. The sidecar runs the clients of
+// the database container, which do not start with an option they do not know.
+var mysqlClientOptions = map[string]sets.String{
+	"client": sets.NewString(
+		"compress", "connect_timeout", "default_auth", "default_character_set",
+		"max_allowed_packet", "net_buffer_length", "protocol",
+	),
+	"mysql": sets.NewString(
+		"auto_rehash", "compress", "connect_timeout", "default_character_set",
+		"max_allowed_packet", "net_buffer_length", "no_auto_rehash", "prompt", "show_warnings",
+	),
+	"mysqldump": sets.NewString(
+		"compress", "default_character_set", "hex_blob", "max_allowed_packet",
+		"net_buffer_length", "quick", "quote_names", "single_transaction",
+	),
+	"mysqladmin": sets.NewString(
+		"compress", "connect_timeout", "default_character_set", "shutdown_timeout",
+	),
+	"mysqld_safe": sets.NewString(
+		"core_file_size", "malloc_lib", "nice", "open_files_limit", "timezone",
+	),
+}
@@ -0,0 +1,134 @@
+package config
+
+import (
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// mysqlStaticParams are the [mysqld] options that cannot be changed on a
+// running server. Options missing here are assumed to be dynamic; when the
+// server refuses to set one of them it is handled as static as well.
+// - https://dev.mysql.com/doc/refman/8.0/en/dynamic-system-variables.html
+var mysqlStaticParams = sets.NewString(
+	"back_log",
+	"binlog_do_db",
+	"binlog_ignore_db",
+	"default_authentication_plugin",
+	"default_time_zone",
+	"innodb_buffer_pool_chunk_size",
+	"innodb_buffer_pool_instances",
+	"innodb_data_file_path",
+	"innodb_doublewrite",
+	"innodb_flush_method",
+	"innodb_log_file_size",
+	"innodb_log_files_in_group",
+	"innodb_open_files",
+	"innodb_page_size",
+	"innodb_purge_threads",
+	"innodb_read_io_threads",
+	"innodb_undo_tablespaces",
+	"innodb_write_io_threads",
+	"log_replica_updates",
+	"log_slave_updates",
+	"lower_case_table_names",
+	"open_files_limit",
+	"performance_schema",
+	"plugin_load",
+	"plugin_load_add",
+	"skip_name_resolve",
+	"skip_replica_start",
+	"skip_slave_start",
+	"table_open_cache_instances",
+	"thread_handling",
+)
+
+// mysqlStartupPrefixes start the names of options that mysqld reads at
+// startup only, they are no system variables SET knows. The option prefixes,
+// e.g. loose, and the replication filters, e.g. replicate-do-db, are such.
+var mysqlStartupPrefixes = append([]string{"replicate_"}, mysqlOptionPrefixes...)
+
+// MySQLConfigChange is the difference between the [mysqld] options of two
+// renderings of my.cnf. Option names are normalized, see normalizeMySQLKey.
+type MySQLConfigChange struct {
+	// Dynamic holds the changed options that can be set on a running server.
+	Dynamic map[string]string
+	// Static holds the changed options that need a restart to take effect.
+	Static []string
+	// Removed holds the options that are no longer set. They return to their
+	// default when the server restarts.
+	Removed []string
+}
+
+// RestartRequired reports whether the change only takes effect after mysqld
+// is restarted.
+func (c MySQLConfigChange) RestartRequired() bool {
+	return len(c.Static) > 0 || len(c.Removed) > 0
+}
+
+// IsMySQLStaticParam reports whether the option name cannot be changed on a
+// running server.
+func IsMySQLStaticParam(name string) bool {
+	name = normalizeMySQLKey(name)
+	for _, prefix := range mysqlStartupPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return mysqlStaticParams.Has(name)
+}
+
+// DiffMySQLConfig compares the [mysqld] options of the my.cnf the server runs
+// with, applied, to those of desired. Bare flags such as skip-name-resolve
+// cannot be set with SET and are always static.
+func DiffMySQLConfig(applied, desired string) MySQLConfigChange {
+	before := parseMyCnf(applied).options(MySQLDefaultSection)
+	after := parseMyCnf(desired).options(MySQLDefaultSection)
+
+	change := MySQLConfigChange{Dynamic: map[string]string{}}
+	for _, name := range sortedKeys(after) {
+		value := after[name]
+		if old, ok := before[name]; ok && old == value {
+			continue
+		}
+		if value == "" || IsMySQLStaticParam(name) {
+			change.Static = append(change.Static, name)
+			continue
+		}
+		change.Dynamic[name] = value
+	}
+	for _, name := range sortedKeys(before) {
+		if _, ok := after[name]; !ok {
+			change.Removed = append(change.Removed, name)
+		}
+	}
+	sort.Strings(change.Static)
+	return change
+}
+
+// options returns the options of section by normalized name. Later lines win
+// like they do in mysqld, trailing comments are removed from the values.
+func (c *myCnf) options(section string) map[string]string {
+	options := map[string]string{}
+	for _, s := range c.sections {
+		if s.name != section {
+			continue
+		}
+		for _, line := range s.lines {
+			name := optionName(line)
+			if name == "" {
+				continue
+			}
+			value := ""
+			if i := strings.Index(line, "="); i >= 0 {
+				value = line[i+1:]
+			}
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = value[:i]
+			}
+			options[name] = strings.TrimSpace(value)
+		}
+	}
+	return options
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	mebibyte = int64(1) << 20
+	gibibyte = int64(1) << 30
+
+	// bufferPoolChunkSize is the innodb_buffer_pool_chunk_size TuneMySQL
+	// sets, the 5.7 template would default to 128Mi otherwise. The buffer
+	// pool is a multiple of chunk size * instances.
+	bufferPoolChunkSize = 32 * mebibyte
+)
+
+// TuneMySQL computes the MySQL options that depend on the size of the database
+// container. The limits of resources are used, falling back to the requests.
+// Nothing is returned when the memory is unknown, the template values are kept.
+//
+// With M the memory and C the number of CPUs (at least 1):
+//
+//	innodb_buffer_pool_size       = M * 50% below 1Gi, M * 60% below 4Gi, M * 75% above,
+//	                                rounded down to chunk size * instances (at least 128Mi)
+//	innodb_buffer_pool_instances  = buffer pool in Gi, between 1 and 16
+//	innodb_buffer_pool_chunk_size = 32Mi
+//	max_connections               = 125 per Gi of M, between 100 and 5000
+//	thread_cache_size             = 8 + max_connections / 100, at most 100
+//	table_open_cache_instances    = C, between 1 and 16
+//	innodb_read_io_threads        = C, between 4 and 32
+//	innodb_write_io_threads       = C, between 4 and 32
+//	innodb_purge_threads          = C / 4, between 1 and 4
+//	innodb_io_capacity            = 200 * C, between 200 and 2000
+//	innodb_io_capacity_max        = 2 * innodb_io_capacity
+//	innodb_log_file_size          = buffer pool / 8, between 48Mi and 2Gi
+//	innodb_log_buffer_size        = 8Mi below 4Gi, 16Mi above
+//
+// The buffer pool leaves room for the per connection buffers, the data
+// dictionary and the page cache of the container. Options set in
+// KDBInstanceSpec.Config are applied after these and always win.
+func TuneMySQL(resources corev1.ResourceRequirements) map[string]string {
+	memoryQuantity := resourceValue(resources, corev1.ResourceMemory)
+	memory := memoryQuantity.Value()
+	if memory <= 0 {
+		return nil
+	}
+	cpuQuantity := resourceValue(resources, corev1.ResourceCPU)
+	cpus := cpuQuantity.MilliValue() / 1000
+	if cpus < 1 {
+		cpus = 1
+	}
+
+	pool := memory * 75 / 100
+	switch {
+	case memory < gibibyte:
+		pool = memory * 50 / 100
+	case memory < 4*gibibyte:
+		pool = memory * 60 / 100
+	}
+	instances := clamp(pool/gibibyte, 1, 16)
+	pool = pool / (bufferPoolChunkSize * instances) * (bufferPoolChunkSize * instances)
+	if pool < 128*mebibyte {
+		pool = 128 * mebibyte
+	}
+
+	connections := clamp(125*memory/gibibyte, 100, 5000)
+	ioCapacity := clamp(200*cpus, 200, 2000)
+	logBuffer := 8 * mebibyte
+	if memory >= 4*gibibyte {
+		logBuffer = 16 * mebibyte
+	}
+
+	return map[string]string{
+		"innodb_buffer_pool_size":       strconv.FormatInt(pool, 10),
+		"innodb_buffer_pool_instances":  strconv.FormatInt(instances, 10),
+		"innodb_buffer_pool_chunk_size": strconv.FormatInt(bufferPoolChunkSize, 10),
+		"max_connections":               strconv.FormatInt(connections, 10),
+		"thread_cache_size":             strconv.FormatInt(clamp(8+connections/100, 8, 100), 10),
+		"table_open_cache_instances":    strconv.FormatInt(clamp(cpus, 1, 16), 10),
+		"innodb_read_io_threads":        strconv.FormatInt(clamp(cpus, 4, 32), 10),
+		"innodb_write_io_threads":       strconv.FormatInt(clamp(cpus, 4, 32), 10),
+		"innodb_purge_threads":          strconv.FormatInt(clamp(cpus/4, 1, 4), 10),
+		"innodb_io_capacity":            strconv.FormatInt(ioCapacity, 10),
+		"innodb_io_capacity_max":        strconv.FormatInt(2*ioCapacity, 10),
+		"innodb_log_file_size":          mebibytes(clamp(pool/8, 48*mebibyte, 2*gibibyte)),
+		"innodb_log_buffer_size":        mebibytes(logBuffer),
+	}
+}
+
+// resourceValue returns the limit of name, or its request when there is no
+// limit.
+func resourceValue(resources corev1.ResourceRequirements, name corev1.ResourceName) resource.Quantity {
+	if q, ok := resources.Limits[name]; ok && !q.IsZero() {
+		return q
+	}
+	return resources.Requests[name]
+}
+
+func mebibytes(bytes int64) string {
+	return strconv.FormatInt(bytes/mebibyte, 10) + "M"
+}
+
+func clamp(v, min, max int64) int64 {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestTuneMySQL(t *testing.T) {
+	t.Parallel()
+
+	t.Run("NoResources", func(t *testing.T) {
+		assert.Assert(t, TuneMySQL(corev1.ResourceRequirements{}) == nil)
+	})
+
+	t.Run("Small", func(t *testing.T) {
+		tuned := TuneMySQL(corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("500m"),
+				corev1.ResourceMemory: resource.MustParse("500Mi"),
+			},
+		})
+		assert.Equal(t, tuned["innodb_buffer_pool_size"], "234881024") // 224Mi
+		assert.Equal(t, tuned["innodb_buffer_pool_instances"], "1")
+		assert.Equal(t, tuned["innodb_buffer_pool_chunk_size"], "33554432")
+		assert.Equal(t, tuned["max_connections"], "100")
+		assert.Equal(t, tuned["innodb_io_capacity"], "200")
+		assert.Equal(t, tuned["innodb_log_file_size"], "48M")
+		assert.Equal(t, tuned["innodb_log_buffer_size"], "8M")
+	})
+
+	t.Run("Large", func(t *testing.T) {
+		tuned := TuneMySQL(corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("16"),
+				corev1.ResourceMemory: resource.MustParse("64Gi"),
+			},
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("1"),
+				corev1.ResourceMemory: resource.MustParse("1Gi"),
+			},
+		})
+		assert.Equal(t, tuned["innodb_buffer_pool_size"], "51539607552") // 48Gi
+		assert.Equal(t, tuned["innodb_buffer_pool_instances"], "16")
+		assert.Equal(t, tuned["max_connections"], "5000")
+		assert.Equal(t, tuned["thread_cache_size"], "58")
+		assert.Equal(t, tuned["innodb_read_io_threads"], "16")
+		assert.Equal(t, tuned["innodb_purge_threads"], "4")
+		assert.Equal(t, tuned["innodb_io_capacity"], "2000")
+		assert.Equal(t, tuned["innodb_io_capacity_max"], "4000")
+		assert.Equal(t, tuned["innodb_log_file_size"], "2048M")
+		assert.Equal(t, tuned["innodb_log_buffer_size"], "16M")
+	})
+
+	t.Run("OverridesWin", func(t *testing.T) {
+		tuned := TuneMySQL(corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("8Gi")},
+		})
+		cnf, err := RenderMySQLConfig(MySQL8ConfTmpl, tuned, map[string]string{
+			"innodb-buffer-pool-size": "1G",
+			"mysqld.max_connections":  "42",
+		})
+		assert.NilError(t, err)
+		assert.Assert(t, strings.Contains(cnf, "\ninnodb-buffer-pool-size = 1G\n"), cnf)
+		assert.Assert(t, !strings.Contains(cnf, "innodb_buffer_pool_size"), cnf)
+		assert.Assert(t, strings.Contains(cnf, "\nmax_connections = 42\n"), cnf)
+		assert.Assert(t, strings.Contains(cnf, "\ninnodb_buffer_pool_instances = 6\n"), cnf)
+	})
+}
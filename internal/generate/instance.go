@@ -6,6 +6,7 @@ import (
 
 	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
 	"github.com/sqc157400661/kdb/apis/shared"
+	"github.com/sqc157400661/kdb/internal/config"
 	"github.com/sqc157400661/kdb/internal/naming"
 	"github.com/sqc157400661/kdb/pkg/reconcile/context"
 )
@@ -13,21 +14,10 @@ import (
 func InitKDBInstance(rc *context.ClusterContext, instance *v1.KDBInstance, desc *v1.InstanceDesc, masters []*v1.HostInfo) error {
 	cluster := rc.GetCluster()
 	globalConfig := rc.GetGlobalConfig()
-	instance.Labels = naming.Merge(instance.GetLabels(), cluster.GetLabels())
+	instance.Labels = naming.Merge(instance.GetLabels(), cluster.GetLabels(),
+		map[string]string{naming.LabelClusterID: naming.KDBClusterID(cluster)})
 	instance.Annotations = naming.Merge(instance.GetAnnotations(), cluster.GetAnnotations())
 	instance.Name = desc.Name
-	mainImage, err := globalConfig.GetMainImage(cluster.Spec.Engine, desc.EngineFullVersion)
-	if err != nil {
-		return err
-	}
-	sidecarImage, err := globalConfig.GetSidecarImage(cluster.Spec.Engine, desc.EngineFullVersion)
-	if err != nil {
-		return err
-	}
-	monitorImage, err := globalConfig.GetMonitorImage(cluster.Spec.Engine, desc.EngineFullVersion)
-	if err != nil {
-		return err
-	}
 	var master v1.HostInfo
 	for _, m := range masters {
 		if m.PodName != naming.InstancePodName(instance.Name, 0) {
@@ -39,17 +29,17 @@ func InitKDBInstance(rc *context.ClusterContext, instance *v1.KDBInstance, desc
 			Replicas:    desc.Replicas,
 			Affinity:    desc.Affinity,
 			Tolerations: desc.Tolerations,
+			// The init containers restore or prepare the data before the
+			// database starts, they run with its resources. The requests of
+			// init containers do not add up with those of the containers.
 			InitContainer: shared.ContainerSpec{
-				Image:     sidecarImage,
 				Resources: desc.Resources,
 			},
 			MainContainer: shared.ContainerSpec{
-				Image:     mainImage,
 				Resources: desc.Resources,
 				Command:   []string{"/bin/bash", "-c", "/kdb/bin/run_supervisor.sh"}, // TODO: format to /kdb/bin/start.sh
 			},
 			SidecarContainer: shared.ContainerSpec{
-				Image:   sidecarImage,
 				Command: []string{"/kdb/bin/start.sh"},
 				Resources: corev1.ResourceRequirements{
 					Requests: util.GenerateResource(0.1, 0.5),
@@ -57,7 +47,6 @@ func InitKDBInstance(rc *context.ClusterContext, instance *v1.KDBInstance, desc
 				},
 			},
 			MonitorContainer: shared.ContainerSpec{
-				Image:   monitorImage,
 				Command: []string{"/kdb/bin/start.sh"},
 				Resources: corev1.ResourceRequirements{
 					Requests: util.GenerateResource(0.1, 0.5),
@@ -67,6 +56,7 @@ func InitKDBInstance(rc *context.ClusterContext, instance *v1.KDBInstance, desc
 			DataVolumeClaimSpec: shared.PVCSpec{
 				StorageClass: desc.StorageClass,
 				Size:         desc.Size,
+				Autoscale:    desc.Autoscale,
 			},
 		},
 		Leader:            master,
@@ -75,13 +65,71 @@ func InitKDBInstance(rc *context.ClusterContext, instance *v1.KDBInstance, desc
 		Engine:            cluster.Spec.Engine,
 		EngineFullVersion: desc.EngineFullVersion,
 		Config:            globalConfig.GetDBConfig(cluster.Spec.Engine, desc.EngineFullVersion),
+		CredentialsSecret: naming.ClusterCredentials(cluster).Name,
 	}
 	if !desc.LogSize.IsZero() {
 		instanceSet.InstanceSet.LogVolumeClaimSpec = &shared.PVCSpec{
 			Size:         desc.LogSize,
 			StorageClass: desc.StorageClass,
+			Autoscale:    desc.LogAutoscale,
 		}
 	}
+	if err := ResolveImages(&globalConfig, &instanceSet); err != nil {
+		return err
+	}
+	placeInstance(cluster, &instanceSet.InstanceSet)
 	instance.Spec = instanceSet
 	return nil
 }
+
+// ResolveImages sets the container images of spec to the images configured
+// for its engine full version. An image is replaced only when it is empty or
+// when it is the image configured for one of the managed versions, the
+// versions the images of spec were resolved for before. Images set in the
+// spec explicitly are kept.
+func ResolveImages(globalConfig *config.GlobalConfig, spec *v1.KDBInstanceSpec, managed ...string) error {
+	desired, err := versionImages(globalConfig, spec.Engine, spec.EngineFullVersion)
+	if err != nil {
+		return err
+	}
+	var previous []config.InstanceImage
+	for _, v := range managed {
+		if images, err := versionImages(globalConfig, spec.Engine, v); err == nil {
+			previous = append(previous, images)
+		}
+	}
+	resolve := func(image *string, desired string, of func(config.InstanceImage) string) {
+		if *image == "" {
+			*image = desired
+			return
+		}
+		for _, images := range previous {
+			if *image == of(images) {
+				*image = desired
+				return
+			}
+		}
+	}
+	main := func(images config.InstanceImage) string { return images.Main }
+	sidecar := func(images config.InstanceImage) string { return images.Sidecar }
+	monitor := func(images config.InstanceImage) string { return images.Monitor }
+	resolve(&spec.InstanceSet.InitContainer.Image, desired.Sidecar, sidecar)
+	resolve(&spec.InstanceSet.MainContainer.Image, desired.Main, main)
+	resolve(&spec.InstanceSet.SidecarContainer.Image, desired.Sidecar, sidecar)
+	resolve(&spec.InstanceSet.MonitorContainer.Image, desired.Monitor, monitor)
+	return nil
+}
+
+// versionImages returns the images configured for the engine full version.
+func versionImages(globalConfig *config.GlobalConfig, engine, fullVersion string) (config.InstanceImage, error) {
+	var images config.InstanceImage
+	var err error
+	if images.Main, err = globalConfig.GetMainImage(engine, fullVersion); err != nil {
+		return images, err
+	}
+	if images.Sidecar, err = globalConfig.GetSidecarImage(engine, fullVersion); err != nil {
+		return images, err
+	}
+	images.Monitor, err = globalConfig.GetMonitorImage(engine, fullVersion)
+	return images, err
+}
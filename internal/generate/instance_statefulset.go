@@ -31,7 +31,7 @@ func InstanceStatefulSetIntent(rc *context.InstanceContext, sts *appsv1.Stateful
 		},
 	}
 	sts.Spec.Template.Annotations = naming.Merge(
-		instance.Annotations,
+		naming.PodTemplateAnnotations(instance),
 		instanceSet.Metadata.GetAnnotationsOrNil(),
 	)
 	sts.Spec.Template.Labels = naming.Merge(
@@ -51,8 +51,8 @@ func InstanceStatefulSetIntent(rc *context.InstanceContext, sts *appsv1.Stateful
 	// - https://docs.k8s.io/concepts/services-networking/dns-pod-service/#pods
 	//sts.Spec.ServiceName = rc.GetClusterPodService().Name
 
-	// Disable StatefulSet's "RollingUpdate" strategy. The rolloutInstances
-	// method considers Pods across the entire Kdb instance and deletes
+	// Disable StatefulSet's "RollingUpdate" strategy. The RolloutInstance
+	// step considers Pods across the entire Kdb instance and deletes
 	// them to trigger updates.
 	// - https://docs.k8s.io/concepts/workloads/controllers/statefulset/#on-delete
 	sts.Spec.UpdateStrategy.Type = appsv1.OnDeleteStatefulSetStrategyType
@@ -65,7 +65,7 @@ func InstanceStatefulSetIntent(rc *context.InstanceContext, sts *appsv1.Stateful
 		sts.Spec.Template.Spec.PriorityClassName = *instanceSet.PriorityClassName
 	}
 
-	if instance.Spec.Shutdown != nil && *instance.Spec.Shutdown {
+	if naming.IsInstanceSetStopped(instance, sts.Name) {
 		sts.Spec.Replicas = util.Int32(0)
 	} else {
 		sts.Spec.Replicas = util.Int32(1)
@@ -0,0 +1,55 @@
+package generate
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/apis/shared"
+	"github.com/sqc157400661/kdb/internal/naming"
+)
+
+// placeInstance adds the pod anti-affinity and the topology spread constraint
+// of the placement of cluster to the instance set of one of its instances.
+// They select the pods of all the instances of cluster by its cluster id.
+func placeInstance(cluster *v1.KDBCluster, instanceSet *shared.InstanceSetSpec) {
+	placement := cluster.Spec.Placement
+	if placement == nil {
+		return
+	}
+	selector := &metav1.LabelSelector{
+		MatchLabels: map[string]string{naming.LabelClusterID: naming.KDBClusterID(cluster)},
+	}
+	term := corev1.PodAffinityTerm{
+		LabelSelector: selector,
+		TopologyKey:   naming.PlacementTopologyKey(placement.Topology),
+	}
+	spread := corev1.TopologySpreadConstraint{
+		MaxSkew:           1,
+		TopologyKey:       term.TopologyKey,
+		WhenUnsatisfiable: corev1.ScheduleAnyway,
+		LabelSelector:     selector,
+	}
+
+	// The affinity of the instance comes from the spec of cluster, it is
+	// copied rather than changed in place.
+	affinity := &corev1.Affinity{}
+	if instanceSet.Affinity != nil {
+		affinity = instanceSet.Affinity.DeepCopy()
+	}
+	if affinity.PodAntiAffinity == nil {
+		affinity.PodAntiAffinity = &corev1.PodAntiAffinity{}
+	}
+	antiAffinity := affinity.PodAntiAffinity
+	if placement.Policy == v1.PlacementRequired {
+		antiAffinity.RequiredDuringSchedulingIgnoredDuringExecution = append(
+			antiAffinity.RequiredDuringSchedulingIgnoredDuringExecution, term)
+		spread.WhenUnsatisfiable = corev1.DoNotSchedule
+	} else {
+		antiAffinity.PreferredDuringSchedulingIgnoredDuringExecution = append(
+			antiAffinity.PreferredDuringSchedulingIgnoredDuringExecution,
+			corev1.WeightedPodAffinityTerm{Weight: 100, PodAffinityTerm: term})
+	}
+	instanceSet.Affinity = affinity
+	instanceSet.TopologySpreadConstraints = append(instanceSet.TopologySpreadConstraints, spread)
+}
@@ -1,9 +1,15 @@
 package generate
 
 import (
+	"strconv"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/apis/shared"
 	"github.com/sqc157400661/kdb/internal/naming"
 	"github.com/sqc157400661/kdb/internal/security"
+	"github.com/sqc157400661/kdb/pkg/featuregate"
 	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+	"github.com/sqc157400661/util"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
@@ -43,6 +49,25 @@ func instanceVolsIntent(rc *context.InstanceContext, sts *appsv1.StatefulSet) (m
 		})
 
 	}
+	// The set restoring the backup of a major upgrade reads the dump from the
+	// volume of the backup.
+	if naming.IsRestoreSet(instance, sts.Name) {
+		mounts = append(mounts, corev1.VolumeMount{
+			Name:      "upgrade-backup",
+			MountPath: naming.BackupMountPath,
+			ReadOnly:  true,
+		})
+		vols = append(vols, corev1.Volume{
+			Name: "upgrade-backup",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: naming.UpgradeBackup(instance, instance.Status.MajorUpgrade.ToVersion).Name,
+					ReadOnly:  true,
+				},
+			},
+		})
+	}
+
 	// config map
 	configVolumeMount := naming.ConfigVolumeMount()
 	mounts = append(mounts, configVolumeMount)
@@ -76,10 +101,42 @@ func instanceVolsIntent(rc *context.InstanceContext, sts *appsv1.StatefulSet) (m
 							}},
 						},
 					},
+					{
+						// The passwords are readable by the fsGroup of the pod
+						// only.
+						Secret: &corev1.SecretProjection{
+							LocalObjectReference: corev1.LocalObjectReference{
+								Name: naming.InstanceCredentials(instance).Name,
+							},
+							Items: credentialItems(),
+						},
+					},
+					{
+						// The passwords a rotation moves to are there before
+						// they are set, the probes fall back to them until the
+						// files of the passwords are updated.
+						Secret: &corev1.SecretProjection{
+							LocalObjectReference: corev1.LocalObjectReference{
+								Name: naming.InstanceCredentials(instance).Name,
+							},
+							Items:    pendingCredentialItems(),
+							Optional: util.Bool(true),
+						},
+					},
 				},
 			},
 		},
 	}
+	if naming.IsTLSEnabled(instance) {
+		configVolume.Projected.Sources = append(configVolume.Projected.Sources, corev1.VolumeProjection{
+			Secret: &corev1.SecretProjection{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: naming.InstanceTLS(instance).Name,
+				},
+				Items: tlsItems(),
+			},
+		})
+	}
 	vols = append(vols, configVolume)
 
 	// downward vol
@@ -149,12 +206,27 @@ func instanceVolsIntent(rc *context.InstanceContext, sts *appsv1.StatefulSet) (m
 			Name:      "tmp",
 			MountPath: "/tmp",
 		})
+
+	// The root filesystem of the restricted profile is read-only, the
+	// directories the engine writes to are EmptyDirs.
+	if security.Profile(instance) == v1.SecurityProfileRestricted {
+		for _, mount := range naming.RuntimeVolumeMounts(instance) {
+			mounts = append(mounts, mount)
+			vols = append(vols, corev1.Volume{
+				Name:         mount.Name,
+				VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+			})
+		}
+	}
 	return
 }
 
-func instanceContainer(rc *context.InstanceContext, mounts []corev1.VolumeMount) (initContainers []corev1.Container, containers []corev1.Container) {
+func instanceContainer(rc *context.InstanceContext, sts *appsv1.StatefulSet, mounts []corev1.VolumeMount) (initContainers []corev1.Container, containers []corev1.Container) {
 	instance := rc.GetInstance()
 	instanceSet := naming.InstanceSetSpec(instance)
+	if naming.IsRollingBack(instance) {
+		initContainers = append(initContainers, rollbackContainer(rc, instanceSet, mounts))
+	}
 	containers = append(containers, corev1.Container{
 		Name:      naming.ContainerDatabase,
 		Command:   instanceSet.MainContainer.Command,
@@ -169,74 +241,184 @@ func instanceContainer(rc *context.InstanceContext, mounts []corev1.VolumeMount)
 			Protocol:      corev1.ProtocolTCP,
 		}},
 
-		SecurityContext: security.InitRestrictedSecurityContext(),
+		SecurityContext: security.ContainerSecurityContext(instance),
 		VolumeMounts:    mounts,
 	})
+	if seed := naming.ReplicaSeed(instance, sts.Name); seed != nil && seed.Method == v1.SeedMethodXtrabackup &&
+		seed.Phase != v1.SeedReplicating {
+		initContainers = append(initContainers, seedContainer(rc, instanceSet, mounts))
+	}
 	if instanceSet.SidecarContainer.Image == "" {
 		return
 	}
-	containers = append(containers, corev1.Container{
-		Name:         naming.ContainerSidecar,
-		Command:      instanceSet.SidecarContainer.Command,
-		Env:          append(RequestEnvironment(instance), instanceSet.SidecarContainer.Env...),
-		Args:         instanceSet.SidecarContainer.Args,
-		Image:        instanceSet.SidecarContainer.Image,
-		Resources:    instanceSet.SidecarContainer.Resources,
-		VolumeMounts: mounts,
-	})
+	sidecar := corev1.Container{
+		Name:            naming.ContainerSidecar,
+		Command:         instanceSet.SidecarContainer.Command,
+		Env:             append(RequestEnvironment(instance), instanceSet.SidecarContainer.Env...),
+		Args:            instanceSet.SidecarContainer.Args,
+		Image:           instanceSet.SidecarContainer.Image,
+		Resources:       instanceSet.SidecarContainer.Resources,
+		SecurityContext: security.ContainerSecurityContext(instance),
+		VolumeMounts:    mounts,
+	}
+	if featuregate.Enabled(featuregate.SidecarAPI) {
+		sidecar.Ports = []corev1.ContainerPort{{
+			Name:          naming.PortSidecar,
+			ContainerPort: naming.SidecarPort,
+			Protocol:      corev1.ProtocolTCP,
+		}}
+	}
+	containers = append(containers, sidecar)
 	return
 }
 
+// seedScript receives the xtrabackup stream of a donor on the seed port,
+// prepares it and moves it to the directories of the database config. The
+// binlog position of the backup is kept for the start of the replication.
+// Only an empty data directory, or one left behind by an interrupted seed, is
+// replaced; the script fails rather than remove initialized data.
+const seedScript = `set -euo pipefail
+[ -e "$SEED_MARKER" ] && exit 0
+if [ ! -d "$SEED_DIR" ] && [ -d "$DATA_DIR/mysql" ]; then
+  echo "$DATA_DIR is initialized, it is not replaced by a seed" >&2
+  exit 1
+fi
+rm -rf "$SEED_DIR" "$DATA_DIR"
+mkdir -p "$SEED_DIR"
+socat -u "TCP-LISTEN:$SEED_PORT,reuseaddr" STDOUT | xbstream -x -C "$SEED_DIR"
+xtrabackup --prepare --target-dir="$SEED_DIR"
+cp "$SEED_DIR/xtrabackup_binlog_info" "$SEED_BINLOG_INFO"
+xtrabackup --defaults-file="$MYSQL_CONFIG" --move-back --target-dir="$SEED_DIR"
+rm -rf "$SEED_DIR"
+touch "$SEED_MARKER"
+`
+
+// seedContainer returns the init container a new replica seeded with
+// xtrabackup receives its data with, before the database starts. It is removed
+// once the replica replicates, which restarts the replica once.
+func seedContainer(rc *context.InstanceContext, instanceSet shared.InstanceSetSpec,
+	mounts []corev1.VolumeMount) corev1.Container {
+	instance := rc.GetInstance()
+	globalConfig := rc.GetGlobalConfig()
+	image, err := globalConfig.GetBackupImage(naming.Engine(instance), instance.Spec.EngineFullVersion)
+	if err != nil || image == "" {
+		image = instanceSet.MainContainer.Image
+	}
+	return corev1.Container{
+		Name:    naming.ContainerSeed,
+		Image:   image,
+		Command: []string{"bash", "-c", seedScript},
+		Env: []corev1.EnvVar{
+			{Name: "SEED_PORT", Value: strconv.Itoa(naming.SeedPort)},
+			{Name: "SEED_DIR", Value: naming.DataMountPath + "/seed"},
+			{Name: "SEED_MARKER", Value: naming.SeedMarkerPath},
+			{Name: "SEED_BINLOG_INFO", Value: naming.SeedBinlogInfoPath},
+			{Name: "DATA_DIR", Value: naming.MySQLDataDir},
+			{Name: "MYSQL_CONFIG", Value: naming.ConfigMountPath + "/" + naming.MySQLConfigMapFileKey},
+		},
+		Ports: []corev1.ContainerPort{{
+			Name:          naming.PortSeed,
+			ContainerPort: naming.SeedPort,
+			Protocol:      corev1.ProtocolTCP,
+		}},
+		Resources:       instanceSet.InitContainer.Resources,
+		SecurityContext: security.ContainerSecurityContext(instance),
+		VolumeMounts:    mounts,
+	}
+}
+
 func InstancePodIntent(rc *context.InstanceContext, sts *appsv1.StatefulSet) {
 	podTmpl := sts.Spec.Template
 	mounts, vols := instanceVolsIntent(rc, sts)
 	podTmpl.Spec.Volumes = vols
-	initContainer, containers := instanceContainer(rc, mounts)
-	//for _, c := range containers {
-	//	decorateWithDefaultProbes(&c)
-	//}
+	initContainer, containers := instanceContainer(rc, sts, mounts)
+	for i := range containers {
+		decorateWithProbes(rc.GetInstance(), &containers[i])
+	}
 	podTmpl.Spec.InitContainers = initContainer
 	podTmpl.Spec.Containers = containers
+	podTmpl.Spec.TerminationGracePeriodSeconds = util.Int64(naming.TerminationGracePeriodSeconds)
 	sts.Spec.Template = podTmpl
 }
 
-// decorateWithDefaultProbes adds default liveness and readiness probes to container.
-func decorateWithDefaultProbes(container *corev1.Container) {
-
-	//
-	// If the process does not stop, kubelet will send a SIGKILL after the pod's
-	// TerminationGracePeriodSeconds.
-	// - https://docs.k8s.io/concepts/workloads/pods/pod-lifecycle/
-	//
-	// TODO: Consider TerminationGracePeriodSeconds' impact here.
-	// TODO: Consider if a PreStop hook is necessary.
-	if container.LivenessProbe == nil {
-		container.LivenessProbe = &corev1.Probe{
-			TimeoutSeconds:   6,
-			PeriodSeconds:    3,
-			SuccessThreshold: 1,
-			FailureThreshold: 3,
-		}
-		container.LivenessProbe.InitialDelaySeconds = 30
-		container.LivenessProbe.Exec = &corev1.ExecAction{
-			Command: []string{
-				"/kdb/bin/liveness.sh",
-			},
-		}
+// rollbackScript moves the data directory written by the upgraded version
+// aside once, the database starts with an empty one and restores the backup
+// or copies the data of the restored pod. Nothing is deleted.
+const rollbackScript = `set -euo pipefail
+[ -e "$ROLLBACK_MARKER" ] && exit 0
+if [ -d "$DATA_DIR" ]; then
+  mv "$DATA_DIR" "$DATA_DIR.$UPGRADED_VERSION.$(date +%s)"
+fi
+rm -f "$SEED_MARKER"
+touch "$ROLLBACK_MARKER"
+`
+
+// rollbackContainer returns the init container that prepares the data volume
+// of a pod for the rollback of a major upgrade.
+func rollbackContainer(rc *context.InstanceContext, instanceSet shared.InstanceSetSpec,
+	mounts []corev1.VolumeMount) corev1.Container {
+	instance := rc.GetInstance()
+	return corev1.Container{
+		Name:    naming.ContainerRollback,
+		Image:   instanceSet.MainContainer.Image,
+		Command: []string{"bash", "-c", rollbackScript},
+		Env: []corev1.EnvVar{
+			{Name: "ROLLBACK_MARKER", Value: naming.RollbackMarkerPath(instance)},
+			{Name: "SEED_MARKER", Value: naming.SeedMarkerPath},
+			{Name: "DATA_DIR", Value: naming.MySQLDataDir},
+			{Name: "UPGRADED_VERSION", Value: instance.Status.MajorUpgrade.ToVersion},
+		},
+		Resources:       instanceSet.InitContainer.Resources,
+		SecurityContext: security.ContainerSecurityContext(instance),
+		VolumeMounts:    mounts,
 	}
-	if container.ReadinessProbe == nil {
-		container.ReadinessProbe = &corev1.Probe{
-			TimeoutSeconds:   6,
-			PeriodSeconds:    3,
-			SuccessThreshold: 1,
-			FailureThreshold: 3,
-		}
-		container.ReadinessProbe.InitialDelaySeconds = 60
-		container.ReadinessProbe.Exec = &corev1.ExecAction{
-			Command: []string{
-				"/kdb/bin/readiness.sh",
-			},
-		}
+}
+
+// pendingCredentialItems returns the files of the passwords a rotation of the
+// credentials moves to, next to the files of the current passwords.
+func pendingCredentialItems() []corev1.KeyToPath {
+	keys := naming.CredentialSecretKeys()
+	items := make([]corev1.KeyToPath, 0, len(keys))
+	for _, key := range keys {
+		items = append(items, corev1.KeyToPath{
+			Key:  naming.PendingCredentialKey(key),
+			Path: naming.CredentialsDir + "/" + naming.PendingCredentialKey(key),
+			Mode: util.Int32(0o440),
+		})
 	}
+	return items
+}
+
+// credentialItems returns the files of the passwords of the database users
+// in the credentials directory of the config volume, and of the token of the
+// management API of the sidecar when it is enabled.
+func credentialItems() []corev1.KeyToPath {
+	keys := naming.CredentialSecretKeys()
+	if featuregate.Enabled(featuregate.SidecarAPI) {
+		keys = append(keys, naming.SidecarTokenSecretKey)
+	}
+	items := make([]corev1.KeyToPath, 0, len(keys))
+	for _, key := range keys {
+		items = append(items, corev1.KeyToPath{
+			Key:  key,
+			Path: naming.CredentialsDir + "/" + key,
+			Mode: util.Int32(0o440),
+		})
+	}
+	return items
+}
 
+// tlsItems returns the files of the certificate of the server in the TLS
+// directory of the config volume, the private key is readable by the fsGroup
+// of the pod only.
+func tlsItems() []corev1.KeyToPath {
+	items := make([]corev1.KeyToPath, 0, 3)
+	for _, key := range []string{naming.CACertSecretKey, naming.TLSCertSecretKey, naming.TLSKeySecretKey} {
+		item := corev1.KeyToPath{Key: key, Path: naming.TLSDir + "/" + key}
+		if key == naming.TLSKeySecretKey {
+			item.Mode = util.Int32(0o440)
+		}
+		items = append(items, item)
+	}
+	return items
 }
@@ -0,0 +1,60 @@
+package generate
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestSeedScript(t *testing.T) {
+	t.Parallel()
+
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("requires bash")
+	}
+	// run runs the script until it receives the stream, socat fails.
+	run := func(t *testing.T, root string) error {
+		bin := filepath.Join(root, "bin")
+		assert.NilError(t, os.MkdirAll(bin, 0o755))
+		assert.NilError(t, os.WriteFile(filepath.Join(bin, "socat"), []byte("#!/bin/sh\nexit 1\n"), 0o755))
+		cmd := exec.Command("bash", "-c", seedScript)
+		cmd.Env = append(os.Environ(),
+			"PATH="+bin+":"+os.Getenv("PATH"),
+			"SEED_DIR="+filepath.Join(root, "seed"),
+			"SEED_MARKER="+filepath.Join(root, ".kdb-seeded"),
+			"DATA_DIR="+filepath.Join(root, "data"),
+		)
+		return cmd.Run()
+	}
+
+	t.Run("Initialized", func(t *testing.T) {
+		root := t.TempDir()
+		assert.NilError(t, os.MkdirAll(filepath.Join(root, "data", "mysql"), 0o755))
+		assert.Assert(t, run(t, root) != nil)
+		_, err := os.Stat(filepath.Join(root, "data", "mysql"))
+		assert.NilError(t, err, "the data is kept")
+	})
+	t.Run("Interrupted", func(t *testing.T) {
+		root := t.TempDir()
+		assert.NilError(t, os.MkdirAll(filepath.Join(root, "data", "mysql"), 0o755))
+		assert.NilError(t, os.MkdirAll(filepath.Join(root, "seed"), 0o755))
+		assert.Assert(t, run(t, root) != nil)
+		_, err := os.Stat(filepath.Join(root, "data"))
+		assert.Assert(t, os.IsNotExist(err), "the partial data is replaced")
+	})
+	t.Run("Empty", func(t *testing.T) {
+		root := t.TempDir()
+		assert.Assert(t, run(t, root) != nil)
+		_, err := os.Stat(filepath.Join(root, "seed"))
+		assert.NilError(t, err, "the stream is received")
+	})
+	t.Run("Seeded", func(t *testing.T) {
+		root := t.TempDir()
+		assert.NilError(t, os.MkdirAll(filepath.Join(root, "data", "mysql"), 0o755))
+		assert.NilError(t, os.WriteFile(filepath.Join(root, ".kdb-seeded"), nil, 0o644))
+		assert.NilError(t, run(t, root))
+	})
+}
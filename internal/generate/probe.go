@@ -0,0 +1,133 @@
+package generate
+
+import (
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/apis/shared"
+	"github.com/sqc157400661/kdb/internal/naming"
+)
+
+// The probe scripts ship in the engine images, see hack/docker/Dockerfile.engine.
+const (
+	startupProbeScript   = "/kdb/bin/startup.sh"
+	readinessProbeScript = "/kdb/bin/readiness.sh"
+	livenessProbeScript  = "/kdb/bin/liveness.sh"
+)
+
+// engineProbes holds the default timing of the probes of one engine.
+type engineProbes struct {
+	startup, readiness, liveness corev1.Probe
+}
+
+var (
+	// InnoDB crash recovery replays the redo log before mysqld opens its socket,
+	// which can take a long time after an unclean shutdown of a large instance.
+	// The startup probe allows one hour (10s * 360) before the kubelet gives up.
+	//
+	// The liveness probe only checks that mysqld answers on its socket and is
+	// tolerant (10s * 6) so that a master busy with a heavy workload is never
+	// restarted by the kubelet.
+	mysqlProbes = engineProbes{
+		startup: corev1.Probe{
+			PeriodSeconds:    10,
+			TimeoutSeconds:   5,
+			SuccessThreshold: 1,
+			FailureThreshold: 360,
+		},
+		readiness: corev1.Probe{
+			PeriodSeconds:    5,
+			TimeoutSeconds:   5,
+			SuccessThreshold: 1,
+			FailureThreshold: 3,
+		},
+		liveness: corev1.Probe{
+			PeriodSeconds:    10,
+			TimeoutSeconds:   10,
+			SuccessThreshold: 1,
+			FailureThreshold: 6,
+		},
+	}
+
+	// Postgres replays WAL before accepting connections, the startup probe
+	// allows thirty minutes (10s * 180) for it.
+	postgresProbes = engineProbes{
+		startup: corev1.Probe{
+			PeriodSeconds:    10,
+			TimeoutSeconds:   5,
+			SuccessThreshold: 1,
+			FailureThreshold: 180,
+		},
+		readiness: corev1.Probe{
+			PeriodSeconds:    5,
+			TimeoutSeconds:   5,
+			SuccessThreshold: 1,
+			FailureThreshold: 3,
+		},
+		liveness: corev1.Probe{
+			PeriodSeconds:    10,
+			TimeoutSeconds:   10,
+			SuccessThreshold: 1,
+			FailureThreshold: 6,
+		},
+	}
+)
+
+// decorateWithProbes adds the startup, readiness and liveness probes of the
+// instance engine to container. Probes already set on the container are kept.
+func decorateWithProbes(instance *v1.KDBInstance, container *corev1.Container) {
+	// Only the database container has probes. The sidecar exposes no health
+	// endpoint and restarting it does not help the database.
+	if container.Name != naming.ContainerDatabase {
+		return
+	}
+
+	defaults := mysqlProbes
+	if naming.IsPGEngine(instance) {
+		defaults = postgresProbes
+	}
+	spec := naming.InstanceSetSpec(instance).Probes
+	if spec == nil {
+		spec = &shared.ProbeSpec{}
+	}
+	maxLag := naming.MaxReplicationLagSeconds(instance)
+
+	// The scripts read the engine from ENGINE_ENV, see RequestEnvironment.
+	if container.StartupProbe == nil {
+		container.StartupProbe = probe(defaults.startup, spec.Startup,
+			startupProbeScript)
+	}
+	if container.ReadinessProbe == nil {
+		container.ReadinessProbe = probe(defaults.readiness, spec.Readiness,
+			readinessProbeScript, strconv.Itoa(int(maxLag)))
+	}
+	if container.LivenessProbe == nil {
+		container.LivenessProbe = probe(defaults.liveness, spec.Liveness,
+			livenessProbeScript)
+	}
+}
+
+// probe returns an exec probe running command with the timing of defaults
+// overridden by the non-nil fields of thresholds.
+func probe(defaults corev1.Probe, thresholds *shared.ProbeThresholds, command ...string) *corev1.Probe {
+	p := defaults.DeepCopy()
+	p.Exec = &corev1.ExecAction{Command: command}
+	if thresholds == nil {
+		return p
+	}
+	if thresholds.InitialDelaySeconds != nil {
+		p.InitialDelaySeconds = *thresholds.InitialDelaySeconds
+	}
+	if thresholds.PeriodSeconds != nil {
+		p.PeriodSeconds = *thresholds.PeriodSeconds
+	}
+	if thresholds.TimeoutSeconds != nil {
+		p.TimeoutSeconds = *thresholds.TimeoutSeconds
+	}
+	if thresholds.FailureThreshold != nil {
+		p.FailureThreshold = *thresholds.FailureThreshold
+	}
+	return p
+}
@@ -0,0 +1,83 @@
+package hibernation
+
+import (
+	"time"
+	// The operator image may not ship a time zone database.
+	_ "time/tzdata"
+
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+)
+
+// lookback bounds how far back the last stop and start of the schedules are
+// searched. It is a week and a day so that weekly schedules are found.
+const lookback = 8 * 24 * time.Hour
+
+// State is the outcome of the hibernation schedules at a point in time.
+type State struct {
+	// Hibernating reports whether the last activation of the schedules was a
+	// stop.
+	Hibernating bool
+
+	// NextStop and NextStart are the next activations of the schedules, zero
+	// when there is none.
+	NextStop  time.Time
+	NextStart time.Time
+}
+
+// Evaluate returns the state of the schedules of spec at now. The instance
+// hibernates when the latest stop before now is later than the latest start.
+func Evaluate(spec *v1.HibernationSpec, now time.Time) (State, error) {
+	location := time.UTC
+	if spec.TimeZone != "" {
+		var err error
+		if location, err = time.LoadLocation(spec.TimeZone); err != nil {
+			return State{}, errors.WithMessagef(err, "load time zone %q", spec.TimeZone)
+		}
+	}
+	now = now.In(location)
+
+	var state State
+	var lastStop, lastStart time.Time
+	for _, schedule := range spec.Schedules {
+		stop, err := cron.ParseStandard(schedule.Stop)
+		if err != nil {
+			return State{}, errors.WithMessagef(err, "parse stop schedule %q", schedule.Stop)
+		}
+		start, err := cron.ParseStandard(schedule.Start)
+		if err != nil {
+			return State{}, errors.WithMessagef(err, "parse start schedule %q", schedule.Start)
+		}
+		lastStop = latest(lastStop, last(stop, now))
+		lastStart = latest(lastStart, last(start, now))
+		state.NextStop = earliest(state.NextStop, stop.Next(now))
+		state.NextStart = earliest(state.NextStart, start.Next(now))
+	}
+	state.Hibernating = lastStop.After(lastStart)
+	return state, nil
+}
+
+// last returns the last activation of schedule within lookback of now.
+func last(schedule cron.Schedule, now time.Time) time.Time {
+	var activation time.Time
+	for t := schedule.Next(now.Add(-lookback)); !t.IsZero() && !t.After(now); t = schedule.Next(t) {
+		activation = t
+	}
+	return activation
+}
+
+func latest(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
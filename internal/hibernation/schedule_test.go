@@ -0,0 +1,78 @@
+package hibernation
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+)
+
+func TestEvaluate(t *testing.T) {
+	t.Parallel()
+
+	// Stop on weekday evenings, start on weekday mornings.
+	spec := &v1.HibernationSpec{
+		Schedules: []v1.HibernationSchedule{{Stop: "0 20 * * 1-5", Start: "0 8 * * 1-5"}},
+		TimeZone:  "Europe/Berlin",
+	}
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	assert.NilError(t, err)
+
+	for _, tt := range []struct {
+		name        string
+		now         time.Time
+		hibernating bool
+		nextStop    time.Time
+		nextStart   time.Time
+	}{
+		{
+			name:        "Day",
+			now:         time.Date(2024, 3, 13, 12, 0, 0, 0, berlin),
+			hibernating: false,
+			nextStop:    time.Date(2024, 3, 13, 20, 0, 0, 0, berlin),
+			nextStart:   time.Date(2024, 3, 14, 8, 0, 0, 0, berlin),
+		},
+		{
+			name:        "Night",
+			now:         time.Date(2024, 3, 13, 23, 0, 0, 0, berlin),
+			hibernating: true,
+			nextStop:    time.Date(2024, 3, 14, 20, 0, 0, 0, berlin),
+			nextStart:   time.Date(2024, 3, 14, 8, 0, 0, 0, berlin),
+		},
+		{
+			name:        "Weekend",
+			now:         time.Date(2024, 3, 16, 12, 0, 0, 0, berlin),
+			hibernating: true,
+			nextStop:    time.Date(2024, 3, 18, 20, 0, 0, 0, berlin),
+			nextStart:   time.Date(2024, 3, 18, 8, 0, 0, 0, berlin),
+		},
+		{
+			// The schedules are evaluated in their time zone.
+			name:        "UTC",
+			now:         time.Date(2024, 3, 13, 19, 30, 0, 0, time.UTC),
+			hibernating: true,
+			nextStop:    time.Date(2024, 3, 14, 20, 0, 0, 0, berlin),
+			nextStart:   time.Date(2024, 3, 14, 8, 0, 0, 0, berlin),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			state, err := Evaluate(spec, tt.now)
+			assert.NilError(t, err)
+			assert.Equal(t, state.Hibernating, tt.hibernating)
+			assert.Assert(t, state.NextStop.Equal(tt.nextStop), "got %v", state.NextStop)
+			assert.Assert(t, state.NextStart.Equal(tt.nextStart), "got %v", state.NextStart)
+		})
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := Evaluate(&v1.HibernationSpec{
+			Schedules: []v1.HibernationSchedule{{Stop: "at night", Start: "0 8 * * *"}},
+		}, time.Now())
+		assert.ErrorContains(t, err, "parse stop schedule")
+
+		_, err = Evaluate(&v1.HibernationSpec{TimeZone: "Mars/Olympus"}, time.Now())
+		assert.ErrorContains(t, err, "load time zone")
+	})
+}
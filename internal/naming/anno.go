@@ -13,6 +13,47 @@ const (
 	CurrentInstanceConfigVersion = annoPrefix + "current-instance-config-version"
 	// UpdateInstanceConfigVersion the config version to be updated for the KDBInstance Sidecar
 	UpdateInstanceConfigVersion = annoPrefix + "update-instance-config-version"
+
+	// RestartForConfigVersion marks the pods that must be restarted to load the
+	// static parameters of the given config version.
+	RestartForConfigVersion = annoPrefix + "restart-for-config-version"
+
+	// RestartForVolumeResize marks the pods that must be restarted to finish
+	// the file system resize of the given volume.
+	RestartForVolumeResize = annoPrefix + "restart-for-volume-resize"
+
+	// RestartForCertificate marks the pods that must be restarted to load the
+	// certificate of the given hash, their server cannot reload it.
+	RestartForCertificate = annoPrefix + "restart-for-certificate"
+
+	// OfflineVolumeExpansion marks the StorageClasses whose volumes only grow
+	// their file system when they are mounted again.
+	OfflineVolumeExpansion = annoPrefix + "offline-volume-expansion"
+
+	// AutoscaledSize is set on the PersistentVolumeClaims to the size
+	// autoscaling grew them to, the volume is never requested smaller.
+	AutoscaledSize = annoPrefix + "autoscaled-size"
+
+	// SuspendHibernation suspends the hibernation schedules of an instance.
+	SuspendHibernation = annoPrefix + "suspend-hibernation"
+
+	// AllowDowngrade allows the EngineFullVersion of an instance to be lowered.
+	AllowDowngrade = annoPrefix + "allow-downgrade"
+
+	// RotateCredentials rotates the passwords of the database users whenever
+	// it is set to a new value.
+	RotateCredentials = annoPrefix + "rotate-credentials"
+
+	// CredentialsRotated is set on the pod template of the consumers of the
+	// credentials to the time the passwords were last rotated.
+	CredentialsRotated = annoPrefix + "credentials-rotated"
+
+	// ServerVersion is set on the pods to the engine full version their
+	// server runs, once it is read.
+	ServerVersion = annoPrefix + "server-version"
+
+	// FinalizeUpgrade finalizes the major upgrade to the version it is set to.
+	FinalizeUpgrade = annoPrefix + "finalize-upgrade"
 )
 
 // CurrentConfigVersion return current config version of the KDBInstance Sidecar .
@@ -30,3 +71,41 @@ func UpdateConfigVersion(instance *v1.KDBInstance) string {
 	}
 	return ""
 }
+
+// IsDowngradeAllowed return whether the instance may run an older engine version.
+func IsDowngradeAllowed(instance *v1.KDBInstance) bool {
+	return instance.Annotations[AllowDowngrade] == "true"
+}
+
+// IsHibernationSuspended returns whether the hibernation schedules of instance
+// are suspended.
+func IsHibernationSuspended(instance *v1.KDBInstance) bool {
+	return instance.Annotations[SuspendHibernation] == "true"
+}
+
+// podTemplateExcludedAnnotations change while the instance is reconciled or
+// edited. They are kept out of the pod template, where any change makes the
+// pods outdated and restarts them.
+var podTemplateExcludedAnnotations = []string{
+	StopReconcile,
+	CurrentInstanceConfigVersion,
+	UpdateInstanceConfigVersion,
+	AllowDowngrade,
+	FinalizeUpgrade,
+	RotateCredentials,
+	SuspendHibernation,
+	"kubectl.kubernetes.io/last-applied-configuration",
+}
+
+// PodTemplateAnnotations returns the annotations of the instance that are
+// copied to its pods.
+func PodTemplateAnnotations(instance *v1.KDBInstance) map[string]string {
+	annotations := make(map[string]string, len(instance.Annotations))
+	for k, v := range instance.Annotations {
+		annotations[k] = v
+	}
+	for _, k := range podTemplateExcludedAnnotations {
+		delete(annotations, k)
+	}
+	return annotations
+}
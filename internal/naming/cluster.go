@@ -3,6 +3,7 @@ package naming
 import (
 	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
 	"github.com/sqc157400661/util"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -15,6 +16,43 @@ func KDBCluster(clusterName string) metav1.LabelSelector {
 	}
 }
 
+// KDBClusterID returns the cluster id of cluster, the pods of its instances
+// carry it. It defaults to the name of cluster.
+func KDBClusterID(cluster *v1.KDBCluster) string {
+	if id := cluster.Labels[LabelClusterID]; id != "" {
+		return id
+	}
+	return cluster.Name
+}
+
+// PlacementTopologyKey returns the label of the nodes naming the domains of
+// topology.
+func PlacementTopologyKey(topology v1.PlacementTopology) string {
+	if topology == v1.PlacementTopologyZone {
+		return corev1.LabelTopologyZone
+	}
+	return corev1.LabelHostname
+}
+
+// ClusterPodDisruptionBudget returns the ObjectMeta of the PodDisruptionBudget
+// of the pods of cluster with role.
+func ClusterPodDisruptionBudget(cluster *v1.KDBCluster, role string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Namespace: cluster.Namespace,
+		Name:      cluster.Name + "-" + role,
+	}
+}
+
+// ClusterCredentials returns the ObjectMeta of the Secret holding the
+// passwords of the database users that the instances of cluster share. The
+// instances replicate from each other, so they need the same passwords.
+func ClusterCredentials(cluster *v1.KDBCluster) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Namespace: cluster.Namespace,
+		Name:      cluster.Name + "-cluster-credentials",
+	}
+}
+
 func IsMasterSlaveCluster(cluster *v1.KDBCluster) bool {
 	return IsMasterSlaveArch(cluster.Spec.DeployArch)
 }
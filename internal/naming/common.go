@@ -9,10 +9,43 @@ const (
 )
 
 const (
-	SidecarConfigKey        = "sidecar"
-	DatabaseConfigKey       = "database"
-	SidecarConfigMapFileKey = "config.yaml"
-	MySQLConfigMapFileKey   = "my.cnf"
+	SidecarConfigKey  = "sidecar"
+	DatabaseConfigKey = "database"
+	// AppliedDatabaseConfigKey keeps the database config the running pods were
+	// configured with, it is compared to DatabaseConfigKey to find the changed
+	// parameters.
+	AppliedDatabaseConfigKey = "database-applied"
+	SidecarConfigMapFileKey  = "config.yaml"
+	MySQLConfigMapFileKey    = "my.cnf"
+)
+
+// MonitorUser and BackupUser are the database users of the monitor and of the
+// backups.
+const (
+	MonitorUser = "_monitor_user"
+	BackupUser  = "_backup_user"
+)
+
+// Keys of the passwords of the database users in the credentials Secret of an
+// instance, they are also the names of the files in CredentialsPath.
+const (
+	RootPasswordSecretKey    = "root-password"
+	ReplPasswordSecretKey    = "repl-password"
+	MonitorPasswordSecretKey = "monitor-password"
+	BackupPasswordSecretKey  = "backup-password"
+)
+
+// SidecarTokenSecretKey is the key of the token authenticating the operator to
+// the management API of the sidecar in the credentials Secret of an instance.
+const SidecarTokenSecretKey = "sidecar-token"
+
+// Keys of the certificates in the TLS Secrets, the ones of kubernetes.io/tls
+// Secrets. They are also the names of the files in TLSPath.
+const (
+	TLSCertSecretKey = "tls.crt"
+	TLSKeySecretKey  = "tls.key"
+	CACertSecretKey  = "ca.crt"
+	CAKeySecretKey   = "ca.key"
 )
 
 const (
@@ -27,6 +60,34 @@ const (
 
 	// ConfigMountPath is where to mount the config volume.
 	ConfigMountPath = "/etc/config"
+
+	// CredentialsDir is the directory of the config volume holding the
+	// passwords of the database users, CredentialsPath is where it is mounted.
+	CredentialsDir  = "credentials"
+	CredentialsPath = ConfigMountPath + "/" + CredentialsDir
+
+	// TLSDir is the directory of the config volume holding the certificate
+	// of the server, TLSPath is where it is mounted.
+	TLSDir  = "tls"
+	TLSPath = ConfigMountPath + "/" + TLSDir
+
+	// MySQLDataDir is the data directory of mysqld on the data volume.
+	MySQLDataDir = DataMountPath + "/data"
+
+	// SeedBinlogInfoPath is where a replica seeded with xtrabackup keeps the
+	// binlog position of its backup, SeedMarkerPath marks a finished seed.
+	SeedBinlogInfoPath = DataMountPath + "/xtrabackup_binlog_info"
+	SeedMarkerPath     = DataMountPath + "/.kdb-seeded"
+
+	// BackupMountPath is where the volume of the backup taken before a major
+	// upgrade is mounted.
+	BackupMountPath = "/backup"
+
+	// UpgradeDumpPath is the dump of the backup taken before a major upgrade.
+	UpgradeDumpPath = BackupMountPath + "/dump.sql.gz"
+
+	// MySQLSocketPath is the unix socket mysqld listens on.
+	MySQLSocketPath = DataMountPath + "/socket/mysqld.sock"
 )
 
 // Merge takes sets of labels and merges them. The last set
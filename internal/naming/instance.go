@@ -135,6 +135,80 @@ func EngineVersion(instance *v1.KDBInstance) (*version.Version, error) {
 	return version.NewVersion(instance.Spec.EngineVersion)
 }
 
+// SidecarPasswordFilesVersion is the first version of the sidecar that reads
+// the passwords of the database users from the files of the credentials
+// directory. Older sidecars read them from their config.
+const SidecarPasswordFilesVersion = "0.1.0"
+
+// IsLegacySidecar returns whether the sidecar image of instance is tagged with
+// a version before SidecarPasswordFilesVersion. Images without a version tag
+// are taken to be current.
+func IsLegacySidecar(instance *v1.KDBInstance) bool {
+	image := InstanceSetSpec(instance).SidecarContainer.Image
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	i := strings.LastIndex(image, ":")
+	if i < 0 || strings.Contains(image[i:], "/") {
+		return false
+	}
+	tag, err := version.NewVersion(image[i+1:])
+	if err != nil {
+		return false
+	}
+	return tag.LessThan(version.Must(version.NewVersion(SidecarPasswordFilesVersion)))
+}
+
+// ConfigEngineVersion returns the major version the database configuration is
+// rendered for. It is the major version of the running server until a major
+// upgrade starts to upgrade the replicas.
+func ConfigEngineVersion(instance *v1.KDBInstance) (*version.Version, error) {
+	running := instance.Status.EngineFullVersion
+	if upgrade := instance.Status.MajorUpgrade; upgrade != nil {
+		running = ""
+		if upgrade.Phase == v1.MajorUpgradePreCheck || upgrade.Phase == v1.MajorUpgradeBackup {
+			running = upgrade.FromVersion
+		}
+	}
+	if running == "" {
+		return EngineVersion(instance)
+	}
+	v, err := version.NewVersion(running)
+	if err != nil {
+		return nil, err
+	}
+	segments := v.Segments()
+	return version.NewVersion(fmt.Sprintf("%d.%d", segments[0], segments[1]))
+}
+
+// IsRollingBack reports whether a major upgrade of the instance is rolled
+// back by restoring its backup.
+func IsRollingBack(instance *v1.KDBInstance) bool {
+	upgrade := instance.Status.MajorUpgrade
+	return upgrade != nil && upgrade.Phase == v1.MajorUpgradeRollingBack
+}
+
+// IsRestoreSet reports whether the StatefulSet restores the backup of a major
+// upgrade that is rolled back.
+func IsRestoreSet(instance *v1.KDBInstance, setName string) bool {
+	return IsRollingBack(instance) && instance.Status.MajorUpgrade.RestoreSet == setName
+}
+
+// RollbackMarkerPath marks the data volume of a pod whose upgraded data
+// directory was moved aside by the rollback of the major upgrade. The marker
+// is unique to the upgrade, RestoreMarkerPath marks the restored backup.
+func RollbackMarkerPath(instance *v1.KDBInstance) string {
+	upgrade := instance.Status.MajorUpgrade
+	return fmt.Sprintf("%s/.kdb-rollback-%d", DataMountPath, upgrade.StartTime.Unix())
+}
+
+// RestoreMarkerPath marks the data volume of the pod that restored the backup
+// of a major upgrade, see RollbackMarkerPath.
+func RestoreMarkerPath(instance *v1.KDBInstance) string {
+	upgrade := instance.Status.MajorUpgrade
+	return fmt.Sprintf("%s/.kdb-restore-%d", DataMountPath, upgrade.StartTime.Unix())
+}
+
 // InstanceConfigMap returns the ObjectMeta necessary to lookup
 // cluster's shared ConfigMap.
 func InstanceConfigMap(instance *v1.KDBInstance) metav1.ObjectMeta {
@@ -144,6 +218,169 @@ func InstanceConfigMap(instance *v1.KDBInstance) metav1.ObjectMeta {
 	}
 }
 
+// InstanceCredentials returns the ObjectMeta of the Secret holding the
+// passwords of the database users of instance.
+func InstanceCredentials(instance *v1.KDBInstance) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Namespace: instance.Namespace,
+		Name:      instance.Name + "-credentials",
+	}
+}
+
+// RootCA returns the ObjectMeta of the Secret holding the CA of the operator
+// in namespace, it issues the certificates of the instances.
+func RootCA(namespace string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Namespace: namespace,
+		Name:      "kdb-root-ca",
+	}
+}
+
+// InstanceTLS returns the ObjectMeta of the Secret holding the certificate of
+// the servers of instance.
+func InstanceTLS(instance *v1.KDBInstance) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Namespace: instance.Namespace,
+		Name:      instance.Name + "-tls",
+	}
+}
+
+// InstanceDNSNames returns the DNS names of the certificate of instance: the
+// names of a Service named after the instance and of its pods.
+func InstanceDNSNames(instance *v1.KDBInstance) []string {
+	service := instance.Name + "." + instance.Namespace + ".svc"
+	return []string{
+		instance.Name,
+		instance.Name + "." + instance.Namespace,
+		service,
+		service + ".cluster.local",
+		"*." + service,
+		"*." + service + ".cluster.local",
+		"localhost",
+	}
+}
+
+// IsTLSEnabled reports whether the servers of instance use TLS.
+func IsTLSEnabled(instance *v1.KDBInstance) bool {
+	return instance.Spec.TLS != nil
+}
+
+// InstanceNetworkPolicy returns the ObjectMeta of the NetworkPolicy of the
+// pods of instance.
+func InstanceNetworkPolicy(instance *v1.KDBInstance) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Namespace: instance.Namespace,
+		Name:      instance.Name,
+	}
+}
+
+// IsNetworkPolicyEnabled reports whether the pods of instance are isolated by
+// a NetworkPolicy, defaultEnabled applies when the spec does not tell.
+func IsNetworkPolicyEnabled(instance *v1.KDBInstance, defaultEnabled bool) bool {
+	if policy := instance.Spec.NetworkPolicy; policy != nil && policy.Enabled != nil {
+		return *policy.Enabled
+	}
+	return defaultEnabled
+}
+
+// InstancePodDisruptionBudget returns the ObjectMeta of the
+// PodDisruptionBudget of the pods of instance with role.
+func InstancePodDisruptionBudget(instance *v1.KDBInstance, role string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Namespace: instance.Namespace,
+		Name:      instance.Name + "-" + role,
+	}
+}
+
+// IsHighlyAvailable reports whether instance runs a master and replicas, a
+// replica takes over when the master is disrupted.
+func IsHighlyAvailable(instance *v1.KDBInstance) bool {
+	replicas := instance.Spec.InstanceSet.Replicas
+	return replicas != nil && *replicas > 1
+}
+
+// IsClusterMember reports whether instance is controlled by a KDBCluster.
+func IsClusterMember(instance *v1.KDBInstance) bool {
+	owner := metav1.GetControllerOf(instance)
+	return owner != nil && owner.Kind == "KDBCluster"
+}
+
+// defaultMaxReplicationLagSeconds is the replication lag above which a replica
+// stops receiving read traffic unless the spec says otherwise.
+const defaultMaxReplicationLagSeconds = 30
+
+// MaxReplicationLagSeconds returns the replication lag above which a replica
+// of instance is not ready and its replication is not healthy.
+func MaxReplicationLagSeconds(instance *v1.KDBInstance) int32 {
+	if probes := InstanceSetSpec(instance).Probes; probes != nil && probes.MaxReplicationLagSeconds != nil {
+		return *probes.MaxReplicationLagSeconds
+	}
+	return defaultMaxReplicationLagSeconds
+}
+
+// SeedMethod returns how the new replicas of instance copy its data: the
+// method of the spec, or Clone when the server is MySQL 8.0.17 or later.
+func SeedMethod(instance *v1.KDBInstance) v1.SeedMethod {
+	if seeding := instance.Spec.Seeding; seeding != nil && seeding.Method != "" {
+		return seeding.Method
+	}
+	running := instance.Status.EngineFullVersion
+	if running == "" {
+		running = instance.Spec.EngineFullVersion
+	}
+	v, err := version.NewVersion(running)
+	if err == nil && v.GreaterThanOrEqual(version.Must(version.NewVersion("8.0.17"))) {
+		return v1.SeedMethodClone
+	}
+	return v1.SeedMethodXtrabackup
+}
+
+// ReplicaSeed returns the seeding of the replica of the StatefulSet setName
+// of instance, nil when it is not seeded.
+func ReplicaSeed(instance *v1.KDBInstance, setName string) *v1.ReplicaSeedStatus {
+	for i := range instance.Status.Seeding {
+		if instance.Status.Seeding[i].Set == setName {
+			return &instance.Status.Seeding[i]
+		}
+	}
+	return nil
+}
+
+// SeedJob returns the ObjectMeta of the job streaming the data of a donor to
+// the replica of the StatefulSet setName.
+func SeedJob(instance *v1.KDBInstance, setName string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Namespace: instance.Namespace,
+		Name:      setName + "-seed",
+	}
+}
+
+// CredentialSecretKeys returns the keys of the passwords of the database users
+// in the credentials Secret of an instance.
+func CredentialSecretKeys() []string {
+	return []string{
+		RootPasswordSecretKey,
+		ReplPasswordSecretKey,
+		MonitorPasswordSecretKey,
+		BackupPasswordSecretKey,
+	}
+}
+
+// PendingCredentialKey returns the key of the credentials Secret holding the
+// password being rotated to for key.
+func PendingCredentialKey(key string) string {
+	return "pending-" + key
+}
+
+// UpgradeBackup returns the ObjectMeta of the backup job and its volume taken
+// before the major upgrade of instance to version.
+func UpgradeBackup(instance *v1.KDBInstance, version string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Namespace: instance.Namespace,
+		Name:      instance.Name + "-upgrade-" + strings.ReplaceAll(version, ".", "-"),
+	}
+}
+
 // InstanceRBAC returns the ObjectMeta necessary to lookup the
 // ServiceAccount, Role, and RoleBinding for cluster's kdb instances.
 func InstanceRBAC(instance *v1.KDBInstance) metav1.ObjectMeta {
@@ -226,6 +463,58 @@ func IsInstanceReady(instance *v1.KDBInstance) bool {
 	return true
 }
 
+// InstancePhase returns the coarse phase of instance derived from its spec and
+// the observed pods.
+func InstancePhase(instance *v1.KDBInstance) string {
+	if IsStoppedOrStarting(instance) && instance.Status.Phase != "" {
+		return instance.Status.Phase
+	}
+	if IsShutdown(instance) {
+		return shared.InstanceStatusStopped
+	}
+	status := instance.Status.InstanceSet
+	if status.Replicas > 0 && status.ReadyReplicas == status.Replicas {
+		return shared.InstanceStatusRunning
+	}
+	return shared.InstanceStatusPending
+}
+
+// IsShutdown returns whether instance should be stopped, by its spec or by
+// its hibernation schedules.
+func IsShutdown(instance *v1.KDBInstance) bool {
+	if instance.Spec.Shutdown != nil && *instance.Spec.Shutdown {
+		return true
+	}
+	return instance.Status.Hibernation != nil && instance.Status.Hibernation.Hibernating
+}
+
+// IsStoppedOrStarting returns whether instance should be stopped or has not
+// finished stopping or starting.
+func IsStoppedOrStarting(instance *v1.KDBInstance) bool {
+	if IsShutdown(instance) {
+		return true
+	}
+	switch instance.Status.Phase {
+	case shared.InstanceStatusStopping, shared.InstanceStatusStopped, shared.InstanceStatusStarting:
+		return true
+	}
+	return false
+}
+
+// IsInstanceSetStopped returns whether the StatefulSet setName of instance is
+// scaled to zero.
+func IsInstanceSetStopped(instance *v1.KDBInstance, setName string) bool {
+	if instance.Status.Phase == shared.InstanceStatusStopped {
+		return true
+	}
+	for _, name := range instance.Status.StoppedSets {
+		if name == setName {
+			return true
+		}
+	}
+	return false
+}
+
 func InstancePodName(name string, index int) string {
 	return fmt.Sprintf("%s-0", InstanceStatefulSetName(name, index))
 }
@@ -15,6 +15,16 @@ const (
 	LabelData = labelPrefix + "data"
 	// LabelLog is used to identify Pods and Volumes log store KDB data.
 	LabelLog = labelPrefix + "log"
+
+	// LabelSeed identifies the pods of the jobs streaming data to the new
+	// replicas of the instance named by its value.
+	LabelSeed = labelPrefix + "seed"
+
+	// LabelCredentialsConsumer identifies the Deployments and StatefulSets
+	// reading the passwords of the instance named by its value, e.g. an
+	// exporter or a proxy. Their pods are restarted when the passwords are
+	// rotated.
+	LabelCredentialsConsumer = labelPrefix + "credentials-consumer"
 )
 
 const (
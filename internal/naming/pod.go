@@ -12,6 +12,14 @@ const (
 	ContainerDatabase = "database"
 
 	ContainerSidecar = "mgr"
+
+	// ContainerSeed is the init container receiving the data of a new
+	// replica seeded with xtrabackup.
+	ContainerSeed = "seed"
+
+	// ContainerRollback is the init container moving the upgraded data
+	// directory aside when a major upgrade is rolled back.
+	ContainerRollback = "rollback"
 	//
 	//ContainerInit = "init"
 	//
@@ -21,4 +29,23 @@ const (
 const (
 	// PortDatabase is the name of a port that connects to kdb instance.
 	PortDatabase = "database"
+
+	// PortExporter is the name of the port the metrics exporter of an
+	// instance serves on.
+	PortExporter = "exporter"
+
+	// PortSeed is the name of the port the seed container receives the
+	// data on, SeedPort is its number.
+	PortSeed = "seed"
+	SeedPort = 33070
+
+	// PortSidecar is the name of the port the management API of the sidecar
+	// listens on, SidecarPort is its number.
+	PortSidecar = "mgr-api"
+	SidecarPort = 8430
 )
+
+// TerminationGracePeriodSeconds is the time the database of a pod has to shut
+// down before it is killed. A slow shutdown, e.g. with innodb_fast_shutdown=0
+// when the instance stops, purges and merges all buffered changes first.
+const TerminationGracePeriodSeconds = 600
@@ -1,7 +1,11 @@
 package naming
 
 import (
+	"fmt"
+
 	corev1 "k8s.io/api/core/v1"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
 )
 
 // DataVolumeMount returns the name and mount path of the kdb data volume.
@@ -27,3 +31,18 @@ func DownwardAPIVolumeMount() corev1.VolumeMount {
 func ConfigVolumeMount() corev1.VolumeMount {
 	return corev1.VolumeMount{Name: "kdb-config", MountPath: ConfigMountPath, ReadOnly: true}
 }
+
+// RuntimeVolumeMounts returns the EmptyDir mounts of the directories the
+// engine image of instance writes to outside of the volumes of the instance.
+// They keep the root filesystem of the restricted profile read-only.
+func RuntimeVolumeMounts(instance *v1.KDBInstance) []corev1.VolumeMount {
+	dirs := []string{"/var/run/mysqld", "/var/lib/mysql", "/var/lib/mysql-files", "/var/log/mysql"}
+	if IsPGEngine(instance) {
+		dirs = []string{"/var/run/postgresql"}
+	}
+	mounts := make([]corev1.VolumeMount, 0, len(dirs))
+	for i, dir := range dirs {
+		mounts = append(mounts, corev1.VolumeMount{Name: fmt.Sprintf("kdb-runtime-%d", i), MountPath: dir})
+	}
+	return mounts
+}
@@ -0,0 +1,202 @@
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+const (
+	// rootCAValidity is the lifetime of the CA of the operator.
+	rootCAValidity = 10 * 365 * 24 * time.Hour
+
+	// serverValidity is the lifetime of a server certificate.
+	serverValidity = 365 * 24 * time.Hour
+
+	// clockSkew backdates the certificates for the clocks that run behind.
+	clockSkew = 5 * time.Minute
+)
+
+// CA is a certificate authority that issues server certificates.
+type CA struct {
+	Certificate *x509.Certificate
+	Key         crypto.Signer
+}
+
+// NewRootCA generates a self-signed CA and returns its certificate and its
+// private key in PEM.
+func NewRootCA(commonName string, now time.Time) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-clockSkew),
+		NotAfter:              now.Add(rootCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	keyPEM, err = encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM, nil
+}
+
+// RenewRootCA generates a new CA like NewRootCA. The certificate it returns is
+// followed by those of bundle that are still valid at now, the certificates
+// issued by them are trusted until they are issued again.
+func RenewRootCA(commonName string, bundle []byte, now time.Time) (certPEM, keyPEM []byte, err error) {
+	certPEM, keyPEM, err = NewRootCA(commonName, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	for block, rest := pem.Decode(bundle); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil || !now.Before(cert.NotAfter) {
+			continue
+		}
+		certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+	}
+	return certPEM, keyPEM, nil
+}
+
+// ParseCA returns the CA of a certificate and its private key in PEM. The key
+// is PKCS #8, SEC 1 or PKCS #1 encoded.
+func ParseCA(certPEM, keyPEM []byte) (*CA, error) {
+	cert, err := ParseCertificate(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, errors.New("certificate is not a CA")
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM private key")
+	}
+	var key interface{}
+	if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+		if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				return nil, errors.New("unsupported private key")
+			}
+		}
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key")
+	}
+	return &CA{Certificate: cert, Key: signer}, nil
+}
+
+// IssueServer issues a server certificate for dnsNames and returns it and its
+// private key in PEM.
+func (ca *CA) IssueServer(commonName string, dnsNames []string, now time.Time) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	notAfter := now.Add(serverValidity)
+	if notAfter.After(ca.Certificate.NotAfter) {
+		notAfter = ca.Certificate.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-clockSkew),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Certificate, key.Public(), ca.Key)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	keyPEM, err = encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM, nil
+}
+
+// ParseCertificate returns the first certificate in PEM.
+func ParseCertificate(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	return cert, errors.WithStack(err)
+}
+
+// RenewalTime returns when a certificate is renewed, once two thirds of its
+// lifetime passed.
+func RenewalTime(cert *x509.Certificate) time.Time {
+	return cert.NotBefore.Add(cert.NotAfter.Sub(cert.NotBefore) * 2 / 3)
+}
+
+// NeedsRenewal reports whether the server certificate in PEM has to be issued
+// again: it does not parse, it is not issued by ca for exactly dnsNames, or it
+// is due for renewal.
+func NeedsRenewal(certPEM []byte, ca *CA, dnsNames []string, now time.Time) bool {
+	cert, err := ParseCertificate(certPEM)
+	if err != nil {
+		return true
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Certificate)
+	if _, err = cert.Verify(x509.VerifyOptions{
+		Roots:       roots,
+		CurrentTime: now,
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}); err != nil {
+		return true
+	}
+	if !sets.NewString(cert.DNSNames...).Equal(sets.NewString(dnsNames...)) {
+		return true
+	}
+	return !now.Before(RenewalTime(cert))
+}
+
+func serialNumber() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial, errors.WithStack(err)
+}
+
+func encodeKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
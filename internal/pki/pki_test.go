@@ -0,0 +1,78 @@
+package pki
+
+import (
+	"crypto/x509"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestIssueServer(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 3, 13, 12, 0, 0, 0, time.UTC)
+	caCert, caKey, err := NewRootCA("kdb-root-ca", now)
+	assert.NilError(t, err)
+	ca, err := ParseCA(caCert, caKey)
+	assert.NilError(t, err)
+
+	names := []string{"kdb01", "kdb01.kdb", "kdb01.kdb.svc"}
+	cert, _, err := ca.IssueServer("kdb01", names, now)
+	assert.NilError(t, err)
+
+	t.Run("Fresh", func(t *testing.T) {
+		assert.Assert(t, !NeedsRenewal(cert, ca, names, now.Add(time.Hour)))
+	})
+	t.Run("Due", func(t *testing.T) {
+		assert.Assert(t, NeedsRenewal(cert, ca, names, now.Add(250*24*time.Hour)))
+	})
+	t.Run("Names", func(t *testing.T) {
+		assert.Assert(t, NeedsRenewal(cert, ca, append(names, "kdb01.kdb.svc.cluster.local"), now))
+	})
+	t.Run("OtherCA", func(t *testing.T) {
+		otherCert, otherKey, err := NewRootCA("other", now)
+		assert.NilError(t, err)
+		other, err := ParseCA(otherCert, otherKey)
+		assert.NilError(t, err)
+		assert.Assert(t, NeedsRenewal(cert, other, names, now))
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		assert.Assert(t, NeedsRenewal([]byte("garbage"), ca, names, now))
+	})
+}
+
+func TestRenewRootCA(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 3, 13, 12, 0, 0, 0, time.UTC)
+	oldCert, oldKey, err := NewRootCA("kdb-root-ca", now)
+	assert.NilError(t, err)
+	old, err := ParseCA(oldCert, oldKey)
+	assert.NilError(t, err)
+	names := []string{"kdb01"}
+	server, _, err := old.IssueServer("kdb01", names, now)
+	assert.NilError(t, err)
+
+	later := RenewalTime(old.Certificate)
+	bundle, key, err := RenewRootCA("kdb-root-ca", oldCert, later)
+	assert.NilError(t, err)
+	renewed, err := ParseCA(bundle, key)
+	assert.NilError(t, err)
+	assert.Assert(t, !renewed.Certificate.Equal(old.Certificate))
+	assert.Assert(t, NeedsRenewal(server, renewed, names, later))
+
+	roots := x509.NewCertPool()
+	assert.Assert(t, roots.AppendCertsFromPEM(bundle))
+	cert, err := ParseCertificate(server)
+	assert.NilError(t, err)
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots, CurrentTime: now.Add(time.Hour)})
+	assert.NilError(t, err, "the old certificates are trusted")
+
+	t.Run("DropsExpired", func(t *testing.T) {
+		again, _, err := RenewRootCA("kdb-root-ca", bundle, old.Certificate.NotAfter)
+		assert.NilError(t, err)
+		assert.Equal(t, strings.Count(string(again), "BEGIN CERTIFICATE"), 2)
+	})
+}
@@ -0,0 +1,172 @@
+// Package reconciletest provides the reconcile helpers, contexts and flows the
+// tests of the steps run on. The objects live in a fake client.
+package reconciletest
+
+import (
+	gocontext "context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/sqc157400661/helper/kube"
+	"gotest.tools/v3/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+// Helper is a kube.ReconcileHelper backed by a fake client. Commands executed
+// in pods are answered by Exec. The helper is shared by the workers of the
+// controllers, a step changing its requeue panics.
+type Helper struct {
+	client client.Client
+	scheme *runtime.Scheme
+
+	// Exec answers the commands executed in pods, they succeed without
+	// output when it is nil.
+	Exec func(pod *corev1.Pod, container string, command []string, opts kube.ExecOptions) error
+}
+
+// NewHelper returns a helper whose fake client stores objects.
+func NewHelper(t *testing.T, objects ...client.Object) *Helper {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	for _, add := range []func(*runtime.Scheme) error{
+		v1.AddToScheme, corev1.AddToScheme, appsv1.AddToScheme, batchv1.AddToScheme,
+		networkingv1.AddToScheme, policyv1.AddToScheme,
+	} {
+		assert.NilError(t, add(scheme))
+	}
+	return &Helper{
+		client: ApplyClient{fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build()},
+		scheme: scheme,
+	}
+}
+
+func (h *Helper) PodExec(pod *corev1.Pod, container string, command []string, opts kube.ExecOptions) error {
+	if h.Exec == nil {
+		return nil
+	}
+	return h.Exec(pod, container, command, opts)
+}
+
+func (h *Helper) Debug() bool                            { return false }
+func (h *Helper) ForceRequeueAfter() time.Duration       { return 0 }
+func (h *Helper) ResetForceRequeueAfter(d time.Duration) { panic("shared helper mutated") }
+func (h *Helper) Client() client.Client                  { return h.client }
+func (h *Helper) RestConfig() *rest.Config               { return nil }
+func (h *Helper) ClientSet() *kubernetes.Clientset       { return nil }
+func (h *Helper) Scheme() *runtime.Scheme                { return h.scheme }
+
+// NewReconcileContext returns the base context of a reconcile of object, the
+// object and objects are stored in the fake client.
+func NewReconcileContext(t *testing.T, object client.Object, objects ...client.Object) (
+	kube.ReconcileContext, *Helper, *record.FakeRecorder) {
+	t.Helper()
+	helper := NewHelper(t, append(objects, object)...)
+	recorder := record.NewFakeRecorder(100)
+	request := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(object)}
+	return kube.NewBaseReconcileContext(helper, gocontext.Background(), request, client.FieldOwner("test"),
+		recorder), helper, recorder
+}
+
+// NewInstanceContext returns the context of a reconcile of instance, the
+// objects are stored in the fake client.
+func NewInstanceContext(t *testing.T, instance *v1.KDBInstance, objects ...client.Object) (
+	*context.InstanceContext, *Helper, *record.FakeRecorder) {
+	t.Helper()
+	base, helper, recorder := NewReconcileContext(t, instance, objects...)
+	rc := context.NewInstanceContext(base)
+	_, err := rc.InitInstance()
+	assert.NilError(t, err)
+	return rc, helper, recorder
+}
+
+// ApplyClient turns the apply patches of the steps into creates and updates,
+// the fake client does not support them.
+type ApplyClient struct {
+	client.Client
+}
+
+func (c ApplyClient) Patch(ctx gocontext.Context, object client.Object, patch client.Patch,
+	opts ...client.PatchOption) error {
+	if patch.Type() != types.ApplyPatchType {
+		return c.Client.Patch(ctx, object, patch, opts...)
+	}
+	existing := object.DeepCopyObject().(client.Object)
+	err := c.Get(ctx, client.ObjectKeyFromObject(object), existing)
+	if apierrors.IsNotFound(err) {
+		object.SetResourceVersion("")
+		return c.Create(ctx, object)
+	}
+	if err != nil {
+		return err
+	}
+	object.SetResourceVersion(existing.GetResourceVersion())
+	return c.Update(ctx, object)
+}
+
+// Flow records how a step ended.
+type Flow struct {
+	Result string
+	Err    error
+}
+
+func (f *Flow) Logger() logr.Logger { return logr.Discard() }
+
+func (f *Flow) RetryAfter(d time.Duration, msg string, kvs ...interface{}) (reconcile.Result, error) {
+	f.Result = "RetryAfter"
+	return reconcile.Result{RequeueAfter: d}, nil
+}
+
+func (f *Flow) Retry(msg string, kvs ...interface{}) (reconcile.Result, error) {
+	f.Result = "Retry"
+	return reconcile.Result{Requeue: true}, nil
+}
+
+func (f *Flow) Continue(msg string, kvs ...interface{}) (reconcile.Result, error) {
+	f.Result = "Continue"
+	return reconcile.Result{}, nil
+}
+
+func (f *Flow) Pass() (reconcile.Result, error) {
+	f.Result = "Pass"
+	return reconcile.Result{}, nil
+}
+
+func (f *Flow) Wait(msg string, kvs ...interface{}) (reconcile.Result, error) {
+	f.Result = "Wait"
+	return reconcile.Result{}, nil
+}
+
+func (f *Flow) Break(msg string, kvs ...interface{}) (reconcile.Result, error) {
+	f.Result = "Break"
+	return reconcile.Result{}, nil
+}
+
+func (f *Flow) Error(err error, msg string, kvs ...interface{}) (reconcile.Result, error) {
+	f.Result, f.Err = "Error", err
+	return reconcile.Result{}, err
+}
+
+func (f *Flow) RetryErr(err error, msg string, kvs ...interface{}) (reconcile.Result, error) {
+	f.Result, f.Err = "RetryErr", err
+	return reconcile.Result{}, nil
+}
+
+func (f *Flow) WithLogger(log logr.Logger) kube.Flow                   { return f }
+func (f *Flow) WithLoggerValues(keyAndValues ...interface{}) kube.Flow { return f }
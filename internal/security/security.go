@@ -2,10 +2,22 @@ package security
 
 import (
 	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/internal/naming"
 	"github.com/sqc157400661/util"
 	corev1 "k8s.io/api/core/v1"
 )
 
+const (
+	// mysqlUser is the mysql user of the MySQL images.
+	mysqlUser int64 = 999
+
+	// postgresUser is the postgres user of the PostgreSQL images.
+	postgresUser int64 = 26
+
+	// legacyFSGroup is the group of the volumes of the legacy profile.
+	legacyFSGroup int64 = 26
+)
+
 // InitPodSecurityContext returns a v1.PodSecurityContext with some defaults.
 func InitPodSecurityContext() *corev1.PodSecurityContext {
 	onRootMismatch := corev1.FSGroupChangeOnRootMismatch
@@ -21,24 +33,48 @@ func InitPodSecurityContext() *corev1.PodSecurityContext {
 func InitRestrictedSecurityContext() *corev1.SecurityContext {
 	return &corev1.SecurityContext{
 		// Prevent any container processes from gaining privileges.
-		AllowPrivilegeEscalation: util.Bool(true),
+		AllowPrivilegeEscalation: util.Bool(false),
 
 		// Drop any capabilities granted by the container runtime.
 		// This must be uppercase to pass Pod Security Admission.
 		// - https://releases.k8s.io/v1.24.0/staging/src/k8s.io/pod-security-admission/policy/check_capabilities_restricted.go
 		Capabilities: &corev1.Capabilities{
-			Add: []corev1.Capability{"LINUX_IMMUTABLE", "NET_ADMIN", "SYS_ADMIN"},
+			Drop: []corev1.Capability{"ALL"},
 		},
 
 		// Processes in privileged containers are essentially root on the host.
 		Privileged: util.Bool(false),
 
-		//RunAsUser: helper.Int64(26),
-
 		// Limit filesystem changes to volumes that are mounted read-write.
-		//ReadOnlyRootFilesystem: helper.Bool(true),
+		ReadOnlyRootFilesystem: util.Bool(true),
+
 		// Fail to start the container if its image runs as UID 0 (root).
-		//RunAsNonRoot: helper.Bool(false),
+		RunAsNonRoot: util.Bool(true),
+	}
+}
+
+// InitBaselineSecurityContext returns a v1.SecurityContext that passes the
+// baseline Pod Security Standard. The container keeps the capabilities of the
+// container runtime and a writable root filesystem.
+func InitBaselineSecurityContext() *corev1.SecurityContext {
+	return &corev1.SecurityContext{
+		// Prevent any container processes from gaining privileges.
+		AllowPrivilegeEscalation: util.Bool(false),
+
+		// Processes in privileged containers are essentially root on the host.
+		Privileged: util.Bool(false),
+	}
+}
+
+// InitLegacySecurityContext returns the v1.SecurityContext of the instances
+// created before the security profiles existed.
+func InitLegacySecurityContext() *corev1.SecurityContext {
+	return &corev1.SecurityContext{
+		AllowPrivilegeEscalation: util.Bool(true),
+		Capabilities: &corev1.Capabilities{
+			Add: []corev1.Capability{"LINUX_IMMUTABLE", "NET_ADMIN", "SYS_ADMIN"},
+		},
+		Privileged: util.Bool(false),
 	}
 }
 
@@ -56,6 +92,26 @@ func InitSecurityContextForStartUp() *corev1.SecurityContext {
 	}
 }
 
+// Profile returns the security profile of instance. Instances created before
+// the profiles existed have none and keep the legacy one.
+func Profile(instance *v1.KDBInstance) v1.SecurityProfile {
+	if instance.Spec.SecurityProfile == "" {
+		return v1.SecurityProfileLegacy
+	}
+	return instance.Spec.SecurityProfile
+}
+
+// RunAsUser returns the user of the containers of instance.
+func RunAsUser(instance *v1.KDBInstance) int64 {
+	if instance.Spec.RunAsUser != nil {
+		return *instance.Spec.RunAsUser
+	}
+	if naming.IsPGEngine(instance) {
+		return postgresUser
+	}
+	return mysqlUser
+}
+
 // PodSecurityContext returns a v1.PodSecurityContext for instance that can write
 // to PersistentVolumes.
 func PodSecurityContext(instance *v1.KDBInstance) *corev1.PodSecurityContext {
@@ -71,7 +127,38 @@ func PodSecurityContext(instance *v1.KDBInstance) *corev1.PodSecurityContext {
 		}
 	}
 
-	podSecurityContext.FSGroup = util.Int64(26)
+	if Profile(instance) == v1.SecurityProfileLegacy {
+		podSecurityContext.FSGroup = util.Int64(legacyFSGroup)
+		if instance.Spec.FSGroup != nil {
+			podSecurityContext.FSGroup = util.Int64(*instance.Spec.FSGroup)
+		}
+		return podSecurityContext
+	}
 
+	// The images start as root and switch to the database user, the
+	// containers start as the database user right away.
+	user := RunAsUser(instance)
+	podSecurityContext.RunAsUser = util.Int64(user)
+	podSecurityContext.RunAsGroup = util.Int64(user)
+	podSecurityContext.FSGroup = util.Int64(user)
+	if instance.Spec.FSGroup != nil {
+		podSecurityContext.FSGroup = util.Int64(*instance.Spec.FSGroup)
+	}
+	podSecurityContext.SeccompProfile = &corev1.SeccompProfile{
+		Type: corev1.SeccompProfileTypeRuntimeDefault,
+	}
 	return podSecurityContext
 }
+
+// ContainerSecurityContext returns the v1.SecurityContext of the containers of
+// instance for its security profile.
+func ContainerSecurityContext(instance *v1.KDBInstance) *corev1.SecurityContext {
+	switch Profile(instance) {
+	case v1.SecurityProfileRestricted:
+		return InitRestrictedSecurityContext()
+	case v1.SecurityProfileBaseline:
+		return InitBaselineSecurityContext()
+	default:
+		return InitLegacySecurityContext()
+	}
+}
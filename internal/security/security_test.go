@@ -4,7 +4,11 @@ import (
 	"fmt"
 	"testing"
 
+	"github.com/sqc157400661/util"
 	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
 )
 
 func TestPodSecurityContext(t *testing.T) {
@@ -112,3 +116,26 @@ func TestRestrictedSecurityContext(t *testing.T) {
 		assert.Assert(t, *sc.ReadOnlyRootFilesystem == true)
 	}
 }
+
+func TestProfiles(t *testing.T) {
+	t.Run("Legacy", func(t *testing.T) {
+		instance := &v1.KDBInstance{}
+		psc := PodSecurityContext(instance)
+		assert.Assert(t, psc.RunAsUser == nil)
+		assert.Equal(t, *psc.FSGroup, int64(26))
+		assert.Assert(t, ContainerSecurityContext(instance).Capabilities.Add != nil)
+	})
+
+	t.Run("Restricted", func(t *testing.T) {
+		instance := &v1.KDBInstance{}
+		instance.Spec.SecurityProfile = v1.SecurityProfileRestricted
+		instance.Spec.FSGroup = util.Int64(1000)
+		psc := PodSecurityContext(instance)
+		assert.Equal(t, *psc.RunAsUser, int64(999))
+		assert.Equal(t, *psc.FSGroup, int64(1000))
+		if assert.Check(t, psc.SeccompProfile != nil) {
+			assert.Equal(t, psc.SeccompProfile.Type, corev1.SeccompProfileTypeRuntimeDefault)
+		}
+		assert.DeepEqual(t, ContainerSecurityContext(instance), InitRestrictedSecurityContext())
+	})
+}
@@ -8,6 +8,7 @@ import (
 	reconcile_context "github.com/sqc157400661/kdb/pkg/reconcile/context"
 	"github.com/sqc157400661/kdb/pkg/reconcile/steps"
 	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
 	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -31,6 +32,8 @@ type KDBClusterReconciler struct {
 // +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 // +kubebuilder:rbac:groups=kdb.com,resources=KDBClusters,verbs=get;list;watch
 // +kubebuilder:rbac:groups=kdb.com,resources=KDBClusters/status,verbs=patch
+// +kubebuilder:rbac:groups=kdb.com,resources=KDBClusters/finalizers,verbs=update
+// +kubebuilder:rbac:groups=kdb.com,resources=KDBInstances,verbs=get;list;watch;create;patch;delete
 
 // Reconcile reconciles a ConfigMap in a namespace managed by the PostgreSQL Operator
 func (r *KDBClusterReconciler) Reconcile(
@@ -54,20 +57,29 @@ func (r *KDBClusterReconciler) Reconcile(
 	kube.AbortWhen(rc.IsStopReconcile(), "instance is stop reconcile, skipped")(task)
 
 	var stepManager steps.ClusterStepManager
+	// activate the defer task for updating cluster status changes after all modifications are completed
+	stepManager.PatchKDBClusterStatus()(task, true)
 	// Check for and handle deletion of cluster.
 	kube.AbortWhen(rc.IsDeleted(), "instance is deleted, skipped")(task)
 	kube.Branch(rc.IsDeleting(), stepManager.HandleDelete(), stepManager.CheckAndSetFinalizer())(task)
+	stepManager.SetGlobalConfig()(task)
 	stepManager.InitObservedInstance()(task)
+	stepManager.SetClusterCredentials()(task)
 	stepManager.ScaleUp()(task)
 	stepManager.ScaleDown()(task)
-	return kube.NewExecutor(logger).Execute(rc, task)
+	stepManager.SetPodDisruptionBudget()(task)
+	stepManager.ObservePlacement()(task)
+	return rc.Result(kube.NewExecutor(logger).Execute(rc, task))
 }
 
 // +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
 // +kubebuilder:rbac:groups="",resources=endpoints,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch
 // +kubebuilder:rbac:groups="",resources=persistentvolumeclaims,verbs=get;list;watch
-// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;patch
 // +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch
+// +kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list;watch;create;patch;delete
 
 // SetupWithManager adds the KDBCluster controller to the provided runtime manager
 func (r *KDBClusterReconciler) SetupWithManager(mgr manager.Manager) error {
@@ -79,5 +91,6 @@ func (r *KDBClusterReconciler) SetupWithManager(mgr manager.Manager) error {
 		Owns(&corev1.Service{}).
 		Owns(&corev1.Secret{}).
 		Owns(&v1.KDBInstance{}).
+		Owns(&policyv1.PodDisruptionBudget{}).
 		Complete(r)
 }
@@ -0,0 +1,64 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/sqc157400661/helper/kube"
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/config"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/pkg/metrics"
+	reconcile_context "github.com/sqc157400661/kdb/pkg/reconcile/context"
+	"github.com/sqc157400661/kdb/pkg/reconcile/steps"
+	"github.com/sqc157400661/kdb/pkg/reconcile/steps/mysql"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// KDBDatabaseControllerName is the name of the KDBDatabase controller
+	KDBDatabaseControllerName = "kdb-database-controller"
+)
+
+// KDBDatabaseReconciler holds resources for the KDBDatabase reconciler
+type KDBDatabaseReconciler struct {
+	kube.ReconcileHelper
+	Owner    client.FieldOwner
+	Recorder record.EventRecorder
+}
+
+// +kubebuilder:rbac:groups=kdb.com,resources=kdbdatabases,verbs=get;list;watch;patch
+// +kubebuilder:rbac:groups=kdb.com,resources=kdbdatabases/status,verbs=patch
+
+// Reconcile creates, updates or drops the database of a KDBDatabase
+func (r *KDBDatabaseReconciler) Reconcile(
+	ctx context.Context, request reconcile.Request) (reconcile.Result, error,
+) {
+	logger := log.FromContext(ctx).WithName("controllers").WithName("kdb-database")
+	task := kube.NewTask()
+
+	rc := reconcile_context.NewSchemaContext(kube.NewBaseReconcileContext(r, ctx, request, r.Owner, r.Recorder))
+	kube.AbortWhen(config.IsNamespacePaused(request.Namespace), "Reconciling is paused, skip")(task)
+
+	database, err := rc.InitObject(&v1.KDBDatabase{})
+	if err != nil || database == nil {
+		return reconcile.Result{}, err
+	}
+
+	stepManager := &steps.SchemaStepManager{
+		Controller: metrics.ControllerDatabase,
+		Engines:    map[string]*steps.SchemaHooks{naming.MySQLEngine: mysql.DatabaseHooks()},
+	}
+	return rc.Result(kube.NewExecutor(logger).Execute(rc, schemaTask(task, rc, stepManager)))
+}
+
+// SetupWithManager adds the KDBDatabase controller to the provided runtime manager
+func (r *KDBDatabaseReconciler) SetupWithManager(mgr manager.Manager) error {
+	return builder.ControllerManagedBy(mgr).
+		For(&v1.KDBDatabase{}).
+		Complete(r)
+}
@@ -14,6 +14,8 @@ import (
 	appsv1 "k8s.io/api/apps/v1"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	"k8s.io/client-go/tools/record"
 	"os"
@@ -85,28 +87,55 @@ func (r *KDBInstanceReconciler) Reconcile(
 	kube.AbortWhen(rc.IsDeleted(), "instance is deleted, skipped")(task)
 	kube.Branch(rc.IsDeleting(), stepManager.HandleDelete(), stepManager.CheckAndSetFinalizer())(task)
 	stepManager.SetGlobalConfig()(task)
+	stepManager.CheckResources()(task)
+	stepManager.SetCredentials()(task)
+	stepManager.SetTLS()(task)
 	stepManager.SetInstanceConfig()(task)
 	stepManager.SetRbac()(task)
 	stepManager.SetService()(task)
+	stepManager.SetNetworkPolicy()(task)
+	stepManager.SetPodDisruptionBudget()(task)
 	stepManager.InitObservedRunner()(task)
+	stepManager.HibernateInstance()(task)
+	stepManager.ShutdownInstance()(task)
+	// Pods are not replaced while the instance stops, is stopped or starts.
+	// The condition is evaluated when its steps run, after ShutdownInstance
+	// set the phase.
+	stepManager.StepIfBinder("InstanceRunning", steps.IsInstanceRunning, stepManager.UpgradeInstance())(task)
 	stepManager.ScaleUpInstance()(task)
 	stepManager.ScaleDownInstance()(task)
-	return kube.NewExecutor(logger).Execute(rc, task)
+	stepManager.ObserveVolumes()(task)
+	stepManager.StepIfBinder("InstanceRunning", steps.IsInstanceRunning,
+		stepManager.ObserveReplication(),
+		stepManager.DrainInstance(),
+		stepManager.SeedReplicas(),
+		stepManager.RolloutInstance(),
+		stepManager.FinishUpgradeInstance(),
+		stepManager.ApplyInstanceConfig(),
+		stepManager.RotateCredentials(),
+		stepManager.ReloadTLS(),
+	)(task)
+	return rc.Result(kube.NewExecutor(logger).Execute(rc, task))
 }
 
 // +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
 // +kubebuilder:rbac:groups="",resources=endpoints,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch
 // +kubebuilder:rbac:groups="",resources=persistentvolumeclaims,verbs=get;list;watch
-// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;patch;delete
+// +kubebuilder:rbac:groups="",resources=pods/exec,verbs=create
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;patch
 // +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch
 // +kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch
-// +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch
-// +kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch
-// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch
+// +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;patch
+// +kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;patch
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;patch;delete
 // +kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=roles,verbs=get;list;watch
 // +kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=rolebindings,verbs=get;list;watch
 // +kubebuilder:rbac:groups=batch,resources=cronjobs,verbs=get;list;watch
-// +kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list;watch
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs=get;list;watch;create;patch;delete
+// +kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list;watch;create;patch;delete
+// +kubebuilder:rbac:groups=storage.k8s.io,resources=storageclasses,verbs=get;list;watch
 
 // SetupWithManager adds the KDBInstance controller to the provided runtime manager
 func (r *KDBInstanceReconciler) SetupWithManager(mgr manager.Manager) error {
@@ -137,6 +166,8 @@ func (r *KDBInstanceReconciler) SetupWithManager(mgr manager.Manager) error {
 		Owns(&appsv1.Deployment{}).
 		Owns(&appsv1.StatefulSet{}).
 		Owns(&batchv1.Job{}).
+		Owns(&networkingv1.NetworkPolicy{}).
+		Owns(&policyv1.PodDisruptionBudget{}).
 		Owns(&rbacv1.Role{}).
 		Owns(&rbacv1.RoleBinding{}).
 		Complete(r)
@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/sqc157400661/helper/kube"
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/config"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/pkg/metrics"
+	reconcile_context "github.com/sqc157400661/kdb/pkg/reconcile/context"
+	"github.com/sqc157400661/kdb/pkg/reconcile/steps"
+	"github.com/sqc157400661/kdb/pkg/reconcile/steps/mysql"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// KDBUserControllerName is the name of the KDBUser controller
+	KDBUserControllerName = "kdb-user-controller"
+)
+
+// KDBUserReconciler holds resources for the KDBUser reconciler
+type KDBUserReconciler struct {
+	kube.ReconcileHelper
+	Owner    client.FieldOwner
+	Recorder record.EventRecorder
+}
+
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups=kdb.com,resources=kdbusers,verbs=get;list;watch;patch
+// +kubebuilder:rbac:groups=kdb.com,resources=kdbusers/status,verbs=patch
+// +kubebuilder:rbac:groups=kdb.com,resources=kdbinstances,verbs=get;list;watch
+// +kubebuilder:rbac:groups=kdb.com,resources=kdbclusters,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=pods/exec,verbs=create
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+
+// Reconcile creates, updates or drops the database user of a KDBUser
+func (r *KDBUserReconciler) Reconcile(
+	ctx context.Context, request reconcile.Request) (reconcile.Result, error,
+) {
+	logger := log.FromContext(ctx).WithName("controllers").WithName("kdb-user")
+	task := kube.NewTask()
+
+	rc := reconcile_context.NewSchemaContext(kube.NewBaseReconcileContext(r, ctx, request, r.Owner, r.Recorder))
+	kube.AbortWhen(config.IsNamespacePaused(request.Namespace), "Reconciling is paused, skip")(task)
+
+	user, err := rc.InitObject(&v1.KDBUser{})
+	if err != nil || user == nil {
+		return reconcile.Result{}, err
+	}
+
+	stepManager := &steps.SchemaStepManager{
+		Controller: metrics.ControllerUser,
+		Engines:    map[string]*steps.SchemaHooks{naming.MySQLEngine: mysql.UserHooks()},
+	}
+	return rc.Result(kube.NewExecutor(logger).Execute(rc, schemaTask(task, rc, stepManager)))
+}
+
+// SetupWithManager adds the KDBUser controller to the provided runtime manager
+func (r *KDBUserReconciler) SetupWithManager(mgr manager.Manager) error {
+	return builder.ControllerManagedBy(mgr).
+		For(&v1.KDBUser{}).
+		Complete(r)
+}
+
+// schemaTask adds the steps of a KDBUser or a KDBDatabase to task.
+func schemaTask(task *kube.Task, rc *reconcile_context.SchemaContext, stepManager *steps.SchemaStepManager) *kube.Task {
+	// patch the status after all modifications are completed
+	stepManager.PatchStatus()(task, true)
+
+	kube.AbortWhen(rc.IsDeleted(), "object is deleted, skipped")(task)
+	stepManager.SetGlobalConfig()(task)
+	stepManager.ResolveTarget()(task)
+	kube.Branch(rc.IsDeleting(), stepManager.HandleDelete(), stepManager.CheckAndSetFinalizer())(task)
+	kube.When(!rc.IsDeleting(), stepManager.ApplySchema())(task)
+	return task
+}
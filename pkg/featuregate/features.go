@@ -24,6 +24,11 @@ const (
 	//
 	// Enables support of custom sidecars for pgBouncer Pods
 	PGBouncerSidecars featuregate.Feature = "PGBouncerSidecars"
+	//
+	// Enables the management API of the mgr sidecar of instances with TLS, the
+	// operator observes the replication, switches over and applies config
+	// through it
+	SidecarAPI featuregate.Feature = "SidecarAPI"
 )
 
 // pgoFeatures consists of all known PGO feature keys.
@@ -37,6 +42,7 @@ var pgoFeatures = map[featuregate.Feature]featuregate.FeatureSpec{
 	BridgeIdentifiers: {Default: false, PreRelease: featuregate.Alpha},
 	InstanceSidecars:  {Default: false, PreRelease: featuregate.Alpha},
 	PGBouncerSidecars: {Default: false, PreRelease: featuregate.Alpha},
+	SidecarAPI:        {Default: false, PreRelease: featuregate.Alpha},
 }
 
 // DefaultMutableFeatureGate is a mutable, shared global FeatureGate.
@@ -67,3 +73,12 @@ func AddAndSetFeatureGates(features string) error {
 	}
 	return nil
 }
+
+// Enabled reports whether feature is enabled. The features are disabled
+// before AddAndSetFeatureGates adds them, e.g. in tests.
+func Enabled(feature featuregate.Feature) bool {
+	if _, known := DefaultMutableFeatureGate.GetAll()[feature]; !known {
+		return false
+	}
+	return DefaultMutableFeatureGate.Enabled(feature)
+}
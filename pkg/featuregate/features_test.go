@@ -60,3 +60,7 @@ func TestAddAndSetFeatureGates(t *testing.T) {
 		assert.ErrorContains(t, err, "invalid value of GateNotSet=foo, err: strconv.ParseBool")
 	})
 }
+
+func TestEnabled(t *testing.T) {
+	assert.Assert(t, !Enabled("NotAGate"))
+}
@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/internal/naming"
+)
+
+// listTimeout bounds the time a scrape may spend reading the cache.
+const listTimeout = 5 * time.Second
+
+var (
+	instancesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "instances"),
+		"Number of KDB instances by engine, deploy arch and phase.",
+		[]string{"engine", "arch", "phase"}, nil)
+
+	backupLastSuccessDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "backup", "last_success_timestamp_seconds"),
+		"Unix time of the last successful backup of an instance.",
+		[]string{"namespace", "instance"}, nil)
+
+	backupAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "backup", "age_seconds"),
+		"Seconds since the last successful backup of an instance.",
+		[]string{"namespace", "instance"}, nil)
+
+	configDriftDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "config", "drift"),
+		"Whether the config version applied by the sidecar differs from the desired one (1) or not (0).",
+		[]string{"namespace", "instance"}, nil)
+)
+
+// fleetCollector computes the fleet gauges from the KDBInstances in the cache
+// every time the metrics endpoint is scraped, so they never go stale.
+type fleetCollector struct {
+	reader client.Reader
+}
+
+func newFleetCollector(reader client.Reader) *fleetCollector {
+	return &fleetCollector{reader: reader}
+}
+
+// Describe implements prometheus.Collector.
+func (c *fleetCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- instancesDesc
+	ch <- backupLastSuccessDesc
+	ch <- backupAgeDesc
+	ch <- configDriftDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *fleetCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), listTimeout)
+	defer cancel()
+
+	instances := &v1.KDBInstanceList{}
+	if err := c.reader.List(ctx, instances); err != nil {
+		log.FromContext(ctx).WithName("metrics").Error(err, "list KDBInstances err")
+		return
+	}
+
+	type fleetKey struct{ engine, arch, phase string }
+	counts := map[fleetKey]int{}
+	now := time.Now()
+	for i := range instances.Items {
+		instance := &instances.Items[i]
+		counts[fleetKey{
+			engine: naming.Engine(instance),
+			arch:   naming.DeployArch(instance),
+			phase:  naming.InstancePhase(instance),
+		}]++
+
+		if last, ok := lastBackup(instance.Namespace, instance.Name); ok {
+			ch <- prometheus.MustNewConstMetric(backupLastSuccessDesc, prometheus.GaugeValue,
+				float64(last.Unix()), instance.Namespace, instance.Name)
+			ch <- prometheus.MustNewConstMetric(backupAgeDesc, prometheus.GaugeValue,
+				now.Sub(last).Seconds(), instance.Namespace, instance.Name)
+		}
+
+		drift := 0.0
+		if naming.CurrentConfigVersion(instance) != naming.UpdateConfigVersion(instance) {
+			drift = 1
+		}
+		ch <- prometheus.MustNewConstMetric(configDriftDesc, prometheus.GaugeValue,
+			drift, instance.Namespace, instance.Name)
+	}
+	for key, count := range counts {
+		ch <- prometheus.MustNewConstMetric(instancesDesc, prometheus.GaugeValue,
+			float64(count), key.engine, key.arch, key.phase)
+	}
+}
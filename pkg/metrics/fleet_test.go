@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sqc157400661/util"
+	"gotest.tools/v3/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/apis/shared"
+	"github.com/sqc157400661/kdb/internal/naming"
+)
+
+func TestFleetCollector(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NilError(t, v1.AddToScheme(scheme))
+
+	running := &v1.KDBInstance{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kdb", Name: "running"},
+		Spec:       v1.KDBInstanceSpec{Engine: naming.MySQLEngine, DeployArch: naming.MySQLMasterSlaveDeployArch},
+		Status: v1.KDBInstanceStatus{
+			InstanceSet: shared.InstanceSetStatus{Replicas: 2, ReadyReplicas: 2},
+		},
+	}
+	stopped := &v1.KDBInstance{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kdb", Name: "stopped", Annotations: map[string]string{
+			naming.CurrentInstanceConfigVersion: "1",
+			naming.UpdateInstanceConfigVersion:  "2",
+		}},
+		Spec: v1.KDBInstanceSpec{Engine: naming.MySQLEngine, DeployArch: naming.MySQLSingleDeployArch, Shutdown: util.Bool(true)},
+	}
+	reader := fake.NewClientBuilder().WithScheme(scheme).WithObjects(running, stopped).Build()
+
+	RecordBackup("kdb", "running", time.Now().Add(-time.Hour), nil)
+
+	expected := `
+# HELP kdb_config_drift Whether the config version applied by the sidecar differs from the desired one (1) or not (0).
+# TYPE kdb_config_drift gauge
+kdb_config_drift{instance="running",namespace="kdb"} 0
+kdb_config_drift{instance="stopped",namespace="kdb"} 1
+# HELP kdb_instances Number of KDB instances by engine, deploy arch and phase.
+# TYPE kdb_instances gauge
+kdb_instances{arch="Master-Slave",engine="mysql",phase="Running"} 1
+kdb_instances{arch="Single",engine="mysql",phase="Stopped"} 1
+`
+	collector := newFleetCollector(reader)
+	assert.NilError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"kdb_config_drift", "kdb_instances"))
+	assert.Equal(t, testutil.CollectAndCount(collector, "kdb_backup_age_seconds"), 1)
+}
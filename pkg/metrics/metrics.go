@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const namespace = "kdb"
+
+const (
+	// ControllerInstance is the controller label value of KDBInstance steps.
+	ControllerInstance = "kdbinstance"
+	// ControllerCluster is the controller label value of KDBCluster steps.
+	ControllerCluster = "kdbcluster"
+	// ControllerUser is the controller label value of KDBUser steps.
+	ControllerUser = "kdbuser"
+	// ControllerDatabase is the controller label value of KDBDatabase steps.
+	ControllerDatabase = "kdbdatabase"
+)
+
+var (
+	// stepDuration observes how long every reconcile step takes. The step
+	// label is the name passed to StepBinder.
+	stepDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "reconcile",
+		Name:      "step_duration_seconds",
+		Help:      "Duration of reconcile steps in seconds.",
+		Buckets:   []float64{0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"controller", "step"})
+
+	// stepErrors counts reconcile steps that returned an error.
+	stepErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "reconcile",
+		Name:      "step_errors_total",
+		Help:      "Total number of reconcile steps that returned an error.",
+	}, []string{"controller", "step"})
+
+	failovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "failovers_total",
+		Help:      "Total number of unplanned master changes.",
+	}, []string{"namespace", "instance"})
+
+	switchovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "switchovers_total",
+		Help:      "Total number of planned master changes.",
+	}, []string{"namespace", "instance", "result"})
+
+	backups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backups_total",
+		Help:      "Total number of backups by result.",
+	}, []string{"namespace", "instance", "result"})
+)
+
+// backupTimes keeps the last successful backup of each instance so that the
+// fleet collector can export its age at scrape time.
+var backupTimes = struct {
+	sync.RWMutex
+	last map[instanceKey]time.Time
+}{last: map[instanceKey]time.Time{}}
+
+type instanceKey struct {
+	namespace string
+	name      string
+}
+
+var registerOnce sync.Once
+
+// Register adds the operator metrics to the controller-runtime registry, which
+// is served on the manager's --metrics-addr. The reader is used to compute the
+// fleet gauges and should be backed by the manager cache.
+func Register(reader client.Reader) {
+	registerOnce.Do(func() {
+		ctrlmetrics.Registry.MustRegister(
+			stepDuration,
+			stepErrors,
+			failovers,
+			switchovers,
+			backups,
+			newFleetCollector(reader),
+		)
+	})
+}
+
+// ObserveStep records the duration and the result of one reconcile step.
+func ObserveStep(controller, step string, start time.Time, err error) {
+	stepDuration.WithLabelValues(controller, step).Observe(time.Since(start).Seconds())
+	if err != nil {
+		stepErrors.WithLabelValues(controller, step).Inc()
+	}
+}
+
+// RecordFailover counts an unplanned master change of an instance.
+func RecordFailover(namespace, instance string) {
+	failovers.WithLabelValues(namespace, instance).Inc()
+}
+
+// RecordSwitchover counts a planned master change of an instance.
+func RecordSwitchover(namespace, instance string, err error) {
+	switchovers.WithLabelValues(namespace, instance, result(err)).Inc()
+}
+
+// RecordBackup counts a finished backup of an instance. Successful backups
+// also reset the backup age of the instance.
+func RecordBackup(namespace, instance string, finished time.Time, err error) {
+	backups.WithLabelValues(namespace, instance, result(err)).Inc()
+	if err != nil {
+		return
+	}
+	backupTimes.Lock()
+	defer backupTimes.Unlock()
+	key := instanceKey{namespace: namespace, name: instance}
+	if finished.After(backupTimes.last[key]) {
+		backupTimes.last[key] = finished
+	}
+}
+
+func lastBackup(namespace, instance string) (time.Time, bool) {
+	backupTimes.RLock()
+	defer backupTimes.RUnlock()
+	t, ok := backupTimes.last[instanceKey{namespace: namespace, name: instance}]
+	return t, ok
+}
+
+func result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
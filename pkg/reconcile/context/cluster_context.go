@@ -7,6 +7,7 @@ import (
 	"github.com/sqc157400661/kdb/internal/config"
 	"github.com/sqc157400661/kdb/internal/naming"
 	"github.com/sqc157400661/kdb/internal/observed"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
@@ -14,6 +15,7 @@ import (
 type ClusterContext struct {
 	// base reconcileContext
 	kube.ReconcileContext
+	requeue
 
 	oldCluster *v1.KDBCluster
 	cluster    *v1.KDBCluster
@@ -81,6 +83,17 @@ func (rc *ClusterContext) GetCluster() *v1.KDBCluster {
 	return rc.cluster
 }
 
+// PatchKDBClusterStatus patches the status of the cluster when it changed.
+func (rc *ClusterContext) PatchKDBClusterStatus() error {
+	if !equality.Semantic.DeepEqual(rc.oldCluster.Status, rc.cluster.Status) {
+		if err := errors.WithStack(rc.Client().Status().Patch(
+			rc.Context(), rc.cluster, client.MergeFrom(rc.oldCluster), rc.Owner())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // IsDeleted The instance is being deleted and there is no finalizer.
 func (rc *ClusterContext) IsDeleted() bool {
 	if rc.cluster.DeletionTimestamp != nil && !rc.cluster.DeletionTimestamp.IsZero() && !rc.HasFinalizer(naming.Finalizer) {
@@ -108,10 +121,11 @@ func (rc *ClusterContext) InitObservedCluster(instances *v1.KDBInstanceList) {
 	var ready int
 	var items []*v1.KDBInstance
 	var byName = make(map[string]*v1.KDBInstance, len(instances.Items))
-	for _, v := range instances.Items {
-		byName[v.Name] = &v
-		items = append(items, &v)
-		if naming.IsInstanceReady(&v) {
+	for i := range instances.Items {
+		v := &instances.Items[i]
+		byName[v.Name] = v
+		items = append(items, v)
+		if naming.IsInstanceReady(v) {
 			ready++
 		}
 	}
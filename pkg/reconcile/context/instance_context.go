@@ -2,6 +2,7 @@ package context
 
 import (
 	"fmt"
+
 	"github.com/pkg/errors"
 	"github.com/sqc157400661/helper/kube"
 	corev1 "k8s.io/api/core/v1"
@@ -23,6 +24,7 @@ import (
 type InstanceContext struct {
 	// base reconcileContext
 	kube.ReconcileContext
+	requeue
 
 	oldInstance *v1.KDBInstance
 	instance    *v1.KDBInstance
@@ -39,6 +41,10 @@ type InstanceContext struct {
 
 	instanceConfigMap *corev1.ConfigMap
 
+	instanceCredentials *corev1.Secret
+
+	instanceTLS *corev1.Secret
+
 	instanceVolumes []corev1.PersistentVolumeClaim
 }
 
@@ -198,6 +204,33 @@ func (rc *InstanceContext) GetInstanceConfigMap() *corev1.ConfigMap {
 	return rc.instanceConfigMap
 }
 
+func (rc *InstanceContext) SetInstanceCredentials(secret *corev1.Secret) {
+	rc.instanceCredentials = secret
+}
+
+func (rc *InstanceContext) GetInstanceCredentials() *corev1.Secret {
+	return rc.instanceCredentials
+}
+
+// GetCredential returns the value of key in the credentials Secret of the
+// instance.
+func (rc *InstanceContext) GetCredential(key string) string {
+	if rc.instanceCredentials == nil {
+		return ""
+	}
+	return string(rc.instanceCredentials.Data[key])
+}
+
+func (rc *InstanceContext) SetInstanceTLS(secret *corev1.Secret) {
+	rc.instanceTLS = secret
+}
+
+// GetInstanceTLS returns the TLS Secret of the instance read or written during
+// this reconcile, nil before.
+func (rc *InstanceContext) GetInstanceTLS() *corev1.Secret {
+	return rc.instanceTLS
+}
+
 func (rc *InstanceContext) SetInstancePodService(service *corev1.Service) {
 	rc.instancePodService = service
 }
@@ -0,0 +1,39 @@
+package context
+
+import (
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// requeue is the requeue the steps of one reconcile ask for. It lives in the
+// context of the reconcile, the reconcile helper is shared by the workers of
+// all the controllers.
+type requeue struct {
+	after time.Duration
+}
+
+// RequeueWithin makes the object reconcile again within d, a shorter requeue
+// asked for by another step is kept.
+func (r *requeue) RequeueWithin(d time.Duration) {
+	if d > 0 && (r.after == 0 || r.after > d) {
+		r.after = d
+	}
+}
+
+// RequeueAfter returns the requeue asked for by the steps, 0 when none did.
+func (r *requeue) RequeueAfter() time.Duration {
+	return r.after
+}
+
+// Result folds the requeue asked for by the steps into the result of the
+// task. An error is returned as is, the controller retries it with backoff.
+func (r *requeue) Result(result reconcile.Result, err error) (reconcile.Result, error) {
+	if err != nil || r.after == 0 {
+		return result, err
+	}
+	if result.RequeueAfter == 0 || result.RequeueAfter > r.after {
+		result.RequeueAfter = r.after
+	}
+	return result, nil
+}
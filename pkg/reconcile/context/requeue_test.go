@@ -0,0 +1,45 @@
+package context
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestRequeue(t *testing.T) {
+	t.Parallel()
+
+	t.Run("None", func(t *testing.T) {
+		var r requeue
+		result, err := r.Result(reconcile.Result{}, nil)
+		assert.NilError(t, err)
+		assert.Equal(t, result, reconcile.Result{})
+	})
+
+	t.Run("Shortest", func(t *testing.T) {
+		var r requeue
+		r.RequeueWithin(time.Minute)
+		r.RequeueWithin(10 * time.Second)
+		r.RequeueWithin(time.Hour)
+		assert.Equal(t, r.RequeueAfter(), 10*time.Second)
+
+		result, err := r.Result(reconcile.Result{}, nil)
+		assert.NilError(t, err)
+		assert.Equal(t, result.RequeueAfter, 10*time.Second)
+
+		result, err = r.Result(reconcile.Result{RequeueAfter: time.Second}, nil)
+		assert.NilError(t, err)
+		assert.Equal(t, result.RequeueAfter, time.Second)
+	})
+
+	t.Run("ErrorKept", func(t *testing.T) {
+		var r requeue
+		r.RequeueWithin(time.Minute)
+		result, err := r.Result(reconcile.Result{}, errors.New("boom"))
+		assert.Error(t, err, "boom")
+		assert.Equal(t, result, reconcile.Result{})
+	})
+}
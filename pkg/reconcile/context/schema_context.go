@@ -0,0 +1,133 @@
+package context
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/helper/kube"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/internal/config"
+	"github.com/sqc157400661/kdb/internal/naming"
+)
+
+// SchemaObject is a KDBUser or a KDBDatabase, the objects that declare the
+// accounts and the schemas of an instance.
+type SchemaObject interface {
+	client.Object
+	SchemaTarget() v1.InstanceRef
+	SchemaDeletionPolicy() v1.DeletionPolicy
+	SchemaStatus() *v1.SchemaStatus
+}
+
+// SchemaContext is the reconcile context of a SchemaObject. The statements of
+// the object are run on the master of its target instance.
+type SchemaContext struct {
+	// base reconcileContext
+	kube.ReconcileContext
+	requeue
+
+	oldObject SchemaObject
+	object    SchemaObject
+
+	// target
+	instance    *v1.KDBInstance
+	master      *corev1.Pod
+	credentials *corev1.Secret
+
+	// config
+	globalConfig *config.GlobalConfig
+}
+
+func NewSchemaContext(base kube.ReconcileContext) *SchemaContext {
+	return &SchemaContext{
+		ReconcileContext: base,
+	}
+}
+
+// InitObject fetches the object of the request into object, it returns nil
+// when the object does not exist.
+func (rc *SchemaContext) InitObject(object SchemaObject) (SchemaObject, error) {
+	if rc.object != nil {
+		return rc.object, nil
+	}
+	if err := rc.Client().Get(rc.Context(), rc.Request().NamespacedName, object); err != nil {
+		if err = client.IgnoreNotFound(err); err != nil {
+			err = errors.Wrapf(err, "unable to fetch %T", object)
+		}
+		return nil, err
+	}
+	rc.oldObject = object.DeepCopyObject().(SchemaObject)
+	rc.object = object
+	return rc.object, nil
+}
+
+// GetObject get current object
+func (rc *SchemaContext) GetObject() SchemaObject {
+	return rc.object
+}
+
+// IsDeleting The object is being deleted and has the finalizer.
+func (rc *SchemaContext) IsDeleting() bool {
+	return rc.object.GetDeletionTimestamp() != nil && rc.HasFinalizer(naming.Finalizer)
+}
+
+// IsDeleted The object is being deleted and there is no finalizer.
+func (rc *SchemaContext) IsDeleted() bool {
+	return rc.object.GetDeletionTimestamp() != nil && !rc.HasFinalizer(naming.Finalizer)
+}
+
+// HasFinalizer determine if the finalizer exists
+func (rc *SchemaContext) HasFinalizer(key string) bool {
+	return sets.NewString(rc.object.GetFinalizers()...).Has(key)
+}
+
+// PatchStatus patches the status of the object when it changed.
+func (rc *SchemaContext) PatchStatus() error {
+	if rc.object.GetDeletionTimestamp() != nil && !rc.HasFinalizer(naming.Finalizer) {
+		return nil
+	}
+	if equality.Semantic.DeepEqual(rc.oldObject, rc.object) {
+		return nil
+	}
+	return errors.WithStack(rc.Client().Status().Patch(
+		rc.Context(), rc.object, client.MergeFrom(rc.oldObject), rc.Owner()))
+}
+
+func (rc *SchemaContext) SetGlobalConfig(config *config.GlobalConfig) {
+	rc.globalConfig = config
+}
+
+func (rc *SchemaContext) GetGlobalConfig() config.GlobalConfig {
+	if rc.globalConfig == nil {
+		return config.GlobalConfig{}
+	}
+	return *rc.globalConfig
+}
+
+// SetTarget records the instance the object is applied to, its master and
+// its credentials.
+func (rc *SchemaContext) SetTarget(instance *v1.KDBInstance, master *corev1.Pod, credentials *corev1.Secret) {
+	rc.instance, rc.master, rc.credentials = instance, master, credentials
+}
+
+// GetTargetInstance returns the instance the object is applied to.
+func (rc *SchemaContext) GetTargetInstance() *v1.KDBInstance {
+	return rc.instance
+}
+
+// GetMaster returns the master pod of the target instance.
+func (rc *SchemaContext) GetMaster() *corev1.Pod {
+	return rc.master
+}
+
+// GetCredential returns the value of key in the credentials Secret of the
+// target instance.
+func (rc *SchemaContext) GetCredential(key string) string {
+	if rc.credentials == nil {
+		return ""
+	}
+	return string(rc.credentials.Data[key])
+}
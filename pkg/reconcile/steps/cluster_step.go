@@ -6,17 +6,21 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sqc157400661/helper/kube"
 	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/apis/shared"
 	"github.com/sqc157400661/kdb/internal/config"
 	"github.com/sqc157400661/kdb/internal/generate"
 	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/pkg/metrics"
 	"github.com/sqc157400661/kdb/pkg/reconcile/context"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/json"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sort"
+	"time"
 )
 
 type Condition func(rc *context.ClusterContext, log logr.Logger) (bool, error)
@@ -40,7 +44,10 @@ type ClusterStepManager struct {
 func (s *ClusterStepManager) StepBinder(name string, f Step) kube.BindFunc {
 	return kube.NewStepBinder(
 		kube.NewStep(
-			name, func(rc kube.ReconcileContext, flow kube.Flow) (reconcile.Result, error) {
+			name, func(rc kube.ReconcileContext, flow kube.Flow) (result reconcile.Result, err error) {
+				defer func(start time.Time) {
+					metrics.ObserveStep(metrics.ControllerCluster, name, start, err)
+				}(time.Now())
 				return f(rc.(*context.ClusterContext), flow)
 			},
 		),
@@ -115,7 +122,7 @@ func (s *ClusterStepManager) HandleDelete() kube.BindFunc {
 		})
 }
 
-// SetGlobalConfig including configuration information such as Root certificate, username and password
+// SetGlobalConfig including configuration information such as images, username and password
 func (s *ClusterStepManager) SetGlobalConfig() kube.BindFunc {
 	return s.StepBinder(
 		"SetGlobalConfig",
@@ -162,37 +169,58 @@ func (s *ClusterStepManager) InitObservedInstance() kube.BindFunc {
 		})
 }
 
+// ScaleUp writes the instances of the cluster spec. The spec of an instance
+// is generated from its description in the cluster, so that changes of the
+// description, e.g. of its resources or placement, reach existing instances.
+// The images are resolved when an instance is created only, afterwards the
+// instance controller resolves them from its engine full version, e.g. keeps
+// the images of the previous version during a major upgrade.
 func (s *ClusterStepManager) ScaleUp() kube.BindFunc {
 	return s.StepBinder(
 		"ScaleUp",
 		func(rc *context.ClusterContext, flow kube.Flow) (reconcile.Result, error) {
 			cluster := rc.GetCluster()
 			observedCluster := rc.GetObservedCluster()
-			instances := observedCluster.Items
-			existInstanceNames := sets.NewString()
-			for _, instance := range instances {
-				existInstanceNames.Insert(instance.Name)
-			}
 			masters, err := picMasterInstances(rc)
 			if err != nil {
 				return flow.Error(err, "picMasterInstances err")
 			}
-			for _, ins := range cluster.Spec.Instances {
-				if !existInstanceNames.Has(ins.Name) {
-					observedCluster.AddInstance(&v1.KDBInstance{ObjectMeta: metav1.ObjectMeta{
-						Namespace: cluster.Namespace,
-						Name:      ins.Name,
-					}})
+			for i := range cluster.Spec.Instances {
+				desc := &cluster.Spec.Instances[i]
+				// Only the fields generated from the description are applied,
+				// the fields the instance controller writes are kept.
+				intent := &v1.KDBInstance{ObjectMeta: metav1.ObjectMeta{
+					Namespace: cluster.Namespace,
+					Name:      desc.Name,
+				}}
+				intent.SetGroupVersionKind(v1.GroupVersion.WithKind("KDBInstance"))
+				err = generate.InitKDBInstance(rc, intent, desc, masters)
+				if existing := observedCluster.GetInstanceByName(desc.Name); err == nil && existing != nil {
+					keepImages(&intent.Spec.InstanceSet, &existing.Spec.InstanceSet)
+				}
+				if err == nil {
+					err = errors.WithStack(controllerutil.SetControllerReference(cluster, intent, rc.Client().Scheme()))
+				}
+				if err == nil {
+					err = errors.WithStack(rc.Apply(intent))
 				}
-				err = generate.InitKDBInstance(rc, observedCluster.GetInstanceByName(ins.Name), &ins, masters)
 				if err != nil {
-					return flow.Error(err, "reconcileInstance err")
+					return flow.Error(err, "reconcileInstance err", "instance", desc.Name)
 				}
+				observedCluster.AddInstance(intent)
 			}
 			return flow.Pass()
 		})
 }
 
+// keepImages sets the images of the containers of spec to those of existing.
+func keepImages(spec, existing *shared.InstanceSetSpec) {
+	spec.InitContainer.Image = existing.InitContainer.Image
+	spec.MainContainer.Image = existing.MainContainer.Image
+	spec.SidecarContainer.Image = existing.SidecarContainer.Image
+	spec.MonitorContainer.Image = existing.MonitorContainer.Image
+}
+
 func (s *ClusterStepManager) ScaleDown() kube.BindFunc {
 	return s.StepBinder(
 		"ScaleDown",
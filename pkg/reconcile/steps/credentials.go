@@ -0,0 +1,182 @@
+package steps
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/helper/kube"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+// SetCredentials keeps the passwords of the database users in the credentials
+// Secret of the instance, the pods read them from the config volume. A new
+// instance takes the passwords of the Secret referenced by its spec and
+// generates the others. The passwords of the credentials Secret are kept once
+// it exists: the database was initialized with them. The token of the
+// management API of the sidecar is generated as well.
+func (s *InstanceStepManager) SetCredentials() kube.BindFunc {
+	return s.StepBinder(
+		"SetCredentials",
+		func(rc *context.InstanceContext, flow kube.Flow) (reconcile.Result, error) {
+			instance := rc.GetInstance()
+			existing := &corev1.Secret{ObjectMeta: naming.InstanceCredentials(instance)}
+			err := errors.WithStack(client.IgnoreNotFound(rc.Get(existing)))
+			if err != nil {
+				return flow.Error(err, "get credentials err")
+			}
+
+			source := existing.Data
+			switch {
+			case len(source) > 0:
+			case instance.Status.ConfigHash != "":
+				// An instance created before the credentials Secret has the
+				// passwords of the global config, its monitor user the root
+				// password.
+				db := rc.GetGlobalConfig().DB
+				source = map[string][]byte{
+					naming.RootPasswordSecretKey:    []byte(db.RootPassword),
+					naming.ReplPasswordSecretKey:    []byte(db.ReplPassword),
+					naming.MonitorPasswordSecretKey: []byte(db.RootPassword),
+				}
+			case instance.Spec.CredentialsSecret != "":
+				override := &corev1.Secret{}
+				override.Namespace, override.Name = instance.Namespace, instance.Spec.CredentialsSecret
+				if err = errors.WithStack(rc.Get(override)); err != nil {
+					if apierrors.IsNotFound(errors.Cause(err)) {
+						rc.Recorder().Eventf(instance, corev1.EventTypeWarning, "CredentialsSecretNotFound",
+							"Secret %s does not exist", override.Name)
+						return flow.RetryAfter(time.Minute, "credentials secret not found",
+							"secret", override.Name)
+					}
+					return flow.Error(err, "get credentials secret err")
+				}
+				source = override.Data
+			}
+
+			data := map[string][]byte{}
+			for _, key := range naming.CredentialSecretKeys() {
+				data[key] = source[key]
+				if len(data[key]) > 0 {
+					continue
+				}
+				password, err := generatePassword()
+				if err != nil {
+					return flow.Error(err, "generate password err")
+				}
+				data[key] = []byte(password)
+			}
+			data[naming.SidecarTokenSecretKey] = existing.Data[naming.SidecarTokenSecretKey]
+			if len(data[naming.SidecarTokenSecretKey]) == 0 {
+				token, err := generatePassword()
+				if err != nil {
+					return flow.Error(err, "generate sidecar token err")
+				}
+				data[naming.SidecarTokenSecretKey] = []byte(token)
+			}
+			// Keep the passwords of a rotation in progress.
+			for _, key := range naming.CredentialSecretKeys() {
+				if pending := existing.Data[naming.PendingCredentialKey(key)]; len(pending) > 0 {
+					data[naming.PendingCredentialKey(key)] = pending
+				}
+			}
+
+			secret := &corev1.Secret{ObjectMeta: naming.InstanceCredentials(instance)}
+			secret.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Secret"))
+			secret.Labels = naming.Merge(instance.Labels,
+				map[string]string{
+					naming.LabelInstance: instance.Name,
+				})
+			secret.Type = corev1.SecretTypeOpaque
+			secret.Data = data
+			err = errors.WithStack(rc.SetControllerReference(secret))
+			if err == nil {
+				err = errors.WithStack(rc.Apply(secret))
+			}
+			if err != nil {
+				return flow.Error(err, "apply credentials err")
+			}
+			rc.SetInstanceCredentials(secret)
+			return flow.Pass()
+		})
+}
+
+// SetClusterCredentials keeps the passwords the instances of the cluster share
+// in the credentials Secret of the cluster. The instances reference it by
+// their CredentialsSecret and copy it when they are created. The Secret of a
+// cluster whose instances exist already starts with the passwords of the
+// first of them, the others are generated. The passwords are kept once the
+// Secret exists.
+func (s *ClusterStepManager) SetClusterCredentials() kube.BindFunc {
+	return s.StepBinder(
+		"SetClusterCredentials",
+		func(rc *context.ClusterContext, flow kube.Flow) (reconcile.Result, error) {
+			cluster := rc.GetCluster()
+			existing := &corev1.Secret{ObjectMeta: naming.ClusterCredentials(cluster)}
+			err := errors.WithStack(client.IgnoreNotFound(rc.Get(existing)))
+			if err != nil {
+				return flow.Error(err, "get cluster credentials err")
+			}
+
+			source := existing.Data
+			for i := 0; len(source) == 0 && i < len(cluster.Spec.Instances); i++ {
+				instance := rc.GetObservedCluster().GetInstanceByName(cluster.Spec.Instances[i].Name)
+				if instance == nil {
+					continue
+				}
+				credentials := &corev1.Secret{ObjectMeta: naming.InstanceCredentials(instance)}
+				if err = errors.WithStack(client.IgnoreNotFound(rc.Get(credentials))); err != nil {
+					return flow.Error(err, "get instance credentials err", "instance", instance.Name)
+				}
+				source = credentials.Data
+			}
+
+			data := map[string][]byte{}
+			for _, key := range naming.CredentialSecretKeys() {
+				data[key] = source[key]
+				if len(data[key]) > 0 {
+					continue
+				}
+				password, err := generatePassword()
+				if err != nil {
+					return flow.Error(err, "generate password err")
+				}
+				data[key] = []byte(password)
+			}
+
+			secret := &corev1.Secret{ObjectMeta: naming.ClusterCredentials(cluster)}
+			secret.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Secret"))
+			secret.Labels = naming.Merge(cluster.Labels,
+				map[string]string{
+					naming.LabelClusterID: naming.KDBClusterID(cluster),
+				})
+			secret.Type = corev1.SecretTypeOpaque
+			secret.Data = data
+			err = errors.WithStack(controllerutil.SetControllerReference(cluster, secret, rc.Client().Scheme()))
+			if err == nil {
+				err = errors.WithStack(rc.Apply(secret))
+			}
+			if err != nil {
+				return flow.Error(err, "apply cluster credentials err")
+			}
+			return flow.Pass()
+		})
+}
+
+// generatePassword returns a random password of 32 characters that needs no
+// quoting in SQL or shell.
+func generatePassword() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
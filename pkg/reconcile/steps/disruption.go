@@ -0,0 +1,287 @@
+package steps
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/helper/kube"
+	"github.com/sqc157400661/util"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+// drainPollInterval is how often the node of the master of a highly available
+// instance is checked for a drain.
+const drainPollInterval = 30 * time.Second
+
+// podDisruptionBudget returns the PodDisruptionBudget of the pods with role
+// among the pods matching the labels of selector. The master may not be
+// evicted at all, it is moved away by a switchover. One replica may be
+// evicted at a time.
+func podDisruptionBudget(meta metav1.ObjectMeta, selector map[string]string, role string) *policyv1.PodDisruptionBudget {
+	pdb := &policyv1.PodDisruptionBudget{ObjectMeta: meta}
+	pdb.SetGroupVersionKind(policyv1.SchemeGroupVersion.WithKind("PodDisruptionBudget"))
+	pdb.Labels = naming.Merge(pdb.Labels, selector)
+	maxUnavailable := intstr.FromInt(1)
+	if role == naming.MasterRole {
+		maxUnavailable = intstr.FromInt(0)
+	}
+	pdb.Spec = policyv1.PodDisruptionBudgetSpec{
+		Selector: &metav1.LabelSelector{
+			MatchLabels: naming.Merge(selector, map[string]string{naming.LabelRole: role}),
+		},
+		MaxUnavailable: &maxUnavailable,
+	}
+	return pdb
+}
+
+// deletePodDisruptionBudget deletes the PodDisruptionBudget meta when it is
+// controlled by owner.
+func deletePodDisruptionBudget(rc kube.ReconcileContext, owner metav1.Object, meta metav1.ObjectMeta) error {
+	pdb := &policyv1.PodDisruptionBudget{ObjectMeta: meta}
+	err := errors.WithStack(client.IgnoreNotFound(rc.Get(pdb)))
+	if err == nil && metav1.IsControlledBy(pdb, owner) {
+		uid := pdb.GetUID()
+		err = errors.WithStack(client.IgnoreNotFound(rc.Client().Delete(rc.Context(), pdb,
+			client.Preconditions{UID: &uid})))
+	}
+	return err
+}
+
+// SetPodDisruptionBudget keeps a PodDisruptionBudget for the master and one
+// for the replicas of a highly available instance, so that draining nodes
+// never takes down the master together with its last ready replica. The
+// instances of a cluster are covered by the budgets of the cluster.
+func (s *InstanceStepManager) SetPodDisruptionBudget() kube.BindFunc {
+	return s.StepBinder(
+		"SetPodDisruptionBudget",
+		func(rc *context.InstanceContext, flow kube.Flow) (reconcile.Result, error) {
+			if err := setInstancePodDisruptionBudgets(rc); err != nil {
+				return flow.Error(err, "set pod disruption budget err")
+			}
+			return flow.Pass()
+		})
+}
+
+// setInstancePodDisruptionBudgets applies the PodDisruptionBudgets of the
+// instance of rc, or deletes them when the instance needs none. The master may
+// be evicted while its drain is blocked, see DrainStep.
+func setInstancePodDisruptionBudgets(rc *context.InstanceContext) error {
+	instance := rc.GetInstance()
+	for _, role := range []string{naming.MasterRole, naming.ReplicaRole} {
+		meta := naming.InstancePodDisruptionBudget(instance, role)
+		if !naming.IsHighlyAvailable(instance) || naming.IsClusterMember(instance) {
+			if err := deletePodDisruptionBudget(rc, instance, meta); err != nil {
+				return errors.WithMessagef(err, "delete pod disruption budget of %s", role)
+			}
+			continue
+		}
+		pdb := podDisruptionBudget(meta, map[string]string{naming.LabelInstance: instance.Name}, role)
+		if role == naming.MasterRole && isDrainBlocked(instance) {
+			relaxed := intstr.FromInt(1)
+			pdb.Spec.MaxUnavailable = &relaxed
+		}
+		err := errors.WithStack(rc.SetControllerReference(pdb))
+		if err == nil {
+			err = errors.WithStack(rc.Apply(pdb))
+		}
+		if err != nil {
+			return errors.WithMessagef(err, "apply pod disruption budget of %s", role)
+		}
+	}
+	return nil
+}
+
+// isDrainBlocked reports whether the master of instance sits on a cordoned
+// node and cannot be switched over, see DrainStep.
+func isDrainBlocked(instance *v1.KDBInstance) bool {
+	return meta.IsStatusConditionTrue(instance.Status.Conditions, v1.KDBInstanceDrainBlocked)
+}
+
+// SetPodDisruptionBudget keeps a PodDisruptionBudget for the masters and one
+// for the replicas of the instances of a cluster with more than one pod. Only
+// the masters of instances that can switch over are guarded, the others could
+// never be evicted, and neither are masters whose drain is blocked.
+func (s *ClusterStepManager) SetPodDisruptionBudget() kube.BindFunc {
+	return s.StepBinder(
+		"SetPodDisruptionBudget",
+		func(rc *context.ClusterContext, flow kube.Flow) (reconcile.Result, error) {
+			cluster := rc.GetCluster()
+			var pods int32
+			for _, desc := range cluster.Spec.Instances {
+				pods++
+				if desc.Replicas != nil && *desc.Replicas > 1 {
+					pods += *desc.Replicas - 1
+				}
+			}
+			var guarded []string
+			for _, instance := range rc.GetObservedCluster().Items {
+				if naming.IsHighlyAvailable(instance) && !isDrainBlocked(instance) {
+					guarded = append(guarded, instance.Name)
+				}
+			}
+			sort.Strings(guarded)
+			id := naming.KDBClusterID(cluster)
+			for _, role := range []string{naming.MasterRole, naming.ReplicaRole} {
+				meta := naming.ClusterPodDisruptionBudget(cluster, role)
+				if pods < 2 || (role == naming.MasterRole && len(guarded) == 0) {
+					if err := deletePodDisruptionBudget(rc, cluster, meta); err != nil {
+						return flow.Error(err, "delete pod disruption budget err", "role", role)
+					}
+					continue
+				}
+				pdb := podDisruptionBudget(meta, map[string]string{naming.LabelClusterID: id}, role)
+				if role == naming.MasterRole {
+					pdb.Spec.Selector.MatchExpressions = []metav1.LabelSelectorRequirement{{
+						Key:      naming.LabelInstance,
+						Operator: metav1.LabelSelectorOpIn,
+						Values:   guarded,
+					}}
+				}
+				err := errors.WithStack(controllerutil.SetControllerReference(cluster, pdb, rc.Client().Scheme()))
+				if err == nil {
+					err = errors.WithStack(rc.Apply(pdb))
+				}
+				if err != nil {
+					return flow.Error(err, "apply pod disruption budget err", "role", role)
+				}
+			}
+			return flow.Pass()
+		})
+}
+
+// DrainInstance moves the master away from a cordoned node without engine
+// hooks, see DrainStep.
+func (s *InstanceStepManager) DrainInstance() kube.BindFunc {
+	return s.DrainStep(nil)
+}
+
+// DrainStep returns the step that switches the master of a highly available
+// instance over to a ready replica when the node of the master is cordoned,
+// which precedes a drain. The PodDisruptionBudget of the master blocks its
+// eviction until the switchover, then the old master is evicted as a replica.
+// Without switchover, without a ready replica on a schedulable node or when
+// the switchover fails, the drain is blocked: the budget of the master is
+// relaxed so that the drain can evict it anyway, until the master is on a
+// schedulable node again.
+func (s *InstanceStepManager) DrainStep(switchover SwitchoverFunc) kube.BindFunc {
+	return s.StepBinder(
+		"DrainInstance",
+		func(rc *context.InstanceContext, flow kube.Flow) (reconcile.Result, error) {
+			return drainInstance(rc, flow, switchover)
+		})
+}
+
+// drainInstance moves the master away from a cordoned node or blocks the
+// drain, see DrainStep.
+func drainInstance(rc *context.InstanceContext, flow kube.Flow, switchover SwitchoverFunc) (reconcile.Result, error) {
+	instance := rc.GetInstance()
+	if !naming.IsHighlyAvailable(instance) {
+		meta.RemoveStatusCondition(&instance.Status.Conditions, v1.KDBInstanceDrainBlocked)
+		return flow.Pass()
+	}
+	rc.RequeueWithin(drainPollInterval)
+
+	var master *corev1.Pod
+	var replicas []*corev1.Pod
+	for _, runner := range rc.GetObservedRunner().List {
+		for _, pod := range runner.Pods {
+			switch {
+			case pod.DeletionTimestamp != nil:
+			case naming.IsMasterPod(pod):
+				master = pod
+			case util.IsPodReady(pod):
+				replicas = append(replicas, pod)
+			}
+		}
+	}
+	if master == nil {
+		return flow.Pass()
+	}
+	cordoned, err := isNodeCordoned(rc, master.Spec.NodeName)
+	if err != nil {
+		return flow.Error(err, "get node err", "node", master.Spec.NodeName)
+	}
+	if !cordoned {
+		if isDrainBlocked(instance) {
+			meta.RemoveStatusCondition(&instance.Status.Conditions, v1.KDBInstanceDrainBlocked)
+			if err := setInstancePodDisruptionBudgets(rc); err != nil {
+				return flow.Error(err, "set pod disruption budget err")
+			}
+		}
+		return flow.Pass()
+	}
+
+	var candidates []*corev1.Pod
+	for _, pod := range replicas {
+		cordoned, err := isNodeCordoned(rc, pod.Spec.NodeName)
+		if err != nil {
+			return flow.Error(err, "get node err", "node", pod.Spec.NodeName)
+		}
+		if !cordoned {
+			candidates = append(candidates, pod)
+		}
+	}
+	if switchover == nil || len(candidates) == 0 {
+		err := blockDrain(rc, "NoSwitchover", fmt.Sprintf(
+			"Node %s of master %s is cordoned and no ready replica can take over, the master may be evicted",
+			master.Spec.NodeName, master.Name))
+		if err != nil {
+			return flow.Error(err, "set pod disruption budget err")
+		}
+		return flow.Pass()
+	}
+	if err := switchover(rc, master, candidates); err != nil {
+		rc.Recorder().Event(instance, corev1.EventTypeWarning, "SwitchoverFailed", err.Error())
+		if err := blockDrain(rc, "SwitchoverFailed", fmt.Sprintf(
+			"Node %s of master %s is cordoned and the switchover failed, the master may be evicted",
+			master.Spec.NodeName, master.Name)); err != nil {
+			return flow.Error(err, "set pod disruption budget err")
+		}
+		return flow.Error(err, "switchover err", "pod", master.Name)
+	}
+	rc.Recorder().Eventf(instance, corev1.EventTypeNormal, "DrainSwitchover",
+		"Moved the master away from cordoned node %s", master.Spec.NodeName)
+	return flow.RetryAfter(rolloutPollInterval, "switched over from cordoned node", "pod", master.Name)
+}
+
+// blockDrain records that the master on a cordoned node cannot be switched
+// over and relaxes its PodDisruptionBudget, so that the drain does not hang.
+// The budgets of a cluster member are relaxed by the cluster.
+func blockDrain(rc *context.InstanceContext, reason, message string) error {
+	instance := rc.GetInstance()
+	if !isDrainBlocked(instance) {
+		rc.Recorder().Event(instance, corev1.EventTypeWarning, "DrainBlocked", message)
+	}
+	meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+		Type:               v1.KDBInstanceDrainBlocked,
+		Status:             metav1.ConditionTrue,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: instance.Generation,
+	})
+	return setInstancePodDisruptionBudgets(rc)
+}
+
+// isNodeCordoned reports whether no new pods are scheduled to the node name.
+func isNodeCordoned(rc *context.InstanceContext, name string) (bool, error) {
+	if name == "" {
+		return false, nil
+	}
+	node := &corev1.Node{}
+	node.Name = name
+	err := errors.WithStack(client.IgnoreNotFound(rc.Get(node)))
+	return node.Spec.Unschedulable, err
+}
@@ -0,0 +1,176 @@
+package steps
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/util"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/internal/reconciletest"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+func TestDrainInstance(t *testing.T) {
+	t.Parallel()
+
+	failed := errors.New("replica is behind")
+	for _, tt := range []struct {
+		name     string
+		replicas int32
+		// cordoned are the sets whose pod runs on a cordoned node.
+		cordoned   []int
+		blocked    bool
+		switchover bool
+		err        error
+
+		result     string
+		candidates []string
+		reason     string
+		// maxUnavailable of the budget of the master, -1 when there is none.
+		maxUnavailable int
+	}{
+		{
+			name:           "NotHighlyAvailable",
+			replicas:       1,
+			blocked:        true,
+			result:         "Pass",
+			maxUnavailable: -1,
+		},
+		{
+			name:           "NotCordoned",
+			replicas:       3,
+			switchover:     true,
+			result:         "Pass",
+			maxUnavailable: -1,
+		},
+		{
+			name:           "Switchover",
+			replicas:       3,
+			cordoned:       []int{0},
+			switchover:     true,
+			result:         "RetryAfter",
+			candidates:     []string{"kdb1-0", "kdb2-0"},
+			maxUnavailable: -1,
+		},
+		{
+			name:           "CandidatesOnSchedulableNodes",
+			replicas:       3,
+			cordoned:       []int{0, 1},
+			switchover:     true,
+			result:         "RetryAfter",
+			candidates:     []string{"kdb2-0"},
+			maxUnavailable: -1,
+		},
+		{
+			name:           "NoSwitchover",
+			replicas:       3,
+			cordoned:       []int{0},
+			result:         "Pass",
+			reason:         "NoSwitchover",
+			maxUnavailable: 1,
+		},
+		{
+			name:           "NoCandidates",
+			replicas:       3,
+			cordoned:       []int{0, 1, 2},
+			switchover:     true,
+			result:         "Pass",
+			reason:         "NoSwitchover",
+			maxUnavailable: 1,
+		},
+		{
+			name:           "SwitchoverFailed",
+			replicas:       3,
+			cordoned:       []int{0},
+			switchover:     true,
+			err:            failed,
+			result:         "Error",
+			candidates:     []string{"kdb1-0", "kdb2-0"},
+			reason:         "SwitchoverFailed",
+			maxUnavailable: 1,
+		},
+		{
+			name:           "Unblocked",
+			replicas:       3,
+			blocked:        true,
+			switchover:     true,
+			result:         "Pass",
+			maxUnavailable: 0,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			instance := &v1.KDBInstance{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "kdb", UID: "uid"}}
+			instance.Spec.InstanceSet.Replicas = util.Int32(tt.replicas)
+			if tt.blocked {
+				meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+					Type: v1.KDBInstanceDrainBlocked, Status: metav1.ConditionTrue, Reason: "NoSwitchover",
+				})
+			}
+			var nodes []client.Object
+			for i := 0; i < 3; i++ {
+				node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("node%d", i)}}
+				for _, cordoned := range tt.cordoned {
+					node.Spec.Unschedulable = node.Spec.Unschedulable || cordoned == i
+				}
+				nodes = append(nodes, node)
+			}
+			rc, _, _ := reconciletest.NewInstanceContext(t, instance, nodes...)
+			observeSets(rc, true, 0, 1, 2)
+			for i, item := range rc.GetObservedRunner().List {
+				item.Pods[0].Spec.NodeName = fmt.Sprintf("node%d", i)
+			}
+			// The budgets as the last reconcile left them.
+			if tt.blocked && tt.replicas > 1 {
+				assert.NilError(t, setInstancePodDisruptionBudgets(rc))
+			}
+			var switchover SwitchoverFunc
+			var candidates []string
+			if tt.switchover {
+				switchover = func(rc *context.InstanceContext, master *corev1.Pod, pods []*corev1.Pod) error {
+					assert.Equal(t, master.Name, "kdb0-0")
+					for _, pod := range pods {
+						candidates = append(candidates, pod.Name)
+					}
+					return tt.err
+				}
+			}
+
+			flow := &reconciletest.Flow{}
+			_, err := drainInstance(rc, flow, switchover)
+			assert.Equal(t, err, tt.err)
+			assert.Equal(t, flow.Result, tt.result)
+			assert.DeepEqual(t, candidates, tt.candidates)
+			blocked := meta.FindStatusCondition(rc.GetInstance().Status.Conditions, v1.KDBInstanceDrainBlocked)
+			if tt.reason == "" {
+				assert.Assert(t, blocked == nil)
+			} else {
+				assert.Equal(t, blocked.Reason, tt.reason)
+			}
+			if tt.replicas > 1 {
+				assert.Equal(t, rc.RequeueAfter(), drainPollInterval)
+			}
+
+			pdb := &policyv1.PodDisruptionBudget{
+				ObjectMeta: naming.InstancePodDisruptionBudget(instance, naming.MasterRole),
+			}
+			err = rc.Get(pdb)
+			if tt.maxUnavailable < 0 {
+				assert.Assert(t, err != nil)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, pdb.Spec.MaxUnavailable.IntValue(), tt.maxUnavailable)
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package steps
+
+import (
+	"time"
+
+	"github.com/sqc157400661/helper/kube"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/internal/hibernation"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+// HibernateInstance evaluates the hibernation schedules of the instance and
+// records whether they stop it, the ShutdownInstance step stops and starts
+// the instance accordingly. The reconcile is requeued for the next stop or
+// start of the schedules.
+func (s *InstanceStepManager) HibernateInstance() kube.BindFunc {
+	return s.StepBinder(
+		"HibernateInstance",
+		func(rc *context.InstanceContext, flow kube.Flow) (reconcile.Result, error) {
+			instance := rc.GetInstance()
+			spec := instance.Spec.Hibernation
+			if spec == nil {
+				instance.Status.Hibernation = nil
+				return flow.Pass()
+			}
+
+			status := &v1.HibernationStatus{}
+			previous := instance.Status.Hibernation
+			if previous == nil {
+				previous = &v1.HibernationStatus{}
+			}
+			if naming.IsHibernationSuspended(instance) {
+				status.Message = "Suspended by the " + naming.SuspendHibernation + " annotation"
+			} else if state, err := hibernation.Evaluate(spec, time.Now()); err != nil {
+				status.Message = err.Error()
+				if previous.Message != status.Message {
+					rc.Recorder().Event(instance, corev1.EventTypeWarning, "InvalidHibernation", status.Message)
+				}
+			} else {
+				status.Hibernating = state.Hibernating
+				status.NextStop = hibernationTime(state.NextStop)
+				status.NextStart = hibernationTime(state.NextStart)
+				next := state.NextStart
+				if !status.Hibernating {
+					next = state.NextStop
+				}
+				if !next.IsZero() {
+					// Wake up shortly after the next transition.
+					d := time.Until(next) + time.Second
+					rc.RequeueWithin(d)
+				}
+			}
+
+			if status.Hibernating != previous.Hibernating {
+				reason, message := "HibernationEnded", "The hibernation schedule starts the instance"
+				if status.Hibernating {
+					reason, message = "Hibernating", "The hibernation schedule stops the instance"
+				}
+				rc.Recorder().Event(instance, corev1.EventTypeNormal, reason, message)
+			}
+			instance.Status.Hibernation = status
+			return flow.Pass()
+		})
+}
+
+func hibernationTime(t time.Time) *metav1.Time {
+	if t.IsZero() {
+		return nil
+	}
+	mt := metav1.NewTime(t)
+	return &mt
+}
@@ -45,14 +45,14 @@ func reconcileDataVolume(rc *context.InstanceContext, runner *appsv1.StatefulSet
 	}
 
 	var pvc *corev1.PersistentVolumeClaim
-	existingPVCName, err := getPVCName(labelMap, instanceVolumes)
+	existing, err := getPVC(labelMap, instanceVolumes)
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	if existingPVCName != "" {
+	if existing != nil {
 		pvc = &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
 			Namespace: instance.GetNamespace(),
-			Name:      existingPVCName,
+			Name:      existing.Name,
 		}}
 	} else {
 		pvc = &corev1.PersistentVolumeClaim{ObjectMeta: naming.InstanceDataVolume(runner)}
@@ -65,7 +65,8 @@ func reconcileDataVolume(rc *context.InstanceContext, runner *appsv1.StatefulSet
 	instanceSet := naming.InstanceSetSpec(instance)
 	pvc.Annotations = naming.Merge(
 		instanceSet.Metadata.GetAnnotationsOrNil(),
-		dataPvcSpec.Metadata.GetAnnotationsOrNil())
+		dataPvcSpec.Metadata.GetAnnotationsOrNil(),
+		autoscaledAnnotations(existing))
 
 	pvc.Labels = naming.Merge(
 		instanceSet.Metadata.GetLabelsOrNil(),
@@ -79,7 +80,7 @@ func reconcileDataVolume(rc *context.InstanceContext, runner *appsv1.StatefulSet
 		},
 		Resources: corev1.ResourceRequirements{
 			Requests: corev1.ResourceList{
-				corev1.ResourceStorage: dataPvcSpec.Size,
+				corev1.ResourceStorage: volumeSize(rc, existing, dataPvcSpec.Size),
 			},
 		},
 	}
@@ -105,14 +106,14 @@ func reconcileLogVolume(rc *context.InstanceContext, runner *appsv1.StatefulSet)
 	}
 
 	var pvc *corev1.PersistentVolumeClaim
-	existingPVCName, err := getPVCName(labelMap, instanceVolumes)
+	existing, err := getPVC(labelMap, instanceVolumes)
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	if existingPVCName != "" {
+	if existing != nil {
 		pvc = &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
 			Namespace: instance.GetNamespace(),
-			Name:      existingPVCName,
+			Name:      existing.Name,
 		}}
 	} else {
 		pvc = &corev1.PersistentVolumeClaim{ObjectMeta: naming.InstanceLogVolume(runner)}
@@ -122,7 +123,8 @@ func reconcileLogVolume(rc *context.InstanceContext, runner *appsv1.StatefulSet)
 	logPvcSpec := naming.InstanceLogPvcSpec(instance)
 	pvc.Annotations = naming.Merge(
 		instanceSet.Metadata.GetAnnotationsOrNil(),
-		logPvcSpec.Metadata.GetAnnotationsOrNil())
+		logPvcSpec.Metadata.GetAnnotationsOrNil(),
+		autoscaledAnnotations(existing))
 
 	pvc.Labels = naming.Merge(
 		instanceSet.Metadata.GetLabelsOrNil(),
@@ -136,7 +138,7 @@ func reconcileLogVolume(rc *context.InstanceContext, runner *appsv1.StatefulSet)
 		},
 		Resources: corev1.ResourceRequirements{
 			Requests: corev1.ResourceList{
-				corev1.ResourceStorage: logPvcSpec.Size,
+				corev1.ResourceStorage: volumeSize(rc, existing, logPvcSpec.Size),
 			},
 		},
 	}
@@ -147,25 +149,25 @@ func reconcileLogVolume(rc *context.InstanceContext, runner *appsv1.StatefulSet)
 	return err
 }
 
-// getPVCName returns the name of a PVC that has the provided labels, if found.
-func getPVCName(labelMap map[string]string,
+// getPVC returns the PVC that has the provided labels, if found.
+func getPVC(labelMap map[string]string,
 	volumes []corev1.PersistentVolumeClaim,
-) (string, error) {
+) (*corev1.PersistentVolumeClaim, error) {
 
 	selector, err := naming.AsSelector(metav1.LabelSelector{
 		MatchLabels: labelMap,
 	})
 	if err != nil {
-		return "", errors.WithStack(err)
+		return nil, errors.WithStack(err)
 	}
 
-	for _, pvc := range volumes {
-		if selector.Matches(labels.Set(pvc.GetLabels())) {
-			return pvc.GetName(), nil
+	for i := range volumes {
+		if selector.Matches(labels.Set(volumes[i].GetLabels())) {
+			return &volumes[i], nil
 		}
 	}
 
-	return "", nil
+	return nil, nil
 }
 
 // reconcileInstance writes instance according to spec of cluster.
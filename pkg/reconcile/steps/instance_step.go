@@ -18,11 +18,13 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
 	"github.com/sqc157400661/kdb/apis/shared"
 	"github.com/sqc157400661/kdb/internal/config"
 	"github.com/sqc157400661/kdb/internal/naming"
 	"github.com/sqc157400661/kdb/internal/observed"
 	"github.com/sqc157400661/kdb/internal/rbac"
+	"github.com/sqc157400661/kdb/pkg/metrics"
 	"github.com/sqc157400661/kdb/pkg/reconcile/context"
 )
 
@@ -37,12 +39,29 @@ type InstanceStepper interface {
 	CheckAndSetFinalizer() kube.BindFunc
 	HandleDelete() kube.BindFunc
 	SetGlobalConfig() kube.BindFunc
+	CheckResources() kube.BindFunc
+	UpgradeInstance() kube.BindFunc
+	SetCredentials() kube.BindFunc
+	SetTLS() kube.BindFunc
 	SetInstanceConfig() kube.BindFunc
 	SetRbac() kube.BindFunc
 	InitObservedRunner() kube.BindFunc
+	HibernateInstance() kube.BindFunc
+	ShutdownInstance() kube.BindFunc
 	SetService() kube.BindFunc
+	SetNetworkPolicy() kube.BindFunc
+	SetPodDisruptionBudget() kube.BindFunc
 	ScaleUpInstance() kube.BindFunc
 	ScaleDownInstance() kube.BindFunc
+	ObserveVolumes() kube.BindFunc
+	DrainInstance() kube.BindFunc
+	SeedReplicas() kube.BindFunc
+	ObserveReplication() kube.BindFunc
+	RolloutInstance() kube.BindFunc
+	FinishUpgradeInstance() kube.BindFunc
+	ApplyInstanceConfig() kube.BindFunc
+	RotateCredentials() kube.BindFunc
+	ReloadTLS() kube.BindFunc
 	SetMonitor() kube.BindFunc
 }
 
@@ -53,7 +72,10 @@ type InstanceStepManager struct {
 func (s *InstanceStepManager) StepBinder(name string, f StepFunc) kube.BindFunc {
 	return kube.NewStepBinder(
 		kube.NewStep(
-			name, func(rc kube.ReconcileContext, flow kube.Flow) (reconcile.Result, error) {
+			name, func(rc kube.ReconcileContext, flow kube.Flow) (result reconcile.Result, err error) {
+				defer func(start time.Time) {
+					metrics.ObserveStep(metrics.ControllerInstance, name, start, err)
+				}(time.Now())
 				return f(rc.(*context.InstanceContext), flow)
 			},
 		),
@@ -123,11 +145,23 @@ func (s *InstanceStepManager) CheckAndSetFinalizer() kube.BindFunc {
 				// Make another copy so that Patch doesn't write back to cluster.
 				intent := before.DeepCopy()
 				intent.Finalizers = append(intent.Finalizers, naming.Finalizer)
+				// A new instance gets the baseline security profile, the
+				// restricted one needs images that run as RunAsUser on a
+				// read-only root filesystem. An instance that ran already gets
+				// the legacy one, its pods keep their security context.
+				if intent.Spec.SecurityProfile == "" {
+					intent.Spec.SecurityProfile = v1.SecurityProfileBaseline
+					if intent.Status.ConfigHash != "" {
+						intent.Spec.SecurityProfile = v1.SecurityProfileLegacy
+					}
+				}
 				err := errors.WithStack(rc.Patch(intent,
 					client.MergeFromWithOptions(before, client.MergeFromWithOptimisticLock{})))
 				if err != nil {
 					return flow.Error(err, "patch finalizers error")
 				}
+				rc.GetInstance().Spec.SecurityProfile = intent.Spec.SecurityProfile
+				rc.GetOldInstance().Spec.SecurityProfile = intent.Spec.SecurityProfile
 			}
 			return flow.Pass()
 		})
@@ -251,35 +285,45 @@ func (s *InstanceStepManager) HandleDelete() kube.BindFunc {
 		})
 }
 
-// SetGlobalConfig including configuration information such as Root certificate, username and password
+// SetGlobalConfig including configuration information such as images, username and password
 func (s *InstanceStepManager) SetGlobalConfig() kube.BindFunc {
 	return s.StepBinder(
 		"SetGlobalConfig",
 		func(rc *context.InstanceContext, flow kube.Flow) (reconcile.Result, error) {
-			instance := rc.GetInstance()
-			existing := &corev1.Secret{}
-			existing.Namespace, existing.Name = instance.Namespace, naming.GlobalConfigSecret
-			err := errors.WithStack(client.IgnoreNotFound(rc.Get(existing)))
+			conf, err := loadGlobalConfig(rc, rc.GetInstance().Namespace)
 			if err != nil {
 				return flow.Error(err, "get GlobalConfig err")
 			}
-			if len(existing.Data) == 0 {
-				return flow.Error(errors.New("GlobalConfig not exist"), "get GlobalConfig err")
-			}
-			globalConf := existing.Data[naming.GlobalConfigSecretKey]
-			if len(globalConf) == 0 {
-				return flow.Pass()
-			}
-			var conf config.GlobalConfig
-			err = json.Unmarshal(globalConf, &conf)
-			if err != nil {
-				return flow.Error(errors.New("Unmarshal err"), err.Error())
+			if conf != nil {
+				rc.SetGlobalConfig(conf)
 			}
-			rc.SetGlobalConfig(&conf)
 			return flow.Pass()
 		})
 }
 
+// loadGlobalConfig reads the global config Secret of namespace. It returns
+// no config when the Secret holds none.
+func loadGlobalConfig(rc kube.ReconcileContext, namespace string) (*config.GlobalConfig, error) {
+	existing := &corev1.Secret{}
+	existing.Namespace, existing.Name = namespace, naming.GlobalConfigSecret
+	err := errors.WithStack(client.IgnoreNotFound(rc.Get(existing)))
+	if err != nil {
+		return nil, err
+	}
+	if len(existing.Data) == 0 {
+		return nil, errors.New("GlobalConfig not exist")
+	}
+	globalConf := existing.Data[naming.GlobalConfigSecretKey]
+	if len(globalConf) == 0 {
+		return nil, nil
+	}
+	var conf config.GlobalConfig
+	if err = json.Unmarshal(globalConf, &conf); err != nil {
+		return nil, errors.Wrap(err, "Unmarshal err")
+	}
+	return &conf, nil
+}
+
 func (s *InstanceStepManager) SetInstanceConfig() kube.BindFunc {
 	return s.StepBinder(
 		"SetInstanceConfig",
@@ -386,25 +430,66 @@ func (s *InstanceStepManager) InitObservedRunner() kube.BindFunc {
 					continue
 				}
 				pod := item.Pods[0]
-				if util.IsPodReady(pod) {
+				ready := util.IsPodReady(pod)
+				if ready {
 					status.ReadyReplicas++
-					status.PodInfos = append(status.PodInfos, shared.PodStatusInfo{
-						PodName:  pod.Name,
-						PodPhase: pod.Status.Phase,
-						PodIP:    pod.Status.PodIP,
-						NodeName: pod.Spec.NodeName,
-						HostIP:   pod.Status.HostIP,
-					})
 				}
+				// The pods that are not ready are listed too, the state of
+				// their replication tells why. That state is kept until
+				// ObserveReplication reads it again, or the role changes.
+				info := shared.PodStatusInfo{}
+				for _, before := range instance.Status.InstanceSet.PodInfos {
+					if before.PodName == pod.Name && before.Role == pod.Labels[naming.LabelRole] {
+						info.ReadOnly, info.GTIDExecuted, info.Replication = before.ReadOnly, before.GTIDExecuted, before.Replication
+						info.Message, info.ObservedTime = before.Message, before.ObservedTime
+					}
+				}
+				info.PodName, info.PodPhase, info.PodIP = pod.Name, pod.Status.Phase, pod.Status.PodIP
+				info.NodeName, info.HostIP = pod.Spec.NodeName, pod.Status.HostIP
+				info.Role, info.Ready = pod.Labels[naming.LabelRole], ready
+				info.ServerVersion = pod.Annotations[naming.ServerVersion]
+				status.PodInfos = append(status.PodInfos, info)
 				if matches, known := item.PodMatchesPodTemplate(); known && matches {
 					status.UpdatedReplicas++
 				}
 			}
+			recordFailover(rc, instance.Status.InstanceSet.PodInfos, status.PodInfos)
 			instance.Status.InstanceSet = status
 			return flow.Pass()
 		})
 }
 
+// recordFailover counts a master change between the pods of the status and
+// the observed pods as a failover. The switchovers of the operator set the
+// roles of the status themselves and are not counted.
+func recordFailover(rc *context.InstanceContext, before, after []shared.PodStatusInfo) {
+	master := func(infos []shared.PodStatusInfo) string {
+		for _, info := range infos {
+			if info.Role == naming.MasterRole {
+				return info.PodName
+			}
+		}
+		return ""
+	}
+	from, to := master(before), master(after)
+	if from == "" || to == "" || from == to {
+		return
+	}
+	instance := rc.GetInstance()
+	metrics.RecordFailover(instance.Namespace, instance.Name)
+	rc.Recorder().Eventf(instance, corev1.EventTypeWarning, "Failover",
+		"The master changed from %s to %s", from, to)
+}
+
+// SetPodRole sets the role of the pod in the status of the instance.
+func SetPodRole(instance *v1.KDBInstance, podName, role string) {
+	for i := range instance.Status.InstanceSet.PodInfos {
+		if instance.Status.InstanceSet.PodInfos[i].PodName == podName {
+			instance.Status.InstanceSet.PodInfos[i].Role = role
+		}
+	}
+}
+
 func (s *InstanceStepManager) SetService() kube.BindFunc {
 	return s.StepBinder(
 		"SetService",
@@ -419,15 +504,46 @@ func (s *InstanceStepManager) ScaleUpInstance() kube.BindFunc {
 		func(rc *context.InstanceContext, flow kube.Flow) (reconcile.Result, error) {
 			instance := rc.GetInstance()
 			observedInstances := rc.GetObservedRunner()
+			// Write the existing StatefulSets again so that they pick up
+			// changes of the spec, RolloutInstance replaces their pods.
+			var runners []*appsv1.StatefulSet
+			for _, item := range observedInstances.List {
+				if item.Runner != nil {
+					runners = append(runners, &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{
+						Namespace: item.Runner.Namespace,
+						Name:      item.Runner.Name,
+					}})
+				}
+			}
 			// Range over instance sets to scale up and ensure that each set has
 			// at least the number of replicas defined in the spec. The set can
-			// have more replicas than defined
-			var runners []*appsv1.StatefulSet
+			// have more replicas than defined.
+			// The replicas added to an instance that has a master copy its
+			// data before they replicate, see SeedReplicas. A replica whose
+			// data volume was retained starts on its data.
+			seed := naming.IsMySQLEngine(instance) && hasSeedSource(rc)
 			existNum := len(observedInstances.List)
-			for existNum < int(*instance.Spec.InstanceSet.Replicas) {
-				next := naming.GenerateInstanceStatefulSetMeta(instance, existNum)
+			for index := 0; existNum < int(*instance.Spec.InstanceSet.Replicas); index++ {
+				next := naming.GenerateInstanceStatefulSetMeta(instance, index)
+				if _, ok := observedInstances.BySet[next.Name]; ok {
+					continue
+				}
 				runners = append(runners, &appsv1.StatefulSet{ObjectMeta: next})
 				existNum++
+				if !seed || naming.ReplicaSeed(instance, next.Name) != nil {
+					continue
+				}
+				retained, err := hasDataVolume(rc, next)
+				if err != nil {
+					return flow.Error(err, "get data volume err", "set", next.Name)
+				}
+				if !retained {
+					instance.Status.Seeding = append(instance.Status.Seeding, v1.ReplicaSeedStatus{
+						Set:    next.Name,
+						Method: naming.SeedMethod(instance),
+						Phase:  v1.SeedPending,
+					})
+				}
 			}
 			var err error
 			for n := range runners {
@@ -477,8 +593,10 @@ func getNamesNeedToKeep(rc *context.InstanceContext) sets.String {
 		}
 	}
 
+	// Sets without a pod are kept as well, their pod is being created or was
+	// deleted by a rollout.
 	for _, ins := range observedInstances.List {
-		if len(ins.Pods) > 0 && !naming.IsMasterPod(ins.Pods[0]) && namesToKeep.Len() < int(wantNums) {
+		if (len(ins.Pods) == 0 || !naming.IsMasterPod(ins.Pods[0])) && namesToKeep.Len() < int(wantNums) {
 			namesToKeep.Insert(ins.Name)
 		}
 	}
@@ -507,6 +625,14 @@ func deleteSts(rc *context.InstanceContext, stsName string) error {
 	return err
 }
 
+func (s *InstanceStepManager) ApplyInstanceConfig() kube.BindFunc {
+	return s.StepBinder(
+		"ApplyInstanceConfig",
+		func(rc *context.InstanceContext, flow kube.Flow) (reconcile.Result, error) {
+			return flow.Pass()
+		})
+}
+
 func (s *InstanceStepManager) SetMonitor() kube.BindFunc {
 	return s.StepBinder(
 		"SetMonitor",
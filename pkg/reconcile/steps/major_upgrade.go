@@ -0,0 +1,304 @@
+package steps
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/helper/kube"
+	"github.com/sqc157400661/util"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/internal/generate"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/internal/observed"
+	"github.com/sqc157400661/kdb/pkg/metrics"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+// MajorUpgradeHooks are the engine specific parts of a major upgrade.
+type MajorUpgradeHooks struct {
+	// PreCheck returns an error when the server in pod cannot be upgraded to
+	// the version.
+	PreCheck func(rc *context.InstanceContext, pod *corev1.Pod, to string) error
+
+	// Backup starts or polls the backup taken before the upgrade. It returns
+	// the name of the backup and whether it completed.
+	Backup func(rc *context.InstanceContext) (name string, done bool, err error)
+
+	// Restore starts or polls the restore of the backup into the server in
+	// pod, which runs the previous version on an empty data directory. It
+	// returns whether the restore completed.
+	Restore func(rc *context.InstanceContext, pod *corev1.Pod) (done bool, err error)
+
+	// Finalize runs once the upgrade is finalized.
+	Finalize func(rc *context.InstanceContext) error
+}
+
+// startMajorUpgrade records the major upgrade in the status. The pods keep
+// the running version until the backup completed.
+func startMajorUpgrade(rc *context.InstanceContext, flow kube.Flow, hooks *MajorUpgradeHooks) (reconcile.Result, error) {
+	instance := rc.GetInstance()
+	running, desired := instance.Status.EngineFullVersion, instance.Spec.EngineFullVersion
+	if hooks == nil {
+		return rejectUpgrade(rc, flow, "UpgradeRejected",
+			errors.Errorf("major upgrades are not supported for engine %s", instance.Spec.Engine))
+	}
+	for _, v := range []string{running, desired} {
+		if _, err := versionImages(rc, v); err != nil {
+			return rejectUpgrade(rc, flow, "ImageNotFound", errors.WithMessagef(err, "resolve images of version %s", v))
+		}
+	}
+	if masterRunner(rc) == nil {
+		return flow.RetryAfter(rolloutPollInterval, "waiting for master to start major upgrade")
+	}
+
+	instance.Status.MajorUpgrade = &v1.MajorUpgradeStatus{
+		FromVersion: running,
+		ToVersion:   desired,
+		Phase:       v1.MajorUpgradePreCheck,
+		StartTime:   metav1.Now(),
+	}
+	rc.Recorder().Eventf(instance, corev1.EventTypeNormal, "MajorUpgrade",
+		"Started major upgrade from %s to %s", running, desired)
+	return majorUpgrade(rc, flow, hooks)
+}
+
+// majorUpgrade moves the major upgrade of the instance through its phases:
+//
+//  1. PreCheck checks that the master can be upgraded,
+//  2. Backup takes a backup of the instance with the running version,
+//  3. Upgrading lets RolloutInstance upgrade the replicas, switch the master
+//     role over to an upgraded replica and upgrade the previous master,
+//  4. AwaitingFinalize waits for the kdb.finalize-upgrade annotation.
+//
+// Setting the versions of the spec back before the upgrade is finalized rolls
+// it back by restoring the backup, see rollbackMajorUpgrade.
+func majorUpgrade(rc *context.InstanceContext, flow kube.Flow, hooks *MajorUpgradeHooks) (reconcile.Result, error) {
+	instance := rc.GetInstance()
+	upgrade := instance.Status.MajorUpgrade
+	if hooks == nil {
+		return rejectUpgrade(rc, flow, "UpgradeRejected",
+			errors.Errorf("major upgrades are not supported for engine %s", instance.Spec.Engine))
+	}
+
+	switch desired := instance.Spec.EngineFullVersion; {
+	case upgrade.Phase == v1.MajorUpgradeRollingBack && desired != upgrade.FromVersion:
+		return rejectUpgrade(rc, flow, "UpgradeRejected",
+			errors.Errorf("rollback of the major upgrade to %s is in progress, set the version to %s",
+				upgrade.ToVersion, upgrade.FromVersion))
+	case upgrade.Phase == v1.MajorUpgradeRollingBack:
+	case desired == upgrade.FromVersion &&
+		(upgrade.Phase == v1.MajorUpgradePreCheck || upgrade.Phase == v1.MajorUpgradeBackup):
+		instance.Status.MajorUpgrade = nil
+		rc.Recorder().Eventf(instance, corev1.EventTypeNormal, "MajorUpgrade",
+			"Canceled major upgrade to %s", upgrade.ToVersion)
+		setUpgrading(instance, metav1.ConditionFalse, "UpgradeCanceled",
+			fmt.Sprintf("Running version %s", upgrade.FromVersion))
+		return flow.Pass()
+	case desired == upgrade.FromVersion:
+		upgrade.Phase = v1.MajorUpgradeRollingBack
+		if master := masterRunner(rc); master != nil {
+			upgrade.RestoreSet = master.Name
+		} else if len(rc.GetObservedRunner().List) > 0 {
+			upgrade.RestoreSet = rc.GetObservedRunner().List[0].Name
+		}
+		rc.Recorder().Eventf(instance, corev1.EventTypeWarning, "MajorUpgrade",
+			"Rolling back major upgrade to %s by restoring backup %s, the data written since is kept "+
+				"next to the data directory of every pod", upgrade.ToVersion, upgrade.Backup)
+	case desired != upgrade.ToVersion:
+		return rejectUpgrade(rc, flow, "UpgradeRejected",
+			errors.Errorf("major upgrade from %s to %s is in progress, set the version to one of them",
+				upgrade.FromVersion, upgrade.ToVersion))
+	}
+
+	// Only the phases after the backup change the images of the pods.
+	images := upgrade.ToVersion
+	switch upgrade.Phase {
+	case v1.MajorUpgradePreCheck, v1.MajorUpgradeBackup, v1.MajorUpgradeRollingBack:
+		images = upgrade.FromVersion
+	}
+	spec, err := versionImages(rc, images)
+	if err != nil {
+		return rejectUpgrade(rc, flow, "ImageNotFound", errors.WithMessagef(err, "resolve images of version %s", images))
+	}
+	instance.Spec.InstanceSet = spec.InstanceSet
+	setUpgrading(instance, metav1.ConditionTrue, upgrade.Phase,
+		fmt.Sprintf("Major upgrade from %s to %s", upgrade.FromVersion, upgrade.ToVersion))
+
+	switch upgrade.Phase {
+	case v1.MajorUpgradePreCheck:
+		master := masterRunner(rc)
+		if master == nil || !util.IsPodReady(master.Pods[0]) {
+			return flow.RetryAfter(rolloutPollInterval, "waiting for master to be ready for pre-checks")
+		}
+		if err = hooks.PreCheck(rc, master.Pods[0], upgrade.ToVersion); err != nil {
+			return rejectUpgrade(rc, flow, "PreCheckFailed", err)
+		}
+		upgrade.Phase = v1.MajorUpgradeBackup
+		return flow.Retry("pre-checks passed")
+
+	case v1.MajorUpgradeBackup:
+		name, done, err := hooks.Backup(rc)
+		if err != nil {
+			metrics.RecordBackup(instance.Namespace, instance.Name, time.Now(), err)
+			return rejectUpgrade(rc, flow, "BackupFailed", err)
+		}
+		upgrade.Backup = name
+		if !done {
+			return flow.RetryAfter(rolloutPollInterval, "waiting for backup", "backup", name)
+		}
+		metrics.RecordBackup(instance.Namespace, instance.Name, time.Now(), nil)
+		rc.Recorder().Eventf(instance, corev1.EventTypeNormal, "MajorUpgrade",
+			"Backup %s completed, upgrading to %s", name, upgrade.ToVersion)
+		upgrade.Phase = v1.MajorUpgradeUpgrading
+		return flow.Pass()
+
+	case v1.MajorUpgradeUpgrading:
+		// RolloutInstance replaces the pods, the master last.
+		for _, item := range rc.GetObservedRunner().List {
+			if len(item.Pods) == 0 || !util.IsPodReady(item.Pods[0]) ||
+				podImage(item.Pods[0]) != spec.InstanceSet.MainContainer.Image {
+				return flow.Pass()
+			}
+		}
+		upgrade.Phase = v1.MajorUpgradeAwaitingFinalize
+		rc.Recorder().Eventf(instance, corev1.EventTypeNormal, "MajorUpgrade",
+			"Pods run %s, annotate the instance with %s=%s to finalize the upgrade, "+
+				"or set the version back to %s to restore backup %s",
+			upgrade.ToVersion, naming.FinalizeUpgrade, upgrade.ToVersion, upgrade.FromVersion, upgrade.Backup)
+		return flow.Pass()
+
+	case v1.MajorUpgradeAwaitingFinalize:
+		if instance.Annotations[naming.FinalizeUpgrade] != upgrade.ToVersion {
+			return flow.Pass()
+		}
+		if err = hooks.Finalize(rc); err != nil {
+			return flow.Error(err, "finalize major upgrade err")
+		}
+		instance.Status.MajorUpgrade = nil
+		rc.Recorder().Eventf(instance, corev1.EventTypeNormal, "MajorUpgrade",
+			"Finalized major upgrade to %s", upgrade.ToVersion)
+		return flow.Pass()
+
+	case v1.MajorUpgradeRollingBack:
+		return rollbackMajorUpgrade(rc, flow, hooks)
+	}
+	return flow.Pass()
+}
+
+// rollbackMajorUpgrade restores the backup taken before the upgrade with the
+// previous version. The data of the upgraded version cannot be read by the
+// previous one:
+//
+//  1. every pod is recreated with the previous version, its init container
+//     moves the upgraded data directory aside and the server starts empty,
+//  2. the pod of RestoreSet restores the backup,
+//  3. the other pods copy its data, see SeedStep.
+//
+// Nothing is deleted, the upgraded data directories stay on the volumes.
+func rollbackMajorUpgrade(rc *context.InstanceContext, flow kube.Flow, hooks *MajorUpgradeHooks) (reconcile.Result, error) {
+	instance := rc.GetInstance()
+	upgrade := instance.Status.MajorUpgrade
+	observed := rc.GetObservedRunner()
+
+	if !upgrade.Restored {
+		// The pods are replaced all at once, the instance serves the
+		// restored data only.
+		replaced := false
+		for _, item := range observed.List {
+			matches, known := item.PodMatchesPodTemplate()
+			if !known {
+				return flow.RetryAfter(rolloutPollInterval, "waiting for StatefulSet status", "set", item.Name)
+			}
+			if len(item.Pods) == 0 || matches || item.Pods[0].DeletionTimestamp != nil {
+				continue
+			}
+			pod := item.Pods[0]
+			uid := pod.GetUID()
+			err := errors.WithStack(client.IgnoreNotFound(rc.Client().Delete(rc.Context(), pod,
+				client.Preconditions{UID: &uid})))
+			if err != nil {
+				return flow.Error(err, "replace upgraded pod err", "pod", pod.Name)
+			}
+			replaced = true
+		}
+		if replaced {
+			return flow.RetryAfter(rolloutPollInterval, "replacing upgraded pods")
+		}
+		restore, ok := observed.BySet[upgrade.RestoreSet]
+		if !ok || len(restore.Pods) == 0 || !util.IsPodReady(restore.Pods[0]) {
+			return flow.RetryAfter(rolloutPollInterval, "waiting for pod to restore the backup",
+				"set", upgrade.RestoreSet)
+		}
+		done, err := hooks.Restore(rc, restore.Pods[0])
+		if err != nil {
+			rc.Recorder().Event(instance, corev1.EventTypeWarning, "RestoreFailed", err.Error())
+			return flow.Error(err, "restore backup err", "backup", upgrade.Backup)
+		}
+		if !done {
+			return flow.RetryAfter(rolloutPollInterval, "waiting for backup to be restored", "backup", upgrade.Backup)
+		}
+		upgrade.Restored = true
+		for _, item := range observed.List {
+			if item.Name == upgrade.RestoreSet || naming.ReplicaSeed(instance, item.Name) != nil {
+				continue
+			}
+			instance.Status.Seeding = append(instance.Status.Seeding, v1.ReplicaSeedStatus{
+				Set:    item.Name,
+				Method: naming.SeedMethod(instance),
+				Phase:  v1.SeedPending,
+			})
+		}
+		rc.Recorder().Eventf(instance, corev1.EventTypeNormal, "MajorUpgrade",
+			"Restored backup %s on pod %s", upgrade.Backup, restore.Pods[0].Name)
+	}
+
+	// SeedReplicas copies the restored data to the other pods.
+	if len(instance.Status.Seeding) > 0 {
+		return flow.Pass()
+	}
+	instance.Status.MajorUpgrade = nil
+	rc.Recorder().Eventf(instance, corev1.EventTypeNormal, "MajorUpgrade",
+		"Rolled back major upgrade to %s", upgrade.ToVersion)
+	setUpgrading(instance, metav1.ConditionFalse, "RolledBack",
+		fmt.Sprintf("Running version %s", upgrade.FromVersion))
+	return flow.Pass()
+}
+
+// versionImages returns a copy of the spec with the images of the version.
+// The images set in the spec explicitly are kept.
+func versionImages(rc *context.InstanceContext, fullVersion string) (*v1.KDBInstanceSpec, error) {
+	instance := rc.GetInstance()
+	spec := instance.Spec.DeepCopy()
+	spec.EngineFullVersion = fullVersion
+	managed := []string{instance.Spec.EngineFullVersion, instance.Status.EngineFullVersion}
+	if upgrade := instance.Status.MajorUpgrade; upgrade != nil {
+		managed = append(managed, upgrade.FromVersion, upgrade.ToVersion)
+	}
+	globalConfig := rc.GetGlobalConfig()
+	return spec, generate.ResolveImages(&globalConfig, spec, managed...)
+}
+
+// masterRunner returns the set of the master pod.
+func masterRunner(rc *context.InstanceContext) *observed.SingleRunner {
+	for _, item := range rc.GetObservedRunner().List {
+		if len(item.Pods) > 0 && naming.IsMasterPod(item.Pods[0]) {
+			return item
+		}
+	}
+	return nil
+}
+
+func podImage(pod *corev1.Pod) string {
+	for _, container := range pod.Spec.Containers {
+		if container.Name == naming.ContainerDatabase {
+			return container.Image
+		}
+	}
+	return ""
+}
@@ -0,0 +1,275 @@
+package steps
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/util"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/internal/config"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/internal/reconciletest"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+func TestMajorUpgrade(t *testing.T) {
+	t.Parallel()
+
+	const from, to = "5.7.40", "8.0.32"
+	globalConfig := &config.GlobalConfig{MySQLInstanceConfig: config.InstanceConfig{
+		VersionImagesMap: map[config.FullVersion]config.InstanceImage{
+			from: {Main: "mysql:" + from, Sidecar: "sidecar:5.7", Monitor: "exporter"},
+			to:   {Main: "mysql:" + to, Sidecar: "sidecar:8.0", Monitor: "exporter"},
+		},
+	}}
+	failed := errors.New("failed")
+
+	for _, tt := range []struct {
+		name     string
+		phase    string
+		desired  string
+		finalize bool
+		// unready tells whether the pods are not ready.
+		unready bool
+		// upgraded are the sets whose pods run the image of the new version.
+		upgraded  []int
+		precheck  error
+		backup    error
+		backedUp  bool
+		restored  bool
+		finalized error
+
+		result string
+		// next is the phase after the step, empty when the upgrade ended.
+		next   string
+		reason string
+		image  string
+	}{
+		{
+			name:    "PreCheckPasses",
+			phase:   v1.MajorUpgradePreCheck,
+			desired: to,
+			result:  "Retry",
+			next:    v1.MajorUpgradeBackup,
+			reason:  v1.MajorUpgradePreCheck,
+			image:   "mysql:" + from,
+		},
+		{
+			name:    "PreCheckWaitsForMaster",
+			phase:   v1.MajorUpgradePreCheck,
+			desired: to,
+			unready: true,
+			result:  "RetryAfter",
+			next:    v1.MajorUpgradePreCheck,
+			reason:  v1.MajorUpgradePreCheck,
+			image:   "mysql:" + from,
+		},
+		{
+			name:     "PreCheckFails",
+			phase:    v1.MajorUpgradePreCheck,
+			desired:  to,
+			precheck: failed,
+			result:   "Pass",
+			next:     v1.MajorUpgradePreCheck,
+			reason:   "PreCheckFailed",
+			image:    "mysql:" + from,
+		},
+		{
+			name:    "BackupRuns",
+			phase:   v1.MajorUpgradeBackup,
+			desired: to,
+			result:  "RetryAfter",
+			next:    v1.MajorUpgradeBackup,
+			reason:  v1.MajorUpgradeBackup,
+			image:   "mysql:" + from,
+		},
+		{
+			name:     "BackupCompletes",
+			phase:    v1.MajorUpgradeBackup,
+			desired:  to,
+			backedUp: true,
+			result:   "Pass",
+			next:     v1.MajorUpgradeUpgrading,
+			reason:   v1.MajorUpgradeBackup,
+			image:    "mysql:" + from,
+		},
+		{
+			name:    "BackupFails",
+			phase:   v1.MajorUpgradeBackup,
+			desired: to,
+			backup:  failed,
+			result:  "Pass",
+			next:    v1.MajorUpgradeBackup,
+			reason:  "BackupFailed",
+			image:   "mysql:" + from,
+		},
+		{
+			name:     "Upgrading",
+			phase:    v1.MajorUpgradeUpgrading,
+			desired:  to,
+			upgraded: []int{1, 2},
+			result:   "Pass",
+			next:     v1.MajorUpgradeUpgrading,
+			reason:   v1.MajorUpgradeUpgrading,
+			image:    "mysql:" + to,
+		},
+		{
+			name:     "Upgraded",
+			phase:    v1.MajorUpgradeUpgrading,
+			desired:  to,
+			upgraded: []int{0, 1, 2},
+			result:   "Pass",
+			next:     v1.MajorUpgradeAwaitingFinalize,
+			reason:   v1.MajorUpgradeUpgrading,
+			image:    "mysql:" + to,
+		},
+		{
+			name:    "AwaitsFinalize",
+			phase:   v1.MajorUpgradeAwaitingFinalize,
+			desired: to,
+			result:  "Pass",
+			next:    v1.MajorUpgradeAwaitingFinalize,
+			reason:  v1.MajorUpgradeAwaitingFinalize,
+			image:   "mysql:" + to,
+		},
+		{
+			name:     "Finalized",
+			phase:    v1.MajorUpgradeAwaitingFinalize,
+			desired:  to,
+			finalize: true,
+			result:   "Pass",
+			reason:   v1.MajorUpgradeAwaitingFinalize,
+			image:    "mysql:" + to,
+		},
+		{
+			name:      "FinalizeFails",
+			phase:     v1.MajorUpgradeAwaitingFinalize,
+			desired:   to,
+			finalize:  true,
+			finalized: failed,
+			result:    "Error",
+			next:      v1.MajorUpgradeAwaitingFinalize,
+			reason:    v1.MajorUpgradeAwaitingFinalize,
+			image:     "mysql:" + to,
+		},
+		{
+			name:    "CanceledBeforeBackup",
+			phase:   v1.MajorUpgradeBackup,
+			desired: from,
+			result:  "Pass",
+			reason:  "UpgradeCanceled",
+		},
+		{
+			name:    "OtherVersionRejected",
+			phase:   v1.MajorUpgradeUpgrading,
+			desired: "8.0.33",
+			result:  "Pass",
+			next:    v1.MajorUpgradeUpgrading,
+			reason:  "UpgradeRejected",
+		},
+		{
+			name:    "RollsBack",
+			phase:   v1.MajorUpgradeUpgrading,
+			desired: from,
+			result:  "RetryAfter",
+			next:    v1.MajorUpgradeRollingBack,
+			reason:  v1.MajorUpgradeRollingBack,
+			image:   "mysql:" + from,
+		},
+		{
+			name:     "RestoresBackup",
+			phase:    v1.MajorUpgradeRollingBack,
+			desired:  from,
+			restored: true,
+			result:   "Pass",
+			next:     v1.MajorUpgradeRollingBack,
+			reason:   v1.MajorUpgradeRollingBack,
+			image:    "mysql:" + from,
+		},
+		{
+			name:    "RollbackKeepsVersion",
+			phase:   v1.MajorUpgradeRollingBack,
+			desired: to,
+			result:  "Pass",
+			next:    v1.MajorUpgradeRollingBack,
+			reason:  "UpgradeRejected",
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			instance := &v1.KDBInstance{ObjectMeta: metav1.ObjectMeta{
+				Namespace: "ns", Name: "kdb", Annotations: map[string]string{},
+			}}
+			instance.Spec.Engine = naming.MySQLEngine
+			instance.Spec.EngineFullVersion = tt.desired
+			instance.Spec.InstanceSet.Replicas = util.Int32(3)
+			instance.Status.EngineFullVersion = from
+			instance.Status.MajorUpgrade = &v1.MajorUpgradeStatus{
+				FromVersion: from, ToVersion: to, Phase: tt.phase, Backup: "kdb-upgrade",
+			}
+			if tt.phase == v1.MajorUpgradeRollingBack {
+				instance.Status.MajorUpgrade.RestoreSet = "kdb0"
+			}
+			if tt.finalize {
+				instance.Annotations[naming.FinalizeUpgrade] = to
+			}
+			rc, _, _ := reconciletest.NewInstanceContext(t, instance)
+			rc.SetGlobalConfig(globalConfig)
+			observeSets(rc, !tt.unready, 0, 1, 2)
+			for i, item := range rc.GetObservedRunner().List {
+				image := "mysql:" + from
+				for _, upgraded := range tt.upgraded {
+					if upgraded == i {
+						image = "mysql:" + to
+					}
+				}
+				item.Pods[0].Spec.Containers = []corev1.Container{{Name: naming.ContainerDatabase, Image: image}}
+			}
+
+			var finalized int
+			hooks := &MajorUpgradeHooks{
+				PreCheck: func(rc *context.InstanceContext, pod *corev1.Pod, version string) error {
+					assert.Equal(t, pod.Name, "kdb0-0")
+					assert.Equal(t, version, to)
+					return tt.precheck
+				},
+				Backup: func(rc *context.InstanceContext) (string, bool, error) {
+					return "kdb-upgrade", tt.backedUp, tt.backup
+				},
+				Restore: func(rc *context.InstanceContext, pod *corev1.Pod) (bool, error) {
+					assert.Equal(t, pod.Name, "kdb0-0")
+					return tt.restored, nil
+				},
+				Finalize: func(rc *context.InstanceContext) error {
+					finalized++
+					return tt.finalized
+				},
+			}
+
+			flow := &reconciletest.Flow{}
+			_, err := majorUpgrade(rc, flow, hooks)
+			assert.Equal(t, err, tt.finalized)
+			assert.Equal(t, flow.Result, tt.result)
+			status := rc.GetInstance().Status
+			if tt.next == "" {
+				assert.Assert(t, status.MajorUpgrade == nil)
+			} else {
+				assert.Equal(t, status.MajorUpgrade.Phase, tt.next)
+			}
+			upgrading := meta.FindStatusCondition(status.Conditions, v1.KDBInstanceUpgrading)
+			assert.Equal(t, upgrading.Reason, tt.reason)
+			if tt.image != "" {
+				assert.Equal(t, rc.GetInstance().Spec.InstanceSet.MainContainer.Image, tt.image)
+			}
+			if tt.finalize && tt.phase == v1.MajorUpgradeAwaitingFinalize {
+				assert.Equal(t, finalized, 1)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package mysql
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/helper/kube"
+	"github.com/sqc157400661/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	kdbv1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/internal/config"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+	"github.com/sqc157400661/kdb/pkg/sidecar"
+)
+
+// ApplyInstanceConfig brings the running pods from the current to the update
+// config version. Dynamic parameters are set live on every pod, static ones
+// are loaded by restarting the pods one at a time, replicas first and the
+// master last. Pods created after the config changed, e.g. by a rollout of
+// new resources, have loaded it and are not restarted.
+func (s *InstanceStepManager) ApplyInstanceConfig() kube.BindFunc {
+	return s.StepBinder(
+		"ApplyInstanceConfig",
+		func(rc *context.InstanceContext, flow kube.Flow) (reconcile.Result, error) {
+			instance := rc.GetInstance()
+			desired := naming.UpdateConfigVersion(instance)
+			if desired == "" || naming.CurrentConfigVersion(instance) == desired {
+				return flow.Pass()
+			}
+			// A major upgrade restarts every pod with the new config.
+			if instance.Status.MajorUpgrade != nil {
+				return flow.Pass()
+			}
+			// The version sets parameters the servers do not know, it was
+			// tried once. SetInstanceConfig resets the condition for the next
+			// version.
+			if valid := meta.FindStatusCondition(instance.Status.Conditions, kdbv1.KDBInstanceConfigValid); valid != nil &&
+				valid.Status == metav1.ConditionFalse && valid.Reason == unknownParameterReason {
+				return flow.Pass()
+			}
+
+			pods := configPods(rc)
+			for _, pod := range pods {
+				if pod.DeletionTimestamp != nil || !util.IsPodReady(pod) {
+					return flow.RetryAfter(10*time.Second, "waiting for pods to be ready to apply config",
+						"pod", pod.Name)
+				}
+			}
+
+			// Apply the dynamic parameters and mark the pods to restart once
+			// per config version. The condition remembers the version.
+			message := fmt.Sprintf("Restarting pods to load config version %s", desired)
+			restarting := meta.FindStatusCondition(instance.Status.Conditions, kdbv1.KDBInstanceRestartRequired)
+			if restarting == nil || restarting.Status != metav1.ConditionTrue || restarting.Message != message {
+				cm := rc.GetInstanceConfigMap()
+				change := config.DiffMySQLConfig(
+					cm.Data[naming.AppliedDatabaseConfigKey], cm.Data[naming.DatabaseConfigKey])
+				static, unknown, err := applyDynamicConfig(rc, pods, change, desired)
+				if err != nil {
+					return flow.Error(err, "apply dynamic config err")
+				}
+				if len(unknown) > 0 {
+					// Restarting would not bring the pods back, keep them on
+					// their config until the spec is fixed.
+					message := fmt.Sprintf("Config version %s sets unknown parameters %v", desired, unknown)
+					meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+						Type:               kdbv1.KDBInstanceConfigValid,
+						Status:             metav1.ConditionFalse,
+						Reason:             unknownParameterReason,
+						Message:            message,
+						ObservedGeneration: instance.Generation,
+					})
+					rc.Recorder().Event(instance, corev1.EventTypeWarning, "InvalidConfig", message)
+					return flow.Pass()
+				}
+				var stale []*corev1.Pod
+				for _, pod := range pods {
+					if updated := instance.Status.ConfigUpdateTime; updated == nil ||
+						!pod.CreationTimestamp.After(updated.Time) {
+						stale = append(stale, pod)
+					}
+				}
+				if len(static) == 0 || len(stale) == 0 {
+					return finishInstanceConfig(rc, flow, desired)
+				}
+				for _, pod := range stale {
+					before := pod.DeepCopy()
+					pod.Annotations = naming.Merge(pod.Annotations,
+						map[string]string{naming.RestartForConfigVersion: desired})
+					if err = errors.WithStack(rc.Patch(pod, client.MergeFrom(before))); err != nil {
+						return flow.Error(err, "mark pod for restart err", "pod", pod.Name)
+					}
+				}
+				instance.Status.PendingRestart = static
+				meta.RemoveStatusCondition(&instance.Status.Conditions, kdbv1.KDBInstanceRestartRequired)
+				meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+					Type:               kdbv1.KDBInstanceRestartRequired,
+					Status:             metav1.ConditionTrue,
+					Reason:             "StaticParametersChanged",
+					Message:            message,
+					ObservedGeneration: instance.Generation,
+				})
+				rc.Recorder().Eventf(instance, corev1.EventTypeNormal, "RestartRequired",
+					"Restarting pods to change %v", static)
+			}
+
+			// Recreated pods carry no mark and have loaded the update version.
+			for _, pod := range pods {
+				if pod.Annotations[naming.RestartForConfigVersion] != desired {
+					continue
+				}
+				if naming.IsMasterPod(pod) && len(pods) > 1 {
+					if err := switchover(rc, pod, pods[:len(pods)-1]); err != nil {
+						rc.Recorder().Event(instance, corev1.EventTypeWarning, "SwitchoverFailed", err.Error())
+						return flow.Error(err, "switchover err", "pod", pod.Name)
+					}
+				}
+				uid := pod.GetUID()
+				err := errors.WithStack(client.IgnoreNotFound(rc.Client().Delete(rc.Context(), pod,
+					client.Preconditions{UID: &uid})))
+				if err != nil {
+					return flow.Error(err, "restart pod err", "pod", pod.Name)
+				}
+				return flow.RetryAfter(10*time.Second, "restarting pod to load config", "pod", pod.Name)
+			}
+			return finishInstanceConfig(rc, flow, desired)
+		})
+}
+
+// configPods returns the pods of the instance, the replicas before the master.
+func configPods(rc *context.InstanceContext) []*corev1.Pod {
+	var pods []*corev1.Pod
+	for _, runner := range rc.GetObservedRunner().List {
+		pods = append(pods, runner.Pods...)
+	}
+	sort.SliceStable(pods, func(i, j int) bool {
+		if naming.IsMasterPod(pods[i]) != naming.IsMasterPod(pods[j]) {
+			return !naming.IsMasterPod(pods[i])
+		}
+		return pods[i].Name < pods[j].Name
+	})
+	return pods
+}
+
+// unknownParameterReason is the reason of the ConfigValid condition of a
+// config setting parameters the servers do not know.
+const unknownParameterReason = "UnknownParameter"
+
+// applyDynamicConfig sets the dynamic parameters of change on every pod and
+// returns the parameters that need a restart, read only ones included, and
+// the parameters the servers do not know. The sidecars apply config version
+// themselves when their management API is enabled and report the parameters
+// that need a restart.
+func applyDynamicConfig(rc *context.InstanceContext, pods []*corev1.Pod,
+	change config.MySQLConfigChange, version string) (static, unknown []string, err error) {
+	// SET PERSIST keeps the value in mysqld-auto.cnf, which is read after
+	// my.cnf. Parameters removed from the config are reset so that my.cnf
+	// decides again after the restart.
+	persist, err := isMySQL8(rc.GetInstance())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	restart := sets.NewString(change.Static...)
+	restart.Insert(change.Removed...)
+	unknowns := sets.NewString()
+	names := make([]string, 0, len(change.Dynamic))
+	for name := range change.Dynamic {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, pod := range pods {
+		applied, err := withSidecar(rc, pod, func(client *sidecar.Client) error {
+			pending, err := client.ApplyConfig(rc.Context(), version)
+			restart.Insert(pending...)
+			return err
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if applied {
+			continue
+		}
+		for _, name := range names {
+			if restart.Has(name) || unknowns.Has(name) {
+				continue
+			}
+			statement := fmt.Sprintf("SET GLOBAL %s = %s", name, sqlValue(change.Dynamic[name]))
+			if persist {
+				statement = fmt.Sprintf("SET PERSIST %s = %s", name, sqlValue(change.Dynamic[name]))
+			}
+			_, err = execSQL(rc, pod, statement)
+			switch {
+			case isReadOnlyVariableErr(err):
+				restart.Insert(name)
+			case isUnknownVariableErr(err):
+				unknowns.Insert(name)
+			case err != nil:
+				return nil, nil, err
+			}
+		}
+		if !persist {
+			continue
+		}
+		for _, name := range change.Removed {
+			if _, err = execSQL(rc, pod, "RESET PERSIST IF EXISTS "+name); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return restart.List(), unknowns.List(), nil
+}
+
+// finishInstanceConfig records that the pods run the desired config version.
+func finishInstanceConfig(rc *context.InstanceContext, flow kube.Flow, desired string) (reconcile.Result, error) {
+	instance := rc.GetInstance()
+	if err := markConfigApplied(rc); err != nil {
+		return flow.Error(err, "apply err")
+	}
+	instance.Status.PendingRestart = nil
+	if meta.IsStatusConditionTrue(instance.Status.Conditions, kdbv1.KDBInstanceRestartRequired) {
+		meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+			Type:               kdbv1.KDBInstanceRestartRequired,
+			Status:             metav1.ConditionFalse,
+			Reason:             "Restarted",
+			Message:            fmt.Sprintf("Pods run config version %s", desired),
+			ObservedGeneration: instance.Generation,
+		})
+	}
+	return flow.Continue("config applied", "version", desired)
+}
@@ -0,0 +1,132 @@
+package mysql
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/go-version"
+	"github.com/sqc157400661/helper/kube"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+	"github.com/sqc157400661/kdb/pkg/reconcile/steps"
+)
+
+// RotateCredentials sets the rotated passwords with ALTER USER on the master,
+// the replicas apply them from the binary log. Since 8.0.14 the old password
+// is retained until it is discarded. Older servers only accept the new one,
+// the probes read it from the pending password files until the files of the
+// passwords are updated.
+// - https://dev.mysql.com/doc/refman/8.0/en/password-management.html#dual-passwords
+func (s *InstanceStepManager) RotateCredentials() kube.BindFunc {
+	return s.RotationStep(&steps.CredentialHooks{
+		SetPassword:         setPassword,
+		DiscardOldPasswords: discardOldPasswords,
+	})
+}
+
+// credentialUser returns the database user whose password is kept under key.
+func credentialUser(rc *context.InstanceContext, key string) string {
+	db := rc.GetGlobalConfig().DB
+	switch key {
+	case naming.RootPasswordSecretKey:
+		return db.RootUser
+	case naming.ReplPasswordSecretKey:
+		return db.ReplUser
+	case naming.MonitorPasswordSecretKey:
+		return naming.MonitorUser
+	case naming.BackupPasswordSecretKey:
+		return naming.BackupUser
+	}
+	return ""
+}
+
+// setPassword sets the password of the user of key for all its hosts. The
+// replicas connect to their source with the new replication password, the
+// pods that do not replicate are skipped.
+func setPassword(rc *context.InstanceContext, master *corev1.Pod, replicas []*corev1.Pod,
+	key, password string) error {
+	dual, err := supportsDualPasswords(rc, master)
+	if err != nil {
+		return err
+	}
+	retain := ""
+	if dual {
+		retain = " RETAIN CURRENT PASSWORD"
+	}
+	if err = alterUser(rc, master, credentialUser(rc, key),
+		"IDENTIFIED BY "+sqlString(password)+retain); err != nil {
+		return err
+	}
+	if key != naming.ReplPasswordSecretKey {
+		return nil
+	}
+	for _, pod := range replicas {
+		syntax, err := replicaSyntax(rc, pod)
+		if err != nil {
+			return err
+		}
+		status, err := execSQL(rc, pod, "SHOW "+syntax.replica+" STATUS")
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(status) == "" {
+			continue
+		}
+		change := "CHANGE MASTER TO MASTER_PASSWORD = " + sqlString(password)
+		if syntax.source {
+			change = "CHANGE REPLICATION SOURCE TO SOURCE_PASSWORD = " + sqlString(password)
+		}
+		if _, err = execSQL(rc, pod, fmt.Sprintf("STOP %[1]s IO_THREAD; %s; START %[1]s IO_THREAD",
+			syntax.replica, change)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discardOldPasswords discards the retained passwords of all users.
+func discardOldPasswords(rc *context.InstanceContext, master *corev1.Pod) error {
+	dual, err := supportsDualPasswords(rc, master)
+	if err != nil || !dual {
+		return err
+	}
+	for _, key := range naming.CredentialSecretKeys() {
+		if err = alterUser(rc, master, credentialUser(rc, key), "DISCARD OLD PASSWORD"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// alterUser runs ALTER USER with clause for every host of user.
+func alterUser(rc *context.InstanceContext, pod *corev1.Pod, user, clause string) error {
+	out, err := execSQL(rc, pod, "SELECT Host FROM mysql.user WHERE User = "+sqlString(user))
+	if err != nil {
+		return err
+	}
+	var statements []string
+	for _, host := range strings.Fields(out) {
+		statements = append(statements, fmt.Sprintf("ALTER USER %s@%s %s", sqlString(user), sqlString(host), clause))
+	}
+	if len(statements) == 0 {
+		return nil
+	}
+	_, err = execSQL(rc, pod, strings.Join(statements, "; "))
+	return err
+}
+
+// supportsDualPasswords reports whether the server in pod retains the current
+// password of a user, since 8.0.14.
+func supportsDualPasswords(rc *context.InstanceContext, pod *corev1.Pod) (bool, error) {
+	running, err := serverVersion(rc, pod)
+	if err != nil {
+		return false, err
+	}
+	v, err := version.NewVersion(running)
+	if err != nil {
+		return false, err
+	}
+	return v.GreaterThanOrEqual(version.Must(version.NewVersion("8.0.14"))), nil
+}
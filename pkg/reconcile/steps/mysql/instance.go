@@ -1,25 +1,32 @@
 package mysql
 
 import (
+	"strconv"
+
 	"github.com/hashicorp/go-version"
 	"github.com/pkg/errors"
 	"github.com/sqc157400661/helper/kube"
 	"github.com/sqc157400661/util"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
+	kdbv1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
 	"github.com/sqc157400661/kdb/internal/config"
 	"github.com/sqc157400661/kdb/internal/naming"
 	"github.com/sqc157400661/kdb/pkg/reconcile/context"
 	"github.com/sqc157400661/kdb/pkg/reconcile/steps"
+	"github.com/sqc157400661/kdb/pkg/sidecar"
 )
 
 type InstanceStepManager struct {
 	steps.InstanceStepManager
 }
 
-// SetInstanceConfig set mysql and sidecar config
-// TODO: processing parameters that require a restart to take effect
+// SetInstanceConfig set mysql and sidecar config. The hash of the rendered
+// my.cnf becomes the update config version of the instance.
 func (s *InstanceStepManager) SetInstanceConfig() kube.BindFunc {
 	return s.StepBinder(
 		"SetInstanceConfig",
@@ -33,47 +40,136 @@ func (s *InstanceStepManager) SetInstanceConfig() kube.BindFunc {
 			if err != nil {
 				return flow.Error(err, "Set Reference err")
 			}
-			instanceConfigMap.Annotations = instance.Annotations
 			instanceConfigMap.Labels = naming.Merge(instance.Labels,
 				map[string]string{
 					naming.LabelInstance: instance.Name,
 				})
-			globalConfig := rc.GetGlobalConfig()
-			// create config
+			v1, err := naming.ConfigEngineVersion(instance)
+			if err != nil {
+				return flow.Error(err, "get instance version err")
+			}
+			v2, _ := version.NewVersion("8.0")
+			tmpl := config.MySQL57ConfTmpl
+			if v1.GreaterThanOrEqual(v2) {
+				tmpl = config.MySQL8ConfTmpl
+			}
+			tuned := config.TuneMySQL(naming.InstanceSetSpec(instance).MainContainer.Resources)
+			existing := &corev1.ConfigMap{ObjectMeta: naming.InstanceConfigMap(instance)}
+			if err = errors.WithStack(client.IgnoreNotFound(rc.Get(existing))); err != nil {
+				return flow.Error(err, "get instance config map err")
+			}
+			cnf, err := config.RenderMySQLConfig(tmpl, tuned, tlsConfig(rc), instance.Spec.Config)
+			if err != nil {
+				// Keep the last valid config until the spec is fixed, the
+				// change of the spec triggers another reconcile. The other
+				// steps go on with the config map as it is.
+				meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+					Type:               kdbv1.KDBInstanceConfigValid,
+					Status:             metav1.ConditionFalse,
+					Reason:             "InvalidConfig",
+					Message:            err.Error(),
+					ObservedGeneration: instance.Generation,
+				})
+				rc.Recorder().Event(instance, corev1.EventTypeWarning, "InvalidConfig", err.Error())
+				// A new instance has no config yet, its pods cannot start.
+				if existing.Data[naming.DatabaseConfigKey] == "" {
+					return flow.Break("waiting for a valid config")
+				}
+				instanceConfigMap.Annotations = existing.Annotations
+				instanceConfigMap.Data = existing.Data
+				rc.SetInstanceConfigMap(instanceConfigMap)
+				return flow.Pass()
+			}
+			cnf = naming.YamlGeneratedWarning + cnf
+			// The config is not tuned for resources no node fits, it stays
+			// as it is until the spec is fixed, see steps.CheckResources.
+			if held := existing.Data[naming.DatabaseConfigKey]; held != "" && !steps.ResourcesFit(instance) {
+				cnf = held
+			}
+			configVersion := util.MD5Hash(cnf)
+			// ApplyInstanceConfig reports the parameters of the version the
+			// servers do not know.
+			if valid := meta.FindStatusCondition(instance.Status.Conditions, kdbv1.KDBInstanceConfigValid); valid == nil ||
+				valid.Reason != unknownParameterReason || naming.UpdateConfigVersion(instance) != configVersion {
+				meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+					Type:               kdbv1.KDBInstanceConfigValid,
+					Status:             metav1.ConditionTrue,
+					Reason:             "ConfigRendered",
+					ObservedGeneration: instance.Generation,
+				})
+			}
+
+			// The running pods keep the config they were started with until
+			// ApplyInstanceConfig brings them to the update version. Pods of a
+			// new instance start with the rendered config right away.
+			applied := existing.Data[naming.AppliedDatabaseConfigKey]
+			if applied == "" {
+				applied = existing.Data[naming.DatabaseConfigKey]
+			}
+			if applied == "" {
+				applied = cnf
+				instance.Annotations[naming.CurrentInstanceConfigVersion] = configVersion
+			}
+			if naming.UpdateConfigVersion(instance) != configVersion {
+				now := metav1.Now()
+				instance.Status.ConfigUpdateTime = &now
+			}
+			instance.Annotations[naming.UpdateInstanceConfigVersion] = configVersion
 			util.StringMap(&instanceConfigMap.Data)
+			instanceConfigMap.Data[naming.DatabaseConfigKey] = cnf
+			instanceConfigMap.Data[naming.AppliedDatabaseConfigKey] = applied
+
+			// The passwords stay in the credentials Secret, the sidecar reads
+			// them from the files of the config volume. Sidecars that predate
+			// the files still find the passwords in their config, until the
+			// instance runs a current sidecar image.
+			globalConfig := rc.GetGlobalConfig()
+			legacy := naming.IsLegacySidecar(instance)
+			legacyPassword := func(key string) string {
+				if !legacy {
+					return ""
+				}
+				return strconv.Quote(rc.GetCredential(key))
+			}
 			configStr, err := util.SafeTemplateFill(config.InstanceConfigTmpl, map[string]interface{}{
-				"RootUser":       globalConfig.DB.RootUser,
-				"RootPassword":   globalConfig.DB.RootPassword,
-				"ReplUser":       globalConfig.DB.ReplUser,
-				"ReplPassword":   globalConfig.DB.ReplPassword,
-				"CurrentVersion": naming.CurrentConfigVersion(instance),
-				"UpdateVersion":  naming.UpdateConfigVersion(instance),
-				"MasterPort":     naming.KDBInstanceMasterPort(instance),
-				"MasterHost":     naming.KDBInstanceMasterHost(instance),
-				"MasterPodName":  naming.KDBInstanceMasterPodName(instance),
+				"LegacyPasswords":    legacy,
+				"RootPassword":       legacyPassword(naming.RootPasswordSecretKey),
+				"ReplPassword":       legacyPassword(naming.ReplPasswordSecretKey),
+				"MonitorPassword":    legacyPassword(naming.MonitorPasswordSecretKey),
+				"BackupPassword":     legacyPassword(naming.BackupPasswordSecretKey),
+				"RootUser":           globalConfig.DB.RootUser,
+				"ReplUser":           globalConfig.DB.ReplUser,
+				"MonitorUser":        naming.MonitorUser,
+				"BackupUser":         naming.BackupUser,
+				"CredentialsPath":    naming.CredentialsPath,
+				"RootPasswordKey":    naming.RootPasswordSecretKey,
+				"ReplPasswordKey":    naming.ReplPasswordSecretKey,
+				"MonitorPasswordKey": naming.MonitorPasswordSecretKey,
+				"BackupPasswordKey":  naming.BackupPasswordSecretKey,
+				"CurrentVersion":     naming.CurrentConfigVersion(instance),
+				"UpdateVersion":      naming.UpdateConfigVersion(instance),
+				"MasterPort":         naming.KDBInstanceMasterPort(instance),
+				"MasterHost":         naming.KDBInstanceMasterHost(instance),
+				"MasterPodName":      naming.KDBInstanceMasterPodName(instance),
+				"TLS":                naming.IsTLSEnabled(instance),
+				"CACertFile":         naming.TLSPath + "/" + naming.CACertSecretKey,
+				"API":                steps.SidecarAPIEnabled(instance),
+				"APIVersion":         sidecar.Version,
+				"APIPort":            naming.SidecarPort,
+				"APITokenKey":        naming.SidecarTokenSecretKey,
+				"TLSCertFile":        naming.TLSPath + "/" + naming.TLSCertSecretKey,
+				"TLSKeyFile":         naming.TLSPath + "/" + naming.TLSKeySecretKey,
 			})
 			if err != nil {
 				return flow.Error(err, "get instance config err")
 			}
-			if err != nil {
-				return flow.Error(err, "conf create err")
-			}
 			instanceConfigMap.Data[naming.SidecarConfigKey] = naming.YamlGeneratedWarning + configStr
-			v1, err := naming.EngineVersion(instance)
-			if err != nil {
-				return flow.Error(err, "get instance version err")
-			}
-			v2, _ := version.NewVersion("8.0")
-			// TODO: 根据内存和cpu动态调整 tmpl配置的内容
-			if v1.GreaterThanOrEqual(v2) {
-				instanceConfigMap.Data[naming.DatabaseConfigKey] = naming.YamlGeneratedWarning + config.MySQL8ConfTmpl
-			} else {
-				instanceConfigMap.Data[naming.DatabaseConfigKey] = naming.YamlGeneratedWarning + config.MySQL57ConfTmpl
-			}
+			instanceConfigMap.Annotations = instance.Annotations
 			err = errors.WithStack(rc.Apply(instanceConfigMap))
 			if err != nil {
 				return flow.Error(err, "apply err")
 			}
+			instance.Status.ConfigHash = configVersion
 			rc.SetInstanceConfigMap(instanceConfigMap)
 			return flow.Pass()
 		})
@@ -0,0 +1,263 @@
+package mysql
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/helper/kube"
+	"github.com/sqc157400661/util"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/sqc157400661/kdb/internal/generate"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/internal/security"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+	"github.com/sqc157400661/kdb/pkg/reconcile/steps"
+)
+
+// upgradeCheckTimeout bounds the upgrade checker of MySQL Shell.
+const upgradeCheckTimeout = 5 * time.Minute
+
+// UpgradeInstance resolves the images of EngineFullVersion and upgrades the
+// major version with MySQL specific pre-checks, backup and restore.
+func (s *InstanceStepManager) UpgradeInstance() kube.BindFunc {
+	return s.UpgradeStep(&steps.MajorUpgradeHooks{
+		PreCheck: checkForServerUpgrade,
+		Backup:   backupBeforeUpgrade,
+		Restore:  restoreUpgradeBackup,
+		Finalize: markConfigApplied,
+	})
+}
+
+// upgradeCheckReport is the part of the JSON report of
+// util.checkForServerUpgrade the pre-check looks at.
+type upgradeCheckReport struct {
+	ErrorCount int `json:"errorCount"`
+	Checks     []struct {
+		ID       string `json:"id"`
+		Problems []struct {
+			Level       string `json:"level"`
+			DBObject    string `json:"dbObject"`
+			Description string `json:"description"`
+		} `json:"detectedProblems"`
+	} `json:"checksPerformed"`
+}
+
+// checkForServerUpgrade runs the upgrade checker of MySQL Shell against the
+// server in pod and fails when it reports errors.
+// - https://dev.mysql.com/doc/mysql-shell/8.0/en/mysql-shell-utilities-upgrade.html
+func checkForServerUpgrade(rc *context.InstanceContext, pod *corev1.Pod, to string) error {
+	target, err := version.NewVersion(to)
+	if err != nil {
+		return err
+	}
+	// mysqlsh reads the password from stdin instead of MYSQL_PWD.
+	out, err := execMySQLProgram(rc, pod, fmt.Sprintf("mysqlsh --passwords-from-stdin --js "+
+		`-e "util.checkForServerUpgrade(null, {targetVersion: '%s', outputFormat: 'JSON'})"`, target),
+		rc.GetCredential(naming.RootPasswordSecretKey)+"\n", upgradeCheckTimeout)
+	// The checker exits with an error when it finds errors, the report
+	// explains them.
+	var report upgradeCheckReport
+	if i := strings.Index(out, "{"); i < 0 || json.Unmarshal([]byte(out[i:]), &report) != nil {
+		if err != nil {
+			return err
+		}
+		return errors.Errorf("parse upgrade check report: %q", out)
+	}
+	if report.ErrorCount == 0 {
+		return nil
+	}
+	var problems []string
+	for _, check := range report.Checks {
+		for _, problem := range check.Problems {
+			if problem.Level == "Error" {
+				problems = append(problems, fmt.Sprintf("%s: %s %s", check.ID, problem.DBObject, problem.Description))
+			}
+		}
+	}
+	return errors.Errorf("upgrade check found %d errors: %s", report.ErrorCount, strings.Join(problems, "; "))
+}
+
+// backupBeforeUpgrade takes a logical backup of the instance with a job that
+// runs mysqldump of the running version against a replica, or the master when
+// there is none. It connects as the backup user, over TLS when the instance
+// serves it. The dump carries the GTIDs of the backup and is kept on a volume
+// of the instance until the instance is deleted.
+func backupBeforeUpgrade(rc *context.InstanceContext) (string, bool, error) {
+	instance := rc.GetInstance()
+	upgrade := instance.Status.MajorUpgrade
+	meta := naming.UpgradeBackup(instance, upgrade.ToVersion)
+
+	job := &batchv1.Job{ObjectMeta: meta}
+	err := errors.WithStack(rc.Get(job))
+	if err == nil {
+		for _, cond := range job.Status.Conditions {
+			if cond.Type == batchv1.JobFailed && cond.Status == corev1.ConditionTrue {
+				return job.Name, false, errors.Errorf("backup job %s failed: %s", job.Name, cond.Message)
+			}
+		}
+		return job.Name, job.Status.Succeeded > 0, nil
+	}
+	if !apierrors.IsNotFound(errors.Cause(err)) {
+		return meta.Name, false, err
+	}
+
+	var source *corev1.Pod
+	for _, pod := range configPods(rc) {
+		if pod.DeletionTimestamp == nil && util.IsPodReady(pod) && pod.Status.PodIP != "" {
+			source = pod
+			break
+		}
+	}
+	if source == nil {
+		return meta.Name, false, nil
+	}
+
+	labels := naming.Merge(instance.Labels, map[string]string{naming.LabelInstance: instance.Name})
+	dataSpec := naming.InstanceDataPvcSpec(instance)
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: meta}
+	pvc.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("PersistentVolumeClaim"))
+	pvc.Labels = labels
+	pvc.Spec = corev1.PersistentVolumeClaimSpec{
+		AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceStorage: dataSpec.Size},
+		},
+	}
+	if dataSpec.StorageClass != "" {
+		pvc.Spec.StorageClassName = &dataSpec.StorageClass
+	}
+	if err = errors.WithStack(rc.SetControllerReference(pvc)); err == nil {
+		err = errors.WithStack(rc.Apply(pvc))
+	}
+	if err != nil {
+		return meta.Name, false, err
+	}
+
+	from := instance.Spec.DeepCopy()
+	from.EngineFullVersion = upgrade.FromVersion
+	globalConfig := rc.GetGlobalConfig()
+	if err = generate.ResolveImages(&globalConfig, from, instance.Spec.EngineFullVersion,
+		upgrade.ToVersion); err != nil {
+		return meta.Name, false, err
+	}
+	sslMode := "PREFERRED"
+	if naming.IsTLSEnabled(instance) {
+		sslMode = "REQUIRED"
+	}
+	job.SetGroupVersionKind(batchv1.SchemeGroupVersion.WithKind("Job"))
+	job.Labels = labels
+	job.Spec = batchv1.JobSpec{
+		BackoffLimit: util.Int32(2),
+		Template: corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{Labels: labels},
+			Spec: corev1.PodSpec{
+				RestartPolicy:   corev1.RestartPolicyNever,
+				SecurityContext: security.PodSecurityContext(instance),
+				Containers: []corev1.Container{{
+					Name:  "backup",
+					Image: from.InstanceSet.MainContainer.Image,
+					Command: []string{"bash", "-ceu", "set -o pipefail; " +
+						`mysqldump --host="$MYSQL_HOST" --port="$MYSQL_PORT" --user="$MYSQL_USER" ` +
+						`--ssl-mode="$MYSQL_SSL_MODE" --set-gtid-purged=ON ` +
+						"--single-transaction --all-databases --routines --events --triggers " +
+						"| gzip > " + naming.UpgradeDumpPath},
+					Env: []corev1.EnvVar{
+						{Name: "MYSQL_HOST", Value: source.Status.PodIP},
+						{Name: "MYSQL_PORT", Value: fmt.Sprint(*instance.Spec.Port)},
+						{Name: "MYSQL_SSL_MODE", Value: sslMode},
+						{Name: "MYSQL_USER", Value: naming.BackupUser},
+						{Name: "MYSQL_PWD", ValueFrom: &corev1.EnvVarSource{
+							SecretKeyRef: &corev1.SecretKeySelector{
+								LocalObjectReference: corev1.LocalObjectReference{
+									Name: naming.InstanceCredentials(instance).Name,
+								},
+								Key: naming.BackupPasswordSecretKey,
+							},
+						}},
+					},
+					SecurityContext: security.ContainerSecurityContext(instance),
+					VolumeMounts:    []corev1.VolumeMount{{Name: "backup", MountPath: naming.BackupMountPath}},
+				}},
+				Volumes: []corev1.Volume{{
+					Name: "backup",
+					VolumeSource: corev1.VolumeSource{
+						PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: pvc.Name},
+					},
+				}},
+			},
+		},
+	}
+	if err = errors.WithStack(rc.SetControllerReference(job)); err == nil {
+		err = errors.WithStack(rc.Apply(job))
+	}
+	if err == nil {
+		rc.Recorder().Eventf(instance, corev1.EventTypeNormal, "MajorUpgrade",
+			"Started backup %s from pod %s", job.Name, source.Name)
+	}
+	return job.Name, false, err
+}
+
+// restoreScript loads the dump of the backup into the server in the
+// background and prints its state: "running", or "done" once RESTORE_MARKER
+// exists. The GTIDs of the empty server are reset, the dump sets the ones of
+// the backup. A failed load is printed on stderr and started again by the next
+// call.
+const restoreScript = `read -r MYSQL_PWD; export MYSQL_PWD
+user="$1" socket="$2" dump="$3" marker="$4" state=/tmp/kdb-restore
+[ -e "$marker" ] && { echo done; exit 0; }
+if [ -e "$state.failed" ]; then
+  cat "$state.failed" >&2
+  rm -f "$state.failed" "$state.running"
+  exit 1
+fi
+[ -e "$state.running" ] && { echo running; exit 0; }
+touch "$state.running"
+nohup bash -c '
+  { echo "SET GLOBAL super_read_only = OFF; RESET MASTER;"; gunzip -c "$3"; } |
+    mysql --user="$1" --socket="$2" 2>"$5.err" && touch "$4" || mv "$5.err" "$5.failed"
+  rm -f "$5.running" "$5.err"' - "$user" "$socket" "$dump" "$marker" "$state" >/dev/null 2>&1 &
+echo running
+`
+
+// restoreUpgradeBackup restores the dump of the backup taken before the major
+// upgrade into the server of pod, which mounts the volume of the backup. The
+// dump is loaded as the root user over the socket of the server.
+func restoreUpgradeBackup(rc *context.InstanceContext, pod *corev1.Pod) (bool, error) {
+	instance := rc.GetInstance()
+	var stdout, stderr bytes.Buffer
+	err := rc.PodExec(pod, naming.ContainerDatabase,
+		[]string{"bash", "-c", restoreScript, "-", rc.GetGlobalConfig().DB.RootUser, naming.MySQLSocketPath,
+			naming.UpgradeDumpPath, naming.RestoreMarkerPath(instance)},
+		kube.ExecOptions{
+			Stdin:   strings.NewReader(rc.GetCredential(naming.RootPasswordSecretKey) + "\n"),
+			Stdout:  &stdout,
+			Stderr:  &stderr,
+			Timeout: sqlTimeout,
+		})
+	if err != nil {
+		return false, errors.Wrapf(err, "restore backup in pod %s: %s", pod.Name, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()) == "done", nil
+}
+
+// markConfigApplied records that the pods run the database config, they were
+// all restarted by the major upgrade.
+func markConfigApplied(rc *context.InstanceContext) error {
+	instance := rc.GetInstance()
+	cm := rc.GetInstanceConfigMap()
+	cm.Data[naming.AppliedDatabaseConfigKey] = cm.Data[naming.DatabaseConfigKey]
+	if err := errors.WithStack(rc.Apply(cm)); err != nil {
+		return err
+	}
+	instance.Annotations[naming.CurrentInstanceConfigVersion] = naming.UpdateConfigVersion(instance)
+	return nil
+}
@@ -0,0 +1,119 @@
+package mysql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sqc157400661/helper/kube"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/sqc157400661/kdb/apis/shared"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+	"github.com/sqc157400661/kdb/pkg/reconcile/steps"
+	"github.com/sqc157400661/kdb/pkg/sidecar"
+)
+
+// ObserveReplication reads the state of the databases and of their
+// replication from the management API of the sidecars when it is enabled, and
+// with SQL otherwise.
+func (s *InstanceStepManager) ObserveReplication() kube.BindFunc {
+	return s.ReplicationStep(observeSidecarReplication)
+}
+
+// withSidecar calls call with a client of the management API of the sidecar of
+// pod. It reports false when the API is disabled or the sidecar does not serve
+// it, e.g. an older one, then the caller does the same with SQL.
+func withSidecar(rc *context.InstanceContext, pod *corev1.Pod, call func(client *sidecar.Client) error) (bool, error) {
+	if !steps.SidecarAPIEnabled(rc.GetInstance()) {
+		return false, nil
+	}
+	client, err := steps.SidecarClient(rc, pod)
+	if err != nil {
+		return false, err
+	}
+	err = call(client)
+	if sidecar.IsUnavailable(err) {
+		return false, nil
+	}
+	return true, err
+}
+
+// observeSidecarReplication fills info with the state the sidecar of pod
+// reports. A pod whose sidecar serves no API is observed with SQL.
+func observeSidecarReplication(rc *context.InstanceContext, pod *corev1.Pod, info *shared.PodStatusInfo) error {
+	done, err := withSidecar(rc, pod, func(client *sidecar.Client) error {
+		status, err := client.Replication(rc.Context())
+		if err == nil {
+			info.ReadOnly = &status.ReadOnly
+			info.GTIDExecuted = status.GTIDExecuted
+			info.Replication = status.Replication
+		}
+		return err
+	})
+	if done || err != nil {
+		return err
+	}
+	return observeReplication(rc, pod, info)
+}
+
+// observeReplication fills info with the read only flag, the executed GTIDs
+// and the replica status of the server in pod.
+func observeReplication(rc *context.InstanceContext, pod *corev1.Pod, info *shared.PodStatusInfo) error {
+	syntax, err := replicaSyntax(rc, pod)
+	if err != nil {
+		return err
+	}
+	globals, err := execSQL(rc, pod, "SELECT @@GLOBAL.read_only, @@GLOBAL.gtid_executed")
+	if err != nil {
+		return err
+	}
+	fields := strings.SplitN(strings.TrimSpace(globals), "\t", 2)
+	readOnly := fields[0] == "1"
+	info.ReadOnly = &readOnly
+	if len(fields) > 1 {
+		info.GTIDExecuted = strings.ReplaceAll(fields[1], "\\n", "")
+	}
+
+	status, err := execMySQLProgram(rc, pod, "mysql --vertical",
+		fmt.Sprintf("SHOW %s STATUS;\n", syntax.replica), sqlTimeout)
+	if err != nil {
+		return err
+	}
+	info.Replication = parseReplicaStatus(status)
+	return nil
+}
+
+// parseReplicaStatus returns the replication of the vertical output of SHOW
+// REPLICA STATUS, nil when the server does not replicate. Both the SLAVE and
+// the REPLICA names of the columns are understood.
+func parseReplicaStatus(output string) *shared.ReplicationStatus {
+	columns := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		name = strings.NewReplacer("Slave", "Replica", "Master", "Source").Replace(strings.TrimSpace(name))
+		if _, seen := columns[name]; !seen {
+			columns[name] = strings.TrimSpace(value)
+		}
+	}
+	host, ok := columns["Source_Host"]
+	if !ok {
+		return nil
+	}
+	repl := &shared.ReplicationStatus{
+		Source:    host + ":" + columns["Source_Port"],
+		IOThread:  columns["Replica_IO_Running"],
+		SQLThread: columns["Replica_SQL_Running"],
+		LastError: columns["Last_IO_Error"],
+	}
+	if repl.LastError == "" {
+		repl.LastError = columns["Last_SQL_Error"]
+	}
+	if lag, err := strconv.ParseInt(columns["Seconds_Behind_Source"], 10, 64); err == nil {
+		repl.SecondsBehindSource = &lag
+	}
+	return repl
+}
@@ -0,0 +1,261 @@
+package mysql
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	kdbv1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+	"github.com/sqc157400661/kdb/pkg/reconcile/steps"
+)
+
+// allPrivileges is how SHOW GRANTS reports ALL on a database or a table. On
+// *.* 8.0 lists the privileges one by one instead, so a desired ALL is granted
+// whenever it is not reported and never revokes anything.
+const allPrivileges = "ALL PRIVILEGES"
+
+// staticPrivileges are the static privileges a KDBUser may be granted. GRANT
+// OPTION and PROXY are not listed by SHOW GRANTS like the others, USAGE is no
+// privilege.
+// - https://dev.mysql.com/doc/refman/8.0/en/privileges-provided.html
+var staticPrivileges = sets.NewString(
+	allPrivileges, "ALTER", "ALTER ROUTINE", "CREATE", "CREATE ROLE", "CREATE ROUTINE",
+	"CREATE TABLESPACE", "CREATE TEMPORARY TABLES", "CREATE USER", "CREATE VIEW", "DELETE", "DROP",
+	"DROP ROLE", "EVENT", "EXECUTE", "FILE", "INDEX", "INSERT", "LOCK TABLES", "PROCESS", "REFERENCES",
+	"RELOAD", "REPLICATION CLIENT", "REPLICATION SLAVE", "SELECT", "SHOW DATABASES", "SHOW VIEW",
+	"SHUTDOWN", "SUPER", "TRIGGER", "UPDATE",
+)
+
+// dynamicPrivilege matches the names of the dynamic privileges of 8.0, e.g.
+// BACKUP_ADMIN.
+var dynamicPrivilege = regexp.MustCompile(`^[A-Z]+(_[A-Z]+)+$`)
+
+// UserHooks create the user of a KDBUser, keep its password and its grants in
+// sync with the spec and drop it.
+func UserHooks() *steps.SchemaHooks {
+	return &steps.SchemaHooks{Apply: applyUser, Drop: dropUser}
+}
+
+// DatabaseHooks create the database of a KDBDatabase, keep its character set
+// and collation in sync with the spec and drop it.
+func DatabaseHooks() *steps.SchemaHooks {
+	return &steps.SchemaHooks{Apply: applyDatabase, Drop: dropDatabase}
+}
+
+// userHost returns the host of user, any host when it is not set.
+func userHost(user *kdbv1.KDBUser) string {
+	if user.Spec.Host == "" {
+		return "%"
+	}
+	return user.Spec.Host
+}
+
+// account returns the account of user as a SQL literal.
+func account(user *kdbv1.KDBUser) string {
+	return sqlString(user.UserName()) + "@" + sqlString(userHost(user))
+}
+
+// reservedUsers returns the database users of the operator. A KDBUser never
+// changes or drops them.
+func reservedUsers(rc *context.SchemaContext) sets.String {
+	db := rc.GetGlobalConfig().DB
+	return sets.NewString(db.RootUser, db.ReplUser, naming.MonitorUser, naming.BackupUser)
+}
+
+// applyUser creates the user, sets its password when the password Secret
+// changed, and grants and revokes privileges until SHOW GRANTS matches the
+// spec.
+func applyUser(rc *context.SchemaContext) error {
+	user := rc.GetObject().(*kdbv1.KDBUser)
+	if reservedUsers(rc).Has(user.UserName()) {
+		return errors.Errorf("user %s is reserved for the operator", user.UserName())
+	}
+	desired, err := desiredGrants(user)
+	if err != nil {
+		return err
+	}
+	secret := &corev1.Secret{}
+	secret.Namespace, secret.Name = user.Namespace, user.Spec.PasswordSecret.Name
+	if err = errors.WithStack(rc.Get(secret)); err != nil {
+		return err
+	}
+	password, ok := secret.Data[user.Spec.PasswordSecret.Key]
+	if !ok || len(password) == 0 {
+		return errors.Errorf("secret %s has no key %q", secret.Name, user.Spec.PasswordSecret.Key)
+	}
+
+	out, err := execSchemaSQL(rc, fmt.Sprintf("SELECT COUNT(*) FROM mysql.user WHERE User = %s AND Host = %s",
+		sqlString(user.UserName()), sqlString(userHost(user))))
+	if err != nil {
+		return err
+	}
+	switch {
+	case strings.TrimSpace(out) == "0":
+		_, err = execSchemaSQL(rc, "CREATE USER "+account(user)+" IDENTIFIED BY "+sqlString(string(password)))
+	case user.Status.PasswordVersion != secret.ResourceVersion:
+		_, err = execSchemaSQL(rc, "ALTER USER "+account(user)+" IDENTIFIED BY "+sqlString(string(password)))
+	}
+	if err != nil {
+		return err
+	}
+	user.Status.PasswordVersion = secret.ResourceVersion
+
+	out, err = execSchemaSQL(rc, "SHOW GRANTS FOR "+account(user))
+	if err != nil {
+		return err
+	}
+	statements := grantStatements(account(user), parseGrants(out), desired)
+	if len(statements) == 0 {
+		return nil
+	}
+	_, err = execSchemaSQL(rc, strings.Join(statements, "; "))
+	return err
+}
+
+// grantStatements returns the statements that take the privileges of account
+// from current to desired, both by object. The revokes run first, a REVOKE ALL
+// PRIVILEGES would take back the privileges granted before it.
+func grantStatements(account string, current, desired map[string]sets.String) []string {
+	var revokes, grants []string
+	for _, object := range sets.StringKeySet(current).Union(sets.StringKeySet(desired)).List() {
+		have, want := current[object], desired[object]
+		if have == nil {
+			have = sets.NewString()
+		}
+		if want == nil {
+			want = sets.NewString()
+		}
+		if want.Has(allPrivileges) {
+			if !have.Has(allPrivileges) {
+				grants = append(grants, fmt.Sprintf("GRANT %s ON %s TO %s", allPrivileges, object, account))
+			}
+			continue
+		}
+		if grant := want.Difference(have); grant.Len() > 0 {
+			grants = append(grants, fmt.Sprintf("GRANT %s ON %s TO %s",
+				strings.Join(grant.List(), ", "), object, account))
+		}
+		if revoke := have.Difference(want); revoke.Len() > 0 {
+			revokes = append(revokes, fmt.Sprintf("REVOKE %s ON %s FROM %s",
+				strings.Join(revoke.List(), ", "), object, account))
+		}
+	}
+	return append(revokes, grants...)
+}
+
+// desiredGrants returns the privileges of the spec of user by object. A
+// privilege that is not allowed is an error, it is never sent to the server.
+func desiredGrants(user *kdbv1.KDBUser) (map[string]sets.String, error) {
+	desired := map[string]sets.String{}
+	for _, grant := range user.Spec.Grants {
+		object := grantObject(grant.Database, grant.Table)
+		if desired[object] == nil {
+			desired[object] = sets.NewString()
+		}
+		for _, privilege := range grant.Privileges {
+			privilege = strings.ToUpper(strings.TrimSpace(privilege))
+			if privilege == "ALL" {
+				privilege = allPrivileges
+			}
+			if !staticPrivileges.Has(privilege) && !dynamicPrivilege.MatchString(privilege) {
+				return nil, errors.Errorf("privilege %q is not allowed", privilege)
+			}
+			desired[object].Insert(privilege)
+		}
+	}
+	return desired, nil
+}
+
+// dropUser drops the user, the users of the operator are kept.
+func dropUser(rc *context.SchemaContext) error {
+	user := rc.GetObject().(*kdbv1.KDBUser)
+	if reservedUsers(rc).Has(user.UserName()) {
+		return nil
+	}
+	_, err := execSchemaSQL(rc, "DROP USER IF EXISTS "+account(user))
+	return err
+}
+
+var sqlIdentifierName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// applyDatabase creates the database and sets its character set and
+// collation.
+func applyDatabase(rc *context.SchemaContext) error {
+	database := rc.GetObject().(*kdbv1.KDBDatabase)
+	var options string
+	for _, option := range []struct{ keyword, value string }{
+		{"CHARACTER SET", database.Spec.CharacterSet},
+		{"COLLATE", database.Spec.Collation},
+	} {
+		if option.value == "" {
+			continue
+		}
+		if !sqlIdentifierName.MatchString(option.value) {
+			return errors.Errorf("invalid %s %q", strings.ToLower(option.keyword), option.value)
+		}
+		options += " " + option.keyword + " " + option.value
+	}
+	name := quoteIdentifier(database.DatabaseName())
+	statements := "CREATE DATABASE IF NOT EXISTS " + name + options
+	if options != "" {
+		statements += "; ALTER DATABASE " + name + options
+	}
+	_, err := execSchemaSQL(rc, statements)
+	return err
+}
+
+func dropDatabase(rc *context.SchemaContext) error {
+	database := rc.GetObject().(*kdbv1.KDBDatabase)
+	_, err := execSchemaSQL(rc, "DROP DATABASE IF EXISTS "+quoteIdentifier(database.DatabaseName()))
+	return err
+}
+
+// quoteIdentifier returns name as a quoted SQL identifier.
+func quoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// grantObject returns the object of a grant the way SHOW GRANTS prints it,
+// e.g. `app`.* or *.*.
+func grantObject(database, table string) string {
+	object := func(name string) string {
+		if name == "" || name == "*" {
+			return "*"
+		}
+		return quoteIdentifier(name)
+	}
+	return object(database) + "." + object(table)
+}
+
+var showGrantsLine = regexp.MustCompile(`^GRANT (.+) ON (\S+) TO `)
+
+// parseGrants returns the privileges of the output of SHOW GRANTS by object.
+// USAGE only means that the account exists and is left out, so are grants of
+// roles and proxies.
+func parseGrants(out string) map[string]sets.String {
+	grants := map[string]sets.String{}
+	for _, line := range strings.Split(out, "\n") {
+		m := showGrantsLine.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil || strings.HasPrefix(m[1], "PROXY") {
+			continue
+		}
+		object := strings.ReplaceAll(m[2], "'", "`")
+		for _, privilege := range strings.Split(m[1], ",") {
+			privilege = strings.TrimSpace(privilege)
+			if privilege == "" || privilege == "USAGE" {
+				continue
+			}
+			if grants[object] == nil {
+				grants[object] = sets.NewString()
+			}
+			grants[object].Insert(privilege)
+		}
+	}
+	return grants
+}
@@ -0,0 +1,146 @@
+package mysql
+
+import (
+	"testing"
+
+	"github.com/sqc157400661/helper/kube"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	kdbv1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/internal/config"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/internal/reconciletest"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+// newTestUserContext returns the context of a reconcile of user on the master
+// kdb0-0.
+func newTestUserContext(t *testing.T, user *kdbv1.KDBUser) *context.SchemaContext {
+	t.Helper()
+	base, helper, _ := reconciletest.NewReconcileContext(t, user)
+	helper.Exec = func(pod *corev1.Pod, container string, command []string, opts kube.ExecOptions) error {
+		t.Errorf("unexpected exec in %s: %v", pod.Name, command)
+		return nil
+	}
+	rc := context.NewSchemaContext(base)
+	_, err := rc.InitObject(&kdbv1.KDBUser{})
+	assert.NilError(t, err)
+	rc.SetGlobalConfig(&config.GlobalConfig{DB: config.DBConfig{RootUser: "root", ReplUser: "repl"}})
+	rc.SetTarget(&kdbv1.KDBInstance{}, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "kdb0-0"}}, nil)
+	return rc
+}
+
+func TestParseGrants(t *testing.T) {
+	t.Parallel()
+
+	grants := parseGrants(`GRANT USAGE ON *.* TO ` + "`app`@`%`" + `
+GRANT SELECT, INSERT, UPDATE ON ` + "`app`.* TO `app`@`%`" + `
+GRANT ALL PRIVILEGES ON ` + "`logs`.`events` TO `app`@`%` WITH GRANT OPTION" + `
+GRANT BACKUP_ADMIN,REPLICATION_SLAVE_ADMIN ON *.* TO ` + "`app`@`%`" + `
+GRANT PROXY ON ''@'' TO 'app'@'%'
+GRANT ` + "`reader`@`%` TO `app`@`%`" + `
+`)
+	assert.DeepEqual(t, grants, map[string]sets.String{
+		"`app`.*":         sets.NewString("SELECT", "INSERT", "UPDATE"),
+		"`logs`.`events`": sets.NewString("ALL PRIVILEGES"),
+		"*.*":             sets.NewString("BACKUP_ADMIN", "REPLICATION_SLAVE_ADMIN"),
+	})
+	assert.Equal(t, len(parseGrants("")), 0)
+}
+
+func TestDesiredGrants(t *testing.T) {
+	t.Parallel()
+
+	user := func(privileges ...string) *kdbv1.KDBUser {
+		user := &kdbv1.KDBUser{}
+		user.Spec.Grants = []kdbv1.Grant{{Privileges: privileges, Database: "app", Table: "*"}}
+		return user
+	}
+
+	t.Run("Allowed", func(t *testing.T) {
+		grants, err := desiredGrants(user(" select", "Insert", "all", "lock tables", "BACKUP_ADMIN"))
+		assert.NilError(t, err)
+		assert.DeepEqual(t, grants, map[string]sets.String{
+			"`app`.*": sets.NewString("SELECT", "INSERT", "ALL PRIVILEGES", "LOCK TABLES", "BACKUP_ADMIN"),
+		})
+	})
+
+	for _, privilege := range []string{
+		"SELECT ON *.* TO `root`@`%`; DROP DATABASE app; --",
+		"SELECT, SUPER",
+		"GRANT OPTION",
+		"PROXY",
+		"USAGE",
+		"_ADMIN",
+		"",
+	} {
+		privilege := privilege
+		t.Run("Rejects "+privilege, func(t *testing.T) {
+			_, err := desiredGrants(user("SELECT", privilege))
+			assert.ErrorContains(t, err, "is not allowed")
+		})
+	}
+}
+
+func TestGrantStatements(t *testing.T) {
+	t.Parallel()
+
+	const account = "'app'@'%'"
+	for _, tt := range []struct {
+		name             string
+		current, desired map[string]sets.String
+		expected         []string
+	}{{
+		name:    "Unchanged",
+		current: map[string]sets.String{"`app`.*": sets.NewString("SELECT")},
+		desired: map[string]sets.String{"`app`.*": sets.NewString("SELECT")},
+	}, {
+		name:     "AllToSelect",
+		current:  map[string]sets.String{"`app`.*": sets.NewString("ALL PRIVILEGES")},
+		desired:  map[string]sets.String{"`app`.*": sets.NewString("SELECT")},
+		expected: []string{"REVOKE ALL PRIVILEGES ON `app`.* FROM " + account, "GRANT SELECT ON `app`.* TO " + account},
+	}, {
+		name:     "SelectToAll",
+		current:  map[string]sets.String{"`app`.*": sets.NewString("SELECT")},
+		desired:  map[string]sets.String{"`app`.*": sets.NewString("ALL PRIVILEGES")},
+		expected: []string{"GRANT ALL PRIVILEGES ON `app`.* TO " + account},
+	}, {
+		name: "RevokesFirst",
+		current: map[string]sets.String{
+			"`app`.*":  sets.NewString("SELECT", "INSERT"),
+			"`logs`.*": sets.NewString("SELECT"),
+		},
+		desired: map[string]sets.String{
+			"`app`.*":  sets.NewString("SELECT", "UPDATE"),
+			"`logs`.*": sets.NewString("INSERT", "SELECT"),
+		},
+		expected: []string{
+			"REVOKE INSERT ON `app`.* FROM " + account,
+			"GRANT UPDATE ON `app`.* TO " + account,
+			"GRANT INSERT ON `logs`.* TO " + account,
+		},
+	}} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			assert.DeepEqual(t, grantStatements(account, tt.current, tt.desired), tt.expected)
+		})
+	}
+}
+
+func TestReservedUsers(t *testing.T) {
+	t.Parallel()
+
+	for _, name := range []string{"root", "repl", naming.MonitorUser, naming.BackupUser} {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			user := &kdbv1.KDBUser{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "user"}}
+			user.Spec.Name = name
+			rc := newTestUserContext(t, user)
+			assert.ErrorContains(t, applyUser(rc), "reserved for the operator")
+			assert.NilError(t, dropUser(rc))
+		})
+	}
+}
@@ -0,0 +1,437 @@
+package mysql
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/helper/kube"
+	"github.com/sqc157400661/util"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kdbv1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/internal/security"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+	"github.com/sqc157400661/kdb/pkg/reconcile/steps"
+)
+
+// cloneStartTimeout bounds the time a started clone takes to show up in the
+// clone status of the replica.
+const cloneStartTimeout = 2 * time.Minute
+
+// SeedReplicas copies the data of a donor to the new replicas with the CLONE
+// plugin or with xtrabackup, then starts their replication.
+func (s *InstanceStepManager) SeedReplicas() kube.BindFunc {
+	return s.SeedStep(&steps.SeedHooks{
+		Start:     startSeed,
+		Progress:  seedProgress,
+		Replicate: replicateSeed,
+	})
+}
+
+// backupPrivileges are the privileges of the backup user to copy the data of
+// a donor with xtrabackup. CLONE and xtrabackup of 8.0 need BACKUP_ADMIN in
+// addition.
+// - https://dev.mysql.com/doc/refman/8.0/en/clone-plugin-remote.html
+// - https://docs.percona.com/percona-xtrabackup/8.0/privileges.html
+const backupPrivileges = "SELECT, RELOAD, LOCK TABLES, PROCESS, REPLICATION CLIENT"
+
+func startSeed(rc *context.InstanceContext, seed *kdbv1.ReplicaSeedStatus, donor, recipient *corev1.Pod) (bool, error) {
+	if err := ensureBackupAccount(rc); err != nil {
+		return false, err
+	}
+	if seed.Method == kdbv1.SeedMethodXtrabackup {
+		return startXtrabackup(rc, seed, donor, recipient)
+	}
+	return startClone(rc, donor, recipient)
+}
+
+func seedProgress(rc *context.InstanceContext, seed *kdbv1.ReplicaSeedStatus, donor, recipient *corev1.Pod) (bool, error) {
+	if seed.Method == kdbv1.SeedMethodXtrabackup {
+		return xtrabackupProgress(rc, seed, recipient)
+	}
+	return cloneProgress(rc, seed, recipient)
+}
+
+// replicateSeed starts the replication of recipient from host and port. A
+// replica seeded with xtrabackup first takes the GTIDs of its backup. The
+// replica is read only afterwards.
+func replicateSeed(rc *context.InstanceContext, seed *kdbv1.ReplicaSeedStatus, recipient *corev1.Pod,
+	host string, port int32) error {
+	syntax, err := replicaSyntax(rc, recipient)
+	if err != nil {
+		return err
+	}
+	started, err := execSQL(rc, recipient,
+		"SELECT COUNT(*) FROM performance_schema.replication_connection_status WHERE SERVICE_STATE <> 'OFF'")
+	if err != nil {
+		return err
+	}
+	// The replication was started by a former attempt, resetting the GTIDs
+	// would apply its transactions again. A clone of a replica carries the
+	// stopped replication of its donor, it is configured again.
+	if strings.TrimSpace(started) == "0" {
+		statements := []string{"STOP " + syntax.replica}
+		if seed.Method == kdbv1.SeedMethodXtrabackup {
+			gtids, err := backupGTIDs(rc, recipient)
+			if err != nil {
+				return err
+			}
+			statements = append(statements, "SET GLOBAL super_read_only = OFF", "RESET MASTER",
+				"SET GLOBAL gtid_purged = "+sqlString(gtids))
+		}
+		statements = append(statements, changeSource(rc, syntax, host, port), "START "+syntax.replica)
+		if _, err = execSQL(rc, recipient, strings.Join(statements, "; ")); err != nil {
+			return err
+		}
+	}
+	_, err = execSQL(rc, recipient, "SET GLOBAL super_read_only = ON")
+	return err
+}
+
+// ensureBackupAccount creates the account of the backup user the donors are
+// copied with over the network on the master, the replicas apply it from the
+// binary log. The sidecar creates the backup user for local connections only.
+// The account has the password of the backup user and is rotated with it.
+func ensureBackupAccount(rc *context.InstanceContext) error {
+	var master *corev1.Pod
+	for _, runner := range rc.GetObservedRunner().List {
+		for _, pod := range runner.Pods {
+			if naming.IsMasterPod(pod) && pod.DeletionTimestamp == nil {
+				master = pod
+			}
+		}
+	}
+	if master == nil {
+		return errors.New("no master to create the backup user on")
+	}
+	running, err := serverVersion(rc, master)
+	if err != nil {
+		return err
+	}
+	v, err := version.NewVersion(running)
+	if err != nil {
+		return err
+	}
+	privileges := backupPrivileges
+	if v.GreaterThanOrEqual(version.Must(version.NewVersion("8.0"))) {
+		privileges += ", BACKUP_ADMIN"
+	}
+	account := sqlString(naming.BackupUser) + "@" + sqlString("%")
+	_, err = execSQL(rc, master, fmt.Sprintf("CREATE USER IF NOT EXISTS %s IDENTIFIED BY %s; GRANT %s ON *.* TO %s",
+		account, sqlString(rc.GetCredential(naming.BackupPasswordSecretKey)), privileges, account))
+	return err
+}
+
+// startClone starts cloning donor into recipient once the database of
+// recipient runs. The CLONE statement runs in the background in the database
+// container of recipient, it restarts the server when it is done.
+func startClone(rc *context.InstanceContext, donor, recipient *corev1.Pod) (bool, error) {
+	if _, err := execSQL(rc, recipient, "SELECT 1"); err != nil {
+		return false, nil
+	}
+	for _, pod := range []*corev1.Pod{donor, recipient} {
+		if err := installClonePlugin(rc, pod); err != nil {
+			return false, err
+		}
+	}
+	instance := rc.GetInstance()
+	rootUser := rc.GetGlobalConfig().DB.RootUser
+	rootPassword := rc.GetCredential(naming.RootPasswordSecretKey)
+	backupPassword := rc.GetCredential(naming.BackupPasswordSecretKey)
+	address := fmt.Sprintf("%s:%d", donor.Status.PodIP, *instance.Spec.Port)
+	if _, err := execSQL(rc, recipient, "SET GLOBAL clone_valid_donor_list = "+sqlString(address)); err != nil {
+		return false, err
+	}
+
+	ssl := "REQUIRE NO SSL"
+	if naming.IsTLSEnabled(instance) {
+		ssl = "REQUIRE SSL"
+	}
+	// The donor is read by the backup user, the root user only runs the
+	// statement on the local socket.
+	clone := fmt.Sprintf("CLONE INSTANCE FROM %s@%s:%d IDENTIFIED BY %s %s;\n",
+		sqlString(naming.BackupUser), sqlString(donor.Status.PodIP), *instance.Spec.Port, sqlString(backupPassword), ssl)
+	// The passwords are read from stdin, the statement is handed over in a
+	// here-string so that neither shows up in the process list.
+	script := `read -r MYSQL_PWD; export MYSQL_PWD; statement=$(cat); ` +
+		`nohup mysql --user="$1" --socket="$2" <<<"$statement" >/dev/null 2>&1 &`
+	var stderr bytes.Buffer
+	err := rc.PodExec(recipient, naming.ContainerDatabase,
+		[]string{"bash", "-c", script, "-", rootUser, naming.MySQLSocketPath},
+		kube.ExecOptions{
+			Stdin:   strings.NewReader(rootPassword + "\n" + clone),
+			Stderr:  &stderr,
+			Timeout: sqlTimeout,
+		})
+	if err != nil {
+		return false, errors.Wrapf(err, "start clone in pod %s: %s", recipient.Name, strings.TrimSpace(stderr.String()))
+	}
+	return true, nil
+}
+
+// cloneProgress reads the clone status of recipient. The server of recipient
+// restarts at the end of the clone, it does not answer meanwhile.
+func cloneProgress(rc *context.InstanceContext, seed *kdbv1.ReplicaSeedStatus, recipient *corev1.Pod) (bool, error) {
+	status, err := execSQL(rc, recipient,
+		"SELECT STATE, IFNULL(ERROR_MESSAGE, '') FROM performance_schema.clone_status")
+	if err != nil {
+		return false, nil
+	}
+	fields := strings.SplitN(strings.TrimSpace(status), "\t", 2)
+	switch fields[0] {
+	case "":
+		if seed.StartTime != nil && time.Since(seed.StartTime.Time) > cloneStartTimeout {
+			return false, errors.Errorf("clone did not start in %s", cloneStartTimeout)
+		}
+		return false, nil
+	case "Completed":
+		return true, nil
+	case "Failed":
+		message := ""
+		if len(fields) > 1 {
+			message = fields[1]
+		}
+		return false, errors.Errorf("clone failed: %s", message)
+	}
+
+	progress, err := execSQL(rc, recipient,
+		"SELECT IFNULL(SUM(DATA), 0), IFNULL(SUM(ESTIMATE), 0) FROM performance_schema.clone_progress")
+	if err != nil {
+		return false, nil
+	}
+	if fields := strings.Fields(progress); len(fields) == 2 {
+		data, _ := strconv.ParseInt(fields[0], 10, 64)
+		estimate, _ := strconv.ParseInt(fields[1], 10, 64)
+		if estimate > 0 && data <= estimate {
+			seed.Progress = int32(data * 100 / estimate)
+		}
+	}
+	return false, nil
+}
+
+// installClonePlugin installs the CLONE plugin in the server of pod. The
+// installation is not written to the binary log, and a read only replica is
+// writable during the installation only.
+func installClonePlugin(rc *context.InstanceContext, pod *corev1.Pod) error {
+	status, err := execSQL(rc, pod, "SELECT PLUGIN_STATUS FROM information_schema.PLUGINS WHERE PLUGIN_NAME = 'clone'")
+	if err != nil || strings.TrimSpace(status) == "ACTIVE" {
+		return err
+	}
+	readOnly, err := execSQL(rc, pod, "SELECT @@GLOBAL.super_read_only")
+	if err != nil {
+		return err
+	}
+	install := "SET SESSION sql_log_bin = 0; INSTALL PLUGIN clone SONAME 'mysql_clone.so'"
+	if strings.TrimSpace(readOnly) != "1" {
+		_, err = execSQL(rc, pod, install)
+		return err
+	}
+	_, err = execSQL(rc, pod, "SET GLOBAL super_read_only = OFF; "+install)
+	if _, restoreErr := execSQL(rc, pod, "SET GLOBAL super_read_only = ON"); err == nil {
+		err = restoreErr
+	}
+	return err
+}
+
+// startXtrabackup starts the job streaming a backup of donor to recipient once
+// the seed container of recipient listens. The job runs on the node of donor
+// and reads its data volumes.
+func startXtrabackup(rc *context.InstanceContext, seed *kdbv1.ReplicaSeedStatus, donor, recipient *corev1.Pod) (bool, error) {
+	if !isInitContainerRunning(recipient, naming.ContainerSeed) || recipient.Status.PodIP == "" {
+		return false, nil
+	}
+	instance := rc.GetInstance()
+	job := &batchv1.Job{ObjectMeta: naming.SeedJob(instance, seed.Set)}
+	err := errors.WithStack(rc.Get(job))
+	if err == nil {
+		return true, nil
+	}
+	if !apierrors.IsNotFound(errors.Cause(err)) {
+		return false, err
+	}
+
+	globalConfig := rc.GetGlobalConfig()
+	image, err := globalConfig.GetBackupImage(naming.Engine(instance), instance.Spec.EngineFullVersion)
+	if err != nil || image == "" {
+		image = naming.InstanceSetSpec(instance).MainContainer.Image
+	}
+	donorSet := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: donor.Labels[naming.LabelInstanceSet]}}
+	volume := func(name, claim string) corev1.Volume {
+		return corev1.Volume{
+			Name: name,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claim, ReadOnly: true},
+			},
+		}
+	}
+	dataMount := naming.DataVolumeMount()
+	dataMount.ReadOnly = true
+	mounts := []corev1.VolumeMount{dataMount, {Name: "tmp", MountPath: "/tmp"}}
+	volumes := []corev1.Volume{
+		volume(dataMount.Name, naming.InstanceDataVolume(donorSet).Name),
+		{Name: "tmp", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+	}
+	if naming.InstanceSetSpec(instance).LogVolumeClaimSpec != nil {
+		logMount := naming.LogVolumeMount()
+		logMount.ReadOnly = true
+		mounts = append(mounts, logMount)
+		volumes = append(volumes, volume(logMount.Name, naming.InstanceLogVolume(donorSet).Name))
+	}
+
+	labels := naming.Merge(instance.Labels, map[string]string{naming.LabelSeed: instance.Name})
+	delete(labels, naming.LabelInstance)
+	job.SetGroupVersionKind(batchv1.SchemeGroupVersion.WithKind("Job"))
+	job.Labels = labels
+	job.Spec = batchv1.JobSpec{
+		BackoffLimit: util.Int32(0),
+		Template: corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{Labels: labels},
+			Spec: corev1.PodSpec{
+				RestartPolicy:   corev1.RestartPolicyNever,
+				NodeName:        donor.Spec.NodeName,
+				SecurityContext: security.PodSecurityContext(instance),
+				Containers: []corev1.Container{{
+					Name:  "seed",
+					Image: image,
+					Command: []string{"bash", "-ceu", "set -o pipefail; " +
+						`xtrabackup --backup --stream=xbstream --target-dir=/tmp --datadir="$DATA_DIR" ` +
+						`--host="$MYSQL_HOST" --port="$MYSQL_PORT" --user="$MYSQL_USER" ` +
+						`| socat -u STDIN "TCP:$SEED_HOST:$SEED_PORT"`},
+					Env: []corev1.EnvVar{
+						{Name: "DATA_DIR", Value: naming.MySQLDataDir},
+						{Name: "MYSQL_HOST", Value: donor.Status.PodIP},
+						{Name: "MYSQL_PORT", Value: fmt.Sprint(*instance.Spec.Port)},
+						{Name: "MYSQL_USER", Value: naming.BackupUser},
+						{Name: "MYSQL_PWD", ValueFrom: &corev1.EnvVarSource{
+							SecretKeyRef: &corev1.SecretKeySelector{
+								LocalObjectReference: corev1.LocalObjectReference{
+									Name: naming.InstanceCredentials(instance).Name,
+								},
+								Key: naming.BackupPasswordSecretKey,
+							},
+						}},
+						{Name: "SEED_HOST", Value: recipient.Status.PodIP},
+						{Name: "SEED_PORT", Value: fmt.Sprint(naming.SeedPort)},
+					},
+					SecurityContext: security.ContainerSecurityContext(instance),
+					VolumeMounts:    mounts,
+				}},
+				Volumes: volumes,
+			},
+		},
+	}
+	if err = errors.WithStack(rc.SetControllerReference(job)); err == nil {
+		err = errors.WithStack(rc.Apply(job))
+	}
+	return err == nil, err
+}
+
+// xtrabackupProgress reports whether the database of recipient started on
+// the streamed backup. A failed job is deleted, the seeding starts again.
+func xtrabackupProgress(rc *context.InstanceContext, seed *kdbv1.ReplicaSeedStatus, recipient *corev1.Pod) (bool, error) {
+	job := &batchv1.Job{ObjectMeta: naming.SeedJob(rc.GetInstance(), seed.Set)}
+	err := errors.WithStack(client.IgnoreNotFound(rc.Get(job)))
+	if err != nil {
+		return false, err
+	}
+	started := false
+	for _, status := range recipient.Status.ContainerStatuses {
+		if status.Name == naming.ContainerDatabase && status.State.Running != nil {
+			started = true
+		}
+	}
+	failed := job.UID == ""
+	for _, cond := range job.Status.Conditions {
+		if cond.Type == batchv1.JobFailed && cond.Status == corev1.ConditionTrue {
+			failed = true
+		}
+	}
+	if !started && !failed {
+		return false, nil
+	}
+	if job.UID != "" {
+		if err = errors.WithStack(client.IgnoreNotFound(rc.Client().Delete(rc.Context(), job,
+			client.PropagationPolicy(metav1.DeletePropagationBackground)))); err != nil {
+			return false, err
+		}
+	}
+	if !started {
+		return false, errors.Errorf("seed job %s failed", job.Name)
+	}
+	// A backup without its GTIDs cannot replicate, it is copied again. The
+	// file is read again when the container does not answer yet.
+	out, err := readBinlogInfo(rc, recipient)
+	if err != nil {
+		return false, nil
+	}
+	if _, err = parseBackupGTIDs(out); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// backupGTIDs returns the GTIDs of the backup recipient was seeded with.
+func backupGTIDs(rc *context.InstanceContext, recipient *corev1.Pod) (string, error) {
+	out, err := readBinlogInfo(rc, recipient)
+	if err != nil {
+		return "", err
+	}
+	return parseBackupGTIDs(out)
+}
+
+// readBinlogInfo returns the xtrabackup_binlog_info of the backup recipient
+// was seeded with.
+func readBinlogInfo(rc *context.InstanceContext, recipient *corev1.Pod) (string, error) {
+	var stdout, stderr bytes.Buffer
+	err := rc.PodExec(recipient, naming.ContainerDatabase, []string{"cat", naming.SeedBinlogInfoPath},
+		kube.ExecOptions{Stdout: &stdout, Stderr: &stderr, Timeout: sqlTimeout})
+	if err != nil {
+		return "", errors.Wrapf(err, "read %s in pod %s: %s", naming.SeedBinlogInfoPath, recipient.Name,
+			strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// gtidInterval is a member of a GTID set: the UUID of a server followed by
+// intervals of transactions, and tags since 8.3.
+var gtidInterval = regexp.MustCompile(
+	`^[0-9a-fA-F]{8}(-[0-9a-fA-F]{4}){3}-[0-9a-fA-F]{12}(:([0-9]+(-[0-9]+)?|[A-Za-z_][A-Za-z0-9_]*))+$`)
+
+// parseBackupGTIDs returns the GTIDs of an xtrabackup_binlog_info. The file
+// holds the binlog file, position and GTIDs separated by tabs, the GTIDs of
+// several servers are on several lines.
+func parseBackupGTIDs(info string) (string, error) {
+	fields := strings.SplitN(info, "\t", 3)
+	if len(fields) < 3 {
+		return "", errors.Errorf("%s has no GTIDs: %q", naming.SeedBinlogInfoPath, info)
+	}
+	gtids := strings.Join(strings.Fields(fields[2]), "")
+	for _, member := range strings.Split(gtids, ",") {
+		if !gtidInterval.MatchString(member) {
+			return "", errors.Errorf("%s has invalid GTIDs: %q", naming.SeedBinlogInfoPath, fields[2])
+		}
+	}
+	return gtids, nil
+}
+
+// isInitContainerRunning reports whether the init container name of pod runs.
+func isInitContainerRunning(pod *corev1.Pod, name string) bool {
+	for _, status := range pod.Status.InitContainerStatuses {
+		if status.Name == name {
+			return status.State.Running != nil
+		}
+	}
+	return false
+}
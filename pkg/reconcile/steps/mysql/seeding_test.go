@@ -0,0 +1,33 @@
+package mysql
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestParseBackupGTIDs(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Valid", func(t *testing.T) {
+		gtids, err := parseBackupGTIDs("binlog.000003\t157\t3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5,\n" +
+			"5a3b1c2d-0000-11ee-8c99-0242ac120002:1-20:22\n")
+		assert.NilError(t, err)
+		assert.Equal(t, gtids,
+			"3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5,5a3b1c2d-0000-11ee-8c99-0242ac120002:1-20:22")
+	})
+
+	for name, info := range map[string]string{
+		"Empty":     "",
+		"Short":     "binlog.000003\t157\n",
+		"NoGTIDs":   "binlog.000003\t157\t\n",
+		"Truncated": "binlog.000003\t157\t3e11fa47-71ca-11e1-9e33-c80aa942",
+		"Garbage":   "binlog.000003\t157\tnot a gtid set",
+	} {
+		info := info
+		t.Run(name, func(t *testing.T) {
+			_, err := parseBackupGTIDs(info)
+			assert.ErrorContains(t, err, "xtrabackup_binlog_info has")
+		})
+	}
+}
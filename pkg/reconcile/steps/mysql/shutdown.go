@@ -0,0 +1,64 @@
+package mysql
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/helper/kube"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+	"github.com/sqc157400661/kdb/pkg/reconcile/steps"
+)
+
+// ShutdownInstance stops the replication threads of the replicas and shuts
+// the master down slowly, and checks that replication resumes on start.
+func (s *InstanceStepManager) ShutdownInstance() kube.BindFunc {
+	return s.ShutdownStep(&steps.ShutdownHooks{
+		PrepareStop: prepareStop,
+		VerifyStart: verifyReplication,
+	})
+}
+
+// prepareStop stops replication on a replica so that its relay log position
+// is saved, and makes InnoDB flush all changes to its data files when the
+// master shuts down.
+// - https://dev.mysql.com/doc/refman/8.0/en/innodb-parameters.html#sysvar_innodb_fast_shutdown
+func prepareStop(rc *context.InstanceContext, pod *corev1.Pod, master bool) error {
+	if master {
+		_, err := execSQL(rc, pod, "SET GLOBAL innodb_fast_shutdown = 0; FLUSH BINARY LOGS")
+		return err
+	}
+	syntax, err := replicaSyntax(rc, pod)
+	if err != nil {
+		return err
+	}
+	_, err = execSQL(rc, pod, fmt.Sprintf("STOP %s; SET GLOBAL innodb_fast_shutdown = 0", syntax.replica))
+	return err
+}
+
+// verifyReplication returns an error until the receiver and the applier
+// threads of every replica run, starting them when they do not.
+func verifyReplication(rc *context.InstanceContext, master *corev1.Pod, replicas []*corev1.Pod) error {
+	for _, pod := range replicas {
+		out, err := execSQL(rc, pod, "SELECT "+
+			"(SELECT COUNT(*) FROM performance_schema.replication_connection_status WHERE SERVICE_STATE = 'ON'), "+
+			"(SELECT COUNT(*) FROM performance_schema.replication_applier_status WHERE SERVICE_STATE = 'ON')")
+		if err != nil {
+			return err
+		}
+		if fields := strings.Fields(out); len(fields) == 2 && fields[0] != "0" && fields[1] != "0" {
+			continue
+		}
+		syntax, err := replicaSyntax(rc, pod)
+		if err != nil {
+			return err
+		}
+		if _, err = execSQL(rc, pod, "START "+syntax.replica); err != nil {
+			return err
+		}
+		return errors.Errorf("replication of %s from %s is not running", pod.Name, master.Name)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package mysql
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/helper/kube"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+// sqlTimeout bounds a statement run in the database container.
+const sqlTimeout = 30 * time.Second
+
+// execSQL runs the statements with the mysql client of the database container
+// of pod and returns their output.
+func execSQL(rc *context.InstanceContext, pod *corev1.Pod, statements string) (string, error) {
+	return execMySQLProgram(rc, pod, "mysql --batch --skip-column-names", statements+";\n", sqlTimeout)
+}
+
+// execMySQLProgram runs a client program of the database container of pod as
+// the root user and returns its output.
+func execMySQLProgram(rc *context.InstanceContext, pod *corev1.Pod, program, input string,
+	timeout time.Duration) (string, error) {
+	return runMySQLProgram(rc, pod, rc.GetGlobalConfig().DB.RootUser,
+		rc.GetCredential(naming.RootPasswordSecretKey), program, input, timeout)
+}
+
+// execSchemaSQL runs the statements of a KDBUser or a KDBDatabase on the
+// master of its instance as the root user and returns their output.
+func execSchemaSQL(rc *context.SchemaContext, statements string) (string, error) {
+	return runMySQLProgram(rc, rc.GetMaster(), rc.GetGlobalConfig().DB.RootUser,
+		rc.GetCredential(naming.RootPasswordSecretKey), "mysql --batch --skip-column-names",
+		statements+";\n", sqlTimeout)
+}
+
+// runMySQLProgram runs a client program of the database container of pod as
+// user and returns its output. The password and the input are sent on stdin
+// so that they do not show up in the process list of the container.
+func runMySQLProgram(rc kube.ReconcileContext, pod *corev1.Pod, user, password, program, input string,
+	timeout time.Duration) (string, error) {
+	script := `read -r MYSQL_PWD; export MYSQL_PWD; ` +
+		`exec ` + program + ` --user="$1" --socket="$2"`
+	var stdout, stderr bytes.Buffer
+	err := rc.PodExec(pod, naming.ContainerDatabase,
+		[]string{"bash", "-c", script, "-", user, naming.MySQLSocketPath},
+		kube.ExecOptions{
+			Stdin:   strings.NewReader(password + "\n" + input),
+			Stdout:  &stdout,
+			Stderr:  &stderr,
+			Timeout: timeout,
+		})
+	if err != nil {
+		return "", errors.Wrapf(err, "exec %s in pod %s: %s", strings.Fields(program)[0], pod.Name,
+			strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+var (
+	mysqlNumberValue = regexp.MustCompile(`^-?([0-9]+(\.[0-9]*)?|\.[0-9]+)$`)
+	mysqlSizeValue   = regexp.MustCompile(`^([0-9]+)([KkMmGg])$`)
+)
+
+// sqlValue returns value of an option file as a SQL literal. The size suffixes
+// of option files are not understood by SET and are expanded, numbers, e.g.
+// 0.5, are kept and anything else becomes a string. A system variable of a
+// numeric type refuses a string.
+func sqlValue(value string) string {
+	if mysqlNumberValue.MatchString(value) {
+		return value
+	}
+	if m := mysqlSizeValue.FindStringSubmatch(value); m != nil {
+		n, _ := strconv.ParseInt(m[1], 10, 64)
+		switch strings.ToUpper(m[2]) {
+		case "K":
+			n <<= 10
+		case "M":
+			n <<= 20
+		case "G":
+			n <<= 30
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	return sqlString(value)
+}
+
+var sqlStringEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\x00", `\0`, "\n", `\n`, "\r", `\r`,
+	"\x1a", `\Z`)
+
+// sqlString returns value as a SQL string literal, e.g. a password, a user
+// name, a host or a GTID set. Unlike sqlValue it never changes the value.
+func sqlString(value string) string {
+	return "'" + sqlStringEscaper.Replace(value) + "'"
+}
+
+// isReadOnlyVariableErr reports whether the server refused to set a variable
+// because it is read only (1238), it is set by a restart.
+func isReadOnlyVariableErr(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "ERROR 1238")
+}
+
+// isUnknownVariableErr reports whether the server refused to set a variable
+// it does not know (1193), mysqld would not start with it either.
+func isUnknownVariableErr(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "ERROR 1193")
+}
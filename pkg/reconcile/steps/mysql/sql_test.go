@@ -0,0 +1,46 @@
+package mysql
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestSQLValue(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		value, expected string
+	}{
+		{"100", "100"},
+		{"-1", "-1"},
+		{"0.5", "0.5"},
+		{".75", ".75"},
+		{"64k", "65536"},
+		{"10M", "10485760"},
+		{"1G", "1073741824"},
+		{"ON", "'ON'"},
+		{"1.2.3", "'1.2.3'"},
+		{"+00:00", "'+00:00'"},
+		{`it's`, `'it\'s'`},
+	} {
+		assert.Equal(t, sqlValue(tt.value), tt.expected, "value %q", tt.value)
+	}
+}
+
+func TestSQLString(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		value, expected string
+	}{
+		{"100", "'100'"},
+		{"64k", "'64k'"},
+		{"%", "'%'"},
+		{"3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5", "'3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5'"},
+		{`p'a\ss`, `'p\'a\\ss'`},
+		{"a\nb\x00", `'a\nb\0'`},
+	} {
+		assert.Equal(t, sqlString(tt.value), tt.expected, "value %q", tt.value)
+	}
+}
@@ -0,0 +1,243 @@
+package mysql
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/helper/kube"
+	"github.com/sqc157400661/util"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kdbv1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/apis/shared"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/pkg/metrics"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+	"github.com/sqc157400661/kdb/pkg/reconcile/steps"
+	"github.com/sqc157400661/kdb/pkg/sidecar"
+)
+
+// switchoverCatchUpSeconds bounds the time a candidate may take to apply the
+// transactions of the old master.
+const switchoverCatchUpSeconds = 60
+
+// RolloutInstance replaces outdated pods and switches the master role over to
+// an updated replica before the master is deleted.
+func (s *InstanceStepManager) RolloutInstance() kube.BindFunc {
+	return s.RolloutStep(switchover)
+}
+
+// DrainInstance switches the master over to a ready replica when its node is
+// cordoned.
+func (s *InstanceStepManager) DrainInstance() kube.BindFunc {
+	return s.DrainStep(switchover)
+}
+
+// isMySQL8 reports whether the instance runs MySQL 8.0 or later.
+func isMySQL8(instance *kdbv1.KDBInstance) (bool, error) {
+	v1, err := naming.EngineVersion(instance)
+	if err != nil {
+		return false, err
+	}
+	v2, _ := version.NewVersion("8.0")
+	return v1.GreaterThanOrEqual(v2), nil
+}
+
+// replicationSyntax holds the replication keywords a server understands.
+type replicationSyntax struct {
+	// replica is REPLICA since 8.0.22 and SLAVE before.
+	replica string
+	// source reports whether CHANGE REPLICATION SOURCE TO exists, since 8.0.23.
+	source bool
+	// major is the major version of the server, e.g. 8.0.
+	major string
+}
+
+// replicaSyntax returns the replication keywords of the server in pod. The
+// pods of an instance run different major versions during a major upgrade.
+func replicaSyntax(rc *context.InstanceContext, pod *corev1.Pod) (replicationSyntax, error) {
+	running, err := serverVersion(rc, pod)
+	if err != nil {
+		return replicationSyntax{}, err
+	}
+	v, err := version.NewVersion(running)
+	if err != nil {
+		return replicationSyntax{}, err
+	}
+	segments := v.Segments()
+	syntax := replicationSyntax{replica: "SLAVE", major: fmt.Sprintf("%d.%d", segments[0], segments[1])}
+	if v.GreaterThanOrEqual(version.Must(version.NewVersion("8.0.22"))) {
+		syntax.replica = "REPLICA"
+	}
+	syntax.source = v.GreaterThanOrEqual(version.Must(version.NewVersion("8.0.23")))
+	return syntax, nil
+}
+
+// changeSource returns the statement making a server with syntax replicate
+// from host and port with GTID auto positioning.
+func changeSource(rc *context.InstanceContext, syntax replicationSyntax, host string, port int32) string {
+	replUser := rc.GetGlobalConfig().DB.ReplUser
+	replPassword := rc.GetCredential(naming.ReplPasswordSecretKey)
+	if syntax.source {
+		return fmt.Sprintf("CHANGE REPLICATION SOURCE TO SOURCE_HOST = %s, SOURCE_PORT = %d, "+
+			"SOURCE_USER = %s, SOURCE_PASSWORD = %s, SOURCE_AUTO_POSITION = 1%s",
+			sqlString(host), port, sqlString(replUser), sqlString(replPassword), sourceSSL(rc, syntax))
+	}
+	return fmt.Sprintf("CHANGE MASTER TO MASTER_HOST = %s, MASTER_PORT = %d, "+
+		"MASTER_USER = %s, MASTER_PASSWORD = %s, MASTER_AUTO_POSITION = 1%s",
+		sqlString(host), port, sqlString(replUser), sqlString(replPassword), sourceSSL(rc, syntax))
+}
+
+// switchover makes the most caught-up candidate the master of the instance:
+//
+//  1. the old master becomes read only so that no transaction is lost,
+//  2. the candidate applies all the transactions of the old master,
+//  3. the candidate stops replicating and becomes writable,
+//  4. the role labels of both pods are swapped, the Services follow them,
+//  5. the old master replicates from the candidate.
+//
+// The sidecars promote the candidate and demote the old master when their
+// management API is enabled, SQL does otherwise.
+//
+// During a major upgrade the old master may run the previous major version.
+// It never replicates from a newer one, it only keeps the source for its
+// replacement, which starts the replication with the new version.
+func switchover(rc *context.InstanceContext, master *corev1.Pod, candidates []*corev1.Pod) (err error) {
+	instance := rc.GetInstance()
+	defer func() { metrics.RecordSwitchover(instance.Namespace, instance.Name, err) }()
+	candidate, err := switchoverCandidate(rc, master, candidates)
+	if err != nil {
+		return err
+	}
+	candidateSyntax, err := replicaSyntax(rc, candidate)
+	if err != nil {
+		return err
+	}
+	masterSyntax, err := replicaSyntax(rc, master)
+	if err != nil {
+		return err
+	}
+
+	if _, err = execSQL(rc, master, "SET GLOBAL super_read_only = ON"); err != nil {
+		return err
+	}
+	// The old master stays the master until the pods are relabeled, it gets
+	// its writes back when the switchover fails before. The rollout retries
+	// later.
+	relabeled := false
+	defer func() {
+		if err != nil && !relabeled {
+			_, _ = execSQL(rc, master, "SET GLOBAL super_read_only = OFF; SET GLOBAL read_only = OFF")
+		}
+	}()
+	gtids, err := execSQL(rc, master, "SELECT @@GLOBAL.gtid_executed")
+	if err != nil {
+		return err
+	}
+	gtids = strings.ReplaceAll(strings.TrimSpace(gtids), "\\n", "")
+	// The wait outlasts the timeout of a statement, its exec gets its own.
+	waited, err := execMySQLProgram(rc, candidate, "mysql --batch --skip-column-names",
+		fmt.Sprintf("SELECT WAIT_FOR_EXECUTED_GTID_SET(%s, %d);\n", sqlString(gtids), switchoverCatchUpSeconds),
+		switchoverCatchUpSeconds*time.Second+sqlTimeout)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(waited) != "0" {
+		return errors.Errorf("%s did not catch up with %s in %ds", candidate.Name, master.Name,
+			switchoverCatchUpSeconds)
+	}
+
+	promoted, err := withSidecar(rc, candidate, func(client *sidecar.Client) error {
+		return client.Promote(rc.Context())
+	})
+	if err == nil && !promoted {
+		_, err = execSQL(rc, candidate, fmt.Sprintf(
+			"STOP %[1]s; RESET %[1]s ALL; SET GLOBAL super_read_only = OFF; SET GLOBAL read_only = OFF",
+			candidateSyntax.replica))
+	}
+	if err != nil {
+		return err
+	}
+
+	// The old master is relabeled first, the Services never route to two
+	// masters and never to the demoted one.
+	relabeled = true
+	for _, pod := range []*corev1.Pod{master, candidate} {
+		role := naming.ReplicaRole
+		if pod == candidate {
+			role = naming.MasterRole
+		}
+		before := pod.DeepCopy()
+		pod.Labels = naming.Merge(pod.Labels, map[string]string{naming.LabelRole: role})
+		if err = errors.WithStack(rc.Patch(pod, client.MergeFrom(before))); err != nil {
+			return errors.WithMessagef(err, "%s is master, but its role label is not set", candidate.Name)
+		}
+		steps.SetPodRole(instance, pod.Name, role)
+	}
+	rc.Recorder().Eventf(instance, corev1.EventTypeNormal, "Switchover",
+		"Switched the master from %s to %s", master.Name, candidate.Name)
+
+	demoted := false
+	if masterSyntax.major == candidateSyntax.major {
+		demoted, err = withSidecar(rc, master, func(client *sidecar.Client) error {
+			return client.Demote(rc.Context(), candidate.Status.PodIP, *instance.Spec.Port)
+		})
+	}
+	if err == nil && !demoted {
+		statements := changeSource(rc, masterSyntax, candidate.Status.PodIP, *instance.Spec.Port)
+		if masterSyntax.major == candidateSyntax.major {
+			statements += "; START " + masterSyntax.replica
+		}
+		_, err = execSQL(rc, master, statements)
+	}
+	if err != nil {
+		return errors.WithMessagef(err, "%s is master, but %s does not replicate from it",
+			candidate.Name, master.Name)
+	}
+	return nil
+}
+
+// switchoverCandidate returns the ready candidate that replicates from master
+// with the smallest lag.
+func switchoverCandidate(rc *context.InstanceContext, master *corev1.Pod, candidates []*corev1.Pod) (*corev1.Pod, error) {
+	var best *corev1.Pod
+	var bestLag int64
+	var problems []string
+	for _, candidate := range candidates {
+		if candidate == master || candidate.DeletionTimestamp != nil || !util.IsPodReady(candidate) {
+			continue
+		}
+		info := &shared.PodStatusInfo{}
+		if err := observeSidecarReplication(rc, candidate, info); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", candidate.Name, err))
+			continue
+		}
+		repl := info.Replication
+		if repl == nil || repl.IOThread != "Yes" || repl.SQLThread != "Yes" {
+			problems = append(problems, candidate.Name+" does not replicate")
+			continue
+		}
+		// The lag is unknown while the SQL thread catches up after a
+		// reconnect, such a candidate comes last.
+		lag := int64(math.MaxInt64)
+		if repl.SecondsBehindSource != nil {
+			lag = *repl.SecondsBehindSource
+		}
+		if best == nil || lag < bestLag {
+			best, bestLag = candidate, lag
+		}
+	}
+	if best == nil && len(problems) > 0 {
+		return nil, errors.Errorf("no ready replica to take over from %s: %s", master.Name,
+			strings.Join(problems, "; "))
+	}
+	if best == nil {
+		return nil, errors.Errorf("no ready replica to take over from %s", master.Name)
+	}
+	return best, nil
+}
@@ -0,0 +1,149 @@
+package mysql
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/helper/kube"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kdbv1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/internal/reconciletest"
+)
+
+// replicaStatus returns the vertical output of SHOW REPLICA STATUS of a
+// replica whose threads run as io and sql, lag is left out when empty.
+func replicaStatus(io, sql, lag string) string {
+	status := fmt.Sprintf("*** 1. row ***\nSource_Host: kdb0-0.kdb\nSource_Port: 3306\n"+
+		"Replica_IO_Running: %s\nReplica_SQL_Running: %s\n", io, sql)
+	if lag != "" {
+		status += "Seconds_Behind_Source: " + lag + "\n"
+	}
+	return status
+}
+
+func TestSwitchoverCandidate(t *testing.T) {
+	t.Parallel()
+
+	newPod := func(name string, ready bool) *corev1.Pod {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name}}
+		if ready {
+			pod.Status.Phase = corev1.PodRunning
+			pod.Status.ContainerStatuses = []corev1.ContainerStatus{{Ready: true}}
+		}
+		return pod
+	}
+
+	for _, tt := range []struct {
+		name string
+		// status is the replica status of the ready pods by name, a pod
+		// without one fails to answer.
+		status  map[string]string
+		unready []string
+
+		candidate string
+		err       string
+	}{
+		{
+			name: "SmallestLag",
+			status: map[string]string{
+				"kdb1-0": replicaStatus("Yes", "Yes", "12"),
+				"kdb2-0": replicaStatus("Yes", "Yes", "3"),
+			},
+			candidate: "kdb2-0",
+		},
+		{
+			name: "UnknownLagLast",
+			status: map[string]string{
+				"kdb1-0": replicaStatus("Yes", "Yes", ""),
+				"kdb2-0": replicaStatus("Yes", "Yes", "300"),
+			},
+			candidate: "kdb2-0",
+		},
+		{
+			name: "SkipsStoppedThreads",
+			status: map[string]string{
+				"kdb1-0": replicaStatus("Yes", "Yes", "30"),
+				"kdb2-0": replicaStatus("Connecting", "Yes", "0"),
+			},
+			candidate: "kdb1-0",
+		},
+		{
+			name: "SkipsUnready",
+			status: map[string]string{
+				"kdb1-0": replicaStatus("Yes", "Yes", "30"),
+				"kdb2-0": replicaStatus("Yes", "Yes", "0"),
+			},
+			unready:   []string{"kdb2-0"},
+			candidate: "kdb1-0",
+		},
+		{
+			name: "SkipsFailed",
+			status: map[string]string{
+				"kdb2-0": replicaStatus("Yes", "Yes", "30"),
+			},
+			candidate: "kdb2-0",
+		},
+		{
+			name: "NoReplica",
+			status: map[string]string{
+				"kdb1-0": "",
+				"kdb2-0": replicaStatus("No", "No", ""),
+			},
+			err: "no ready replica to take over from kdb0-0: kdb1-0 does not replicate; kdb2-0 does not replicate",
+		},
+		{
+			name:    "NoReadyReplica",
+			status:  map[string]string{},
+			unready: []string{"kdb1-0", "kdb2-0"},
+			err:     "no ready replica to take over from kdb0-0",
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			instance := &kdbv1.KDBInstance{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "kdb"}}
+			rc, helper, _ := reconciletest.NewInstanceContext(t, instance)
+			helper.Exec = func(pod *corev1.Pod, container string, command []string, opts kube.ExecOptions) error {
+				status, ok := tt.status[pod.Name]
+				if !ok {
+					return errors.New("container not found")
+				}
+				input, err := io.ReadAll(opts.Stdin)
+				assert.NilError(t, err)
+				switch {
+				case strings.Contains(string(input), "SELECT VERSION()"):
+					_, err = io.WriteString(opts.Stdout, "8.0.32\n")
+				case strings.Contains(string(input), "SHOW REPLICA STATUS"):
+					_, err = io.WriteString(opts.Stdout, status)
+				default:
+					_, err = io.WriteString(opts.Stdout, "1\t\n")
+				}
+				return err
+			}
+
+			master := newPod("kdb0-0", true)
+			candidates := []*corev1.Pod{master}
+			for _, name := range []string{"kdb1-0", "kdb2-0"} {
+				ready := true
+				for _, unready := range tt.unready {
+					ready = ready && unready != name
+				}
+				candidates = append(candidates, newPod(name, ready))
+			}
+
+			candidate, err := switchoverCandidate(rc, master, candidates)
+			if tt.err != "" {
+				assert.ErrorContains(t, err, tt.err)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, candidate.Name, tt.candidate)
+		})
+	}
+}
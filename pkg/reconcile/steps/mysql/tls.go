@@ -0,0 +1,105 @@
+package mysql
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/go-version"
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/helper/kube"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+	"github.com/sqc157400661/kdb/pkg/reconcile/steps"
+)
+
+// ReloadTLS loads a new certificate with ALTER INSTANCE RELOAD TLS, since
+// 8.0.16. Older servers load it when they restart.
+// - https://dev.mysql.com/doc/refman/8.0/en/alter-instance.html
+func (s *InstanceStepManager) ReloadTLS() kube.BindFunc {
+	return s.TLSReloadStep(&steps.TLSHooks{
+		Reload:            reloadTLS,
+		SecureReplication: secureReplication,
+	})
+}
+
+// secureReplication changes the replication channel of the server in pod to
+// connect with TLS, see sourceSSL. The server must have loaded a certificate,
+// its source does once it is done with the master.
+func secureReplication(rc *context.InstanceContext, pod *corev1.Pod) error {
+	ssl, err := execSQL(rc, pod, "SELECT @@GLOBAL.have_ssl")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(ssl) != "YES" {
+		return errors.Errorf("%s has not loaded a certificate", pod.Name)
+	}
+	syntax, err := replicaSyntax(rc, pod)
+	if err != nil {
+		return err
+	}
+	status, err := execSQL(rc, pod, "SHOW "+syntax.replica+" STATUS")
+	if err != nil || strings.TrimSpace(status) == "" {
+		return err
+	}
+	change := "CHANGE MASTER TO "
+	if syntax.source {
+		change = "CHANGE REPLICATION SOURCE TO "
+	}
+	change += strings.TrimPrefix(sourceSSL(rc, syntax), ", ")
+	_, err = execSQL(rc, pod, fmt.Sprintf("STOP %[1]s IO_THREAD; %s; START %[1]s IO_THREAD",
+		syntax.replica, change))
+	return err
+}
+
+func reloadTLS(rc *context.InstanceContext, pod *corev1.Pod) (bool, error) {
+	running, err := serverVersion(rc, pod)
+	if err != nil {
+		return false, err
+	}
+	v, err := version.NewVersion(running)
+	if err != nil {
+		return false, err
+	}
+	if v.LessThan(version.Must(version.NewVersion("8.0.16"))) {
+		return false, nil
+	}
+	_, err = execSQL(rc, pod, "ALTER INSTANCE RELOAD TLS")
+	return err == nil, err
+}
+
+// tlsConfig returns the options of my.cnf that load the certificate of the
+// TLS Secret, none when TLS is disabled.
+func tlsConfig(rc *context.InstanceContext) map[string]string {
+	instance := rc.GetInstance()
+	if !naming.IsTLSEnabled(instance) {
+		return nil
+	}
+	require := "ON"
+	if r := instance.Spec.TLS.RequireSecureTransport; r != nil && !*r {
+		require = "OFF"
+	}
+	return map[string]string{
+		"ssl_ca":                   naming.TLSPath + "/" + naming.CACertSecretKey,
+		"ssl_cert":                 naming.TLSPath + "/" + naming.TLSCertSecretKey,
+		"ssl_key":                  naming.TLSPath + "/" + naming.TLSKeySecretKey,
+		"require_secure_transport": require,
+	}
+}
+
+// sourceSSL returns the options of CHANGE MASTER TO that make a replica
+// connect to its source with TLS and verify the certificate against the CA,
+// none when TLS is disabled. The replicas connect to the IP of the source, so
+// its host name is not verified.
+func sourceSSL(rc *context.InstanceContext, syntax replicationSyntax) string {
+	if !naming.IsTLSEnabled(rc.GetInstance()) {
+		return ""
+	}
+	prefix := "MASTER"
+	if syntax.source {
+		prefix = "SOURCE"
+	}
+	return ", " + prefix + "_SSL = 1, " + prefix + "_SSL_CA = " +
+		sqlString(naming.TLSPath+"/"+naming.CACertSecretKey)
+}
@@ -0,0 +1,67 @@
+package mysql
+
+import (
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/sqc157400661/helper/kube"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+// mysqlUpgradeTimeout bounds the upgrade of the system tables of a server.
+const mysqlUpgradeTimeout = 10 * time.Minute
+
+// FinishUpgradeInstance records the version reported by the servers and
+// upgrades the system tables of servers that do not upgrade them at startup.
+func (s *InstanceStepManager) FinishUpgradeInstance() kube.BindFunc {
+	return s.FinishUpgradeStep(serverVersion, postUpgrade)
+}
+
+// serverVersion returns the version of the server in pod without its suffix,
+// e.g. 8.0.39 for 8.0.39-log.
+func serverVersion(rc *context.InstanceContext, pod *corev1.Pod) (string, error) {
+	out, err := execSQL(rc, pod, "SELECT VERSION()")
+	if err != nil {
+		return "", err
+	}
+	v, _, _ := strings.Cut(strings.TrimSpace(out), "-")
+	return v, nil
+}
+
+// postUpgrade runs mysql_upgrade on every pod. Since 8.0.16 the server
+// upgrades the system tables itself when it starts with a new version.
+// mysql_upgrade does not write to the binary log, so the replicas are made
+// writable for the time of the upgrade.
+// - https://dev.mysql.com/doc/refman/8.0/en/upgrading-what-is-upgraded.html
+func postUpgrade(rc *context.InstanceContext, pods []*corev1.Pod, _, to string) error {
+	v1, err := version.NewVersion(to)
+	if err != nil {
+		return err
+	}
+	v2, _ := version.NewVersion("8.0.16")
+	if v1.GreaterThanOrEqual(v2) {
+		return nil
+	}
+	for _, pod := range pods {
+		replica := !naming.IsMasterPod(pod)
+		if replica {
+			if _, err = execSQL(rc, pod, "SET GLOBAL super_read_only = OFF"); err != nil {
+				return err
+			}
+		}
+		_, err = execMySQLProgram(rc, pod, "mysql_upgrade", "", mysqlUpgradeTimeout)
+		if replica {
+			if _, rerr := execSQL(rc, pod, "SET GLOBAL super_read_only = ON"); err == nil {
+				err = rerr
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
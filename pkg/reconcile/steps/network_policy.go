@@ -0,0 +1,122 @@
+package steps
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/helper/kube"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/sqc157400661/kdb/internal/naming"
+	conf "github.com/sqc157400661/kdb/pkg/config"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+// namespaceNameLabel is the label the API server sets on every namespace to
+// its name.
+const namespaceNameLabel = "kubernetes.io/metadata.name"
+
+// SetNetworkPolicy isolates the pods of the instance with a NetworkPolicy
+// when it is enabled by the spec or by the global config, and deletes it
+// otherwise.
+func (s *InstanceStepManager) SetNetworkPolicy() kube.BindFunc {
+	return s.StepBinder(
+		"SetNetworkPolicy",
+		func(rc *context.InstanceContext, flow kube.Flow) (reconcile.Result, error) {
+			instance := rc.GetInstance()
+			policy := &networkingv1.NetworkPolicy{ObjectMeta: naming.InstanceNetworkPolicy(instance)}
+			if !naming.IsNetworkPolicyEnabled(instance, rc.GetGlobalConfig().NetworkPolicy.Enabled) {
+				err := errors.WithStack(client.IgnoreNotFound(rc.Get(policy)))
+				if err == nil && policy.UID != "" {
+					err = errors.WithStack(client.IgnoreNotFound(rc.DeleteControlled(policy)))
+				}
+				if err != nil {
+					return flow.Error(err, "delete network policy err")
+				}
+				return flow.Pass()
+			}
+
+			policy.SetGroupVersionKind(networkingv1.SchemeGroupVersion.WithKind("NetworkPolicy"))
+			policy.Labels = naming.Merge(instance.Labels,
+				map[string]string{
+					naming.LabelInstance: instance.Name,
+				})
+			policy.Spec = networkPolicySpec(rc)
+			err := errors.WithStack(rc.SetControllerReference(policy))
+			if err == nil {
+				err = errors.WithStack(rc.Apply(policy))
+			}
+			if err != nil {
+				return flow.Error(err, "apply network policy err")
+			}
+			return flow.Pass()
+		})
+}
+
+// networkPolicySpec returns the rules of the NetworkPolicy of the instance.
+// The database port accepts the allowed clients, the pods of the instance and
+// of its cluster for replication, and its proxy. The seed port accepts the
+// jobs seeding replicas, the exporter port accepts the scrapers. The namespace
+// of the operator reaches all ports, e.g. of the sidecar.
+func networkPolicySpec(rc *context.InstanceContext) networkingv1.NetworkPolicySpec {
+	instance := rc.GetInstance()
+	tcp := corev1.ProtocolTCP
+	databasePort := intstr.FromInt(int(*instance.Spec.Port))
+	exporterPort := intstr.FromString(naming.PortExporter)
+
+	self := naming.KDBInstance(instance.Name)
+	proxy := naming.KDBInstanceHaProxy(instance)
+	database := []networkingv1.NetworkPolicyPeer{
+		{PodSelector: &self},
+		{PodSelector: &proxy},
+	}
+	if cluster := naming.KDBInstanceClusterID(instance); cluster != "" {
+		instances := naming.KDBInstances(cluster)
+		database = append(database, networkingv1.NetworkPolicyPeer{PodSelector: &instances})
+	}
+	var scrapers []networkingv1.NetworkPolicyPeer
+	if spec := instance.Spec.NetworkPolicy; spec != nil {
+		database = append(database, spec.AllowedClients...)
+		scrapers = spec.Scrapers
+	}
+
+	rules := []networkingv1.NetworkPolicyIngressRule{
+		{
+			Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &databasePort}},
+			From:  database,
+		},
+		{
+			From: []networkingv1.NetworkPolicyPeer{{
+				NamespaceSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{namespaceNameLabel: conf.K8SNamespace},
+				},
+			}},
+		},
+	}
+	// The jobs seeding new replicas with xtrabackup stream to the seed port.
+	seedPort := intstr.FromString(naming.PortSeed)
+	rules = append(rules, networkingv1.NetworkPolicyIngressRule{
+		Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &seedPort}},
+		From: []networkingv1.NetworkPolicyPeer{{
+			PodSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{naming.LabelSeed: instance.Name},
+			},
+		}},
+	})
+	// A rule without peers accepts everyone, the exporter port is closed
+	// when there are no scrapers.
+	if len(scrapers) > 0 {
+		rules = append(rules, networkingv1.NetworkPolicyIngressRule{
+			Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &exporterPort}},
+			From:  scrapers,
+		})
+	}
+	return networkingv1.NetworkPolicySpec{
+		PodSelector: naming.KDBInstance(instance.Name),
+		PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+		Ingress:     rules,
+	}
+}
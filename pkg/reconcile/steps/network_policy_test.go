@@ -0,0 +1,114 @@
+package steps
+
+import (
+	"testing"
+
+	"github.com/sqc157400661/util"
+	"gotest.tools/v3/assert"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/internal/reconciletest"
+	conf "github.com/sqc157400661/kdb/pkg/config"
+)
+
+func TestNetworkPolicySpec(t *testing.T) {
+	t.Parallel()
+
+	selector := func(labels map[string]string) *metav1.LabelSelector {
+		return &metav1.LabelSelector{MatchLabels: labels}
+	}
+	clients := []networkingv1.NetworkPolicyPeer{
+		{NamespaceSelector: selector(map[string]string{"team": "app"})},
+		{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/8"}},
+	}
+	scrapers := []networkingv1.NetworkPolicyPeer{
+		{PodSelector: selector(map[string]string{"app": "prometheus"})},
+	}
+	instances := naming.KDBInstances("c1")
+
+	for _, tt := range []struct {
+		name    string
+		cluster string
+		spec    *v1.NetworkPolicySpec
+
+		// database are the peers of the database port after the pods of
+		// the instance and its proxy.
+		database []networkingv1.NetworkPolicyPeer
+		scrapers []networkingv1.NetworkPolicyPeer
+	}{
+		{
+			name: "Default",
+		},
+		{
+			name:     "Cluster",
+			cluster:  "c1",
+			database: []networkingv1.NetworkPolicyPeer{{PodSelector: &instances}},
+		},
+		{
+			name:     "AllowedClients",
+			spec:     &v1.NetworkPolicySpec{AllowedClients: clients},
+			database: clients,
+		},
+		{
+			name:     "Scrapers",
+			spec:     &v1.NetworkPolicySpec{Scrapers: scrapers},
+			scrapers: scrapers,
+		},
+		{
+			name:     "ClusterWithClients",
+			cluster:  "c1",
+			spec:     &v1.NetworkPolicySpec{AllowedClients: clients, Scrapers: scrapers},
+			database: append([]networkingv1.NetworkPolicyPeer{{PodSelector: &instances}}, clients...),
+			scrapers: scrapers,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			instance := &v1.KDBInstance{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "kdb"}}
+			if tt.cluster != "" {
+				instance.Labels = map[string]string{naming.LabelClusterID: tt.cluster}
+			}
+			instance.Spec.Port = util.Int32(3306)
+			instance.Spec.NetworkPolicy = tt.spec
+			rc, _, _ := reconciletest.NewInstanceContext(t, instance)
+
+			spec := networkPolicySpec(rc)
+			assert.DeepEqual(t, spec.PodSelector, naming.KDBInstance("kdb"))
+			assert.DeepEqual(t, spec.PolicyTypes, []networkingv1.PolicyType{networkingv1.PolicyTypeIngress})
+
+			ports := map[string][]networkingv1.NetworkPolicyPeer{}
+			for _, rule := range spec.Ingress {
+				// A rule without peers would accept everyone.
+				assert.Assert(t, len(rule.From) > 0)
+				port := "all"
+				if len(rule.Ports) > 0 {
+					assert.Equal(t, len(rule.Ports), 1)
+					port = rule.Ports[0].Port.String()
+				}
+				_, seen := ports[port]
+				assert.Assert(t, !seen, "port %s has two rules", port)
+				ports[port] = rule.From
+			}
+
+			self := naming.KDBInstance("kdb")
+			proxy := naming.KDBInstanceHaProxy(instance)
+			assert.DeepEqual(t, ports["3306"], append([]networkingv1.NetworkPolicyPeer{
+				{PodSelector: &self}, {PodSelector: &proxy},
+			}, tt.database...))
+			assert.DeepEqual(t, ports["all"], []networkingv1.NetworkPolicyPeer{
+				{NamespaceSelector: selector(map[string]string{namespaceNameLabel: conf.K8SNamespace})},
+			})
+			assert.DeepEqual(t, ports[naming.PortSeed], []networkingv1.NetworkPolicyPeer{
+				{PodSelector: selector(map[string]string{naming.LabelSeed: "kdb"})},
+			})
+			assert.DeepEqual(t, ports[naming.PortExporter], tt.scrapers)
+			if tt.scrapers == nil {
+				assert.Equal(t, len(spec.Ingress), 3)
+			}
+		})
+	}
+}
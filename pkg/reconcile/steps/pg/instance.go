@@ -2,6 +2,10 @@ package pg
 
 import "github.com/sqc157400661/kdb/pkg/reconcile/steps"
 
+// InstanceStepManager runs the steps of PostgreSQL instances. The engine
+// creates no pods yet, see reconcilePGInstance, so a major upgrade of it is
+// rejected by UpgradeStep without hooks: pg_upgrade --check, the backup with
+// pg_dumpall and its restore need a running server.
 type InstanceStepManager struct {
 	steps.InstanceStepManager
 }
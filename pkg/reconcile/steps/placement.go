@@ -0,0 +1,124 @@
+package steps
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/helper/kube"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+// placementPollInterval is how often the spread of the pods of a cluster is
+// observed, pods and nodes change without the cluster being reconciled.
+const placementPollInterval = 5 * time.Minute
+
+// PatchKDBClusterStatus patch cluster status
+func (s *ClusterStepManager) PatchKDBClusterStatus() kube.BindFunc {
+	return s.StepBinder(
+		"PatchKDBClusterStatus",
+		func(rc *context.ClusterContext, flow kube.Flow) (reconcile.Result, error) {
+			if err := rc.PatchKDBClusterStatus(); err != nil {
+				return flow.Error(err, "patch cluster status err")
+			}
+			return flow.Pass()
+		})
+}
+
+// ObservePlacement reports the domains the pods of a cluster with a placement
+// run in. The topology is spread when the pods run in as many domains as
+// there are pods or schedulable domains.
+func (s *ClusterStepManager) ObservePlacement() kube.BindFunc {
+	return s.StepBinder(
+		"ObservePlacement",
+		func(rc *context.ClusterContext, flow kube.Flow) (reconcile.Result, error) {
+			cluster := rc.GetCluster()
+			if cluster.Spec.Placement == nil {
+				cluster.Status.Placement = nil
+				meta.RemoveStatusCondition(&cluster.Status.Conditions, v1.KDBClusterTopologySpread)
+				return flow.Pass()
+			}
+			key := naming.PlacementTopologyKey(cluster.Spec.Placement.Topology)
+
+			// Nodes have no namespace, they are listed without the one of the
+			// cluster.
+			nodes := &corev1.NodeList{}
+			if err := errors.WithStack(rc.Client().List(rc.Context(), nodes)); err != nil {
+				return flow.Error(err, "list nodes err")
+			}
+			nodeDomains := make(map[string]string, len(nodes.Items))
+			available := sets.NewString()
+			for _, node := range nodes.Items {
+				domain := node.Labels[key]
+				if domain == "" {
+					continue
+				}
+				nodeDomains[node.Name] = domain
+				if !node.Spec.Unschedulable {
+					available.Insert(domain)
+				}
+			}
+
+			pods := &corev1.PodList{}
+			selector, err := naming.AsSelector(naming.KDBInstances(naming.KDBClusterID(cluster)))
+			if err == nil {
+				err = errors.WithStack(rc.List(pods, selector))
+			}
+			if err != nil {
+				return flow.Error(err, "list pods err")
+			}
+			domains := sets.NewString()
+			var scheduled, pending int32
+			for _, pod := range pods.Items {
+				if pod.DeletionTimestamp != nil {
+					continue
+				}
+				if pod.Spec.NodeName == "" {
+					pending++
+					continue
+				}
+				scheduled++
+				if domain, ok := nodeDomains[pod.Spec.NodeName]; ok {
+					domains.Insert(domain)
+				}
+			}
+
+			cluster.Status.Placement = &v1.PlacementStatus{
+				Pods:             scheduled,
+				Domains:          int32(domains.Len()),
+				AvailableDomains: int32(available.Len()),
+			}
+			want := scheduled
+			if int32(available.Len()) < want {
+				want = int32(available.Len())
+			}
+			condition := metav1.Condition{
+				Type:               v1.KDBClusterTopologySpread,
+				Status:             metav1.ConditionTrue,
+				Reason:             "Spread",
+				Message:            fmt.Sprintf("%d pods run in %d of %d domains of %s", scheduled, domains.Len(), available.Len(), key),
+				ObservedGeneration: cluster.Generation,
+			}
+			switch {
+			case pending > 0:
+				condition.Status = metav1.ConditionFalse
+				condition.Reason = "PodsPending"
+				condition.Message = fmt.Sprintf("%d pods are not scheduled, %s", pending, condition.Message)
+			case int32(domains.Len()) < want:
+				condition.Status = metav1.ConditionFalse
+				condition.Reason = "NotSpread"
+			}
+			meta.SetStatusCondition(&cluster.Status.Conditions, condition)
+
+			rc.RequeueWithin(placementPollInterval)
+			return flow.Pass()
+		})
+}
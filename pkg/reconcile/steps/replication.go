@@ -0,0 +1,148 @@
+package steps
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sqc157400661/helper/kube"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/apis/shared"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+// replicationPollInterval is how often the replication of the pods of an
+// instance is observed, it changes without the instance being reconciled.
+const replicationPollInterval = time.Minute
+
+// ReplicationFunc fills info with the state of the database of pod and of its
+// replication.
+type ReplicationFunc func(rc *context.InstanceContext, pod *corev1.Pod, info *shared.PodStatusInfo) error
+
+// ObserveReplication reports no replication without engine hooks, see
+// ReplicationStep.
+func (s *InstanceStepManager) ObserveReplication() kube.BindFunc {
+	return s.ReplicationStep(nil)
+}
+
+// ReplicationStep returns the step that adds the state of the databases and
+// of their replication to the pods of the status, and sets the
+// ReplicationHealthy condition of an instance with replicas. The replication
+// is healthy when every replica receives and applies the transactions of its
+// source within the maximum lag and refuses the writes of clients. The
+// replicas being seeded do not replicate yet and are left out. The state of a
+// pod is read once per poll interval, the reconciles in between judge the
+// state read before.
+func (s *InstanceStepManager) ReplicationStep(observe ReplicationFunc) kube.BindFunc {
+	return s.StepBinder(
+		"ObserveReplication",
+		func(rc *context.InstanceContext, flow kube.Flow) (reconcile.Result, error) {
+			return observeInstanceReplication(rc, flow, observe)
+		})
+}
+
+// observeInstanceReplication observes the pods of the instance and sets its
+// ReplicationHealthy condition, see ReplicationStep.
+func observeInstanceReplication(rc *context.InstanceContext, flow kube.Flow, observe ReplicationFunc) (
+	reconcile.Result, error) {
+	instance := rc.GetInstance()
+	if observe == nil {
+		meta.RemoveStatusCondition(&instance.Status.Conditions, v1.KDBInstanceReplicationHealthy)
+		return flow.Pass()
+	}
+
+	pods := make(map[string]*corev1.Pod)
+	for _, runner := range rc.GetObservedRunner().List {
+		for _, pod := range runner.Pods {
+			pods[pod.Name] = pod
+		}
+	}
+	maxLag := int64(naming.MaxReplicationLagSeconds(instance))
+	var replicas int
+	var problems []string
+	reason := "Replicating"
+	problem := func(why, format string, args ...interface{}) {
+		if len(problems) == 0 {
+			reason = why
+		}
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	infos := instance.Status.InstanceSet.PodInfos
+	for i := range infos {
+		info := &infos[i]
+		pod := pods[info.PodName]
+		if pod == nil || pod.DeletionTimestamp != nil {
+			continue
+		}
+		replica := info.Role == naming.ReplicaRole &&
+			naming.ReplicaSeed(instance, pod.Labels[naming.LabelInstanceSet]) == nil
+		if replica {
+			replicas++
+		}
+		if pod.Status.Phase != corev1.PodRunning {
+			info.ReadOnly, info.GTIDExecuted, info.Replication, info.ObservedTime = nil, "", nil, nil
+			info.Message = "pod is not running"
+			if replica {
+				problem("ReplicaNotRunning", "%s is not running", pod.Name)
+			}
+			continue
+		}
+		if info.ObservedTime == nil || time.Since(info.ObservedTime.Time) >= replicationPollInterval {
+			now := metav1.Now()
+			info.ReadOnly, info.GTIDExecuted, info.Replication, info.Message = nil, "", nil, ""
+			info.ObservedTime = &now
+			if err := observe(rc, pod, info); err != nil {
+				info.Message = err.Error()
+			}
+		}
+		if info.Message != "" {
+			if replica {
+				problem("ReplicaUnreachable", "%s: %s", pod.Name, info.Message)
+			}
+			continue
+		}
+		if !replica {
+			continue
+		}
+		repl := info.Replication
+		switch {
+		case repl == nil:
+			problem("ReplicationStopped", "%s does not replicate", pod.Name)
+		case repl.IOThread != "Yes" || repl.SQLThread != "Yes":
+			problem("ReplicationStopped", "%s replicates with IO thread %s, SQL thread %s: %s",
+				pod.Name, repl.IOThread, repl.SQLThread, repl.LastError)
+		case repl.SecondsBehindSource != nil && *repl.SecondsBehindSource > maxLag:
+			problem("ReplicationLagging", "%s is %ds behind its source", pod.Name,
+				*repl.SecondsBehindSource)
+		}
+		if info.ReadOnly != nil && !*info.ReadOnly {
+			problem("ReplicaWritable", "%s accepts writes", pod.Name)
+		}
+	}
+
+	if replicas == 0 {
+		meta.RemoveStatusCondition(&instance.Status.Conditions, v1.KDBInstanceReplicationHealthy)
+		return flow.Pass()
+	}
+	condition := metav1.Condition{
+		Type:               v1.KDBInstanceReplicationHealthy,
+		Status:             metav1.ConditionTrue,
+		Reason:             reason,
+		Message:            fmt.Sprintf("%d replicas replicate within %ds", replicas, maxLag),
+		ObservedGeneration: instance.Generation,
+	}
+	if len(problems) > 0 {
+		condition.Status = metav1.ConditionFalse
+		condition.Message = strings.Join(problems, "; ")
+	}
+	meta.SetStatusCondition(&instance.Status.Conditions, condition)
+
+	rc.RequeueWithin(replicationPollInterval)
+	return flow.Pass()
+}
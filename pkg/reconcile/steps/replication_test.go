@@ -0,0 +1,255 @@
+package steps
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/util"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/apis/shared"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/internal/reconciletest"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+func TestObserveInstanceReplication(t *testing.T) {
+	t.Parallel()
+
+	// state is what observing a pod reads.
+	type state struct {
+		repl     *shared.ReplicationStatus
+		writable bool
+		err      error
+	}
+	replicating := func(io, sql string, lag int64) state {
+		return state{repl: &shared.ReplicationStatus{
+			Source: "kdb0-0:3306", IOThread: io, SQLThread: sql, SecondsBehindSource: &lag,
+		}}
+	}
+	newInstance := func(replicas int32) *v1.KDBInstance {
+		instance := &v1.KDBInstance{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "kdb"}}
+		instance.Spec.InstanceSet.Replicas = util.Int32(replicas)
+		for i := int32(0); i < replicas; i++ {
+			role := naming.ReplicaRole
+			if i == 0 {
+				role = naming.MasterRole
+			}
+			instance.Status.InstanceSet.PodInfos = append(instance.Status.InstanceSet.PodInfos,
+				shared.PodStatusInfo{PodName: naming.InstancePodName(instance.Name, int(i)), Role: role})
+		}
+		return instance
+	}
+	observeStates := func(states map[string]state, calls *int) ReplicationFunc {
+		return func(rc *context.InstanceContext, pod *corev1.Pod, info *shared.PodStatusInfo) error {
+			*calls++
+			s := states[pod.Name]
+			readOnly := !s.writable
+			info.ReadOnly, info.Replication = &readOnly, s.repl
+			return s.err
+		}
+	}
+
+	for _, tt := range []struct {
+		name       string
+		replicas   int32
+		states     map[string]state
+		notRunning []int
+		seeding    []int
+
+		// status of the condition, empty when there is none.
+		status  metav1.ConditionStatus
+		reason  string
+		message string
+	}{
+		{
+			name:     "Healthy",
+			replicas: 3,
+			states: map[string]state{
+				"kdb1-0": replicating("Yes", "Yes", 0),
+				"kdb2-0": replicating("Yes", "Yes", 30),
+			},
+			status:  metav1.ConditionTrue,
+			reason:  "Replicating",
+			message: "2 replicas replicate within 30s",
+		},
+		{
+			name:     "MasterUnreachable",
+			replicas: 2,
+			states: map[string]state{
+				"kdb0-0": {err: errors.New("connection refused")},
+				"kdb1-0": replicating("Yes", "Yes", 0),
+			},
+			status:  metav1.ConditionTrue,
+			reason:  "Replicating",
+			message: "1 replicas replicate within 30s",
+		},
+		{
+			name:     "Stopped",
+			replicas: 2,
+			states:   map[string]state{"kdb1-0": {}},
+			status:   metav1.ConditionFalse,
+			reason:   "ReplicationStopped",
+			message:  "kdb1-0 does not replicate",
+		},
+		{
+			name:     "ThreadStopped",
+			replicas: 2,
+			states: map[string]state{"kdb1-0": func() state {
+				s := replicating("No", "Yes", 0)
+				s.repl.LastError = "error connecting to source"
+				return s
+			}()},
+			status:  metav1.ConditionFalse,
+			reason:  "ReplicationStopped",
+			message: "kdb1-0 replicates with IO thread No, SQL thread Yes: error connecting to source",
+		},
+		{
+			name:     "Lagging",
+			replicas: 2,
+			states:   map[string]state{"kdb1-0": replicating("Yes", "Yes", 31)},
+			status:   metav1.ConditionFalse,
+			reason:   "ReplicationLagging",
+			message:  "kdb1-0 is 31s behind its source",
+		},
+		{
+			name:     "Writable",
+			replicas: 2,
+			states: map[string]state{"kdb1-0": func() state {
+				s := replicating("Yes", "Yes", 0)
+				s.writable = true
+				return s
+			}()},
+			status:  metav1.ConditionFalse,
+			reason:  "ReplicaWritable",
+			message: "kdb1-0 accepts writes",
+		},
+		{
+			name:     "Unreachable",
+			replicas: 2,
+			states:   map[string]state{"kdb1-0": {err: errors.New("connection refused")}},
+			status:   metav1.ConditionFalse,
+			reason:   "ReplicaUnreachable",
+			message:  "kdb1-0: connection refused",
+		},
+		{
+			name:       "NotRunning",
+			replicas:   2,
+			notRunning: []int{1},
+			status:     metav1.ConditionFalse,
+			reason:     "ReplicaNotRunning",
+			message:    "kdb1-0 is not running",
+		},
+		{
+			name:     "FirstReasonWins",
+			replicas: 3,
+			states: map[string]state{
+				"kdb1-0": {},
+				"kdb2-0": replicating("Yes", "Yes", 60),
+			},
+			status:  metav1.ConditionFalse,
+			reason:  "ReplicationStopped",
+			message: "kdb1-0 does not replicate; kdb2-0 is 60s behind its source",
+		},
+		{
+			name:     "SeedingLeftOut",
+			replicas: 3,
+			states: map[string]state{
+				"kdb1-0": {},
+				"kdb2-0": replicating("Yes", "Yes", 0),
+			},
+			seeding: []int{1},
+			status:  metav1.ConditionTrue,
+			reason:  "Replicating",
+			message: "1 replicas replicate within 30s",
+		},
+		{
+			name:     "NoReplicas",
+			replicas: 1,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			instance := newInstance(tt.replicas)
+			meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+				Type: v1.KDBInstanceReplicationHealthy, Status: metav1.ConditionUnknown, Reason: "Unknown",
+			})
+			for _, i := range tt.seeding {
+				instance.Status.Seeding = append(instance.Status.Seeding,
+					v1.ReplicaSeedStatus{Set: naming.InstanceStatefulSetName(instance.Name, i)})
+			}
+			rc, _, _ := reconciletest.NewInstanceContext(t, instance)
+			running := make([]int, tt.replicas)
+			for i := range running {
+				running[i] = i
+			}
+			observeSets(rc, true, running...)
+			for _, i := range tt.notRunning {
+				set := naming.InstanceStatefulSetName(instance.Name, i)
+				rc.GetObservedRunner().BySet[set].Pods[0].Status.Phase = corev1.PodPending
+			}
+
+			flow := &reconciletest.Flow{}
+			_, err := observeInstanceReplication(rc, flow, observeStates(tt.states, new(int)))
+			assert.NilError(t, err)
+			assert.Equal(t, flow.Result, "Pass")
+			condition := meta.FindStatusCondition(rc.GetInstance().Status.Conditions,
+				v1.KDBInstanceReplicationHealthy)
+			if tt.status == "" {
+				assert.Assert(t, condition == nil)
+				return
+			}
+			assert.Equal(t, condition.Status, tt.status)
+			assert.Equal(t, condition.Reason, tt.reason)
+			assert.Equal(t, condition.Message, tt.message)
+			assert.Equal(t, rc.RequeueAfter(), replicationPollInterval)
+		})
+	}
+
+	t.Run("NoHooks", func(t *testing.T) {
+		instance := newInstance(2)
+		meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+			Type: v1.KDBInstanceReplicationHealthy, Status: metav1.ConditionTrue, Reason: "Replicating",
+		})
+		rc, _, _ := reconciletest.NewInstanceContext(t, instance)
+		observeSets(rc, true, 0, 1)
+
+		_, err := observeInstanceReplication(rc, &reconciletest.Flow{}, nil)
+		assert.NilError(t, err)
+		assert.Assert(t, meta.FindStatusCondition(rc.GetInstance().Status.Conditions,
+			v1.KDBInstanceReplicationHealthy) == nil)
+	})
+
+	t.Run("ObservesOncePerPoll", func(t *testing.T) {
+		rc, _, _ := reconciletest.NewInstanceContext(t, newInstance(2))
+		observeSets(rc, true, 0, 1)
+		calls := 0
+		observe := observeStates(map[string]state{"kdb1-0": replicating("Yes", "Yes", 0)}, &calls)
+
+		_, err := observeInstanceReplication(rc, &reconciletest.Flow{}, observe)
+		assert.NilError(t, err)
+		assert.Equal(t, calls, 2)
+
+		// The next reconcile judges the state read before.
+		_, err = observeInstanceReplication(rc, &reconciletest.Flow{}, observe)
+		assert.NilError(t, err)
+		assert.Equal(t, calls, 2)
+		assert.Assert(t, meta.IsStatusConditionTrue(rc.GetInstance().Status.Conditions,
+			v1.KDBInstanceReplicationHealthy))
+
+		// Once the poll interval passed the pods are read again.
+		past := metav1.NewTime(time.Now().Add(-replicationPollInterval))
+		for i := range rc.GetInstance().Status.InstanceSet.PodInfos {
+			rc.GetInstance().Status.InstanceSet.PodInfos[i].ObservedTime = &past
+		}
+		_, err = observeInstanceReplication(rc, &reconciletest.Flow{}, observe)
+		assert.NilError(t, err)
+		assert.Equal(t, calls, 4)
+	})
+}
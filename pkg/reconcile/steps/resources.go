@@ -0,0 +1,179 @@
+package steps
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/helper/kube"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/apis/shared"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+// CheckResources refuses container resources that no node can fit before the
+// config is tuned for them and the pods are rolled. It sets the ResourcesFit
+// condition to False and the other steps go on, e.g. a shutdown or a scale
+// down. While the condition is False the config keeps its tuning and the pods
+// are not replaced, they keep running with their resources until the spec is
+// fixed, see ResourcesFit.
+func (s *InstanceStepManager) CheckResources() kube.BindFunc {
+	return s.StepBinder(
+		"CheckResources",
+		func(rc *context.InstanceContext, flow kube.Flow) (reconcile.Result, error) {
+			instance := rc.GetInstance()
+			instanceSet := naming.InstanceSetSpec(instance)
+			requests := podRequests(instanceSet)
+			if len(requests) == 0 {
+				return flow.Pass()
+			}
+			nodes := &corev1.NodeList{}
+			if err := errors.WithStack(rc.Client().List(rc.Context(), nodes)); err != nil {
+				return flow.Error(err, "list nodes err")
+			}
+			// Without nodes there is nothing to compare with.
+			if len(nodes.Items) == 0 {
+				return flow.Pass()
+			}
+			for i := range nodes.Items {
+				if nodeFits(&nodes.Items[i], instanceSet, requests) {
+					meta.RemoveStatusCondition(&instance.Status.Conditions, v1.KDBInstanceResourcesFit)
+					return flow.Pass()
+				}
+			}
+
+			message := fmt.Sprintf("No node can fit a pod requesting cpu %s and memory %s",
+				requests.Cpu().String(), requests.Memory().String())
+			cond := meta.FindStatusCondition(instance.Status.Conditions, v1.KDBInstanceResourcesFit)
+			if cond == nil || cond.Message != message {
+				rc.Recorder().Event(instance, corev1.EventTypeWarning, "InsufficientResources", message)
+			}
+			meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+				Type:               v1.KDBInstanceResourcesFit,
+				Status:             metav1.ConditionFalse,
+				Reason:             "InsufficientResources",
+				Message:            message,
+				ObservedGeneration: instance.Generation,
+			})
+			return flow.Pass()
+		})
+}
+
+// ResourcesFit reports whether a node can fit the resources of the spec of
+// instance, as checked by CheckResources the last time.
+func ResourcesFit(instance *v1.KDBInstance) bool {
+	return !meta.IsStatusConditionFalse(instance.Status.Conditions, v1.KDBInstanceResourcesFit)
+}
+
+// podRequests returns the cpu and memory the containers of a pod request. A
+// container without requests requests its limits. The init containers run
+// one after the other before the containers, a pod requests the larger of
+// their requests and the sum of the requests of the containers.
+func podRequests(instanceSet shared.InstanceSetSpec) corev1.ResourceList {
+	containers := []shared.ContainerSpec{instanceSet.MainContainer}
+	if instanceSet.SidecarContainer.Image != "" {
+		containers = append(containers, instanceSet.SidecarContainer)
+	}
+	requests := corev1.ResourceList{}
+	for _, container := range containers {
+		for name, quantity := range containerRequests(container) {
+			total := requests[name]
+			total.Add(quantity)
+			requests[name] = total
+		}
+	}
+	for name, quantity := range containerRequests(instanceSet.InitContainer) {
+		if total, ok := requests[name]; !ok || quantity.Cmp(total) > 0 {
+			requests[name] = quantity
+		}
+	}
+	return requests
+}
+
+// containerRequests returns the cpu and memory container requests.
+func containerRequests(container shared.ContainerSpec) corev1.ResourceList {
+	requests := corev1.ResourceList{}
+	for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+		quantity, ok := container.Resources.Requests[name]
+		if !ok {
+			quantity, ok = container.Resources.Limits[name]
+		}
+		if ok {
+			requests[name] = quantity
+		}
+	}
+	return requests
+}
+
+// nodeFits reports whether the allocatable resources of node can hold a pod
+// of instanceSet with requests. Nodes that are cordoned, have taints the pod
+// does not tolerate or do not match its required node affinity are skipped.
+func nodeFits(node *corev1.Node, instanceSet shared.InstanceSetSpec, requests corev1.ResourceList) bool {
+	if node.Spec.Unschedulable {
+		return false
+	}
+	for i := range node.Spec.Taints {
+		taint := &node.Spec.Taints[i]
+		if taint.Effect == corev1.TaintEffectPreferNoSchedule {
+			continue
+		}
+		tolerated := false
+		for j := range instanceSet.Tolerations {
+			if instanceSet.Tolerations[j].ToleratesTaint(taint) {
+				tolerated = true
+				break
+			}
+		}
+		if !tolerated {
+			return false
+		}
+	}
+	if affinity := instanceSet.Affinity; affinity != nil && affinity.NodeAffinity != nil &&
+		affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution != nil &&
+		!nodeSelectorMatches(node, affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution) {
+		return false
+	}
+	for name, quantity := range requests {
+		allocatable, ok := node.Status.Allocatable[name]
+		if !ok || allocatable.Cmp(quantity) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// nodeSelectorMatches reports whether the labels of node match one of the
+// terms of selector. Fields and the Gt and Lt operators are not checked.
+func nodeSelectorMatches(node *corev1.Node, selector *corev1.NodeSelector) bool {
+	operators := map[corev1.NodeSelectorOperator]selection.Operator{
+		corev1.NodeSelectorOpIn:           selection.In,
+		corev1.NodeSelectorOpNotIn:        selection.NotIn,
+		corev1.NodeSelectorOpExists:       selection.Exists,
+		corev1.NodeSelectorOpDoesNotExist: selection.DoesNotExist,
+	}
+	for _, term := range selector.NodeSelectorTerms {
+		matches := true
+		for _, expression := range term.MatchExpressions {
+			operator, ok := operators[expression.Operator]
+			if !ok {
+				continue
+			}
+			requirement, err := labels.NewRequirement(expression.Key, operator, expression.Values)
+			if err != nil || !requirement.Matches(labels.Set(node.Labels)) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,197 @@
+package steps
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/sqc157400661/kdb/apis/shared"
+)
+
+func TestPodRequests(t *testing.T) {
+	t.Parallel()
+
+	container := func(cpu, memory string, limits bool) shared.ContainerSpec {
+		list := corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse(cpu),
+			corev1.ResourceMemory: resource.MustParse(memory),
+		}
+		if limits {
+			return shared.ContainerSpec{Resources: corev1.ResourceRequirements{Limits: list}}
+		}
+		return shared.ContainerSpec{Resources: corev1.ResourceRequirements{Requests: list}}
+	}
+
+	t.Run("NoResources", func(t *testing.T) {
+		assert.Equal(t, len(podRequests(shared.InstanceSetSpec{})), 0)
+	})
+
+	t.Run("SidecarWithoutImage", func(t *testing.T) {
+		requests := podRequests(shared.InstanceSetSpec{
+			MainContainer:    container("1", "1Gi", false),
+			SidecarContainer: container("500m", "512Mi", false),
+		})
+		assert.Equal(t, requests.Cpu().String(), "1")
+		assert.Equal(t, requests.Memory().String(), "1Gi")
+	})
+
+	t.Run("Sum", func(t *testing.T) {
+		sidecar := container("500m", "512Mi", false)
+		sidecar.Image = "sidecar"
+		requests := podRequests(shared.InstanceSetSpec{
+			MainContainer:    container("1", "1Gi", true),
+			SidecarContainer: sidecar,
+		})
+		assert.Equal(t, requests.Cpu().String(), "1500m")
+		assert.Equal(t, requests.Memory().String(), "1536Mi")
+	})
+
+	t.Run("InitContainer", func(t *testing.T) {
+		requests := podRequests(shared.InstanceSetSpec{
+			InitContainer: container("2", "512Mi", false),
+			MainContainer: container("1", "1Gi", false),
+		})
+		assert.Equal(t, requests.Cpu().String(), "2")
+		assert.Equal(t, requests.Memory().String(), "1Gi")
+	})
+}
+
+func TestNodeFits(t *testing.T) {
+	t.Parallel()
+
+	requests := corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("2"),
+		corev1.ResourceMemory: resource.MustParse("4Gi"),
+	}
+	node := func() *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node", Labels: map[string]string{"disk": "ssd"}},
+			Status: corev1.NodeStatus{Allocatable: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("4"),
+				corev1.ResourceMemory: resource.MustParse("8Gi"),
+			}},
+		}
+	}
+
+	t.Run("Fits", func(t *testing.T) {
+		assert.Assert(t, nodeFits(node(), shared.InstanceSetSpec{}, requests))
+	})
+
+	t.Run("TooSmall", func(t *testing.T) {
+		small := node()
+		small.Status.Allocatable[corev1.ResourceMemory] = resource.MustParse("2Gi")
+		assert.Assert(t, !nodeFits(small, shared.InstanceSetSpec{}, requests))
+	})
+
+	t.Run("Unschedulable", func(t *testing.T) {
+		cordoned := node()
+		cordoned.Spec.Unschedulable = true
+		assert.Assert(t, !nodeFits(cordoned, shared.InstanceSetSpec{}, requests))
+	})
+
+	t.Run("Taints", func(t *testing.T) {
+		tainted := node()
+		tainted.Spec.Taints = []corev1.Taint{{Key: "dedicated", Value: "db", Effect: corev1.TaintEffectNoSchedule}}
+		assert.Assert(t, !nodeFits(tainted, shared.InstanceSetSpec{}, requests))
+
+		tolerated := shared.InstanceSetSpec{Tolerations: []corev1.Toleration{{
+			Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "db", Effect: corev1.TaintEffectNoSchedule,
+		}}}
+		assert.Assert(t, nodeFits(tainted, tolerated, requests))
+
+		preferred := node()
+		preferred.Spec.Taints = []corev1.Taint{{Key: "dedicated", Effect: corev1.TaintEffectPreferNoSchedule}}
+		assert.Assert(t, nodeFits(preferred, shared.InstanceSetSpec{}, requests))
+	})
+
+	t.Run("NodeAffinity", func(t *testing.T) {
+		affinity := func(values ...string) shared.InstanceSetSpec {
+			return shared.InstanceSetSpec{Affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+					NodeSelectorTerms: []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{{
+						Key: "disk", Operator: corev1.NodeSelectorOpIn, Values: values,
+					}}}},
+				},
+			}}}
+		}
+		assert.Assert(t, nodeFits(node(), affinity("ssd"), requests))
+		assert.Assert(t, !nodeFits(node(), affinity("hdd"), requests))
+	})
+}
+
+func TestNodeSelectorMatches(t *testing.T) {
+	t.Parallel()
+
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{
+		"disk": "ssd",
+		"zone": "a",
+	}}}
+	term := func(requirements ...corev1.NodeSelectorRequirement) corev1.NodeSelectorTerm {
+		return corev1.NodeSelectorTerm{MatchExpressions: requirements}
+	}
+
+	for _, tt := range []struct {
+		name    string
+		terms   []corev1.NodeSelectorTerm
+		matches bool
+	}{
+		{
+			name:    "NoTerms",
+			matches: false,
+		},
+		{
+			name: "In",
+			terms: []corev1.NodeSelectorTerm{term(corev1.NodeSelectorRequirement{
+				Key: "disk", Operator: corev1.NodeSelectorOpIn, Values: []string{"ssd", "nvme"},
+			})},
+			matches: true,
+		},
+		{
+			name: "NotIn",
+			terms: []corev1.NodeSelectorTerm{term(corev1.NodeSelectorRequirement{
+				Key: "zone", Operator: corev1.NodeSelectorOpNotIn, Values: []string{"a"},
+			})},
+			matches: false,
+		},
+		{
+			name: "Exists",
+			terms: []corev1.NodeSelectorTerm{term(
+				corev1.NodeSelectorRequirement{Key: "zone", Operator: corev1.NodeSelectorOpExists},
+				corev1.NodeSelectorRequirement{Key: "gpu", Operator: corev1.NodeSelectorOpDoesNotExist},
+			)},
+			matches: true,
+		},
+		{
+			name: "AllExpressionsOfATerm",
+			terms: []corev1.NodeSelectorTerm{term(
+				corev1.NodeSelectorRequirement{Key: "disk", Operator: corev1.NodeSelectorOpIn, Values: []string{"ssd"}},
+				corev1.NodeSelectorRequirement{Key: "zone", Operator: corev1.NodeSelectorOpIn, Values: []string{"b"}},
+			)},
+			matches: false,
+		},
+		{
+			name: "AnyTerm",
+			terms: []corev1.NodeSelectorTerm{
+				term(corev1.NodeSelectorRequirement{Key: "zone", Operator: corev1.NodeSelectorOpIn, Values: []string{"b"}}),
+				term(corev1.NodeSelectorRequirement{Key: "zone", Operator: corev1.NodeSelectorOpIn, Values: []string{"a"}}),
+			},
+			matches: true,
+		},
+		{
+			name: "GtIsNotChecked",
+			terms: []corev1.NodeSelectorTerm{term(corev1.NodeSelectorRequirement{
+				Key: "cores", Operator: corev1.NodeSelectorOpGt, Values: []string{"8"},
+			})},
+			matches: true,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			selector := &corev1.NodeSelector{NodeSelectorTerms: tt.terms}
+			assert.Equal(t, nodeSelectorMatches(node, selector), tt.matches)
+		})
+	}
+}
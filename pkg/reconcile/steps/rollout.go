@@ -0,0 +1,204 @@
+package steps
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/helper/kube"
+	"github.com/sqc157400661/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+const (
+	// rolloutPollInterval is how often a rollout checks the pod it replaced.
+	rolloutPollInterval = 10 * time.Second
+
+	// rolloutReadyTimeout is how long a replaced pod may take to become ready
+	// before the rollout pauses.
+	rolloutReadyTimeout = 10 * time.Minute
+)
+
+// SwitchoverFunc moves the master role from master to one of the ready
+// candidates before master is deleted.
+type SwitchoverFunc func(rc *context.InstanceContext, master *corev1.Pod, candidates []*corev1.Pod) error
+
+// RolloutInstance replaces the pods that do not match the template of their
+// StatefulSet without a switchover.
+func (s *InstanceStepManager) RolloutInstance() kube.BindFunc {
+	return s.RolloutStep(nil)
+}
+
+// RolloutStep returns the step that replaces outdated pods. The StatefulSets
+// use the OnDelete strategy, so the step deletes one outdated pod at a time,
+// the replicas first and the master last, and waits for the pods to be ready
+// in between. When switchover is not nil it is called before the master is
+// deleted. The rollout pauses when a replaced pod does not become ready and
+// resumes once it is ready or the spec changes.
+func (s *InstanceStepManager) RolloutStep(switchover SwitchoverFunc) kube.BindFunc {
+	return s.StepBinder(
+		"RolloutInstance",
+		func(rc *context.InstanceContext, flow kube.Flow) (reconcile.Result, error) {
+			return rolloutInstance(rc, flow, switchover)
+		})
+}
+
+// rolloutInstance deletes the next outdated pod, see RolloutStep.
+func rolloutInstance(rc *context.InstanceContext, flow kube.Flow, switchover SwitchoverFunc) (reconcile.Result, error) {
+	instance := rc.GetInstance()
+	// The rollback of a major upgrade replaces the pods itself. Pods
+	// with resources no node fits would not be scheduled again.
+	if naming.IsRollingBack(instance) || !ResourcesFit(instance) {
+		return flow.Pass()
+	}
+	var pods, outdated []*corev1.Pod
+	for _, item := range rc.GetObservedRunner().List {
+		// A replica being seeded is restarted by its seeding, it
+		// joins the rollout once it replicates.
+		if len(item.Pods) == 0 || naming.ReplicaSeed(instance, item.Name) != nil {
+			continue
+		}
+		matches, known := item.PodMatchesPodTemplate()
+		if !known {
+			return flow.RetryAfter(rolloutPollInterval, "waiting for StatefulSet status", "set", item.Name)
+		}
+		pods = append(pods, item.Pods[0])
+		// A pod is restarted to grow the file system of a volume
+		// that cannot be expanded online, or to load a certificate
+		// its server cannot reload.
+		restart := item.Pods[0].Annotations[naming.RestartForVolumeResize] != "" ||
+			item.Pods[0].Annotations[naming.RestartForCertificate] != ""
+		if !matches || restart {
+			outdated = append(outdated, item.Pods[0])
+		}
+	}
+	if len(outdated) == 0 {
+		if meta.FindStatusCondition(instance.Status.Conditions, v1.KDBInstanceProgressing) != nil {
+			setProgressing(instance, metav1.ConditionFalse, "RolloutComplete",
+				"All pods match their template")
+		}
+		return flow.Pass()
+	}
+
+	// Replace pods only while all of them are ready, so that no more
+	// than one pod is unavailable because of the rollout. An outdated
+	// pod that is not ready is replaced right away, this is how a
+	// paused rollout resumes after the spec is fixed.
+	for _, pod := range pods {
+		switch {
+		case pod.DeletionTimestamp == nil && util.IsPodReady(pod):
+			continue
+		case pod.DeletionTimestamp == nil && isOutdated(pod, outdated):
+			setProgressing(instance, metav1.ConditionTrue, "RollingUpdate",
+				fmt.Sprintf("Replacing pod %s that is not ready", pod.Name))
+			if err := switchoverBeforeDelete(rc, switchover, pod, pods, outdated); err != nil {
+				return flow.Error(err, "switchover err", "pod", pod.Name)
+			}
+			return deleteOutdatedPod(rc, flow, pod)
+		case pod.DeletionTimestamp == nil && time.Since(pod.CreationTimestamp.Time) > rolloutReadyTimeout:
+			message := fmt.Sprintf("Pod %s is not ready after %s", pod.Name, rolloutReadyTimeout)
+			if !isRolloutPaused(instance) {
+				rc.Recorder().Event(instance, corev1.EventTypeWarning, "RolloutPaused", message)
+			}
+			setProgressing(instance, metav1.ConditionFalse, "RolloutPaused", message)
+			return flow.Wait("rollout paused", "pod", pod.Name)
+		default:
+			return flow.RetryAfter(rolloutPollInterval, "waiting for pod to be ready", "pod", pod.Name)
+		}
+	}
+
+	sort.SliceStable(outdated, func(i, j int) bool {
+		if naming.IsMasterPod(outdated[i]) != naming.IsMasterPod(outdated[j]) {
+			return !naming.IsMasterPod(outdated[i])
+		}
+		return outdated[i].Name < outdated[j].Name
+	})
+	pod := outdated[0]
+	setProgressing(instance, metav1.ConditionTrue, "RollingUpdate",
+		fmt.Sprintf("Replacing pod %s, %d of %d pods are outdated", pod.Name, len(outdated), len(pods)))
+
+	if err := switchoverBeforeDelete(rc, switchover, pod, pods, outdated); err != nil {
+		return flow.Error(err, "switchover err", "pod", pod.Name)
+	}
+	return deleteOutdatedPod(rc, flow, pod)
+}
+
+// switchoverBeforeDelete moves the master role from pod to one of the updated
+// pods when pod is the master, whether it is ready or not. A master that is
+// not ready may be replaced before the replicas, the outdated ones are
+// candidates then. The pod is not deleted when the switchover fails, its
+// replacement would not be the master.
+func switchoverBeforeDelete(rc *context.InstanceContext, switchover SwitchoverFunc, pod *corev1.Pod,
+	pods, outdated []*corev1.Pod) error {
+	if !naming.IsMasterPod(pod) || switchover == nil || len(pods) < 2 {
+		return nil
+	}
+	var candidates, others []*corev1.Pod
+	for _, candidate := range pods {
+		if candidate == pod {
+			continue
+		}
+		others = append(others, candidate)
+		if !isOutdated(candidate, outdated) {
+			candidates = append(candidates, candidate)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = others
+	}
+	err := switchover(rc, pod, candidates)
+	if err != nil {
+		instance := rc.GetInstance()
+		rc.Recorder().Event(instance, corev1.EventTypeWarning, "SwitchoverFailed", err.Error())
+		setProgressing(instance, metav1.ConditionFalse, "RolloutPaused",
+			fmt.Sprintf("Switchover from %s failed: %v", pod.Name, err))
+	}
+	return err
+}
+
+// deleteOutdatedPod deletes pod so that its StatefulSet creates it again from
+// the current template.
+func deleteOutdatedPod(rc *context.InstanceContext, flow kube.Flow, pod *corev1.Pod) (reconcile.Result, error) {
+	uid := pod.GetUID()
+	err := errors.WithStack(client.IgnoreNotFound(rc.Client().Delete(rc.Context(), pod,
+		client.Preconditions{UID: &uid})))
+	if err != nil {
+		return flow.Error(err, "delete outdated pod err", "pod", pod.Name)
+	}
+	rc.Recorder().Eventf(rc.GetInstance(), corev1.EventTypeNormal, "RollingUpdate",
+		"Deleted outdated pod %s", pod.Name)
+	return flow.RetryAfter(rolloutPollInterval, "replacing outdated pod", "pod", pod.Name)
+}
+
+func isOutdated(pod *corev1.Pod, outdated []*corev1.Pod) bool {
+	for _, o := range outdated {
+		if o == pod {
+			return true
+		}
+	}
+	return false
+}
+
+func isRolloutPaused(instance *v1.KDBInstance) bool {
+	cond := meta.FindStatusCondition(instance.Status.Conditions, v1.KDBInstanceProgressing)
+	return cond != nil && cond.Reason == "RolloutPaused"
+}
+
+func setProgressing(instance *v1.KDBInstance, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+		Type:               v1.KDBInstanceProgressing,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: instance.Generation,
+	})
+}
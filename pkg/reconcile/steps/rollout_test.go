@@ -0,0 +1,177 @@
+package steps
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/util"
+	"gotest.tools/v3/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/internal/reconciletest"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+// outdate gives the StatefulSets of rc a new revision, the pods of the sets
+// in outdated keep the old one.
+func outdate(rc *context.InstanceContext, outdated ...int) {
+	for _, item := range rc.GetObservedRunner().List {
+		item.Runner.Status.UpdateRevision = "new"
+		for _, pod := range item.Pods {
+			pod.Labels[appsv1.StatefulSetRevisionLabel] = "new"
+		}
+	}
+	for _, i := range outdated {
+		set := naming.InstanceStatefulSetName(rc.GetInstance().Name, i)
+		for _, pod := range rc.GetObservedRunner().BySet[set].Pods {
+			pod.Labels[appsv1.StatefulSetRevisionLabel] = "old"
+		}
+	}
+}
+
+// unready marks the pod of the set i of rc as not ready since created.
+func unready(rc *context.InstanceContext, i int, created time.Time) {
+	set := naming.InstanceStatefulSetName(rc.GetInstance().Name, i)
+	for _, pod := range rc.GetObservedRunner().BySet[set].Pods {
+		pod.Status.ContainerStatuses = nil
+		pod.CreationTimestamp = metav1.NewTime(created)
+	}
+}
+
+// deletedPods returns the pods the rollout deleted according to its events.
+func deletedPods(recorder *record.FakeRecorder) []string {
+	var deleted []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			const prefix = "Normal RollingUpdate Deleted outdated pod "
+			if strings.HasPrefix(event, prefix) {
+				deleted = append(deleted, strings.TrimPrefix(event, prefix))
+			}
+		default:
+			return deleted
+		}
+	}
+}
+
+func TestRolloutInstance(t *testing.T) {
+	t.Parallel()
+
+	failed := errors.New("replica is behind")
+	for _, tt := range []struct {
+		name     string
+		outdated []int
+		unready  []int
+		stuck    []int
+		err      error
+
+		result     string
+		deleted    []string
+		candidates []string
+		progress   string
+	}{
+		{
+			name:   "Complete",
+			result: "Pass",
+		},
+		{
+			name:     "ReplicasFirst",
+			outdated: []int{0, 1, 2},
+			result:   "RetryAfter",
+			deleted:  []string{"kdb1-0"},
+			progress: "RollingUpdate",
+		},
+		{
+			name:       "MasterLast",
+			outdated:   []int{0},
+			result:     "RetryAfter",
+			deleted:    []string{"kdb0-0"},
+			candidates: []string{"kdb1-0", "kdb2-0"},
+			progress:   "RollingUpdate",
+		},
+		{
+			name:     "WaitsForReady",
+			outdated: []int{0, 2},
+			unready:  []int{1},
+			result:   "RetryAfter",
+		},
+		{
+			name:     "PausesWhenNotReady",
+			outdated: []int{0, 2},
+			stuck:    []int{1},
+			result:   "Wait",
+			progress: "RolloutPaused",
+		},
+		{
+			name:       "OutdatedNotReadyFirst",
+			outdated:   []int{0, 1},
+			unready:    []int{0},
+			result:     "RetryAfter",
+			deleted:    []string{"kdb0-0"},
+			candidates: []string{"kdb2-0"},
+			progress:   "RollingUpdate",
+		},
+		{
+			name:       "OutdatedCandidates",
+			outdated:   []int{0, 1, 2},
+			unready:    []int{0},
+			result:     "RetryAfter",
+			deleted:    []string{"kdb0-0"},
+			candidates: []string{"kdb1-0", "kdb2-0"},
+			progress:   "RollingUpdate",
+		},
+		{
+			name:       "SwitchoverFails",
+			outdated:   []int{0},
+			err:        failed,
+			result:     "Error",
+			candidates: []string{"kdb1-0", "kdb2-0"},
+			progress:   "RolloutPaused",
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			instance := &v1.KDBInstance{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "kdb"}}
+			instance.Spec.InstanceSet.Replicas = util.Int32(3)
+			rc, _, recorder := reconciletest.NewInstanceContext(t, instance)
+			observeSets(rc, true, 0, 1, 2)
+			outdate(rc, tt.outdated...)
+			for _, i := range tt.unready {
+				unready(rc, i, time.Now())
+			}
+			for _, i := range tt.stuck {
+				unready(rc, i, time.Now().Add(-2*rolloutReadyTimeout))
+			}
+			var candidates []string
+			switchover := func(rc *context.InstanceContext, master *corev1.Pod, pods []*corev1.Pod) error {
+				assert.Equal(t, master.Name, "kdb0-0")
+				for _, pod := range pods {
+					candidates = append(candidates, pod.Name)
+				}
+				return tt.err
+			}
+
+			flow := &reconciletest.Flow{}
+			_, err := rolloutInstance(rc, flow, switchover)
+			assert.Equal(t, err, tt.err)
+			assert.Equal(t, flow.Result, tt.result)
+			assert.DeepEqual(t, deletedPods(recorder), tt.deleted)
+			assert.DeepEqual(t, candidates, tt.candidates)
+			progressing := meta.FindStatusCondition(rc.GetInstance().Status.Conditions, v1.KDBInstanceProgressing)
+			if tt.progress == "" {
+				assert.Assert(t, progressing == nil)
+			} else {
+				assert.Equal(t, progressing.Reason, tt.progress)
+			}
+		})
+	}
+}
@@ -0,0 +1,401 @@
+package steps
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/helper/kube"
+	"github.com/sqc157400661/util"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+// rotationGracePeriod is how long the old passwords are accepted after the
+// new ones are stored in the credentials Secret. The kubelet updates the
+// files of the Secret in the running pods within about a minute.
+const rotationGracePeriod = 5 * time.Minute
+
+// credentialPropagationPeriod is how long a rotation waits before it sets the
+// first password. The kubelet projects the new passwords into the running pods
+// meanwhile, the probes fall back to them on servers without dual passwords.
+const credentialPropagationPeriod = 2 * time.Minute
+
+// rotationOrder is the order in which the passwords are rotated. The root
+// password comes last: the operator runs the statements as root.
+var rotationOrder = []string{
+	naming.MonitorPasswordSecretKey,
+	naming.BackupPasswordSecretKey,
+	naming.ReplPasswordSecretKey,
+	naming.RootPasswordSecretKey,
+}
+
+// CredentialHooks are the engine specific parts of rotating the passwords of
+// the database users.
+type CredentialHooks struct {
+	// SetPassword sets the password of the user of key on the master and
+	// makes the replicas use it, the pods of the followers of a cluster are
+	// replicas too. The old password must keep working until
+	// DiscardOldPasswords when the server supports it.
+	SetPassword func(rc *context.InstanceContext, master *corev1.Pod, replicas []*corev1.Pod,
+		key, password string) error
+
+	// DiscardOldPasswords makes the master refuse the old passwords.
+	DiscardOldPasswords func(rc *context.InstanceContext, master *corev1.Pod) error
+}
+
+// RotateCredentials is not supported without engine hooks, see
+// RotationStep.
+func (s *InstanceStepManager) RotateCredentials() kube.BindFunc {
+	return s.RotationStep(nil)
+}
+
+// RotationStep returns the step that rotates the passwords of the database
+// users when the kdb.rotate-credentials annotation changes or the interval of
+// the spec has passed. The new passwords are kept in the credentials Secret
+// while they are set, one user at a time, and replace the old ones once set.
+// The first one is set after credentialPropagationPeriod, the old ones are
+// discarded after rotationGracePeriod. The consumers of the credentials are
+// restarted once all are set.
+//
+// The instances of a cluster share their passwords and replicate the users
+// from its leader. The leader rotates the passwords of all of them, the
+// followers never start a rotation and ignore kdb.rotate-credentials.
+func (s *InstanceStepManager) RotationStep(hooks *CredentialHooks) kube.BindFunc {
+	return s.StepBinder(
+		"RotateCredentials",
+		func(rc *context.InstanceContext, flow kube.Flow) (reconcile.Result, error) {
+			return rotateCredentials(rc, flow, hooks)
+		})
+}
+
+func rotateCredentials(rc *context.InstanceContext, flow kube.Flow, hooks *CredentialHooks) (reconcile.Result, error) {
+	if hooks == nil || hooks.SetPassword == nil {
+		return flow.Pass()
+	}
+	instance := rc.GetInstance()
+	if naming.KDBInstanceClusterID(instance) != "" && !naming.IsEmptyLeader(instance.Spec.Leader) {
+		return flow.Pass()
+	}
+	followers, err := clusterFollowers(rc)
+	if err != nil {
+		return flow.Error(err, "list cluster followers err")
+	}
+	if instance.Status.Credentials == nil || instance.Status.Credentials.Rotation == nil {
+		// The servers of a major upgrade run different versions.
+		reason := rotationReason(rc)
+		if reason == "" || instance.Status.MajorUpgrade != nil {
+			return flow.Pass()
+		}
+		if err = startRotation(rc, reason, followers); err != nil {
+			return flow.Error(err, "start credential rotation err")
+		}
+	}
+	status := instance.Status.Credentials
+	rotation := status.Rotation
+	if rotation.UpdateTime == nil {
+		if wait := time.Until(rotation.StartTime.Add(credentialPropagationPeriod)); wait > 0 {
+			rotation.Message = "Waiting for the pods to read the new passwords"
+			rc.RequeueWithin(wait)
+			return flow.Pass()
+		}
+	}
+
+	master, replicas, err := readyPods(rc, followers)
+	if err != nil {
+		return flow.Error(err, "list rotation pods err")
+	}
+	if master == nil {
+		rotation.Message = "Waiting for all pods to be ready"
+		return flow.RetryAfter(rolloutPollInterval, "waiting for pods to rotate credentials")
+	}
+	secret := rc.GetInstanceCredentials()
+	for len(rotation.Pending) > 0 {
+		key := rotation.Pending[0]
+		password := string(secret.Data[naming.PendingCredentialKey(key)])
+		if password != "" {
+			if err = hooks.SetPassword(rc, master, replicas, key, password); err != nil {
+				rotation.Message = err.Error()
+				rc.Recorder().Eventf(instance, corev1.EventTypeWarning, "CredentialRotationFailed",
+					"Set password of %s: %v", key, err)
+				return flow.RetryAfter(rolloutPollInterval, "set password err", "key", key)
+			}
+			secret.Data[key] = []byte(password)
+			delete(secret.Data, naming.PendingCredentialKey(key))
+			if err = errors.WithStack(rc.Apply(secret)); err != nil {
+				return flow.Error(err, "apply credentials err")
+			}
+			rc.SetInstanceCredentials(secret)
+			if err = storeFollowerPassword(rc, followers, key, password); err != nil {
+				return flow.Error(err, "store follower credentials err", "key", key)
+			}
+		}
+		rotation.Pending = rotation.Pending[1:]
+		if len(rotation.Pending) == 0 {
+			now := metav1.Now()
+			rotation.UpdateTime = &now
+		}
+	}
+	rotation.Message = ""
+
+	names := []string{instance.Name}
+	for _, follower := range followers {
+		names = append(names, follower.Name)
+	}
+	if err = restartCredentialConsumers(rc, names, rotation.UpdateTime.Time); err != nil {
+		return flow.Error(err, "restart credential consumers err")
+	}
+	if wait := time.Until(rotation.UpdateTime.Add(rotationGracePeriod)); wait > 0 {
+		rc.RequeueWithin(wait)
+		return flow.Pass()
+	}
+	if hooks.DiscardOldPasswords != nil {
+		if err = hooks.DiscardOldPasswords(rc, master); err != nil {
+			rotation.Message = err.Error()
+			return flow.RetryAfter(rolloutPollInterval, "discard old passwords err", "err", err.Error())
+		}
+	}
+	now := metav1.Now()
+	status.LastRotated = &now
+	status.Rotation = nil
+	rc.Recorder().Event(instance, corev1.EventTypeNormal, "CredentialsRotated",
+		"Rotated the passwords of the database users")
+	return flow.Pass()
+}
+
+// rotationReason returns why the passwords must be rotated, or nothing when
+// they need not. The reconcile is requeued for the next rotation of the
+// interval.
+func rotationReason(rc *context.InstanceContext) string {
+	instance := rc.GetInstance()
+	status := instance.Status.Credentials
+	if status == nil {
+		status = &v1.CredentialsStatus{}
+	}
+	if request := instance.Annotations[naming.RotateCredentials]; request != "" && request != status.LastRequest {
+		return "Requested"
+	}
+	spec := instance.Spec.CredentialRotation
+	if spec == nil || spec.IntervalDays == nil {
+		return ""
+	}
+	last := instance.CreationTimestamp.Time
+	if status.LastRotated != nil {
+		last = status.LastRotated.Time
+	}
+	wait := time.Until(last.Add(time.Duration(*spec.IntervalDays) * 24 * time.Hour))
+	if wait <= 0 {
+		return "Interval"
+	}
+	rc.RequeueWithin(wait)
+	return ""
+}
+
+// startRotation stores new passwords for all users in the credentials Secret
+// and records the rotation in the status. The followers get them as well,
+// their pods read them while they are set.
+func startRotation(rc *context.InstanceContext, reason string, followers []*v1.KDBInstance) error {
+	instance := rc.GetInstance()
+	secret := rc.GetInstanceCredentials()
+	if secret == nil {
+		return errors.New("credentials not set")
+	}
+	util.ByteMap(&secret.Data)
+	for _, key := range rotationOrder {
+		password, err := generatePassword()
+		if err != nil {
+			return err
+		}
+		secret.Data[naming.PendingCredentialKey(key)] = []byte(password)
+	}
+	if err := errors.WithStack(rc.Apply(secret)); err != nil {
+		return err
+	}
+	rc.SetInstanceCredentials(secret)
+	for _, follower := range followers {
+		err := patchCredentials(rc, naming.InstanceCredentials(follower).Name, func(data map[string][]byte) {
+			for _, key := range rotationOrder {
+				data[naming.PendingCredentialKey(key)] = secret.Data[naming.PendingCredentialKey(key)]
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if instance.Status.Credentials == nil {
+		instance.Status.Credentials = &v1.CredentialsStatus{}
+	}
+	status := instance.Status.Credentials
+	status.LastRequest = instance.Annotations[naming.RotateCredentials]
+	status.Rotation = &v1.CredentialRotationStatus{
+		StartTime: metav1.Now(),
+		Reason:    reason,
+		Pending:   append([]string(nil), rotationOrder...),
+	}
+	rc.Recorder().Eventf(instance, corev1.EventTypeNormal, "RotatingCredentials",
+		"Rotating the passwords of the database users: %s", reason)
+	return nil
+}
+
+// readyPods returns the master and the replicas of the instance, the pods
+// of the followers count as replicas. There is no master while a pod is not
+// ready.
+func readyPods(rc *context.InstanceContext, followers []*v1.KDBInstance) (
+	master *corev1.Pod, replicas []*corev1.Pod, err error) {
+	observed := rc.GetObservedRunner()
+	for _, item := range observed.List {
+		for _, pod := range item.Pods {
+			if pod.DeletionTimestamp != nil || !util.IsPodReady(pod) {
+				return nil, nil, nil
+			}
+			if master == nil && (naming.IsMasterPod(pod) || len(observed.List) == 1) {
+				master = pod
+				continue
+			}
+			replicas = append(replicas, pod)
+		}
+	}
+	for _, follower := range followers {
+		pods := &corev1.PodList{}
+		selector, err := naming.AsSelector(naming.KDBInstance(follower.Name))
+		if err == nil {
+			err = errors.WithStack(rc.List(pods, selector))
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			if pod.DeletionTimestamp != nil || !util.IsPodReady(pod) {
+				return nil, nil, nil
+			}
+			replicas = append(replicas, pod)
+		}
+	}
+	return master, replicas, nil
+}
+
+// clusterFollowers returns the other instances of the cluster of the instance,
+// they follow it when it is the leader.
+func clusterFollowers(rc *context.InstanceContext) ([]*v1.KDBInstance, error) {
+	instance := rc.GetInstance()
+	id := naming.KDBInstanceClusterID(instance)
+	if id == "" {
+		return nil, nil
+	}
+	instances := &v1.KDBInstanceList{}
+	selector, err := naming.AsSelector(metav1.LabelSelector{
+		MatchLabels: map[string]string{naming.LabelClusterID: id},
+	})
+	if err == nil {
+		err = errors.WithStack(rc.List(instances, selector))
+	}
+	if err != nil {
+		return nil, err
+	}
+	var followers []*v1.KDBInstance
+	for i := range instances.Items {
+		if instances.Items[i].Name != instance.Name {
+			followers = append(followers, &instances.Items[i])
+		}
+	}
+	return followers, nil
+}
+
+// storeFollowerPassword stores the password of key, which is set, in the
+// credentials Secrets of the followers and in the Secret of the cluster they
+// copy when they are created.
+func storeFollowerPassword(rc *context.InstanceContext, followers []*v1.KDBInstance, key, password string) error {
+	if len(followers) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(followers)+1)
+	for _, follower := range followers {
+		names = append(names, naming.InstanceCredentials(follower).Name)
+	}
+	if owner := metav1.GetControllerOf(rc.GetInstance()); owner != nil && owner.Kind == "KDBCluster" {
+		cluster := &v1.KDBCluster{}
+		cluster.Namespace, cluster.Name = rc.Namespace(), owner.Name
+		names = append(names, naming.ClusterCredentials(cluster).Name)
+	}
+	for _, name := range names {
+		err := patchCredentials(rc, name, func(data map[string][]byte) {
+			data[key] = []byte(password)
+			delete(data, naming.PendingCredentialKey(key))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// patchCredentials changes the data of the Secret called name, when it exists.
+func patchCredentials(rc *context.InstanceContext, name string, change func(data map[string][]byte)) error {
+	secret := &corev1.Secret{}
+	secret.Namespace, secret.Name = rc.Namespace(), name
+	if err := errors.WithStack(rc.Get(secret)); err != nil {
+		return client.IgnoreNotFound(errors.Cause(err))
+	}
+	before := secret.DeepCopy()
+	util.ByteMap(&secret.Data)
+	change(secret.Data)
+	return errors.WithStack(rc.Patch(secret, client.MergeFrom(before)))
+}
+
+// restartCredentialConsumers restarts the pods of the Deployments and
+// StatefulSets labeled as consumers of the credentials of instances, they read
+// the passwords when they start. Their pod template is annotated with the
+// time the passwords were rotated, once.
+func restartCredentialConsumers(rc *context.InstanceContext, instances []string, rotated time.Time) error {
+	value := rotated.UTC().Format(time.RFC3339)
+	for _, name := range instances {
+		selector, err := naming.AsSelector(metav1.LabelSelector{
+			MatchLabels: map[string]string{naming.LabelCredentialsConsumer: name},
+		})
+		if err != nil {
+			return err
+		}
+		deployments := &appsv1.DeploymentList{}
+		if err = errors.WithStack(rc.List(deployments, selector)); err != nil {
+			return err
+		}
+		for i := range deployments.Items {
+			deployment := &deployments.Items[i]
+			if err = restartConsumer(rc, deployment, &deployment.Spec.Template, value); err != nil {
+				return err
+			}
+		}
+		statefulSets := &appsv1.StatefulSetList{}
+		if err = errors.WithStack(rc.List(statefulSets, selector)); err != nil {
+			return err
+		}
+		for i := range statefulSets.Items {
+			statefulSet := &statefulSets.Items[i]
+			if err = restartConsumer(rc, statefulSet, &statefulSet.Spec.Template, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// restartConsumer sets the CredentialsRotated annotation of the pod template
+// of object to value.
+func restartConsumer(rc *context.InstanceContext, object client.Object, template *corev1.PodTemplateSpec,
+	value string) error {
+	if template.Annotations[naming.CredentialsRotated] == value {
+		return nil
+	}
+	before := object.DeepCopyObject().(client.Object)
+	template.Annotations = naming.Merge(template.Annotations,
+		map[string]string{naming.CredentialsRotated: value})
+	return errors.WithStack(rc.Patch(object, client.MergeFrom(before)))
+}
@@ -0,0 +1,223 @@
+package steps
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sqc157400661/util"
+	"gotest.tools/v3/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/internal/reconciletest"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+func TestRotateCredentials(t *testing.T) {
+	t.Parallel()
+
+	newInstance := func(name string) *v1.KDBInstance {
+		instance := &v1.KDBInstance{ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "ns",
+			Name:        name,
+			Annotations: map[string]string{naming.RotateCredentials: "1"},
+		}}
+		instance.Spec.InstanceSet.Replicas = util.Int32(3)
+		return instance
+	}
+	rotating := func(instance *v1.KDBInstance, started time.Duration, pending ...string) {
+		instance.Status.Credentials = &v1.CredentialsStatus{
+			LastRequest: "1",
+			Rotation: &v1.CredentialRotationStatus{
+				StartTime: metav1.NewTime(time.Now().Add(-started)),
+				Reason:    "Requested",
+				Pending:   pending,
+			},
+		}
+	}
+	credentials := func(name string, pending bool) *corev1.Secret {
+		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name}}
+		secret.Data = map[string][]byte{}
+		for _, key := range rotationOrder {
+			secret.Data[key] = []byte("old-" + key)
+			if pending {
+				secret.Data[naming.PendingCredentialKey(key)] = []byte("new-" + key)
+			}
+		}
+		return secret
+	}
+	newContext := func(t *testing.T, instance *v1.KDBInstance, pending bool, objects ...client.Object) *context.InstanceContext {
+		secret := credentials(naming.InstanceCredentials(instance).Name, pending)
+		rc, _, _ := reconciletest.NewInstanceContext(t, instance, append(objects, secret)...)
+		assert.NilError(t, rc.Get(secret))
+		rc.SetInstanceCredentials(secret)
+		observeSets(rc, true, 0, 1, 2)
+		return rc
+	}
+	getSecret := func(t *testing.T, rc *context.InstanceContext, name string) *corev1.Secret {
+		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name}}
+		assert.NilError(t, rc.Get(secret))
+		return secret
+	}
+	recordHooks := func(set *[]string, discarded *int) *CredentialHooks {
+		return &CredentialHooks{
+			SetPassword: func(rc *context.InstanceContext, master *corev1.Pod, replicas []*corev1.Pod,
+				key, password string) error {
+				*set = append(*set, fmt.Sprintf("%s %s %s %d", key, password, master.Name, len(replicas)))
+				return nil
+			},
+			DiscardOldPasswords: func(rc *context.InstanceContext, master *corev1.Pod) error {
+				*discarded++
+				return nil
+			},
+		}
+	}
+
+	t.Run("Starts", func(t *testing.T) {
+		rc := newContext(t, newInstance("kdb"), false)
+		var set []string
+		flow := &reconciletest.Flow{}
+		_, err := rotateCredentials(rc, flow, recordHooks(&set, new(int)))
+		assert.NilError(t, err)
+		assert.Equal(t, flow.Result, "Pass")
+		assert.Equal(t, len(set), 0)
+
+		status := rc.GetInstance().Status.Credentials
+		assert.Equal(t, status.LastRequest, "1")
+		assert.Equal(t, status.Rotation.Reason, "Requested")
+		assert.DeepEqual(t, status.Rotation.Pending, rotationOrder)
+		assert.Equal(t, status.Rotation.Message, "Waiting for the pods to read the new passwords")
+		secret := getSecret(t, rc, "kdb-credentials")
+		for _, key := range rotationOrder {
+			assert.Equal(t, string(secret.Data[key]), "old-"+key)
+			assert.Assert(t, len(secret.Data[naming.PendingCredentialKey(key)]) > 0)
+		}
+	})
+
+	t.Run("WaitsForPods", func(t *testing.T) {
+		instance := newInstance("kdb")
+		rotating(instance, 3*time.Minute, rotationOrder...)
+		rc := newContext(t, instance, true)
+		observeSets(rc, false, 0, 1, 2)
+		var set []string
+		flow := &reconciletest.Flow{}
+		_, err := rotateCredentials(rc, flow, recordHooks(&set, new(int)))
+		assert.NilError(t, err)
+		assert.Equal(t, flow.Result, "RetryAfter")
+		assert.Equal(t, len(set), 0)
+		assert.Equal(t, rc.GetInstance().Status.Credentials.Rotation.Message, "Waiting for all pods to be ready")
+	})
+
+	t.Run("SetsPasswords", func(t *testing.T) {
+		instance := newInstance("kdb")
+		rotating(instance, 3*time.Minute, rotationOrder...)
+		consumer := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "ns",
+			Name:      "exporter",
+			Labels:    map[string]string{naming.LabelCredentialsConsumer: "kdb"},
+		}}
+		rc := newContext(t, instance, true, consumer)
+		var set []string
+		discarded := 0
+		flow := &reconciletest.Flow{}
+		_, err := rotateCredentials(rc, flow, recordHooks(&set, &discarded))
+		assert.NilError(t, err)
+		assert.Equal(t, flow.Result, "Pass")
+		assert.DeepEqual(t, set, []string{
+			"monitor-password new-monitor-password kdb0-0 2",
+			"backup-password new-backup-password kdb0-0 2",
+			"repl-password new-repl-password kdb0-0 2",
+			"root-password new-root-password kdb0-0 2",
+		})
+		assert.Equal(t, discarded, 0)
+
+		rotation := rc.GetInstance().Status.Credentials.Rotation
+		assert.Equal(t, len(rotation.Pending), 0)
+		assert.Assert(t, rotation.UpdateTime != nil)
+		secret := getSecret(t, rc, "kdb-credentials")
+		for _, key := range rotationOrder {
+			assert.Equal(t, string(secret.Data[key]), "new-"+key)
+			_, pending := secret.Data[naming.PendingCredentialKey(key)]
+			assert.Assert(t, !pending)
+		}
+		assert.NilError(t, rc.Get(consumer))
+		assert.Equal(t, consumer.Spec.Template.Annotations[naming.CredentialsRotated],
+			rotation.UpdateTime.UTC().Format(time.RFC3339))
+	})
+
+	t.Run("DiscardsOldPasswords", func(t *testing.T) {
+		instance := newInstance("kdb")
+		rotating(instance, 10*time.Minute)
+		updated := metav1.NewTime(time.Now().Add(-rotationGracePeriod - time.Minute))
+		instance.Status.Credentials.Rotation.UpdateTime = &updated
+		rc := newContext(t, instance, false)
+		var set []string
+		discarded := 0
+		_, err := rotateCredentials(rc, &reconciletest.Flow{}, recordHooks(&set, &discarded))
+		assert.NilError(t, err)
+		assert.Equal(t, discarded, 1)
+		status := rc.GetInstance().Status.Credentials
+		assert.Assert(t, status.Rotation == nil)
+		assert.Assert(t, status.LastRotated != nil)
+
+		// The same request is not rotated again.
+		flow := &reconciletest.Flow{}
+		_, err = rotateCredentials(rc, flow, recordHooks(&set, &discarded))
+		assert.NilError(t, err)
+		assert.Equal(t, flow.Result, "Pass")
+		assert.Assert(t, status.Rotation == nil)
+	})
+
+	t.Run("Cluster", func(t *testing.T) {
+		labels := map[string]string{naming.LabelClusterID: "cluster"}
+		leader := newInstance("kdb")
+		leader.Labels = labels
+		leader.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: v1.GroupVersion.String(),
+			Kind:       "KDBCluster",
+			Name:       "cluster",
+			UID:        "uid",
+			Controller: util.Bool(true),
+		}}
+		rotating(leader, 3*time.Minute, rotationOrder...)
+		follower := newInstance("kdb-dr")
+		follower.Labels = labels
+		follower.Spec.Leader = v1.HostInfo{PodName: "kdb0-0", Host: "kdb0-0.kdb"}
+		followerPod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "ns",
+			Name:      "kdb-dr0-0",
+			Labels:    map[string]string{naming.LabelInstance: "kdb-dr"},
+		}}
+		followerPod.Status.Phase = corev1.PodRunning
+		followerPod.Status.ContainerStatuses = []corev1.ContainerStatus{{Ready: true}}
+		rc := newContext(t, leader, true, follower, followerPod,
+			credentials("kdb-dr-credentials", true), credentials("cluster-cluster-credentials", false))
+
+		var set []string
+		_, err := rotateCredentials(rc, &reconciletest.Flow{}, recordHooks(&set, new(int)))
+		assert.NilError(t, err)
+		assert.Equal(t, len(set), 4)
+		assert.Equal(t, set[0], "monitor-password new-monitor-password kdb0-0 3")
+		for _, name := range []string{"kdb-dr-credentials", "cluster-cluster-credentials"} {
+			secret := getSecret(t, rc, name)
+			for _, key := range rotationOrder {
+				assert.Equal(t, string(secret.Data[key]), "new-"+key, name)
+				_, pending := secret.Data[naming.PendingCredentialKey(key)]
+				assert.Assert(t, !pending, name)
+			}
+		}
+
+		// The followers are rotated by the leader.
+		rc = newContext(t, follower, false)
+		flow := &reconciletest.Flow{}
+		_, err = rotateCredentials(rc, flow, recordHooks(&set, new(int)))
+		assert.NilError(t, err)
+		assert.Equal(t, flow.Result, "Pass")
+		assert.Assert(t, rc.GetInstance().Status.Credentials == nil)
+	})
+}
@@ -0,0 +1,267 @@
+package steps
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/helper/kube"
+	"github.com/sqc157400661/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/pkg/metrics"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+// schemaDriftInterval is how often an applied object is applied again, which
+// reverts the changes made to the account or the schema outside of the spec.
+const schemaDriftInterval = 10 * time.Minute
+
+type SchemaStepFunc func(rc *context.SchemaContext, flow kube.Flow) (reconcile.Result, error)
+
+// SchemaHooks are the engine specific statements of a KDBUser or a
+// KDBDatabase, they run on the master of the target instance.
+type SchemaHooks struct {
+	// Apply creates the account or the schema, or updates it to the spec.
+	Apply func(rc *context.SchemaContext) error
+
+	// Drop drops the account or the schema.
+	Drop func(rc *context.SchemaContext) error
+}
+
+// SchemaStepManager holds the steps of the KDBUser and the KDBDatabase
+// controllers.
+type SchemaStepManager struct {
+	// Controller is the controller label of the step metrics.
+	Controller string
+
+	// Engines are the hooks of each engine, by engine name.
+	Engines map[string]*SchemaHooks
+}
+
+// StepBinder bind one step to a task function
+func (s *SchemaStepManager) StepBinder(name string, f SchemaStepFunc) kube.BindFunc {
+	return kube.NewStepBinder(
+		kube.NewStep(
+			name, func(rc kube.ReconcileContext, flow kube.Flow) (result reconcile.Result, err error) {
+				defer func(start time.Time) {
+					metrics.ObserveStep(s.Controller, name, start, err)
+				}(time.Now())
+				return f(rc.(*context.SchemaContext), flow)
+			},
+		),
+	)
+}
+
+// PatchStatus patch object status
+func (s *SchemaStepManager) PatchStatus() kube.BindFunc {
+	return s.StepBinder(
+		"PatchStatus",
+		func(rc *context.SchemaContext, flow kube.Flow) (reconcile.Result, error) {
+			if err := rc.PatchStatus(); err != nil {
+				return flow.Error(err, "patch status err")
+			}
+			return flow.Pass()
+		})
+}
+
+// SetGlobalConfig reads the global config for the name of the root user.
+func (s *SchemaStepManager) SetGlobalConfig() kube.BindFunc {
+	return s.StepBinder(
+		"SetGlobalConfig",
+		func(rc *context.SchemaContext, flow kube.Flow) (reconcile.Result, error) {
+			conf, err := loadGlobalConfig(rc, rc.GetObject().GetNamespace())
+			if err != nil {
+				return flow.Error(err, "get GlobalConfig err")
+			}
+			if conf != nil {
+				rc.SetGlobalConfig(conf)
+			}
+			return flow.Pass()
+		})
+}
+
+// ResolveTarget finds the target instance of the object, its ready master
+// and its credentials. A deleted object whose instance is gone has nothing
+// to drop.
+func (s *SchemaStepManager) ResolveTarget() kube.BindFunc {
+	return s.StepBinder(
+		"ResolveTarget",
+		func(rc *context.SchemaContext, flow kube.Flow) (reconcile.Result, error) {
+			object := rc.GetObject()
+			instance, err := targetInstance(rc, object)
+			if err != nil {
+				return flow.Error(err, "get target instance err")
+			}
+			if instance == nil {
+				if rc.IsDeleting() {
+					return flow.Pass()
+				}
+				setSchemaReady(object, metav1.ConditionFalse, "InstanceNotFound",
+					"The target instance does not exist")
+				return flow.RetryAfter(time.Minute, "target instance not found")
+			}
+			object.SchemaStatus().Instance = instance.Name
+
+			pods := &corev1.PodList{}
+			selector, err := naming.AsSelector(naming.KDBInstance(instance.Name))
+			if err == nil {
+				err = errors.WithStack(rc.List(pods, selector))
+			}
+			if err != nil {
+				return flow.Error(err, "list pods err")
+			}
+			var master *corev1.Pod
+			for i := range pods.Items {
+				pod := &pods.Items[i]
+				if pod.Namespace == instance.Namespace && naming.IsMasterPod(pod) &&
+					pod.DeletionTimestamp == nil && util.IsPodReady(pod) {
+					master = pod
+				}
+			}
+			if master == nil {
+				setSchemaReady(object, metav1.ConditionFalse, "MasterNotReady",
+					"The master of instance "+instance.Name+" is not ready")
+				return flow.RetryAfter(30*time.Second, "master not ready", "instance", instance.Name)
+			}
+
+			credentials := &corev1.Secret{ObjectMeta: naming.InstanceCredentials(instance)}
+			if err = errors.WithStack(rc.Get(credentials)); err != nil {
+				return flow.Error(err, "get credentials err")
+			}
+			rc.SetTarget(instance, master, credentials)
+			return flow.Pass()
+		})
+}
+
+// CheckAndSetFinalizer check if the Finalizer exists, if not, add it
+func (s *SchemaStepManager) CheckAndSetFinalizer() kube.BindFunc {
+	return s.StepBinder(
+		"CheckAndSetFinalizer",
+		func(rc *context.SchemaContext, flow kube.Flow) (reconcile.Result, error) {
+			if rc.HasFinalizer(naming.Finalizer) {
+				return flow.Pass()
+			}
+			before := rc.GetObject().DeepCopyObject().(client.Object)
+			intent := before.DeepCopyObject().(client.Object)
+			intent.SetFinalizers(append(intent.GetFinalizers(), naming.Finalizer))
+			err := errors.WithStack(rc.Patch(intent,
+				client.MergeFromWithOptions(before, client.MergeFromWithOptimisticLock{})))
+			if err != nil {
+				return flow.Error(err, "patch finalizers error")
+			}
+			return flow.Pass()
+		})
+}
+
+// HandleDelete drops the account or the schema of a deleted object unless its
+// deletion policy retains it, then removes the finalizer.
+func (s *SchemaStepManager) HandleDelete() kube.BindFunc {
+	return s.StepBinder(
+		"HandleDelete",
+		func(rc *context.SchemaContext, flow kube.Flow) (reconcile.Result, error) {
+			object := rc.GetObject()
+			if instance := rc.GetTargetInstance(); instance != nil &&
+				object.SchemaDeletionPolicy() != v1.DeletionPolicyRetain {
+				hooks := s.Engines[strings.ToLower(naming.Engine(instance))]
+				if hooks != nil && hooks.Drop != nil {
+					if err := hooks.Drop(rc); err != nil {
+						rc.Recorder().Event(object, corev1.EventTypeWarning, "DropFailed", err.Error())
+						return flow.RetryAfter(30*time.Second, "drop err", "err", err.Error())
+					}
+				}
+			}
+			before := object.DeepCopyObject().(client.Object)
+			intent := before.DeepCopyObject().(client.Object)
+			finalizers := sets.NewString(intent.GetFinalizers()...)
+			finalizers.Delete(naming.Finalizer)
+			intent.SetFinalizers(finalizers.List())
+			err := errors.WithStack(rc.Patch(intent,
+				client.MergeFromWithOptions(before, client.MergeFromWithOptimisticLock{})))
+			if err != nil {
+				return flow.Error(err, "patch finalizers error")
+			}
+			object.SetFinalizers(intent.GetFinalizers())
+			return flow.Break("deleted")
+		})
+}
+
+// ApplySchema applies the object to the master of its instance. It is
+// applied again every schemaDriftInterval.
+func (s *SchemaStepManager) ApplySchema() kube.BindFunc {
+	return s.StepBinder(
+		"ApplySchema",
+		func(rc *context.SchemaContext, flow kube.Flow) (reconcile.Result, error) {
+			object := rc.GetObject()
+			engine := naming.Engine(rc.GetTargetInstance())
+			hooks := s.Engines[strings.ToLower(engine)]
+			if hooks == nil || hooks.Apply == nil {
+				setSchemaReady(object, metav1.ConditionFalse, "Unsupported",
+					"The engine "+engine+" is not supported")
+				return flow.Wait("unsupported engine", "engine", engine)
+			}
+			if err := hooks.Apply(rc); err != nil {
+				if cond := meta.FindStatusCondition(object.SchemaStatus().Conditions, v1.SchemaReady); cond == nil ||
+					cond.Message != err.Error() {
+					rc.Recorder().Event(object, corev1.EventTypeWarning, "ApplyFailed", err.Error())
+				}
+				setSchemaReady(object, metav1.ConditionFalse, "ApplyFailed", err.Error())
+				return flow.RetryAfter(30*time.Second, "apply err", "err", err.Error())
+			}
+			setSchemaReady(object, metav1.ConditionTrue, "Applied", "")
+			object.SchemaStatus().ObservedGeneration = object.GetGeneration()
+			rc.RequeueWithin(schemaDriftInterval)
+			return flow.Pass()
+		})
+}
+
+// targetInstance returns the instance the object is applied to, nil when it
+// does not exist. The instance of a cluster is the one without a leader.
+func targetInstance(rc *context.SchemaContext, object context.SchemaObject) (*v1.KDBInstance, error) {
+	target := object.SchemaTarget()
+	name := target.InstanceName
+	if name == "" && target.ClusterName != "" {
+		cluster := &v1.KDBCluster{}
+		cluster.Namespace, cluster.Name = object.GetNamespace(), target.ClusterName
+		if err := errors.WithStack(client.IgnoreNotFound(rc.Get(cluster))); err != nil || cluster.UID == "" {
+			return nil, err
+		}
+		for _, desc := range cluster.Spec.Instances {
+			instance := &v1.KDBInstance{}
+			instance.Namespace, instance.Name = cluster.Namespace, desc.Name
+			if err := errors.WithStack(client.IgnoreNotFound(rc.Get(instance))); err != nil {
+				return nil, err
+			}
+			if instance.UID != "" && naming.IsEmptyLeader(instance.Spec.Leader) {
+				return instance, nil
+			}
+		}
+		return nil, nil
+	}
+	if name == "" {
+		return nil, nil
+	}
+	instance := &v1.KDBInstance{}
+	instance.Namespace, instance.Name = object.GetNamespace(), name
+	if err := errors.WithStack(client.IgnoreNotFound(rc.Get(instance))); err != nil || instance.UID == "" {
+		return nil, err
+	}
+	return instance, nil
+}
+
+func setSchemaReady(object context.SchemaObject, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&object.SchemaStatus().Conditions, metav1.Condition{
+		Type:               v1.SchemaReady,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: object.GetGeneration(),
+	})
+}
@@ -0,0 +1,222 @@
+package steps
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/helper/kube"
+	"github.com/sqc157400661/util"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+// seedPollInterval is how often the progress of a seeding is checked.
+const seedPollInterval = 10 * time.Second
+
+// SeedHooks are the engine specific parts of seeding a new replica.
+type SeedHooks struct {
+	// Start starts copying the data of donor to recipient. It returns false
+	// when recipient cannot receive it yet.
+	Start func(rc *context.InstanceContext, seed *v1.ReplicaSeedStatus, donor, recipient *corev1.Pod) (bool, error)
+
+	// Progress updates the progress of the copy started before and returns
+	// whether recipient runs on the copied data. It fails when the copy
+	// failed, the copy is started again.
+	Progress func(rc *context.InstanceContext, seed *v1.ReplicaSeedStatus, donor, recipient *corev1.Pod) (bool, error)
+
+	// Replicate makes recipient replicate from the server at host and port,
+	// from the position of the copied data.
+	Replicate func(rc *context.InstanceContext, seed *v1.ReplicaSeedStatus, recipient *corev1.Pod,
+		host string, port int32) error
+}
+
+// SeedReplicas drops the seeding of the replicas without engine hooks, they
+// replicate from the start.
+func (s *InstanceStepManager) SeedReplicas() kube.BindFunc {
+	return s.SeedStep(nil)
+}
+
+// SeedStep returns the step that seeds the replicas added to a running
+// instance, ScaleUpInstance lists them in the status. The data is copied from
+// a ready replica, or from the master when there is none, then the replica
+// replicates from the master. A failed copy is started again.
+func (s *InstanceStepManager) SeedStep(hooks *SeedHooks) kube.BindFunc {
+	return s.StepBinder(
+		"SeedReplicas",
+		func(rc *context.InstanceContext, flow kube.Flow) (reconcile.Result, error) {
+			instance := rc.GetInstance()
+			if len(instance.Status.Seeding) == 0 {
+				return flow.Pass()
+			}
+			if hooks == nil {
+				instance.Status.Seeding = nil
+				return flow.Pass()
+			}
+
+			observed := rc.GetObservedRunner()
+			var seeding []v1.ReplicaSeedStatus
+			for i := range instance.Status.Seeding {
+				seed := instance.Status.Seeding[i]
+				runner, ok := observed.BySet[seed.Set]
+				if !ok {
+					// The replica was scaled down.
+					continue
+				}
+				var recipient *corev1.Pod
+				if len(runner.Pods) > 0 && runner.Pods[0].DeletionTimestamp == nil {
+					recipient = runner.Pods[0]
+				}
+				done, err := seedReplica(rc, hooks, &seed, recipient)
+				if err != nil {
+					return flow.Error(err, "seed replica err", "set", seed.Set)
+				}
+				if done {
+					rc.Recorder().Eventf(instance, corev1.EventTypeNormal, "ReplicaSeeded",
+						"Pod %s replicates on the data of %s", recipient.Name, seed.Donor)
+					continue
+				}
+				seeding = append(seeding, seed)
+			}
+			instance.Status.Seeding = seeding
+			if len(seeding) > 0 {
+				rc.RequeueWithin(seedPollInterval)
+			}
+			return flow.Pass()
+		})
+}
+
+// seedReplica moves the seeding of recipient on by one phase at most and
+// returns whether recipient replicates. Failures of the copy are reported on
+// seed, only errors of the API are returned.
+func seedReplica(rc *context.InstanceContext, hooks *SeedHooks, seed *v1.ReplicaSeedStatus,
+	recipient *corev1.Pod) (bool, error) {
+	instance := rc.GetInstance()
+	if recipient == nil {
+		seed.Message = "waiting for the pod of the replica"
+		return false, nil
+	}
+	switch seed.Phase {
+	case v1.SeedCopying:
+		donor := &corev1.Pod{}
+		donor.Namespace, donor.Name = instance.Namespace, seed.Donor
+		if err := errors.WithStack(client.IgnoreNotFound(rc.Get(donor))); err != nil {
+			return false, err
+		}
+		done, err := hooks.Progress(rc, seed, donor, recipient)
+		if err != nil {
+			rc.Recorder().Eventf(instance, corev1.EventTypeWarning, "SeedFailed",
+				"Copying the data of %s to %s failed: %v", seed.Donor, recipient.Name, err)
+			seed.Phase, seed.Donor, seed.Progress, seed.Message = v1.SeedPending, "", 0, err.Error()
+			return false, nil
+		}
+		if done {
+			seed.Phase, seed.Progress, seed.Message = v1.SeedReplicating, 100, ""
+		}
+		return false, nil
+
+	case v1.SeedReplicating:
+		host, port := seedSource(rc, recipient)
+		if host == "" {
+			seed.Message = "waiting for the master"
+			return false, nil
+		}
+		if err := hooks.Replicate(rc, seed, recipient, host, port); err != nil {
+			seed.Message = err.Error()
+			return false, nil
+		}
+		return true, nil
+
+	default:
+		donor := seedDonor(rc, recipient)
+		if donor == nil {
+			seed.Message = "waiting for a ready donor"
+			return false, nil
+		}
+		seed.Donor = donor.Name
+		started, err := hooks.Start(rc, seed, donor, recipient)
+		if err != nil {
+			seed.Message = err.Error()
+			return false, nil
+		}
+		if !started {
+			seed.Message = "waiting for the replica to receive the data"
+			return false, nil
+		}
+		now := metav1.Now()
+		seed.Phase, seed.StartTime, seed.Message = v1.SeedCopying, &now, ""
+		rc.Recorder().Eventf(instance, corev1.EventTypeNormal, "SeedStarted",
+			"Copying the data of %s to %s with %s", donor.Name, recipient.Name, seed.Method)
+		return false, nil
+	}
+}
+
+// seedDonor returns the pod the data of recipient is copied from: a ready
+// replica of the instance, or its master when there is none.
+func seedDonor(rc *context.InstanceContext, recipient *corev1.Pod) *corev1.Pod {
+	instance := rc.GetInstance()
+	var master *corev1.Pod
+	for _, runner := range rc.GetObservedRunner().List {
+		for _, pod := range runner.Pods {
+			if pod == recipient || pod.DeletionTimestamp != nil || !util.IsPodReady(pod) ||
+				pod.Status.PodIP == "" || naming.ReplicaSeed(instance, runner.Name) != nil {
+				continue
+			}
+			if !naming.IsMasterPod(pod) {
+				return pod
+			}
+			master = pod
+		}
+	}
+	return master
+}
+
+// seedSource returns the address of the master of the instance recipient
+// replicates from.
+func seedSource(rc *context.InstanceContext, recipient *corev1.Pod) (string, int32) {
+	for _, runner := range rc.GetObservedRunner().List {
+		for _, pod := range runner.Pods {
+			if pod != recipient && naming.IsMasterPod(pod) && pod.Status.PodIP != "" {
+				return pod.Status.PodIP, *rc.GetInstance().Spec.Port
+			}
+		}
+	}
+	return "", 0
+}
+
+// hasSeedSource reports whether the instance has a master the data of new
+// replicas is copied from. The followers of a cluster replicate from the
+// master of another instance and are not seeded, a copy would carry the users
+// and passwords of the other instance.
+func hasSeedSource(rc *context.InstanceContext) bool {
+	if !naming.IsEmptyLeader(rc.GetInstance().Spec.Leader) {
+		return false
+	}
+	for _, runner := range rc.GetObservedRunner().List {
+		for _, pod := range runner.Pods {
+			if naming.IsMasterPod(pod) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasDataVolume reports whether the data volume of the set meta exists, e.g.
+// because it was retained when the set was scaled down. The set starts on
+// that data rather than on a copy.
+func hasDataVolume(rc *context.InstanceContext, meta metav1.ObjectMeta) (bool, error) {
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: naming.InstanceDataVolume(&appsv1.StatefulSet{ObjectMeta: meta})}
+	err := errors.WithStack(rc.Get(pvc))
+	if apierrors.IsNotFound(errors.Cause(err)) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,55 @@
+package steps
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/internal/reconciletest"
+)
+
+func TestHasSeedSource(t *testing.T) {
+	t.Parallel()
+
+	newInstance := func() *v1.KDBInstance {
+		return &v1.KDBInstance{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "kdb"}}
+	}
+
+	t.Run("Master", func(t *testing.T) {
+		rc, _, _ := reconciletest.NewInstanceContext(t, newInstance())
+		observeSets(rc, true, 0, 1)
+		assert.Assert(t, hasSeedSource(rc))
+	})
+	t.Run("NoMaster", func(t *testing.T) {
+		rc, _, _ := reconciletest.NewInstanceContext(t, newInstance())
+		observeSets(rc, true, 1, 2)
+		assert.Assert(t, !hasSeedSource(rc))
+	})
+	t.Run("Follower", func(t *testing.T) {
+		instance := newInstance()
+		instance.Spec.Leader = v1.HostInfo{PodName: "other0-0", Host: "other0-0.other"}
+		rc, _, _ := reconciletest.NewInstanceContext(t, instance)
+		observeSets(rc, true, 0, 1)
+		assert.Assert(t, !hasSeedSource(rc))
+	})
+}
+
+func TestHasDataVolume(t *testing.T) {
+	t.Parallel()
+
+	instance := &v1.KDBInstance{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "kdb"}}
+	retained := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "kdb2-kdb-data"}}
+	rc, _, _ := reconciletest.NewInstanceContext(t, instance, retained)
+
+	exists, err := hasDataVolume(rc, naming.GenerateInstanceStatefulSetMeta(instance, 2))
+	assert.NilError(t, err)
+	assert.Assert(t, exists)
+
+	exists, err = hasDataVolume(rc, naming.GenerateInstanceStatefulSetMeta(instance, 3))
+	assert.NilError(t, err)
+	assert.Assert(t, !exists)
+}
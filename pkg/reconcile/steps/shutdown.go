@@ -0,0 +1,199 @@
+package steps
+
+import (
+	"github.com/go-logr/logr"
+	"github.com/sqc157400661/helper/kube"
+	"github.com/sqc157400661/util"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/sqc157400661/kdb/apis/shared"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+// ShutdownHooks are the engine specific parts of stopping and starting an
+// instance.
+type ShutdownHooks struct {
+	// PrepareStop readies the server in pod to shut down cleanly, it is
+	// called on the replicas before the master.
+	PrepareStop func(rc *context.InstanceContext, pod *corev1.Pod, master bool) error
+
+	// VerifyStart returns an error until the replicas replicate from the
+	// master again, it is called once all pods are ready.
+	VerifyStart func(rc *context.InstanceContext, master *corev1.Pod, replicas []*corev1.Pod) error
+}
+
+// ShutdownInstance stops and starts the instance without engine hooks, see
+// ShutdownStep.
+func (s *InstanceStepManager) ShutdownInstance() kube.BindFunc {
+	return s.ShutdownStep(nil)
+}
+
+// ShutdownStep returns the step that stops the instance when Spec.Shutdown is
+// set or it hibernates, and starts it again otherwise. The StatefulSets are
+// scaled to zero one at a time, the replicas before the master, and scaled up
+// again master first. A stop that is cancelled starts the StatefulSets that
+// are stopped already. The step records the phase of the instance; the steps
+// that replace pods are skipped until the instance runs again.
+func (s *InstanceStepManager) ShutdownStep(hooks *ShutdownHooks) kube.BindFunc {
+	if hooks == nil {
+		hooks = &ShutdownHooks{}
+	}
+	return s.StepBinder(
+		"ShutdownInstance",
+		func(rc *context.InstanceContext, flow kube.Flow) (reconcile.Result, error) {
+			return shutdownInstance(rc, flow, hooks)
+		})
+}
+
+// IsInstanceRunning is the condition of the steps that replace pods. They are
+// skipped while the instance stops, is stopped or starts.
+func IsInstanceRunning(rc *context.InstanceContext, _ logr.Logger) (bool, error) {
+	return !naming.IsStoppedOrStarting(rc.GetInstance()), nil
+}
+
+func shutdownInstance(rc *context.InstanceContext, flow kube.Flow, hooks *ShutdownHooks) (reconcile.Result, error) {
+	instance := rc.GetInstance()
+	shutdown := naming.IsShutdown(instance)
+	switch {
+	case shutdown && instance.Status.Phase != shared.InstanceStatusStopped:
+		return stopInstance(rc, flow, hooks)
+	case !shutdown && (instance.Status.Phase == shared.InstanceStatusStopping ||
+		instance.Status.Phase == shared.InstanceStatusStopped ||
+		instance.Status.Phase == shared.InstanceStatusStarting):
+		return startInstance(rc, flow, hooks)
+	case shutdown:
+		return flow.Pass()
+	}
+
+	instance.Status.Phase = shared.InstanceStatusPending
+	status := instance.Status.InstanceSet
+	if status.Replicas > 0 && status.ReadyReplicas == status.Replicas {
+		instance.Status.Phase = shared.InstanceStatusRunning
+	}
+	return flow.Pass()
+}
+
+// stopInstance scales the StatefulSets of the replicas to zero, then the one
+// of the master once the replicas are gone.
+func stopInstance(rc *context.InstanceContext, flow kube.Flow, hooks *ShutdownHooks) (reconcile.Result, error) {
+	instance := rc.GetInstance()
+	if instance.Status.Phase != shared.InstanceStatusStopping {
+		instance.Status.Phase = shared.InstanceStatusStopping
+		instance.Status.StoppedSets = nil
+		instance.Status.MasterSet = ""
+		rc.Recorder().Event(instance, corev1.EventTypeNormal, "Stopping", "Stopping the instance")
+	}
+	// The StatefulSets are not scaled down in this pass, poll their pods.
+	rc.RequeueWithin(rolloutPollInterval)
+	stopped := sets.NewString(instance.Status.StoppedSets...)
+	observed := rc.GetObservedRunner()
+	running := 0
+	for _, item := range observed.List {
+		if len(item.Pods) > 0 && (naming.IsMasterPod(item.Pods[0]) || len(observed.List) == 1) {
+			instance.Status.MasterSet = item.Name
+			continue
+		}
+		if !stopped.Has(item.Name) {
+			if err := prepareStop(rc, hooks, item.Pods, false); err != nil {
+				return flow.Error(err, "prepare stop err", "set", item.Name)
+			}
+			stopped.Insert(item.Name)
+		}
+		running += len(item.Pods)
+	}
+	instance.Status.StoppedSets = stopped.List()
+	if running > 0 {
+		return flow.Pass()
+	}
+
+	// The replicas are gone, stop the master.
+	if item, ok := observed.BySet[instance.Status.MasterSet]; ok && len(item.Pods) > 0 {
+		if !stopped.Has(item.Name) {
+			if err := prepareStop(rc, hooks, item.Pods, true); err != nil {
+				return flow.Error(err, "prepare stop err", "set", item.Name)
+			}
+			stopped.Insert(item.Name)
+			instance.Status.StoppedSets = stopped.List()
+		}
+		return flow.Pass()
+	}
+
+	now := metav1.Now()
+	instance.Status.Phase = shared.InstanceStatusStopped
+	instance.Status.StoppedAt = &now
+	instance.Status.StoppedSets = nil
+	rc.Recorder().Event(instance, corev1.EventTypeNormal, "Stopped", "Stopped the instance")
+	return flow.Pass()
+}
+
+func prepareStop(rc *context.InstanceContext, hooks *ShutdownHooks, pods []*corev1.Pod, master bool) error {
+	if hooks.PrepareStop == nil {
+		return nil
+	}
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil || !util.IsPodReady(pod) {
+			continue
+		}
+		if err := hooks.PrepareStop(rc, pod, master); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startInstance scales up the StatefulSet of the master, then the ones of the
+// replicas once the master is ready, and waits for replication to resume.
+func startInstance(rc *context.InstanceContext, flow kube.Flow, hooks *ShutdownHooks) (reconcile.Result, error) {
+	instance := rc.GetInstance()
+	observed := rc.GetObservedRunner()
+	if instance.Status.Phase != shared.InstanceStatusStarting {
+		if _, ok := observed.BySet[instance.Status.MasterSet]; !ok && len(observed.List) > 0 {
+			instance.Status.MasterSet = observed.List[0].Name
+		}
+		var stopped []string
+		for _, item := range observed.List {
+			if item.Name != instance.Status.MasterSet {
+				stopped = append(stopped, item.Name)
+			}
+		}
+		instance.Status.Phase = shared.InstanceStatusStarting
+		instance.Status.StoppedSets = stopped
+		rc.Recorder().Event(instance, corev1.EventTypeNormal, "Starting", "Starting the instance")
+		return flow.Pass()
+	}
+
+	item, ok := observed.BySet[instance.Status.MasterSet]
+	if !ok || len(item.Pods) == 0 || !util.IsPodReady(item.Pods[0]) {
+		return flow.RetryAfter(rolloutPollInterval, "waiting for master to start", "set", instance.Status.MasterSet)
+	}
+	master := item.Pods[0]
+	if len(instance.Status.StoppedSets) > 0 {
+		instance.Status.StoppedSets = nil
+		return flow.Pass()
+	}
+
+	var replicas []*corev1.Pod
+	for _, item := range observed.List {
+		if len(item.Pods) == 0 || !util.IsPodReady(item.Pods[0]) {
+			return flow.RetryAfter(rolloutPollInterval, "waiting for replica to start", "set", item.Name)
+		}
+		if item.Pods[0] != master {
+			replicas = append(replicas, item.Pods[0])
+		}
+	}
+	if hooks.VerifyStart != nil {
+		if err := hooks.VerifyStart(rc, master, replicas); err != nil {
+			return flow.RetryAfter(rolloutPollInterval, "waiting for replication to resume", "err", err.Error())
+		}
+	}
+
+	instance.Status.Phase = shared.InstanceStatusRunning
+	instance.Status.StoppedAt = nil
+	instance.Status.MasterSet = ""
+	rc.Recorder().Event(instance, corev1.EventTypeNormal, "Started", "Started the instance")
+	return flow.Pass()
+}
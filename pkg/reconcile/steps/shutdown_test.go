@@ -0,0 +1,166 @@
+package steps
+
+import (
+	"testing"
+
+	"github.com/sqc157400661/util"
+	"gotest.tools/v3/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/apis/shared"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/internal/observed"
+	"github.com/sqc157400661/kdb/internal/reconciletest"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+// observeSets sets the observed runner of rc to three StatefulSets, the
+// first one holds the master. Only the sets in running have a pod, ready
+// tells whether the pods are ready.
+func observeSets(rc *context.InstanceContext, ready bool, running ...int) {
+	instance := rc.GetInstance()
+	var sets []appsv1.StatefulSet
+	var pods []corev1.Pod
+	for i := 0; i < 3; i++ {
+		name := naming.InstanceStatefulSetName(instance.Name, i)
+		sets = append(sets, appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Namespace: instance.Namespace, Name: name}})
+	}
+	for _, i := range running {
+		role := naming.ReplicaRole
+		if i == 0 {
+			role = naming.MasterRole
+		}
+		pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Namespace: instance.Namespace,
+			Name:      naming.InstancePodName(instance.Name, i),
+			Labels: map[string]string{
+				naming.LabelInstanceSet: naming.InstanceStatefulSetName(instance.Name, i),
+				naming.LabelRole:        role,
+			},
+		}}
+		if ready {
+			pod.Status.Phase = corev1.PodRunning
+			pod.Status.ContainerStatuses = []corev1.ContainerStatus{{Ready: true}}
+		}
+		pods = append(pods, pod)
+	}
+	rc.SetObservedRunner(observed.NewObservedRunner(instance, sets, pods))
+}
+
+func TestShutdownInstance(t *testing.T) {
+	t.Parallel()
+
+	newInstance := func(shutdown bool, phase string) *v1.KDBInstance {
+		instance := &v1.KDBInstance{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "kdb"}}
+		instance.Spec.InstanceSet.Replicas = util.Int32(3)
+		instance.Spec.Shutdown = &shutdown
+		instance.Status.Phase = phase
+		return instance
+	}
+
+	t.Run("StopsReplicasFirst", func(t *testing.T) {
+		rc, _, _ := reconciletest.NewInstanceContext(t, newInstance(true, shared.InstanceStatusRunning))
+		observeSets(rc, true, 0, 1, 2)
+		var prepared []string
+		hooks := &ShutdownHooks{PrepareStop: func(rc *context.InstanceContext, pod *corev1.Pod, master bool) error {
+			assert.Assert(t, !master)
+			prepared = append(prepared, pod.Name)
+			return nil
+		}}
+
+		flow := &reconciletest.Flow{}
+		_, err := shutdownInstance(rc, flow, hooks)
+		assert.NilError(t, err)
+		status := rc.GetInstance().Status
+		assert.Equal(t, status.Phase, shared.InstanceStatusStopping)
+		assert.Equal(t, status.MasterSet, "kdb0")
+		assert.DeepEqual(t, status.StoppedSets, []string{"kdb1", "kdb2"})
+		assert.DeepEqual(t, prepared, []string{"kdb1-0", "kdb2-0"})
+		assert.Equal(t, rc.RequeueAfter(), rolloutPollInterval)
+	})
+
+	t.Run("StopsMasterLast", func(t *testing.T) {
+		instance := newInstance(true, shared.InstanceStatusStopping)
+		instance.Status.MasterSet = "kdb0"
+		instance.Status.StoppedSets = []string{"kdb1", "kdb2"}
+		rc, _, _ := reconciletest.NewInstanceContext(t, instance)
+		observeSets(rc, true, 0)
+		masters := 0
+		hooks := &ShutdownHooks{PrepareStop: func(rc *context.InstanceContext, pod *corev1.Pod, master bool) error {
+			assert.Assert(t, master)
+			masters++
+			return nil
+		}}
+
+		_, err := shutdownInstance(rc, &reconciletest.Flow{}, hooks)
+		assert.NilError(t, err)
+		assert.Equal(t, masters, 1)
+		assert.DeepEqual(t, rc.GetInstance().Status.StoppedSets, []string{"kdb0", "kdb1", "kdb2"})
+
+		observeSets(rc, true)
+		_, err = shutdownInstance(rc, &reconciletest.Flow{}, hooks)
+		assert.NilError(t, err)
+		status := rc.GetInstance().Status
+		assert.Equal(t, status.Phase, shared.InstanceStatusStopped)
+		assert.Assert(t, status.StoppedAt != nil)
+		assert.Assert(t, status.StoppedSets == nil)
+	})
+
+	t.Run("StartsMasterFirst", func(t *testing.T) {
+		instance := newInstance(false, shared.InstanceStatusStopped)
+		instance.Status.MasterSet = "kdb0"
+		rc, _, _ := reconciletest.NewInstanceContext(t, instance)
+		observeSets(rc, false)
+
+		_, err := shutdownInstance(rc, &reconciletest.Flow{}, &ShutdownHooks{})
+		assert.NilError(t, err)
+		status := rc.GetInstance().Status
+		assert.Equal(t, status.Phase, shared.InstanceStatusStarting)
+		assert.DeepEqual(t, status.StoppedSets, []string{"kdb1", "kdb2"})
+
+		flow := &reconciletest.Flow{}
+		_, err = shutdownInstance(rc, flow, &ShutdownHooks{})
+		assert.NilError(t, err)
+		assert.Equal(t, flow.Result, "RetryAfter")
+
+		observeSets(rc, true, 0)
+		_, err = shutdownInstance(rc, &reconciletest.Flow{}, &ShutdownHooks{})
+		assert.NilError(t, err)
+		assert.Assert(t, rc.GetInstance().Status.StoppedSets == nil)
+
+		verified := false
+		hooks := &ShutdownHooks{VerifyStart: func(rc *context.InstanceContext, master *corev1.Pod, replicas []*corev1.Pod) error {
+			assert.Equal(t, master.Name, "kdb0-0")
+			assert.Equal(t, len(replicas), 2)
+			verified = true
+			return nil
+		}}
+		observeSets(rc, true, 0, 1, 2)
+		_, err = shutdownInstance(rc, &reconciletest.Flow{}, hooks)
+		assert.NilError(t, err)
+		assert.Assert(t, verified)
+		assert.Equal(t, rc.GetInstance().Status.Phase, shared.InstanceStatusRunning)
+	})
+
+	t.Run("CancelledStop", func(t *testing.T) {
+		instance := newInstance(false, shared.InstanceStatusStopping)
+		instance.Status.MasterSet = "kdb0"
+		instance.Status.StoppedSets = []string{"kdb0", "kdb1", "kdb2"}
+		rc, _, _ := reconciletest.NewInstanceContext(t, instance)
+		observeSets(rc, true, 0)
+
+		_, err := shutdownInstance(rc, &reconciletest.Flow{}, &ShutdownHooks{})
+		assert.NilError(t, err)
+		status := rc.GetInstance().Status
+		assert.Equal(t, status.Phase, shared.InstanceStatusStarting)
+		assert.DeepEqual(t, status.StoppedSets, []string{"kdb1", "kdb2"})
+		assert.Assert(t, !naming.IsInstanceSetStopped(rc.GetInstance(), "kdb0"))
+
+		_, err = shutdownInstance(rc, &reconciletest.Flow{}, &ShutdownHooks{})
+		assert.NilError(t, err)
+		assert.Assert(t, rc.GetInstance().Status.StoppedSets == nil)
+	})
+}
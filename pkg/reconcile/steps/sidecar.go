@@ -0,0 +1,48 @@
+package steps
+
+import (
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/pkg/featuregate"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+	"github.com/sqc157400661/kdb/pkg/sidecar"
+)
+
+// SidecarAPIEnabled reports whether the operator manages the databases of
+// instance through the management API of the sidecars. The token of the API
+// is never sent over plain HTTP, the API is used with TLS only.
+func SidecarAPIEnabled(instance *v1.KDBInstance) bool {
+	return featuregate.Enabled(featuregate.SidecarAPI) && naming.IsTLSEnabled(instance)
+}
+
+// SidecarClient returns a client of the management API of the sidecar of pod.
+// The certificate of the sidecar is verified with the CA of the instance. The
+// TLS Secret is read once per reconcile.
+func SidecarClient(rc *context.InstanceContext, pod *corev1.Pod) (*sidecar.Client, error) {
+	instance := rc.GetInstance()
+	if !naming.IsTLSEnabled(instance) {
+		return nil, errors.Errorf("the sidecar API of %s requires TLS", instance.Name)
+	}
+	config := sidecar.Config{
+		Host:       pod.Status.PodIP,
+		Port:       naming.SidecarPort,
+		Token:      rc.GetCredential(naming.SidecarTokenSecretKey),
+		ServerName: instance.Name + "." + instance.Namespace + ".svc",
+	}
+	if config.Host == "" {
+		return nil, errors.Errorf("pod %s has no IP", pod.Name)
+	}
+	secret := rc.GetInstanceTLS()
+	if secret == nil {
+		secret = &corev1.Secret{ObjectMeta: naming.InstanceTLS(instance)}
+		if err := errors.WithStack(rc.Get(secret)); err != nil {
+			return nil, err
+		}
+		rc.SetInstanceTLS(secret)
+	}
+	config.CACert = secret.Data[naming.CACertSecretKey]
+	return sidecar.NewClient(config)
+}
@@ -0,0 +1,357 @@
+package steps
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/helper/kube"
+	"github.com/sqc157400661/util"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/internal/pki"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+const (
+	// tlsReloadDelay is how long a new certificate is written before the
+	// servers reload it, the kubelet updates the files of the pods meanwhile.
+	tlsReloadDelay = 2 * time.Minute
+
+	// tlsPollInterval is how often the certificate of a user Secret is
+	// copied again to pick up its renewal.
+	tlsPollInterval = time.Hour
+)
+
+// TLSHooks are the engine specific parts of loading a new certificate.
+type TLSHooks struct {
+	// Reload makes the server in pod load the certificate files again. It
+	// returns false when the server has to restart to load them.
+	Reload func(rc *context.InstanceContext, pod *corev1.Pod) (bool, error)
+
+	// SecureReplication makes the server in pod connect to its source with
+	// TLS, when it replicates. It fails while the server has not loaded a
+	// certificate.
+	SecureReplication func(rc *context.InstanceContext, pod *corev1.Pod) error
+}
+
+// SetTLS keeps the certificate of the servers in the TLS Secret of the
+// instance, the pods read it from the config volume. The certificate is
+// copied from the certificate Secret of the spec, or issued by the CA of the
+// spec or of the operator and renewed once two thirds of its lifetime passed.
+func (s *InstanceStepManager) SetTLS() kube.BindFunc {
+	return s.StepBinder(
+		"SetTLS",
+		func(rc *context.InstanceContext, flow kube.Flow) (reconcile.Result, error) {
+			instance := rc.GetInstance()
+			if !naming.IsTLSEnabled(instance) {
+				instance.Status.TLS = nil
+				return flow.Pass()
+			}
+			existing := &corev1.Secret{ObjectMeta: naming.InstanceTLS(instance)}
+			err := errors.WithStack(client.IgnoreNotFound(rc.Get(existing)))
+			if err != nil {
+				return flow.Error(err, "get tls secret err")
+			}
+
+			now := time.Now()
+			var data map[string][]byte
+			var renewAt time.Time
+			if name := instance.Spec.TLS.CertificateSecret; name != "" {
+				data, err = userCertificate(rc, name)
+				renewAt = now.Add(tlsPollInterval)
+			} else {
+				data, renewAt, err = issuedCertificate(rc, existing.Data, now)
+			}
+			if apierrors.IsNotFound(errors.Cause(err)) {
+				rc.Recorder().Event(instance, corev1.EventTypeWarning, "TLSSecretNotFound", err.Error())
+				return flow.RetryAfter(time.Minute, "tls secret not found", "err", err.Error())
+			}
+			if err != nil {
+				rc.Recorder().Event(instance, corev1.EventTypeWarning, "InvalidTLSSecret", err.Error())
+				return flow.RetryAfter(time.Minute, "invalid tls secret", "err", err.Error())
+			}
+			cert, err := pki.ParseCertificate(data[naming.TLSCertSecretKey])
+			if err != nil {
+				rc.Recorder().Event(instance, corev1.EventTypeWarning, "InvalidTLSSecret", err.Error())
+				return flow.RetryAfter(time.Minute, "invalid tls certificate", "err", err.Error())
+			}
+
+			secret := &corev1.Secret{ObjectMeta: naming.InstanceTLS(instance)}
+			secret.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Secret"))
+			secret.Labels = naming.Merge(instance.Labels,
+				map[string]string{
+					naming.LabelInstance: instance.Name,
+				})
+			secret.Type = corev1.SecretTypeTLS
+			secret.Data = data
+			err = errors.WithStack(rc.SetControllerReference(secret))
+			if err == nil {
+				err = errors.WithStack(rc.Apply(secret))
+			}
+			if err != nil {
+				return flow.Error(err, "apply tls secret err")
+			}
+			rc.SetInstanceTLS(secret)
+
+			// The pods of an instance that enables TLS restart with the new
+			// config and load the first certificate.
+			hash := util.MD5Hash(string(data[naming.TLSCertSecretKey]) + string(data[naming.CACertSecretKey]))
+			if instance.Status.TLS == nil {
+				instance.Status.TLS = &v1.TLSStatus{CertificateHash: hash, LoadedHash: hash}
+			}
+			status := instance.Status.TLS
+			if status.CertificateHash != hash {
+				updated := metav1.NewTime(now)
+				status.CertificateHash = hash
+				status.UpdateTime = &updated
+				rc.Recorder().Event(instance, corev1.EventTypeNormal, "CertificateUpdated",
+					"Wrote a new certificate to the TLS Secret")
+			}
+			notAfter := metav1.NewTime(cert.NotAfter)
+			status.NotAfter = &notAfter
+
+			wait := renewAt.Sub(now)
+			if wait < time.Minute {
+				wait = time.Minute
+			}
+			rc.RequeueWithin(wait)
+			return flow.Pass()
+		})
+}
+
+// userCertificate returns the certificate of the Secret name.
+func userCertificate(rc *context.InstanceContext, name string) (map[string][]byte, error) {
+	source := &corev1.Secret{}
+	source.Namespace, source.Name = rc.GetInstance().Namespace, name
+	if err := errors.WithStack(rc.Get(source)); err != nil {
+		return nil, err
+	}
+	data := map[string][]byte{}
+	for _, key := range []string{naming.TLSCertSecretKey, naming.TLSKeySecretKey, naming.CACertSecretKey} {
+		if len(source.Data[key]) == 0 {
+			return nil, errors.Errorf("secret %s has no key %q", name, key)
+		}
+		data[key] = source.Data[key]
+	}
+	return data, nil
+}
+
+// issuedCertificate returns the certificate of existing, or a new one when it
+// has to be renewed, and when it is renewed.
+func issuedCertificate(rc *context.InstanceContext, existing map[string][]byte, now time.Time) (
+	map[string][]byte, time.Time, error) {
+	instance := rc.GetInstance()
+	caCert, ca, err := certificateAuthority(rc, now)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	data := existing
+	names := naming.InstanceDNSNames(instance)
+	if pki.NeedsRenewal(existing[naming.TLSCertSecretKey], ca, names, now) {
+		certPEM, keyPEM, err := ca.IssueServer(instance.Name, names, now)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		data = map[string][]byte{
+			naming.TLSCertSecretKey: certPEM,
+			naming.TLSKeySecretKey:  keyPEM,
+			naming.CACertSecretKey:  caCert,
+		}
+	}
+	cert, err := pki.ParseCertificate(data[naming.TLSCertSecretKey])
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return data, pki.RenewalTime(cert), nil
+}
+
+// certificateAuthority returns the CA of the CA Secret of the spec, or the
+// one of the operator in the namespace of the instance, which is created when
+// it does not exist and renewed, see renewRootCA. It is shared by the
+// instances of the namespace and has no owner.
+func certificateAuthority(rc *context.InstanceContext, now time.Time) ([]byte, *pki.CA, error) {
+	instance := rc.GetInstance()
+	secret := &corev1.Secret{ObjectMeta: naming.RootCA(instance.Namespace)}
+	if name := instance.Spec.TLS.CASecret; name != "" {
+		secret.Name = name
+		if err := errors.WithStack(rc.Get(secret)); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		err := errors.WithStack(client.IgnoreNotFound(rc.Get(secret)))
+		if err == nil && secret.UID == "" {
+			var certPEM, keyPEM []byte
+			certPEM, keyPEM, err = pki.NewRootCA(secret.Name, now)
+			if err != nil {
+				return nil, nil, err
+			}
+			secret.Type = corev1.SecretTypeOpaque
+			secret.Data = map[string][]byte{
+				naming.CACertSecretKey: certPEM,
+				naming.CAKeySecretKey:  keyPEM,
+			}
+			err = errors.WithStack(rc.Client().Create(rc.Context(), secret))
+			if apierrors.IsAlreadyExists(errors.Cause(err)) {
+				err = errors.WithStack(rc.Get(secret))
+			}
+		}
+		if err == nil {
+			err = renewRootCA(rc, secret, now)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	ca, err := pki.ParseCA(secret.Data[naming.CACertSecretKey], secret.Data[naming.CAKeySecretKey])
+	if err != nil {
+		return nil, nil, errors.WithMessagef(err, "secret %s", secret.Name)
+	}
+	return secret.Data[naming.CACertSecretKey], ca, nil
+}
+
+// renewRootCA replaces the CA of the operator in secret once two thirds of its
+// lifetime passed. The old CA stays in the bundle of the new one until it
+// expires, the servers it issued certificates for are issued new ones and the
+// clients trusting the bundle accept both. The first instance to renew the
+// shared Secret wins, the others read its new CA.
+func renewRootCA(rc *context.InstanceContext, secret *corev1.Secret, now time.Time) error {
+	cert, err := pki.ParseCertificate(secret.Data[naming.CACertSecretKey])
+	if err != nil || now.Before(pki.RenewalTime(cert)) {
+		// A certificate that does not parse is reported with the CA.
+		return nil
+	}
+	certPEM, keyPEM, err := pki.RenewRootCA(secret.Name, secret.Data[naming.CACertSecretKey], now)
+	if err != nil {
+		return err
+	}
+	before := secret.DeepCopy()
+	secret.Data[naming.CACertSecretKey] = certPEM
+	secret.Data[naming.CAKeySecretKey] = keyPEM
+	err = errors.WithStack(rc.Patch(secret,
+		client.MergeFromWithOptions(before, client.MergeFromWithOptimisticLock{})))
+	if err == nil {
+		rc.Recorder().Eventf(rc.GetInstance(), corev1.EventTypeNormal, "RootCARenewed",
+			"Renewed the CA of Secret %s", secret.Name)
+	}
+	if apierrors.IsConflict(errors.Cause(err)) {
+		err = errors.WithStack(rc.Get(secret))
+	}
+	return err
+}
+
+// ReloadTLS loads a new certificate without engine hooks, see TLSReloadStep.
+func (s *InstanceStepManager) ReloadTLS() kube.BindFunc {
+	return s.TLSReloadStep(nil)
+}
+
+// TLSReloadStep returns the step that makes the servers load a new
+// certificate of the TLS Secret, tlsReloadDelay after it was written. Pods
+// created since then started with it. The pods whose server cannot reload it
+// are marked with kdb.restart-for-certificate and replaced by the rollout,
+// the previous certificate is valid for a third of its lifetime still. Once
+// TLS is enabled and the servers loaded a certificate, the replicas are made
+// to connect to their source with TLS.
+func (s *InstanceStepManager) TLSReloadStep(hooks *TLSHooks) kube.BindFunc {
+	if hooks == nil {
+		hooks = &TLSHooks{}
+	}
+	return s.StepBinder(
+		"ReloadTLS",
+		func(rc *context.InstanceContext, flow kube.Flow) (reconcile.Result, error) {
+			instance := rc.GetInstance()
+			status := instance.Status.TLS
+			if status == nil {
+				return flow.Pass()
+			}
+			if !status.ReplicationSecured && hooks.SecureReplication != nil {
+				secureReplication(rc, hooks)
+			}
+			if status.LoadedHash == status.CertificateHash || status.UpdateTime == nil {
+				return flow.Pass()
+			}
+			due := status.UpdateTime.Add(tlsReloadDelay)
+			if wait := time.Until(due); wait > 0 {
+				rc.RequeueWithin(wait)
+				return flow.Pass()
+			}
+
+			var restart []*corev1.Pod
+			for _, runner := range rc.GetObservedRunner().List {
+				for _, pod := range runner.Pods {
+					if pod.CreationTimestamp.After(status.UpdateTime.Time) {
+						continue
+					}
+					if pod.Annotations[naming.RestartForCertificate] == status.CertificateHash {
+						restart = append(restart, pod)
+						continue
+					}
+					if pod.DeletionTimestamp != nil || !util.IsPodReady(pod) {
+						return flow.RetryAfter(10*time.Second, "waiting for pods to be ready to reload tls",
+							"pod", pod.Name)
+					}
+					reloaded := false
+					if hooks.Reload != nil {
+						var err error
+						if reloaded, err = hooks.Reload(rc, pod); err != nil {
+							return flow.Error(err, "reload tls err", "pod", pod.Name)
+						}
+					}
+					if !reloaded {
+						restart = append(restart, pod)
+					}
+				}
+			}
+			if len(restart) > 0 {
+				var marked []string
+				for _, pod := range restart {
+					if pod.Annotations[naming.RestartForCertificate] == status.CertificateHash {
+						continue
+					}
+					before := pod.DeepCopy()
+					pod.Annotations = naming.Merge(pod.Annotations,
+						map[string]string{naming.RestartForCertificate: status.CertificateHash})
+					if err := errors.WithStack(rc.Patch(pod, client.MergeFrom(before))); err != nil {
+						return flow.Error(err, "mark pod for restart err", "pod", pod.Name)
+					}
+					marked = append(marked, pod.Name)
+				}
+				if len(marked) > 0 {
+					rc.Recorder().Eventf(instance, corev1.EventTypeNormal, "RestartRequired",
+						"Restarting pods %v to load the new certificate", marked)
+				}
+				rc.RequeueWithin(rolloutPollInterval)
+				return flow.Pass()
+			}
+			status.LoadedHash = status.CertificateHash
+			rc.Recorder().Event(instance, corev1.EventTypeNormal, "CertificateReloaded",
+				"The servers loaded the new certificate")
+			return flow.Pass()
+		})
+}
+
+// secureReplication makes the replicas of the instance connect to their
+// source with TLS, the master first. It is tried again later while a pod is
+// not ready or has not loaded a certificate.
+func secureReplication(rc *context.InstanceContext, hooks *TLSHooks) {
+	instance := rc.GetInstance()
+	master, replicas, err := readyPods(rc, nil)
+	if err != nil || master == nil {
+		rc.RequeueWithin(rolloutPollInterval)
+		return
+	}
+	for _, pod := range append([]*corev1.Pod{master}, replicas...) {
+		if err = hooks.SecureReplication(rc, pod); err != nil {
+			rc.RequeueWithin(rolloutPollInterval)
+			return
+		}
+	}
+	instance.Status.TLS.ReplicationSecured = true
+	rc.Recorder().Event(instance, corev1.EventTypeNormal, "ReplicationSecured",
+		"The replicas connect to their source with TLS")
+}
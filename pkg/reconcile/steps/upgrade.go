@@ -0,0 +1,236 @@
+package steps
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/go-version"
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/helper/kube"
+	"github.com/sqc157400661/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/internal/generate"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+// UpgradeInstance resolves the images of the engine full version of the spec
+// without supporting major upgrades, see UpgradeStep.
+func (s *InstanceStepManager) UpgradeInstance() kube.BindFunc {
+	return s.UpgradeStep(nil)
+}
+
+// UpgradeStep returns the step that resolves the images of the engine full
+// version of the spec when it differs from the version the server runs. The
+// StatefulSets pick up the images and the RolloutInstance step replaces the
+// pods. Downgrades are rejected. A change of the major version runs the major
+// upgrade workflow with the hooks of the engine, it is rejected when hooks is
+// nil.
+func (s *InstanceStepManager) UpgradeStep(hooks *MajorUpgradeHooks) kube.BindFunc {
+	return s.StepBinder(
+		"UpgradeInstance",
+		func(rc *context.InstanceContext, flow kube.Flow) (reconcile.Result, error) {
+			instance := rc.GetInstance()
+			if err := checkVersions(instance); err != nil {
+				return rejectUpgrade(rc, flow, "VersionMismatch", err)
+			}
+			if instance.Status.MajorUpgrade != nil {
+				return majorUpgrade(rc, flow, hooks)
+			}
+			running, desired := instance.Status.EngineFullVersion, instance.Spec.EngineFullVersion
+			if desired == "" || desired == running {
+				return flow.Pass()
+			}
+			if running != "" {
+				major, err := checkUpgrade(instance, running, desired)
+				if err != nil {
+					return rejectUpgrade(rc, flow, "UpgradeRejected", err)
+				}
+				if major {
+					return startMajorUpgrade(rc, flow, hooks)
+				}
+			}
+
+			globalConfig := rc.GetGlobalConfig()
+			if err := generate.ResolveImages(&globalConfig, &instance.Spec, running); err != nil {
+				// The images of a new instance may be set in its spec directly.
+				if running == "" {
+					return flow.Pass()
+				}
+				return rejectUpgrade(rc, flow, "ImageNotFound",
+					errors.WithMessagef(err, "resolve images of version %s", desired))
+			}
+			if running != "" {
+				setUpgrading(instance, metav1.ConditionTrue, "Upgrading",
+					fmt.Sprintf("Upgrading from %s to %s", running, desired))
+			}
+			return flow.Pass()
+		})
+}
+
+// ServerVersionFunc returns the engine full version the server in pod runs.
+type ServerVersionFunc func(rc *context.InstanceContext, pod *corev1.Pod) (string, error)
+
+// PostUpgradeFunc runs the steps an engine needs after its pods started with
+// a new version, e.g. upgrading the system tables.
+type PostUpgradeFunc func(rc *context.InstanceContext, pods []*corev1.Pod, from, to string) error
+
+// FinishUpgradeInstance leaves the running version unknown, see
+// FinishUpgradeStep.
+func (s *InstanceStepManager) FinishUpgradeInstance() kube.BindFunc {
+	return s.FinishUpgradeStep(nil, nil)
+}
+
+// FinishUpgradeStep returns the step that records the version reported by
+// the servers in the status once all pods run the same version. When the
+// version changed, postUpgrade is called before the version is recorded.
+func (s *InstanceStepManager) FinishUpgradeStep(serverVersion ServerVersionFunc, postUpgrade PostUpgradeFunc) kube.BindFunc {
+	return s.StepBinder(
+		"FinishUpgradeInstance",
+		func(rc *context.InstanceContext, flow kube.Flow) (reconcile.Result, error) {
+			instance := rc.GetInstance()
+			if serverVersion == nil || instance.Status.MajorUpgrade != nil || instance.Spec.EngineFullVersion == "" ||
+				instance.Status.EngineFullVersion == instance.Spec.EngineFullVersion {
+				return flow.Pass()
+			}
+			var pods []*corev1.Pod
+			for _, item := range rc.GetObservedRunner().List {
+				pods = append(pods, item.Pods...)
+			}
+			if len(pods) == 0 {
+				return flow.Pass()
+			}
+
+			// The version of a pod is read once, it changes with a new pod
+			// only. It is kept in an annotation of the pod and in the status.
+			running := ""
+			for _, pod := range pods {
+				if pod.DeletionTimestamp != nil || !util.IsPodReady(pod) {
+					return flow.RetryAfter(rolloutPollInterval, "waiting for pod to report its version",
+						"pod", pod.Name)
+				}
+				v := pod.Annotations[naming.ServerVersion]
+				if v == "" {
+					var err error
+					if v, err = serverVersion(rc, pod); err != nil {
+						return flow.Error(err, "get server version err", "pod", pod.Name)
+					}
+					before := pod.DeepCopy()
+					pod.Annotations = naming.Merge(pod.Annotations, map[string]string{naming.ServerVersion: v})
+					if err = errors.WithStack(rc.Patch(pod, client.MergeFrom(before))); err != nil {
+						return flow.Error(err, "record server version err", "pod", pod.Name)
+					}
+					setPodServerVersion(instance, pod.Name, v)
+				}
+				if running != "" && v != running {
+					return flow.RetryAfter(rolloutPollInterval, "waiting for pods to run the same version",
+						"pod", pod.Name, "version", v)
+				}
+				running = v
+			}
+
+			previous := instance.Status.EngineFullVersion
+			if running != previous && previous != "" && postUpgrade != nil {
+				if err := postUpgrade(rc, pods, previous, running); err != nil {
+					rc.Recorder().Event(instance, corev1.EventTypeWarning, "PostUpgradeFailed", err.Error())
+					return flow.Error(err, "post upgrade err")
+				}
+			}
+			instance.Status.EngineFullVersion = running
+			if meta.IsStatusConditionTrue(instance.Status.Conditions, v1.KDBInstanceUpgrading) {
+				rc.Recorder().Eventf(instance, corev1.EventTypeNormal, "Upgraded",
+					"Upgraded from %s to %s", previous, running)
+				setUpgrading(instance, metav1.ConditionFalse, "UpgradeComplete",
+					fmt.Sprintf("Running version %s", running))
+			}
+			return flow.Pass()
+		})
+}
+
+// checkUpgrade returns an error when the instance may not move from the
+// running to the desired version, and whether the move is a major upgrade.
+func checkUpgrade(instance *v1.KDBInstance, running, desired string) (bool, error) {
+	from, err := version.NewVersion(running)
+	if err != nil {
+		return false, errors.WithMessagef(err, "parse running version %q", running)
+	}
+	to, err := version.NewVersion(desired)
+	if err != nil {
+		return false, errors.WithMessagef(err, "parse version %q", desired)
+	}
+	if majorVersion(from) != majorVersion(to) {
+		if to.LessThan(from) {
+			return false, errors.Errorf("downgrade from %s to %s changes the major version", running, desired)
+		}
+		return true, nil
+	}
+	if to.LessThan(from) && !naming.IsDowngradeAllowed(instance) {
+		return false, errors.Errorf("downgrade from %s to %s is not allowed without the %s annotation",
+			running, desired, naming.AllowDowngrade)
+	}
+	return false, nil
+}
+
+// checkVersions returns an error when the engine full version of the spec is
+// not a version of its engine version, e.g. 8.0.39 and 5.7.
+func checkVersions(instance *v1.KDBInstance) error {
+	if instance.Spec.EngineFullVersion == "" {
+		return nil
+	}
+	full, err := version.NewVersion(instance.Spec.EngineFullVersion)
+	if err != nil {
+		return errors.WithMessagef(err, "parse version %q", instance.Spec.EngineFullVersion)
+	}
+	major, err := naming.EngineVersion(instance)
+	if err != nil {
+		return errors.WithMessagef(err, "parse engine version %q", instance.Spec.EngineVersion)
+	}
+	if majorVersion(full) != majorVersion(major) {
+		return errors.Errorf("engine full version %s is not a version of engine version %s",
+			instance.Spec.EngineFullVersion, instance.Spec.EngineVersion)
+	}
+	return nil
+}
+
+// majorVersion returns the first two segments of v, e.g. 8.0 for 8.0.39.
+func majorVersion(v *version.Version) string {
+	segments := v.Segments()
+	return fmt.Sprintf("%d.%d", segments[0], segments[1])
+}
+
+// rejectUpgrade reports why the version of the spec is not rolled out. The
+// pods keep the images they run, the other steps go on.
+func rejectUpgrade(rc *context.InstanceContext, flow kube.Flow, reason string, err error) (reconcile.Result, error) {
+	instance := rc.GetInstance()
+	cond := meta.FindStatusCondition(instance.Status.Conditions, v1.KDBInstanceUpgrading)
+	if cond == nil || cond.Message != err.Error() {
+		rc.Recorder().Event(instance, corev1.EventTypeWarning, reason, err.Error())
+	}
+	setUpgrading(instance, metav1.ConditionFalse, reason, err.Error())
+	return flow.Pass()
+}
+
+// setPodServerVersion sets the version the server of the pod runs in the
+// status of the instance.
+func setPodServerVersion(instance *v1.KDBInstance, podName, serverVersion string) {
+	for i := range instance.Status.InstanceSet.PodInfos {
+		if instance.Status.InstanceSet.PodInfos[i].PodName == podName {
+			instance.Status.InstanceSet.PodInfos[i].ServerVersion = serverVersion
+		}
+	}
+}
+
+func setUpgrading(instance *v1.KDBInstance, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+		Type:               v1.KDBInstanceUpgrading,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: instance.Generation,
+	})
+}
@@ -0,0 +1,340 @@
+package steps
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sqc157400661/helper/kube"
+	"github.com/sqc157400661/util"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	v1 "github.com/sqc157400661/kdb/apis/kdb.com/v1"
+	"github.com/sqc157400661/kdb/apis/shared"
+	"github.com/sqc157400661/kdb/internal/naming"
+	"github.com/sqc157400661/kdb/pkg/reconcile/context"
+)
+
+const (
+	// autoscalePollInterval is how often the usage of volumes with an
+	// autoscale spec is checked.
+	autoscalePollInterval = time.Minute
+
+	// volumeUsageTimeout bounds reading the usage of a volume.
+	volumeUsageTimeout = 10 * time.Second
+
+	// defaultAutoscaleCooldown is the minimum time between two growths of a
+	// volume when the autoscale spec sets none.
+	defaultAutoscaleCooldown = 6 * time.Hour
+)
+
+// ObserveVolumes mirrors the size and the resize progress of the volumes of
+// the instance into its status. The PersistentVolumeResizing condition is
+// true while a volume is smaller than requested and is removed once every
+// volume reports the requested capacity. Pods whose volume waits for a file
+// system resize are restarted when the StorageClass is annotated with
+// kdb.offline-volume-expansion=true, the RolloutInstance step replaces them.
+// Volumes with an autoscale spec grow when their usage reaches its threshold.
+func (s *InstanceStepManager) ObserveVolumes() kube.BindFunc {
+	return s.StepBinder(
+		"ObserveVolumes",
+		func(rc *context.InstanceContext, flow kube.Flow) (reconcile.Result, error) {
+			instance := rc.GetInstance()
+			volumes, err := rc.GetVolumes()
+			if err != nil {
+				return flow.Error(err, "get volumes err")
+			}
+
+			previous := map[string]v1.VolumeStatus{}
+			for _, status := range instance.Status.Volumes {
+				previous[status.Name] = status
+			}
+			var statuses []v1.VolumeStatus
+			var pending []*corev1.PersistentVolumeClaim
+			claims := map[string]*corev1.PersistentVolumeClaim{}
+			resizing, failed := 0, 0
+			for i := range volumes {
+				pvc := &volumes[i]
+				set := pvc.Labels[naming.LabelInstanceSet]
+				if set == "" {
+					continue
+				}
+				claims[pvc.Name] = pvc
+				status := v1.VolumeStatus{
+					Name:              pvc.Name,
+					InstanceSet:       set,
+					Requested:         pvc.Spec.Resources.Requests[corev1.ResourceStorage],
+					Capacity:          pvc.Status.Capacity[corev1.ResourceStorage],
+					Autoscaled:        autoscaledSize(pvc),
+					Used:              previous[pvc.Name].Used,
+					UsageTime:         previous[pvc.Name].UsageTime,
+					LastAutoscaleTime: previous[pvc.Name].LastAutoscaleTime,
+				}
+				if pvc.Status.Phase == corev1.ClaimBound && status.Capacity.Cmp(status.Requested) < 0 {
+					resizing++
+					status.Resize = v1.VolumeResizing
+					for _, cond := range pvc.Status.Conditions {
+						if cond.Status != corev1.ConditionTrue {
+							continue
+						}
+						status.Message = cond.Message
+						if cond.Type == corev1.PersistentVolumeClaimFileSystemResizePending {
+							status.Resize = v1.VolumeFileSystemResizePending
+							pending = append(pending, pvc)
+						}
+					}
+					if pvc.Status.ResizeStatus != nil &&
+						(*pvc.Status.ResizeStatus == corev1.PersistentVolumeClaimControllerExpansionFailed ||
+							*pvc.Status.ResizeStatus == corev1.PersistentVolumeClaimNodeExpansionFailed) {
+						failed++
+						status.Resize = v1.VolumeResizeFailed
+					}
+				}
+				statuses = append(statuses, status)
+			}
+			sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+			grown, err := autoscaleVolumes(rc, statuses, claims)
+			instance.Status.Volumes = statuses
+			if err != nil {
+				return flow.Error(err, "autoscale volumes err")
+			}
+
+			cond := meta.FindStatusCondition(instance.Status.Conditions, v1.PersistentVolumeResizing)
+			switch {
+			case failed > 0:
+				setVolumeResizing(instance, metav1.ConditionFalse, "ResizeFailed",
+					fmt.Sprintf("%d of %d volumes failed to resize", failed, len(statuses)))
+			case len(pending) > 0:
+				setVolumeResizing(instance, metav1.ConditionTrue, v1.VolumeFileSystemResizePending,
+					fmt.Sprintf("%d of %d volumes wait for a file system resize", len(pending), len(statuses)))
+			case resizing > 0:
+				setVolumeResizing(instance, metav1.ConditionTrue, v1.VolumeResizing,
+					fmt.Sprintf("Resizing %d of %d volumes", resizing, len(statuses)))
+			case cond == nil:
+			case cond.Status == metav1.ConditionTrue:
+				rc.Recorder().Event(instance, corev1.EventTypeNormal, "VolumesResized",
+					"All volumes report the requested capacity")
+				meta.RemoveStatusCondition(&instance.Status.Conditions, v1.PersistentVolumeResizing)
+			case cond.ObservedGeneration != instance.Generation:
+				// The spec changed since the resize was refused.
+				meta.RemoveStatusCondition(&instance.Status.Conditions, v1.PersistentVolumeResizing)
+			}
+
+			if err = restartForFileSystemResize(rc, pending); err != nil {
+				return flow.Error(err, "mark pod for restart err")
+			}
+			if grown {
+				return flow.RetryAfter(rolloutPollInterval, "growing volumes")
+			}
+			return flow.Pass()
+		})
+}
+
+// restartForFileSystemResize marks the pods of the pending volumes whose
+// StorageClass cannot grow a mounted file system.
+func restartForFileSystemResize(rc *context.InstanceContext, pending []*corev1.PersistentVolumeClaim) error {
+	offline := map[string]bool{}
+	for _, pvc := range pending {
+		class := ""
+		if pvc.Spec.StorageClassName != nil {
+			class = *pvc.Spec.StorageClassName
+		}
+		if _, ok := offline[class]; !ok && class != "" {
+			sc := &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: class}}
+			if err := errors.WithStack(client.IgnoreNotFound(rc.Get(sc))); err != nil {
+				return err
+			}
+			offline[class] = sc.Annotations[naming.OfflineVolumeExpansion] == "true"
+		}
+		item, ok := rc.GetObservedRunner().BySet[pvc.Labels[naming.LabelInstanceSet]]
+		if !offline[class] || !ok || len(item.Pods) == 0 {
+			continue
+		}
+		pod := item.Pods[0]
+		if pod.DeletionTimestamp != nil || pod.Annotations[naming.RestartForVolumeResize] == pvc.Name {
+			continue
+		}
+		before := pod.DeepCopy()
+		pod.Annotations = naming.Merge(pod.Annotations,
+			map[string]string{naming.RestartForVolumeResize: pvc.Name})
+		if err := errors.WithStack(rc.Patch(pod, client.MergeFrom(before))); err != nil {
+			return err
+		}
+		rc.Recorder().Eventf(rc.GetInstance(), corev1.EventTypeNormal, "FileSystemResizePending",
+			"Restarting pod %s to resize the file system of %s", pod.Name, pvc.Name)
+	}
+	return nil
+}
+
+// autoscaleVolumes grows the volumes whose usage reached the threshold of
+// their autoscale spec. The grown size is requested right away and kept in an
+// annotation of the claim, so that neither the status nor a smaller spec
+// shrinks the request again. It returns whether a volume grows.
+func autoscaleVolumes(rc *context.InstanceContext, statuses []v1.VolumeStatus,
+	claims map[string]*corev1.PersistentVolumeClaim) (bool, error) {
+	instance := rc.GetInstance()
+	grown := false
+	for i := range statuses {
+		status := &statuses[i]
+		pvc := claims[status.Name]
+		autoscale, path := volumeAutoscale(instance, pvc)
+		if autoscale == nil {
+			continue
+		}
+		rc.RequeueWithin(autoscalePollInterval)
+		if status.UsageTime != nil && time.Since(status.UsageTime.Time) < autoscalePollInterval {
+			continue
+		}
+		item, ok := rc.GetObservedRunner().BySet[status.InstanceSet]
+		if !ok || len(item.Pods) == 0 || item.Pods[0].DeletionTimestamp != nil || !util.IsPodReady(item.Pods[0]) {
+			continue
+		}
+		used, capacity, err := volumeUsage(rc, item.Pods[0], path)
+		if err != nil {
+			rc.Recorder().Eventf(instance, corev1.EventTypeWarning, "VolumeUsageUnknown",
+				"Reading the usage of volume %s failed: %v", status.Name, err)
+			continue
+		}
+		now := metav1.Now()
+		status.Used, status.UsageTime = &used, &now
+		if status.Resize != "" || !autoscale.ShouldGrow(used, capacity) {
+			continue
+		}
+		cooldown := defaultAutoscaleCooldown
+		if autoscale.CooldownSeconds != nil {
+			cooldown = time.Duration(*autoscale.CooldownSeconds) * time.Second
+		}
+		if status.LastAutoscaleTime != nil && time.Since(status.LastAutoscaleTime.Time) < cooldown {
+			continue
+		}
+		status.LastAutoscaleTime = &now
+		size := autoscale.Grow(status.Requested)
+		if size.Cmp(status.Requested) <= 0 {
+			rc.Recorder().Eventf(instance, corev1.EventTypeWarning, "VolumeAutoscaleLimitReached",
+				"Volume %s uses %s of %s and cannot grow beyond %s", status.Name,
+				used.String(), capacity.String(), autoscale.Max.String())
+			continue
+		}
+		before := pvc.DeepCopy()
+		pvc.Annotations = naming.Merge(pvc.Annotations, map[string]string{naming.AutoscaledSize: size.String()})
+		pvc.Spec.Resources.Requests[corev1.ResourceStorage] = size
+		if err = rc.HandlePersistentVolumeClaimError(
+			errors.WithStack(rc.Patch(pvc, client.MergeFrom(before)))); err != nil {
+			return grown, err
+		}
+		rc.Recorder().Eventf(instance, corev1.EventTypeNormal, "VolumeAutoscaled",
+			"Growing volume %s from %s to %s, it uses %s of %s", status.Name,
+			status.Requested.String(), size.String(), used.String(), capacity.String())
+		status.Requested, status.Autoscaled = size, &size
+		grown = true
+	}
+	return grown, nil
+}
+
+// volumeAutoscale returns the autoscale spec of the volume and the path it is
+// mounted at.
+func volumeAutoscale(instance *v1.KDBInstance, pvc *corev1.PersistentVolumeClaim) (*shared.StorageAutoscaleSpec, string) {
+	if _, ok := pvc.Labels[naming.LabelLog]; ok {
+		if spec := naming.InstanceLogPvcSpec(instance); spec != nil {
+			return spec.Autoscale, naming.LogMountPath
+		}
+		return nil, ""
+	}
+	return naming.InstanceDataPvcSpec(instance).Autoscale, naming.DataMountPath
+}
+
+// volumeUsage reads the used and the total bytes of the file system mounted
+// at path in the database container of pod.
+func volumeUsage(rc *context.InstanceContext, pod *corev1.Pod, path string) (resource.Quantity, resource.Quantity, error) {
+	var stdout, stderr bytes.Buffer
+	err := rc.PodExec(pod, naming.ContainerDatabase,
+		[]string{"df", "--block-size=1", "--output=used,size", path},
+		kube.ExecOptions{Stdout: &stdout, Stderr: &stderr, Timeout: volumeUsageTimeout})
+	if err != nil {
+		return resource.Quantity{}, resource.Quantity{}, errors.Wrapf(err, "exec df in pod %s: %s",
+			pod.Name, strings.TrimSpace(stderr.String()))
+	}
+	return parseDiskUsage(stdout.String())
+}
+
+// parseDiskUsage parses the used and the size columns of the output of df.
+func parseDiskUsage(out string) (resource.Quantity, resource.Quantity, error) {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(lines) < 2 || len(fields) != 2 {
+		return resource.Quantity{}, resource.Quantity{}, errors.Errorf("parse df output %q", out)
+	}
+	used, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return resource.Quantity{}, resource.Quantity{}, errors.Errorf("parse df output %q", out)
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return resource.Quantity{}, resource.Quantity{}, errors.Errorf("parse df output %q", out)
+	}
+	return *resource.NewQuantity(used, resource.BinarySI), *resource.NewQuantity(size, resource.BinarySI), nil
+}
+
+// autoscaledSize returns the size autoscaling grew the volume to.
+func autoscaledSize(pvc *corev1.PersistentVolumeClaim) *resource.Quantity {
+	size, err := resource.ParseQuantity(pvc.Annotations[naming.AutoscaledSize])
+	if err != nil {
+		return nil
+	}
+	return &size
+}
+
+// autoscaledAnnotations returns the annotation of the existing claim that
+// keeps its autoscaled size.
+func autoscaledAnnotations(existing *corev1.PersistentVolumeClaim) map[string]string {
+	if existing == nil || existing.Annotations[naming.AutoscaledSize] == "" {
+		return nil
+	}
+	return map[string]string{naming.AutoscaledSize: existing.Annotations[naming.AutoscaledSize]}
+}
+
+// volumeSize returns the size to request for a volume, the larger of the size
+// of the spec and the size autoscaling grew the volume to. Volumes cannot
+// shrink, a smaller size keeps the current request and is reported on the
+// instance.
+func volumeSize(rc *context.InstanceContext, existing *corev1.PersistentVolumeClaim,
+	desired resource.Quantity) resource.Quantity {
+	if existing == nil {
+		return desired
+	}
+	if size := autoscaledSize(existing); size != nil && size.Cmp(desired) > 0 {
+		desired = *size
+	}
+	current := existing.Spec.Resources.Requests[corev1.ResourceStorage]
+	if current.IsZero() || desired.Cmp(current) >= 0 {
+		return desired
+	}
+	instance := rc.GetInstance()
+	message := fmt.Sprintf("Volume %s cannot shrink from %s to %s", existing.Name, current.String(), desired.String())
+	if cond := meta.FindStatusCondition(instance.Status.Conditions, v1.PersistentVolumeResizing); cond == nil ||
+		cond.Message != message {
+		rc.Recorder().Event(instance, corev1.EventTypeWarning, "VolumeShrinkRejected", message)
+	}
+	setVolumeResizing(instance, metav1.ConditionFalse, "VolumeShrinkRejected", message)
+	return current
+}
+
+func setVolumeResizing(instance *v1.KDBInstance, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+		Type:               v1.PersistentVolumeResizing,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: instance.Generation,
+	})
+}
@@ -0,0 +1,91 @@
+// Package sidecar defines the management API the mgr sidecar of an instance
+// pod serves, with the client the operator calls it with and the handler the
+// sidecar serves it with.
+//
+// The API is JSON over HTTP, versioned by the prefix of its paths. Every
+// request carries the token of the instance as a bearer token, the sidecar
+// reads it from the credentials of the config volume. The API is served with
+// the certificate of the instance, the operator only uses it when the TLS of
+// the instance is enabled so that the token never crosses the network in
+// plain text.
+package sidecar
+
+import (
+	"github.com/sqc157400661/kdb/apis/shared"
+)
+
+// Version is the version of the API, the prefix of its paths.
+const Version = "v1"
+
+// Paths of the API.
+const (
+	pathPrefix      = "/api/" + Version
+	PathRole        = pathPrefix + "/role"
+	PathReplication = pathPrefix + "/replication"
+	PathPromote     = pathPrefix + "/promote"
+	PathDemote      = pathPrefix + "/demote"
+	PathReadOnly    = pathPrefix + "/read-only"
+	PathApplyConfig = pathPrefix + "/config/apply"
+	PathBackups     = pathPrefix + "/backups"
+)
+
+// RoleResponse is the role of the database, master or replica.
+type RoleResponse struct {
+	Role string `json:"role"`
+}
+
+// ReplicationResponse is the state of the database and of its replication.
+type ReplicationResponse struct {
+	Role         string `json:"role"`
+	ReadOnly     bool   `json:"readOnly"`
+	GTIDExecuted string `json:"gtidExecuted,omitempty"`
+
+	// Replication is nil when the database does not replicate.
+	Replication *shared.ReplicationStatus `json:"replication,omitempty"`
+}
+
+// DemoteRequest makes a master a read only replica of the source at
+// SourceHost and SourcePort.
+type DemoteRequest struct {
+	SourceHost string `json:"sourceHost"`
+	SourcePort int32  `json:"sourcePort"`
+}
+
+// ReadOnlyRequest sets whether the database refuses the writes of clients.
+type ReadOnlyRequest struct {
+	ReadOnly bool `json:"readOnly"`
+}
+
+// ApplyConfigRequest applies the database config of Version, the config
+// version of the instance the sidecar reads from the config volume.
+type ApplyConfigRequest struct {
+	Version string `json:"version"`
+}
+
+// ApplyConfigResponse lists the settings that only apply after a restart.
+type ApplyConfigResponse struct {
+	PendingRestart []string `json:"pendingRestart,omitempty"`
+}
+
+// BackupType is the kind of a backup.
+type BackupType string
+
+const (
+	BackupFull        BackupType = "Full"
+	BackupIncremental BackupType = "Incremental"
+)
+
+// BackupRequest starts a backup of Type.
+type BackupRequest struct {
+	Type BackupType `json:"type"`
+}
+
+// BackupResponse identifies a started backup.
+type BackupResponse struct {
+	ID string `json:"id"`
+}
+
+// ErrorResponse is the body of a failed request.
+type ErrorResponse struct {
+	Message string `json:"message"`
+}
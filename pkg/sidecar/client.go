@@ -0,0 +1,188 @@
+package sidecar
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultTimeout bounds a request to the sidecar.
+const defaultTimeout = 30 * time.Second
+
+// Config locates the API of a sidecar.
+type Config struct {
+	// Host and Port the API listens on, the IP of the pod and SidecarPort.
+	Host string
+	Port int32
+
+	// Token authenticates the operator.
+	Token string
+
+	// CACert verifies the certificate of the sidecar as ServerName. The API is
+	// plain HTTP without it, then no token is sent.
+	CACert     []byte
+	ServerName string
+
+	// Timeout bounds a request, 30s when zero.
+	Timeout time.Duration
+}
+
+// Client calls the API of one sidecar.
+type Client struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+// APIError is a request the sidecar refused or failed.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("sidecar responded %d: %s", e.StatusCode, e.Message)
+}
+
+// IsNotImplemented reports whether err is the refusal of a sidecar that does
+// not implement the request, e.g. an older one.
+func IsNotImplemented(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) &&
+		(apiErr.StatusCode == http.StatusNotFound || apiErr.StatusCode == http.StatusNotImplemented)
+}
+
+// IsUnavailable reports whether err means that the sidecar serves no API: it
+// does not implement the request or does not listen, e.g. an older one. The
+// request was not carried out, the caller may fall back to another way.
+func IsUnavailable(err error) bool {
+	var opErr *net.OpError
+	return IsNotImplemented(err) || (errors.As(err, &opErr) && opErr.Op == "dial")
+}
+
+// NewClient returns a client of the sidecar of config. The token is only sent
+// over TLS.
+func NewClient(config Config) (*Client, error) {
+	if config.Token != "" && len(config.CACert) == 0 {
+		return nil, errors.New("the token of the sidecar is only sent over TLS")
+	}
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	scheme := "http"
+	if len(config.CACert) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(config.CACert) {
+			return nil, errors.New("no certificate in the CA of the sidecar")
+		}
+		transport.TLSClientConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			RootCAs:    pool,
+			ServerName: config.ServerName,
+		}
+		scheme = "https"
+	}
+	return &Client{
+		base:  scheme + "://" + net.JoinHostPort(config.Host, strconv.Itoa(int(config.Port))),
+		token: config.Token,
+		http:  &http.Client{Transport: transport, Timeout: timeout},
+	}, nil
+}
+
+// Role returns the role of the database.
+func (c *Client) Role(ctx context.Context) (string, error) {
+	var out RoleResponse
+	err := c.do(ctx, http.MethodGet, PathRole, nil, &out)
+	return out.Role, err
+}
+
+// Replication returns the state of the database and of its replication.
+func (c *Client) Replication(ctx context.Context) (*ReplicationResponse, error) {
+	out := &ReplicationResponse{}
+	if err := c.do(ctx, http.MethodGet, PathReplication, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Promote stops the replication of the database and makes it writable.
+func (c *Client) Promote(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, PathPromote, nil, nil)
+}
+
+// Demote makes the database a read only replica of host and port.
+func (c *Client) Demote(ctx context.Context, host string, port int32) error {
+	return c.do(ctx, http.MethodPost, PathDemote, DemoteRequest{SourceHost: host, SourcePort: port}, nil)
+}
+
+// SetReadOnly sets whether the database refuses the writes of clients.
+func (c *Client) SetReadOnly(ctx context.Context, readOnly bool) error {
+	return c.do(ctx, http.MethodPut, PathReadOnly, ReadOnlyRequest{ReadOnly: readOnly}, nil)
+}
+
+// ApplyConfig applies the database config of version and returns the
+// settings that apply after a restart only.
+func (c *Client) ApplyConfig(ctx context.Context, version string) ([]string, error) {
+	var out ApplyConfigResponse
+	err := c.do(ctx, http.MethodPost, PathApplyConfig, ApplyConfigRequest{Version: version}, &out)
+	return out.PendingRestart, err
+}
+
+// Backup starts a backup of backupType and returns its ID.
+func (c *Client) Backup(ctx context.Context, backupType BackupType) (string, error) {
+	var out BackupResponse
+	err := c.do(ctx, http.MethodPost, PathBackups, BackupRequest{Type: backupType}, &out)
+	return out.ID, err
+}
+
+// do sends in as the JSON body of a request and decodes the response into
+// out, when they are not nil.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &APIError{StatusCode: resp.StatusCode}
+		var e ErrorResponse
+		if json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&e) == nil {
+			apiErr.Message = e.Message
+		}
+		return apiErr
+	}
+	if out == nil {
+		return nil
+	}
+	return errors.WithStack(json.NewDecoder(resp.Body).Decode(out))
+}
@@ -0,0 +1,133 @@
+package sidecar_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"gotest.tools/v3/assert"
+
+	"github.com/sqc157400661/kdb/apis/shared"
+	"github.com/sqc157400661/kdb/pkg/sidecar"
+	"github.com/sqc157400661/kdb/pkg/sidecar/fake"
+)
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	lag := int64(3)
+	manager := &fake.Manager{State: sidecar.ReplicationResponse{
+		Role:         "replica",
+		ReadOnly:     true,
+		GTIDExecuted: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5",
+		Replication: &shared.ReplicationStatus{
+			Source:              "10.0.0.1:3306",
+			IOThread:            "Yes",
+			SQLThread:           "Yes",
+			SecondsBehindSource: &lag,
+		},
+	}}
+	server, client, err := fake.NewServer(manager, "secret")
+	assert.NilError(t, err)
+	defer server.Close()
+
+	t.Run("Status", func(t *testing.T) {
+		role, err := client.Role(ctx)
+		assert.NilError(t, err)
+		assert.Equal(t, role, "replica")
+
+		status, err := client.Replication(ctx)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, *status, manager.State)
+	})
+
+	t.Run("Switchover", func(t *testing.T) {
+		assert.NilError(t, client.Promote(ctx))
+		status, err := client.Replication(ctx)
+		assert.NilError(t, err)
+		assert.Equal(t, status.Role, "master")
+		assert.Equal(t, status.ReadOnly, false)
+		assert.Assert(t, status.Replication == nil)
+
+		assert.NilError(t, client.Demote(ctx, "10.0.0.2", 3306))
+		status, err = client.Replication(ctx)
+		assert.NilError(t, err)
+		assert.Equal(t, status.Role, "replica")
+		assert.Equal(t, status.Replication.Source, "10.0.0.2:3306")
+
+		var apiErr *sidecar.APIError
+		err = client.Demote(ctx, "", 0)
+		assert.Assert(t, errors.As(err, &apiErr))
+		assert.Equal(t, apiErr.StatusCode, http.StatusBadRequest)
+	})
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		assert.NilError(t, client.SetReadOnly(ctx, false))
+		assert.Equal(t, manager.State.ReadOnly, false)
+		assert.NilError(t, client.SetReadOnly(ctx, true))
+		assert.Equal(t, manager.State.ReadOnly, true)
+	})
+
+	t.Run("ApplyConfig", func(t *testing.T) {
+		pending, err := client.ApplyConfig(ctx, "abc123")
+		assert.NilError(t, err)
+		assert.Equal(t, len(pending), 0)
+		assert.Equal(t, manager.Config, "abc123")
+	})
+
+	t.Run("Backup", func(t *testing.T) {
+		id, err := client.Backup(ctx, sidecar.BackupFull)
+		assert.NilError(t, err)
+		assert.Equal(t, id, "backup-1")
+		assert.DeepEqual(t, manager.Backups, []sidecar.BackupType{sidecar.BackupFull})
+
+		_, err = client.Backup(ctx, "Snapshot")
+		assert.ErrorContains(t, err, "unknown backup type")
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		manager.Err = errors.New("mysqld is down")
+		defer func() { manager.Err = nil }()
+		_, err := client.Role(ctx)
+		assert.ErrorContains(t, err, "500: mysqld is down")
+	})
+}
+
+func TestClientUnauthorized(t *testing.T) {
+	server, _, err := fake.NewServer(&fake.Manager{}, "secret")
+	assert.NilError(t, err)
+	defer server.Close()
+
+	client, err := sidecar.NewClient(fake.ClientConfig(server, "wrong"))
+	assert.NilError(t, err)
+
+	var apiErr *sidecar.APIError
+	_, err = client.Role(context.Background())
+	assert.Assert(t, errors.As(err, &apiErr))
+	assert.Equal(t, apiErr.StatusCode, http.StatusUnauthorized)
+}
+
+func TestClientPlainHTTP(t *testing.T) {
+	_, err := sidecar.NewClient(sidecar.Config{Host: "127.0.0.1", Port: 8080, Token: "secret"})
+	assert.ErrorContains(t, err, "only sent over TLS")
+}
+
+func TestIsNotImplemented(t *testing.T) {
+	assert.Assert(t, sidecar.IsNotImplemented(&sidecar.APIError{StatusCode: http.StatusNotFound}))
+	assert.Assert(t, !sidecar.IsNotImplemented(&sidecar.APIError{StatusCode: http.StatusBadRequest}))
+	assert.Assert(t, !sidecar.IsNotImplemented(errors.New("connection refused")))
+}
+
+func TestIsUnavailable(t *testing.T) {
+	server, _, err := fake.NewServer(&fake.Manager{}, "secret")
+	assert.NilError(t, err)
+	config := fake.ClientConfig(server, "secret")
+	server.Close()
+
+	client, err := sidecar.NewClient(config)
+	assert.NilError(t, err)
+	_, err = client.Role(context.Background())
+	assert.Assert(t, sidecar.IsUnavailable(err), "%v", err)
+	assert.Assert(t, sidecar.IsUnavailable(&sidecar.APIError{StatusCode: http.StatusNotImplemented}))
+	assert.Assert(t, !sidecar.IsUnavailable(&sidecar.APIError{StatusCode: http.StatusInternalServerError}))
+}
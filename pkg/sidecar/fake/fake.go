@@ -0,0 +1,126 @@
+// Package fake provides a sidecar serving the management API from memory,
+// for the tests of the callers of the API.
+package fake
+
+import (
+	"context"
+	"encoding/pem"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+
+	"github.com/sqc157400661/kdb/apis/shared"
+	"github.com/sqc157400661/kdb/pkg/sidecar"
+)
+
+// Manager is a sidecar.Manager keeping the state of a database in memory.
+// Err, when set, fails every call.
+type Manager struct {
+	mu sync.Mutex
+
+	State   sidecar.ReplicationResponse
+	Config  string
+	Backups []sidecar.BackupType
+	Err     error
+}
+
+var _ sidecar.Manager = &Manager{}
+
+func (m *Manager) Role(ctx context.Context) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.State.Role, m.Err
+}
+
+func (m *Manager) Replication(ctx context.Context) (*sidecar.ReplicationResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Err != nil {
+		return nil, m.Err
+	}
+	state := m.State
+	if state.Replication != nil {
+		state.Replication = state.Replication.DeepCopy()
+	}
+	return &state, nil
+}
+
+func (m *Manager) Promote(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Err != nil {
+		return m.Err
+	}
+	m.State.Role, m.State.ReadOnly, m.State.Replication = "master", false, nil
+	return nil
+}
+
+func (m *Manager) Demote(ctx context.Context, req sidecar.DemoteRequest) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Err != nil {
+		return m.Err
+	}
+	m.State.Role, m.State.ReadOnly = "replica", true
+	m.State.Replication = &shared.ReplicationStatus{
+		Source:    net.JoinHostPort(req.SourceHost, strconv.Itoa(int(req.SourcePort))),
+		IOThread:  "Yes",
+		SQLThread: "Yes",
+	}
+	return nil
+}
+
+func (m *Manager) SetReadOnly(ctx context.Context, readOnly bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Err != nil {
+		return m.Err
+	}
+	m.State.ReadOnly = readOnly
+	return nil
+}
+
+func (m *Manager) ApplyConfig(ctx context.Context, version string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Err != nil {
+		return nil, m.Err
+	}
+	m.Config = version
+	return nil, nil
+}
+
+func (m *Manager) Backup(ctx context.Context, backupType sidecar.BackupType) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Err != nil {
+		return "", m.Err
+	}
+	m.Backups = append(m.Backups, backupType)
+	return "backup-" + strconv.Itoa(len(m.Backups)), nil
+}
+
+// NewServer starts a sidecar serving manager over TLS to the clients with
+// token, and returns it with a client of it. The caller closes the server.
+func NewServer(manager *Manager, token string) (*httptest.Server, *sidecar.Client, error) {
+	server := httptest.NewTLSServer(sidecar.NewHandler(manager, token))
+	client, err := sidecar.NewClient(ClientConfig(server, token))
+	if err != nil {
+		server.Close()
+		return nil, nil, err
+	}
+	return server, client, nil
+}
+
+// ClientConfig returns the config of a client of server with token.
+func ClientConfig(server *httptest.Server, token string) sidecar.Config {
+	addr := server.Listener.Addr().(*net.TCPAddr)
+	return sidecar.Config{
+		Host:       addr.IP.String(),
+		Port:       int32(addr.Port),
+		Token:      token,
+		CACert:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}),
+		ServerName: "example.com",
+	}
+}
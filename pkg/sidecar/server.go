@@ -0,0 +1,127 @@
+package sidecar
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Manager is what the sidecar does on behalf of the API.
+type Manager interface {
+	Role(ctx context.Context) (string, error)
+	Replication(ctx context.Context) (*ReplicationResponse, error)
+	Promote(ctx context.Context) error
+	Demote(ctx context.Context, req DemoteRequest) error
+	SetReadOnly(ctx context.Context, readOnly bool) error
+	ApplyConfig(ctx context.Context, version string) ([]string, error)
+	Backup(ctx context.Context, backupType BackupType) (string, error)
+}
+
+// BadRequestError is an error of a Manager caused by the request, e.g. an
+// unknown backup type.
+type BadRequestError struct {
+	Message string
+}
+
+func (e *BadRequestError) Error() string { return e.Message }
+
+// NewHandler returns the handler serving the API with manager to the clients
+// authenticated with token.
+func NewHandler(manager Manager, token string) http.Handler {
+	mux := http.NewServeMux()
+	handle := func(path, method string, serve func(*http.Request) (interface{}, error)) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != method {
+				w.Header().Set("Allow", method)
+				writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Message: "method not allowed"})
+				return
+			}
+			out, err := serve(r)
+			if err != nil {
+				status := http.StatusInternalServerError
+				if _, ok := err.(*BadRequestError); ok {
+					status = http.StatusBadRequest
+				}
+				writeJSON(w, status, ErrorResponse{Message: err.Error()})
+				return
+			}
+			if out == nil {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			writeJSON(w, http.StatusOK, out)
+		})
+	}
+
+	handle(PathRole, http.MethodGet, func(r *http.Request) (interface{}, error) {
+		role, err := manager.Role(r.Context())
+		return RoleResponse{Role: role}, err
+	})
+	handle(PathReplication, http.MethodGet, func(r *http.Request) (interface{}, error) {
+		return manager.Replication(r.Context())
+	})
+	handle(PathPromote, http.MethodPost, func(r *http.Request) (interface{}, error) {
+		return nil, manager.Promote(r.Context())
+	})
+	handle(PathDemote, http.MethodPost, func(r *http.Request) (interface{}, error) {
+		var req DemoteRequest
+		if err := decode(r, &req); err != nil {
+			return nil, err
+		}
+		if req.SourceHost == "" || req.SourcePort == 0 {
+			return nil, &BadRequestError{Message: "sourceHost and sourcePort are required"}
+		}
+		return nil, manager.Demote(r.Context(), req)
+	})
+	handle(PathReadOnly, http.MethodPut, func(r *http.Request) (interface{}, error) {
+		var req ReadOnlyRequest
+		if err := decode(r, &req); err != nil {
+			return nil, err
+		}
+		return nil, manager.SetReadOnly(r.Context(), req.ReadOnly)
+	})
+	handle(PathApplyConfig, http.MethodPost, func(r *http.Request) (interface{}, error) {
+		var req ApplyConfigRequest
+		if err := decode(r, &req); err != nil {
+			return nil, err
+		}
+		pending, err := manager.ApplyConfig(r.Context(), req.Version)
+		return ApplyConfigResponse{PendingRestart: pending}, err
+	})
+	handle(PathBackups, http.MethodPost, func(r *http.Request) (interface{}, error) {
+		var req BackupRequest
+		if err := decode(r, &req); err != nil {
+			return nil, err
+		}
+		if req.Type != BackupFull && req.Type != BackupIncremental {
+			return nil, &BadRequestError{Message: "unknown backup type " + string(req.Type)}
+		}
+		id, err := manager.Backup(r.Context(), req.Type)
+		return BackupResponse{ID: id}, err
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, ErrorResponse{Message: "invalid token"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// decode decodes the JSON body of r into v.
+func decode(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return &BadRequestError{Message: "invalid body: " + err.Error()}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}